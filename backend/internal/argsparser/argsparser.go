@@ -13,13 +13,107 @@ type CommandLineArguments struct {
 	PresetsPath    string
 	TemplatesPath  string
 	Address        string
+	CheckConfig    bool
+	AuthConfigPath string
+	RecordApiCalls bool
+	TitleModel     string
+	ToolsPath      string
+	KnowledgePath  string
+	UploadsPath    string
+
+	// Run is set for the `run` command, which answers one prompt without
+	// starting the web server.
+	Run *RunArguments
+}
+
+type RunArguments struct {
+	Model    string
+	Template string
+	Preset   string
+	Save     bool
+	Verbose  bool
 }
 
+const RUN_COMMAND = "run"
+
+// Parse reads the command line. The web server is started when no command
+// is given, which argparse can't express, so the `run` command gets its own
+// parser.
 func Parse() *CommandLineArguments {
+	if len(os.Args) > 1 && os.Args[1] == RUN_COMMAND {
+		return parseRun(os.Args[1:])
+	}
+
 	result := &CommandLineArguments{}
 
 	parser := argparse.NewParser("llm-multitool", "Web UI for instructing Large Language Models")
+	commonArguments := addCommonArguments(parser)
+
+	address := parser.String("a", "address",
+		&argparse.Options{
+			Required: false,
+			Help:     "Address and port to server from",
+			Default:  "127.0.0.1:5050"})
+
+	authConfigPath := parser.String("", "auth",
+		&argparse.Options{
+			Required: false,
+			Help:     "Path to the authentication configuration file. Authentication is off if not given",
+			Default:  ""})
+
+	recordApiCalls := parser.Flag("", "record-api-calls",
+		&argparse.Options{
+			Required: false,
+			Help:     "Save each call to the OpenAI compatible /v1/ API as a session",
+			Default:  false})
+
+	titleModel := parser.String("", "title-model",
+		&argparse.Options{
+			Required: false,
+			Help:     "ID of a model to write session titles with. Titles are made from the prompt if not given",
+			Default:  ""})
+
+	knowledgePath := parser.String("", "knowledge",
+		&argparse.Options{
+			Required: false,
+			Help:     "Path to the knowledge configuration file. No document collections are available if not given",
+			Default:  ""})
+
+	uploadsPath := parser.String("", "uploads",
+		&argparse.Options{
+			Required: false,
+			Help:     "Path to the uploads configuration file with file size limits. Defaults are used if not given",
+			Default:  ""})
+
+	checkConfig := parser.Flag("", "check-config",
+		&argparse.Options{
+			Required: false,
+			Help:     "Check the configuration files and backend connections, and then exit",
+			Default:  false})
+
+	err := parser.Parse(os.Args)
+	if err != nil {
+		// In case of error print error and print usage
+		// This can also be done by passing -h or --help flags
+		fmt.Print(parser.Usage(err))
+		return nil
+	}
+
+	commonArguments(result)
+	result.Address = *address
+	result.CheckConfig = *checkConfig
+	result.AuthConfigPath = *authConfigPath
+	result.RecordApiCalls = *recordApiCalls
+	result.TitleModel = *titleModel
+	result.KnowledgePath = *knowledgePath
+	result.UploadsPath = *uploadsPath
 
+	return result
+}
+
+// addCommonArguments adds the arguments which the server and the `run`
+// command share. The returned function copies their values into a result.
+func addCommonArguments(parser *argparse.Parser) func(*CommandLineArguments) {
 	configPath := parser.String("c", "config",
 		&argparse.Options{
 			Required: false,
@@ -44,25 +138,69 @@ func Parse() *CommandLineArguments {
 			Help:     "Path to the file containing templates",
 			Default:  ""})
 
-	address := parser.String("a", "address",
+	toolsPath := parser.String("", "tools",
 		&argparse.Options{
 			Required: false,
-			Help:     "Address and port to server from",
-			Default:  "127.0.0.1:5050"})
+			Help:     "Path to the tools configuration file. Models can't call tools if not given",
+			Default:  ""})
 
-	err := parser.Parse(os.Args)
+	return func(result *CommandLineArguments) {
+		result.ConfigFilePath = *configPath
+		result.StoragePath = *storagePath
+		result.PresetsPath = *presetsPath
+		result.TemplatesPath = *templatesPath
+		result.ToolsPath = *toolsPath
+	}
+}
+
+func parseRun(args []string) *CommandLineArguments {
+	result := &CommandLineArguments{Run: &RunArguments{}}
+
+	parser := argparse.NewParser("llm-multitool run",
+		"Send a prompt read from standard input to a model and write the reply to standard output")
+	commonArguments := addCommonArguments(parser)
+
+	model := parser.String("", "model",
+		&argparse.Options{
+			Required: true,
+			Help:     "ID or name of the model to use"})
+
+	template := parser.String("", "template",
+		&argparse.Options{
+			Required: false,
+			Help:     "ID or name of the template to apply to the prompt. The default template is used if not given",
+			Default:  ""})
+
+	preset := parser.String("", "preset",
+		&argparse.Options{
+			Required: false,
+			Help:     "ID or name of the generation parameter preset. The default preset is used if not given",
+			Default:  ""})
+
+	save := parser.Flag("", "save",
+		&argparse.Options{
+			Required: false,
+			Help:     "Save the prompt and reply as a session in the storage directory",
+			Default:  false})
+
+	verbose := parser.Flag("v", "verbose",
+		&argparse.Options{
+			Required: false,
+			Help:     "Write log messages to standard error",
+			Default:  false})
+
+	err := parser.Parse(args)
 	if err != nil {
-		// In case of error print error and print usage
-		// This can also be done by passing -h or --help flags
 		fmt.Print(parser.Usage(err))
 		return nil
 	}
 
-	result.ConfigFilePath = *configPath
-	result.StoragePath = *storagePath
-	result.PresetsPath = *presetsPath
-	result.TemplatesPath = *templatesPath
-	result.Address = *address
+	commonArguments(result)
+	result.Run.Model = *model
+	result.Run.Template = *template
+	result.Run.Preset = *preset
+	result.Run.Save = *save
+	result.Run.Verbose = *verbose
 
 	return result
 }
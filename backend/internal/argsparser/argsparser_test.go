@@ -0,0 +1,28 @@
+package argsparser
+
+import (
+	"testing"
+)
+
+func TestParseRun(t *testing.T) {
+	result := parseRun([]string{"run", "--model", "Ollama_llama3.2", "--template", "Instruct", "-s", "store",
+		"--tools", "tools.yaml", "--save"})
+	if result == nil || result.Run == nil {
+		t.Fatalf("Expected the run arguments to be parsed")
+	}
+	if result.Run.Model != "Ollama_llama3.2" || result.Run.Template != "Instruct" || result.Run.Preset != "" {
+		t.Errorf("Unexpected run arguments %+v", result.Run)
+	}
+	if !result.Run.Save || result.Run.Verbose {
+		t.Errorf("Unexpected flags %+v", result.Run)
+	}
+	if result.StoragePath != "store" || result.ToolsPath != "tools.yaml" || result.ConfigFilePath != "backend.yaml" {
+		t.Errorf("Unexpected common arguments %+v", result)
+	}
+}
+
+func TestParseRunNeedsModel(t *testing.T) {
+	if result := parseRun([]string{"run", "--template", "Instruct"}); result != nil {
+		t.Errorf("Expected run without a model to be refused, got %+v", result)
+	}
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sedwards2009/llm-multitool/internal/redact"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+type TokenConfig struct {
+	User     string  `yaml:"user"`
+	Token    string  `yaml:"token"`
+	TokenEnv *string `yaml:"token_env"`
+}
+
+type ProxyConfig struct {
+	UserHeader       string   `yaml:"user_header"`
+	TrustedAddresses []string `yaml:"trusted_addresses"`
+}
+
+type AuthConfig struct {
+	Tokens         []*TokenConfig `yaml:"tokens"`
+	UsersFile      *string        `yaml:"users_file"`
+	Proxy          *ProxyConfig   `yaml:"proxy"`
+	AllowedOrigins []string       `yaml:"allowed_origins"`
+	Admins         []string       `yaml:"admins"`
+	DefaultOwner   string         `yaml:"default_owner"`
+}
+
+// Authenticator identifies the user making a request. It returns false if
+// the request doesn't carry credentials it understands or they are wrong.
+type Authenticator interface {
+	Authenticate(request *http.Request) (string, bool)
+}
+
+type Auth struct {
+	config         *AuthConfig
+	authenticators []Authenticator
+	hasBasicAuth   bool
+}
+
+const USER_CONTEXT_KEY = "user"
+const REALM = "llm-multitool"
+
+func ReadConfigFile(file string) (*AuthConfig, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read auth config file: %w", err)
+	}
+	authConfig := &AuthConfig{}
+	if err := yaml.Unmarshal(content, authConfig); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal auth config file '%s': %w", file, err)
+	}
+	if authConfig.UsersFile != nil {
+		usersFile := path.Join(path.Dir(file), *authConfig.UsersFile)
+		authConfig.UsersFile = &usersFile
+	}
+	return authConfig, nil
+}
+
+func New(authConfig *AuthConfig) (*Auth, error) {
+	this := &Auth{
+		config:         authConfig,
+		authenticators: []Authenticator{},
+	}
+
+	if authConfig.Proxy != nil {
+		proxyAuthenticator, err := newProxyAuthenticator(authConfig.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		this.authenticators = append(this.authenticators, proxyAuthenticator)
+	}
+
+	if len(authConfig.Tokens) != 0 {
+		tokenAuthenticator, err := newTokenAuthenticator(authConfig.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		this.authenticators = append(this.authenticators, tokenAuthenticator)
+	}
+
+	if authConfig.UsersFile != nil {
+		basicAuthenticator, err := newBasicAuthenticator(*authConfig.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		this.authenticators = append(this.authenticators, basicAuthenticator)
+		this.hasBasicAuth = true
+	}
+
+	if len(this.authenticators) == 0 {
+		return nil, errors.New("auth config doesn't enable any authentication method")
+	}
+	return this, nil
+}
+
+func (this *Auth) AllowedOrigins() []string {
+	return this.config.AllowedOrigins
+}
+
+// IsAdmin returns true if the user may use the admin API. No one is an
+// admin when no admins are configured.
+func (this *Auth) IsAdmin(user string) bool {
+	for _, admin := range this.config.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Auth) DefaultOwner() string {
+	return this.config.DefaultOwner
+}
+
+// Middleware rejects requests which can't be authenticated and records the
+// user name in the gin context for those which can.
+func (this *Auth) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, authenticator := range this.authenticators {
+			if user, ok := authenticator.Authenticate(c.Request); ok {
+				c.Set(USER_CONTEXT_KEY, user)
+				c.Next()
+				return
+			}
+		}
+
+		if this.hasBasicAuth {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, REALM))
+		}
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// User returns the name of the authenticated user, or an empty string if
+// authentication is disabled.
+func User(c *gin.Context) string {
+	return c.GetString(USER_CONTEXT_KEY)
+}
+
+type tokenAuthenticator struct {
+	tokens map[string]string
+}
+
+func newTokenAuthenticator(tokenConfigs []*TokenConfig) (*tokenAuthenticator, error) {
+	this := &tokenAuthenticator{tokens: map[string]string{}}
+	for _, tokenConfig := range tokenConfigs {
+		if tokenConfig.User == "" {
+			return nil, errors.New("auth token is missing a user")
+		}
+		token := tokenConfig.Token
+		if tokenConfig.TokenEnv != nil {
+			token = strings.TrimSpace(os.Getenv(*tokenConfig.TokenEnv))
+		}
+		if token == "" {
+			return nil, fmt.Errorf("auth token for user '%s' is empty", tokenConfig.User)
+		}
+		redact.AddSecret(token)
+		this.tokens[token] = tokenConfig.User
+	}
+	return this, nil
+}
+
+func (this *tokenAuthenticator) Authenticate(request *http.Request) (string, bool) {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	requestToken := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	for token, user := range this.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(requestToken)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+type basicAuthenticator struct {
+	passwordHashes map[string][]byte
+}
+
+// newBasicAuthenticator reads a users file in the `htpasswd -B` format. Each
+// line is a user name and a bcrypt password hash separated by a colon.
+func newBasicAuthenticator(usersFile string) (*basicAuthenticator, error) {
+	f, err := os.Open(usersFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read users file: %w", err)
+	}
+	defer f.Close()
+
+	this := &basicAuthenticator{passwordHashes: map[string][]byte{}}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found || user == "" {
+			return nil, fmt.Errorf("users file '%s' line %d: expected 'user:bcrypt-hash'", usersFile, lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("users file '%s' line %d: %w", usersFile, lineNumber, err)
+		}
+		this.passwordHashes[user] = []byte(hash)
+	}
+	return this, scanner.Err()
+}
+
+func (this *basicAuthenticator) Authenticate(request *http.Request) (string, bool) {
+	user, password, ok := request.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := this.passwordHashes[user]
+	if !ok {
+		return "", false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	return user, true
+}
+
+type proxyAuthenticator struct {
+	userHeader      string
+	trustedNetworks []*net.IPNet
+}
+
+func newProxyAuthenticator(proxyConfig *ProxyConfig) (*proxyAuthenticator, error) {
+	if proxyConfig.UserHeader == "" {
+		return nil, errors.New("auth proxy config is missing user_header")
+	}
+	if len(proxyConfig.TrustedAddresses) == 0 {
+		return nil, errors.New("auth proxy config is missing trusted_addresses")
+	}
+
+	this := &proxyAuthenticator{userHeader: proxyConfig.UserHeader, trustedNetworks: []*net.IPNet{}}
+	for _, address := range proxyConfig.TrustedAddresses {
+		if !strings.Contains(address, "/") {
+			if strings.Contains(address, ":") {
+				address += "/128"
+			} else {
+				address += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("auth proxy config has an invalid trusted address: %w", err)
+		}
+		this.trustedNetworks = append(this.trustedNetworks, network)
+	}
+	return this, nil
+}
+
+func (this *proxyAuthenticator) Authenticate(request *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return "", false
+	}
+	remoteIP := net.ParseIP(host)
+	if remoteIP == nil {
+		return "", false
+	}
+
+	for _, network := range this.trustedNetworks {
+		if network.Contains(remoteIP) {
+			user := strings.TrimSpace(request.Header.Get(this.userHeader))
+			return user, user != ""
+		}
+	}
+	return "", false
+}
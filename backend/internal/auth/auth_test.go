@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func makeTestRouter(t *testing.T, authConfig *AuthConfig) *gin.Engine {
+	authentication, err := New(authConfig)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(authentication.Middleware())
+	r.GET("/whoami", func(c *gin.Context) {
+		c.String(http.StatusOK, User(c))
+	})
+	return r
+}
+
+func doRequest(r *gin.Engine, remoteAddr string, setup func(*http.Request)) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	request.RemoteAddr = remoteAddr
+	setup(request)
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func expectUser(t *testing.T, recorder *httptest.ResponseRecorder, user string) {
+	if recorder.Code != http.StatusOK || recorder.Body.String() != user {
+		t.Errorf("Expected user '%s', got status %d and '%s'", user, recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAuthenticators(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret-password"), bcrypt.MinCost)
+	usersFile := filepath.Join(t.TempDir(), "users.txt")
+	os.WriteFile(usersFile, []byte("# comment\nbob:"+string(hash)+"\n"), 0600)
+
+	r := makeTestRouter(t, &AuthConfig{
+		Tokens:    []*TokenConfig{{User: "alice", Token: "alice-token-1234"}},
+		UsersFile: &usersFile,
+		Proxy:     &ProxyConfig{UserHeader: "X-Forwarded-User", TrustedAddresses: []string{"10.0.0.0/8"}},
+	})
+
+	expectUser(t, doRequest(r, "192.168.1.5:1234", func(request *http.Request) {
+		request.Header.Set("Authorization", "Bearer alice-token-1234")
+	}), "alice")
+
+	expectUser(t, doRequest(r, "192.168.1.5:1234", func(request *http.Request) {
+		request.SetBasicAuth("bob", "secret-password")
+	}), "bob")
+
+	expectUser(t, doRequest(r, "10.1.2.3:1234", func(request *http.Request) {
+		request.Header.Set("X-Forwarded-User", "carol")
+	}), "carol")
+
+	untrusted := doRequest(r, "192.168.1.5:1234", func(request *http.Request) {
+		request.Header.Set("X-Forwarded-User", "carol")
+	})
+	if untrusted.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a proxy header from an untrusted address to be rejected, got %d", untrusted.Code)
+	}
+	if untrusted.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a WWW-Authenticate header when basic auth is enabled.")
+	}
+
+	wrongPassword := doRequest(r, "192.168.1.5:1234", func(request *http.Request) {
+		request.SetBasicAuth("bob", "wrong")
+	})
+	if wrongPassword.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be rejected, got %d", wrongPassword.Code)
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	tokens := []*TokenConfig{{User: "alice", Token: "alice-token-1234"}}
+	auth, _ := New(&AuthConfig{Tokens: tokens, Admins: []string{"alice"}})
+	if !auth.IsAdmin("alice") || auth.IsAdmin("bob") {
+		t.Errorf("Expected only alice to be an admin")
+	}
+
+	auth, _ = New(&AuthConfig{Tokens: tokens})
+	if auth.IsAdmin("alice") {
+		t.Errorf("Expected no admins when none are configured")
+	}
+}
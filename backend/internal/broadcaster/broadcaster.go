@@ -1,6 +1,8 @@
 package broadcaster
 
 import (
+	"sedwards2009/llm-multitool/internal/metrics"
+
 	"github.com/bobg/go-generics/v2/slices"
 )
 
@@ -46,6 +48,7 @@ func (this *Broadcaster) worker(in chan message, done chan bool) {
 		switch message.messageType {
 		case messageType_Register:
 			this.listeners = append(this.listeners, listener{message.id, message.listenerChan})
+			metrics.WebsocketListeners.Set(float64(len(this.listeners)))
 
 		case messageType_Unregister:
 			targetChan := message.listenerChan
@@ -53,6 +56,7 @@ func (this *Broadcaster) worker(in chan message, done chan bool) {
 				func(l listener) bool {
 					return l.listenerChan != targetChan
 				})
+			metrics.WebsocketListeners.Set(float64(len(this.listeners)))
 
 		case messageType_Send:
 			id := message.id
@@ -63,6 +67,7 @@ func (this *Broadcaster) worker(in chan message, done chan bool) {
 			}
 		case messageType_Quit:
 			this.listeners = []listener{}
+			metrics.WebsocketListeners.Set(0)
 			close(in)
 			done <- true
 			return
@@ -0,0 +1,358 @@
+package configcheck
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"sedwards2009/llm-multitool/internal/engine"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/jsonschema"
+	"sedwards2009/llm-multitool/internal/presets"
+	"sedwards2009/llm-multitool/internal/template"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func checkAddress(value *yaml.Node) string {
+	expanded, err := config.ExpandVariables(value.Value)
+	if err != nil {
+		return "can't be expanded: " + err.Error()
+	}
+	address, err := url.Parse(expanded)
+	if err != nil {
+		return "is not a valid URL: " + err.Error()
+	}
+	if address.Scheme != "http" && address.Scheme != "https" {
+		return "must be an http:// or https:// URL"
+	}
+	if address.Host == "" {
+		return "is missing a host name"
+	}
+	return ""
+}
+
+func checkVariant(value *yaml.Node) string {
+	if !config.IsValidVariant(value.Value) {
+		return fmt.Sprintf("has unknown variant '%s', expected '%s', '%s' or '%s'", value.Value,
+			config.VARIANT_OLLAMA, config.VARIANT_OOBABOOGA, config.VARIANT_LLAMACPP)
+	}
+	return ""
+}
+
+func checkEnvironmentVariable(value *yaml.Node) string {
+	if _, ok := os.LookupEnv(value.Value); !ok {
+		return fmt.Sprintf("names environment variable '%s' which is not set", value.Value)
+	}
+	return ""
+}
+
+func checkNotEmpty(value *yaml.Node) string {
+	if len(value.Content) == 0 {
+		return "must not be empty"
+	}
+	return ""
+}
+
+func checkContextStrategy(value *yaml.Node) string {
+	if !config.IsValidContextStrategy(value.Value) {
+		return fmt.Sprintf("has unknown strategy '%s', expected '%s', '%s' or '%s'", value.Value,
+			config.CONTEXT_STRATEGY_DROP_OLDEST, config.CONTEXT_STRATEGY_KEEP_LAST, config.CONTEXT_STRATEGY_SUMMARIZE)
+	}
+	return ""
+}
+
+func checkContextLengths(value *yaml.Node) string {
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		length, err := strconv.Atoi(value.Content[i+1].Value)
+		if err != nil || length <= 0 {
+			return fmt.Sprintf("has a context length for model '%s' which is not a positive whole number",
+				value.Content[i].Value)
+		}
+	}
+	return ""
+}
+
+// checkPrices checks a mapping from model names to prompt and completion prices.
+func checkPrices(value *yaml.Node) string {
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		modelName := value.Content[i].Value
+		price := value.Content[i+1]
+		if price.Kind != yaml.MappingNode {
+			return fmt.Sprintf("has a price for model '%s' which isn't a mapping with prompt and completion", modelName)
+		}
+		for j := 0; j+1 < len(price.Content); j += 2 {
+			key := price.Content[j].Value
+			if key != "prompt" && key != "completion" {
+				return fmt.Sprintf("has unknown field '%s' in the price for model '%s'", key, modelName)
+			}
+			if !isKind(price.Content[j+1], kindNumber) {
+				return fmt.Sprintf("has a %s price for model '%s' which is not a number", key, modelName)
+			}
+			if message := checkRange(0, math.MaxFloat64)(price.Content[j+1]); message != "" {
+				return fmt.Sprintf("has a %s price for model '%s' which is negative", key, modelName)
+			}
+		}
+	}
+	return ""
+}
+
+func checkDuration(value *yaml.Node) string {
+	duration, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return "is not a valid duration such as '500ms' or '2s'"
+	}
+	if duration <= 0 {
+		return "must be a positive duration"
+	}
+	return ""
+}
+
+func checkStatusCodes(value *yaml.Node) string {
+	for _, child := range value.Content {
+		code, err := strconv.Atoi(child.Value)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Sprintf("has '%s' which is not an HTTP status code", child.Value)
+		}
+	}
+	return ""
+}
+
+// checkFailover checks a mapping from model names to lists of model IDs.
+func checkFailover(value *yaml.Node) string {
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if !isKind(value.Content[i+1], kindStringList) {
+			return fmt.Sprintf("has failover models for model '%s' which are not a list of model IDs",
+				value.Content[i].Value)
+		}
+	}
+	return ""
+}
+
+func checkRange(min float64, max float64) func(*yaml.Node) string {
+	return func(value *yaml.Node) string {
+		number, err := strconv.ParseFloat(value.Value, 64)
+		if err != nil {
+			return "is not a valid number"
+		}
+		if number < min || number > max {
+			return fmt.Sprintf("must be between %g and %g", min, max)
+		}
+		return ""
+	}
+}
+
+func checkTemplateString(value *yaml.Node) string {
+	if !strings.Contains(value.Value, template.PROMPT_PARAM) {
+		return "must contain " + template.PROMPT_PARAM
+	}
+	return ""
+}
+
+func checkJsonSchema(value *yaml.Node) string {
+	schema := map[string]any{}
+	if err := value.Decode(&schema); err != nil {
+		return "is not a JSON schema: " + err.Error()
+	}
+	if err := jsonschema.CheckSchema(schema); err != nil {
+		return "is not usable: " + err.Error()
+	}
+	return ""
+}
+
+func backendSchema() *listSchema {
+	return &listSchema{
+		itemName: "backend",
+		fields: []field{
+			{name: "name", kind: kindString, required: true, unique: true},
+			{name: "address", kind: kindString, check: checkAddress},
+			{name: "api_token_from", kind: kindString},
+			{name: "api_token_env", kind: kindString, check: checkEnvironmentVariable},
+			{name: "api_token_command", kind: kindStringList, check: checkNotEmpty},
+			{name: "api_token", kind: kindString},
+			{name: "models", kind: kindStringList},
+			{name: "variant", kind: kindString, check: checkVariant},
+			{name: "prices", kind: kindMapping, check: checkPrices},
+			{name: "context_lengths", kind: kindMapping, check: checkContextLengths},
+			{name: "context_strategy", kind: kindString, check: checkContextStrategy},
+			{name: "context_keep_turns", kind: kindNumber, check: checkRange(1, math.MaxInt32)},
+			{name: "context_summary_model", kind: kindString},
+			{name: "retry_max_attempts", kind: kindNumber, check: checkRange(1, math.MaxInt32)},
+			{name: "retry_initial_backoff", kind: kindString, check: checkDuration},
+			{name: "retry_max_backoff", kind: kindString, check: checkDuration},
+			{name: "retry_status_codes", kind: kindStringList, check: checkStatusCodes},
+			{name: "failover", kind: kindMapping, check: checkFailover},
+			{name: "tool_models", kind: kindStringList},
+			{name: "embedding_models", kind: kindStringList},
+		},
+	}
+}
+
+func templateSchema() *listSchema {
+	return &listSchema{
+		itemName: "template",
+		fields: []field{
+			{name: "id", kind: kindString, required: true, unique: true},
+			{name: "name", kind: kindString, required: true},
+			{name: "template_string", kind: kindString, required: true, check: checkTemplateString},
+			{name: "default", kind: kindBool},
+			{name: "json_schema", kind: kindMapping, check: checkJsonSchema},
+		},
+	}
+}
+
+func presetSchema() *listSchema {
+	return &listSchema{
+		itemName: "preset",
+		fields: []field{
+			{name: "id", kind: kindString, required: true, unique: true},
+			{name: "name", kind: kindString, required: true},
+			{name: "temperature", kind: kindNumber, required: true, check: checkRange(0, presets.MAX_TEMPERATURE)},
+			{name: "top_p", kind: kindNumber, required: true, check: checkRange(0, 1)},
+			{name: "default", kind: kindBool},
+		},
+	}
+}
+
+func readFile(filePath string) ([]byte, []Diagnostic) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, []Diagnostic{{FilePath: filePath, Message: err.Error()}}
+	}
+	return content, nil
+}
+
+// CheckBackendConfigFile checks a backend config file. Checks which need
+// more than one field, such as a token file existing, are also done here.
+func CheckBackendConfigFile(filePath string) []Diagnostic {
+	content, diagnostics := readFile(filePath)
+	if diagnostics != nil {
+		return diagnostics
+	}
+	diagnostics, items := backendSchema().checkList(filePath, content)
+
+	for _, item := range items {
+		report := func(node *yaml.Node, message string, args ...any) {
+			diagnostics = append(diagnostics, Diagnostic{FilePath: filePath, Line: node.Line, Column: node.Column,
+				Message: fmt.Sprintf(message, args...)})
+		}
+
+		name := item.values["name"].Value
+		variant, hasVariant := item.values["variant"]
+		if _, hasAddress := item.values["address"]; !hasAddress && hasVariant {
+			report(item.node, "backend '%s' with variant '%s' needs an address", name, variant.Value)
+		}
+
+		tokenSources := []string{}
+		for _, fieldName := range []string{"api_token", "api_token_from", "api_token_env", "api_token_command"} {
+			if _, ok := item.values[fieldName]; ok {
+				tokenSources = append(tokenSources, fieldName)
+			}
+		}
+		if len(tokenSources) > 1 {
+			report(item.node, "backend '%s' may only use one of %s", name, strings.Join(tokenSources, ", "))
+		}
+
+		tokenFrom, hasTokenFrom := item.values["api_token_from"]
+		if hasTokenFrom {
+			tokenPath := path.Join(path.Dir(filePath), tokenFrom.Value)
+			if _, err := os.ReadFile(tokenPath); err != nil {
+				report(tokenFrom, "backend '%s' cannot read api_token_from file: %v", name, err)
+			}
+		}
+	}
+	return diagnostics
+}
+
+func CheckTemplatesFile(filePath string) []Diagnostic {
+	content, diagnostics := readFile(filePath)
+	if diagnostics != nil {
+		return diagnostics
+	}
+	diagnostics, items := templateSchema().checkList(filePath, content)
+	return append(diagnostics, checkSingleDefault(filePath, "template", items)...)
+}
+
+func CheckPresetsFile(filePath string) []Diagnostic {
+	content, diagnostics := readFile(filePath)
+	if diagnostics != nil {
+		return diagnostics
+	}
+	diagnostics, items := presetSchema().checkList(filePath, content)
+	return append(diagnostics, checkSingleDefault(filePath, "preset", items)...)
+}
+
+func checkSingleDefault(filePath string, itemName string, items []*checkedItem) []Diagnostic {
+	diagnostics := []Diagnostic{}
+	firstDefaultLine := 0
+	for _, item := range items {
+		defaultNode, ok := item.values["default"]
+		if !ok || defaultNode.Value != "true" {
+			continue
+		}
+		if firstDefaultLine != 0 {
+			diagnostics = append(diagnostics, Diagnostic{FilePath: filePath, Line: defaultNode.Line,
+				Column: defaultNode.Column,
+				Message: fmt.Sprintf("more than one %s is marked as default, the first is on line %d",
+					itemName, firstDefaultLine)})
+		} else {
+			firstDefaultLine = defaultNode.Line
+		}
+	}
+	return diagnostics
+}
+
+// CheckBackendConnections tries to connect to each backend in a config
+// file which is otherwise valid.
+func CheckBackendConnections(filePath string) []Diagnostic {
+	backendConfigs, err := config.ReadConfigFile(filePath)
+	if backendConfigs == nil {
+		return []Diagnostic{{FilePath: filePath, Message: err.Error()}}
+	}
+
+	diagnostics := []Diagnostic{}
+	for _, backend := range engine.MakeBackends(backendConfigs) {
+		if err := backend.CheckConnection(); err != nil {
+			diagnostics = append(diagnostics, Diagnostic{FilePath: filePath,
+				Message: fmt.Sprintf("backend '%s' is not reachable: %v", backend.ID(), err)})
+		}
+	}
+	return diagnostics
+}
+
+// Run checks the config files and the backend connections, and writes a
+// report to `out`. An empty templates or presets path means that the
+// built in file is used and is skipped. Returns true if no problems were found.
+func Run(out io.Writer, configFilePath string, templatesPath string, presetsPath string) bool {
+	diagnostics := CheckBackendConfigFile(configFilePath)
+	isConfigValid := len(diagnostics) == 0
+
+	if templatesPath != "" {
+		diagnostics = append(diagnostics, CheckTemplatesFile(templatesPath)...)
+	}
+	if presetsPath != "" {
+		diagnostics = append(diagnostics, CheckPresetsFile(presetsPath)...)
+	}
+
+	if isConfigValid {
+		diagnostics = append(diagnostics, CheckBackendConnections(configFilePath)...)
+	} else {
+		fmt.Fprintf(out, "Skipping the backend connection check because %s has errors.\n", configFilePath)
+	}
+
+	for _, diagnostic := range diagnostics {
+		fmt.Fprintln(out, diagnostic.String())
+	}
+
+	if len(diagnostics) != 0 {
+		fmt.Fprintf(out, "Found %d problem(s).\n", len(diagnostics))
+		return false
+	}
+	fmt.Fprintln(out, "Configuration OK.")
+	return true
+}
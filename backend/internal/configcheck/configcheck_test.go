@@ -0,0 +1,118 @@
+package configcheck
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	filePath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatalf("Couldn't write %s: %v", filePath, err)
+	}
+	return filePath
+}
+
+func expectDiagnostic(t *testing.T, diagnostics []Diagnostic, line int, column int, messagePart string) {
+	for _, d := range diagnostics {
+		if d.Line == line && d.Column == column && strings.Contains(d.Message, messagePart) {
+			return
+		}
+	}
+	t.Errorf("Expected a diagnostic at %d:%d containing '%s', got %v", line, column, messagePart, diagnostics)
+}
+
+func TestBackendConfigDiagnostics(t *testing.T) {
+	configPath := writeTestFile(t, "backend.yaml", `- name: Ollama
+  address: "localhost:11434"
+  variant: olama
+- name: Ollama
+  api_token_from: missing.txt
+  modles:
+  - gpt-4
+`)
+	diagnostics := CheckBackendConfigFile(configPath)
+
+	expectDiagnostic(t, diagnostics, 2, 12, "http://")
+	expectDiagnostic(t, diagnostics, 3, 12, "unknown variant 'olama'")
+	expectDiagnostic(t, diagnostics, 4, 9, "duplicate name 'Ollama'")
+	expectDiagnostic(t, diagnostics, 6, 3, "unknown field 'modles'")
+}
+
+func TestPriceDiagnostics(t *testing.T) {
+	configPath := writeTestFile(t, "backend.yaml", `- name: OpenAI
+  prices:
+    gpt-4o:
+      prompt: 2.5
+      completion: -10
+`)
+	diagnostics := CheckBackendConfigFile(configPath)
+
+	expectDiagnostic(t, diagnostics, 3, 5, "completion price for model 'gpt-4o' which is negative")
+}
+
+func TestPresetDiagnostics(t *testing.T) {
+	presetsPath := writeTestFile(t, "presets.yaml", `- id: chat
+  name: Chat
+  temperature: hot
+  top_p: 1.5
+- id: other
+  top_p: 0.5
+  temperature: 0.5
+`)
+	diagnostics := CheckPresetsFile(presetsPath)
+
+	expectDiagnostic(t, diagnostics, 3, 16, "must be a number")
+	expectDiagnostic(t, diagnostics, 4, 10, "between 0 and 1")
+	expectDiagnostic(t, diagnostics, 5, 3, "missing the required field 'name'")
+}
+
+func TestSyntaxErrorHasLine(t *testing.T) {
+	templatesPath := writeTestFile(t, "templates.yaml", "- id: a\n  name: [\n")
+	diagnostics := CheckTemplatesFile(templatesPath)
+	if len(diagnostics) != 1 || diagnostics[0].Line == 0 {
+		t.Errorf("Expected one diagnostic with a line number, got %v", diagnostics)
+	}
+}
+
+func TestRunWithStandInBackends(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models": [{"name": "llama3"}]}`))
+		case "/v1/models":
+			w.Write([]byte(`{"object": "list", "data": [{"id": "gpt-4", "object": "model"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	configPath := writeTestFile(t, "backend.yaml", `- name: Ollama
+  address: "`+server.URL+`"
+  variant: ollama
+- name: LocalAI
+  address: "`+server.URL+`/v1"
+`)
+	out := &bytes.Buffer{}
+	if !Run(out, configPath, "", "") {
+		t.Errorf("Expected the check to pass, got:\n%s", out.String())
+	}
+
+	badConfigPath := writeTestFile(t, "backend.yaml", `- name: Ollama
+  address: "`+server.URL+`/wrong"
+  variant: ollama
+`)
+	out = &bytes.Buffer{}
+	if Run(out, badConfigPath, "", "") {
+		t.Errorf("Expected the check to fail for an unreachable backend.")
+	}
+	if !strings.Contains(out.String(), "backend 'Ollama' is not reachable") {
+		t.Errorf("Unexpected report:\n%s", out.String())
+	}
+}
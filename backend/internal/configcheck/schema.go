@@ -0,0 +1,213 @@
+package configcheck
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Diagnostic is a problem found in a config file. Line and Column are 1
+// based and are zero if the position is unknown.
+type Diagnostic struct {
+	FilePath string
+	Line     int
+	Column   int
+	Message  string
+}
+
+func (this Diagnostic) String() string {
+	if this.Line == 0 {
+		return fmt.Sprintf("%s: %s", this.FilePath, this.Message)
+	}
+	if this.Column == 0 {
+		return fmt.Sprintf("%s:%d: %s", this.FilePath, this.Line, this.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", this.FilePath, this.Line, this.Column, this.Message)
+}
+
+type valueKind uint8
+
+const (
+	kindString valueKind = iota
+	kindNumber
+	kindBool
+	kindStringList
+	kindMapping
+)
+
+func (this valueKind) String() string {
+	switch this {
+	case kindNumber:
+		return "a number"
+	case kindBool:
+		return "true or false"
+	case kindStringList:
+		return "a list of strings"
+	case kindMapping:
+		return "a mapping"
+	default:
+		return "a string"
+	}
+}
+
+// field describes one key in a YAML mapping.
+type field struct {
+	name     string
+	kind     valueKind
+	required bool
+	unique   bool
+
+	// check performs extra validation on the value and returns an error
+	// message, or an empty string if the value is fine.
+	check func(value *yaml.Node) string
+}
+
+// listSchema describes a YAML file which holds a list of mappings.
+type listSchema struct {
+	itemName string
+	fields   []field
+}
+
+// checkedItem is a list item which passed the schema check.
+type checkedItem struct {
+	node   *yaml.Node
+	values map[string]*yaml.Node
+}
+
+var yamlErrorLineRegexp = regexp.MustCompile(`line (\d+):`)
+
+// checkList checks YAML content against a schema and returns the problems
+// found and the items which were valid.
+func (this *listSchema) checkList(filePath string, content []byte) ([]Diagnostic, []*checkedItem) {
+	diagnostics := []Diagnostic{}
+	report := func(node *yaml.Node, message string, args ...any) {
+		diagnostics = append(diagnostics, Diagnostic{
+			FilePath: filePath,
+			Line:     node.Line,
+			Column:   node.Column,
+			Message:  fmt.Sprintf(message, args...),
+		})
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		line := 0
+		if match := yamlErrorLineRegexp.FindStringSubmatch(err.Error()); match != nil {
+			line, _ = strconv.Atoi(match[1])
+		}
+		diagnostics = append(diagnostics, Diagnostic{FilePath: filePath, Line: line, Message: err.Error()})
+		return diagnostics, nil
+	}
+
+	if root.Kind == 0 || len(root.Content) == 0 {
+		diagnostics = append(diagnostics, Diagnostic{FilePath: filePath,
+			Message: fmt.Sprintf("file is empty, expected a list of %ss", this.itemName)})
+		return diagnostics, nil
+	}
+
+	list := root.Content[0]
+	if list.Kind != yaml.SequenceNode {
+		report(list, "expected a list of %ss", this.itemName)
+		return diagnostics, nil
+	}
+	if len(list.Content) == 0 {
+		report(list, "the list of %ss is empty", this.itemName)
+		return diagnostics, nil
+	}
+
+	firstSeen := map[string]map[string]int{}
+	for _, f := range this.fields {
+		if f.unique {
+			firstSeen[f.name] = map[string]int{}
+		}
+	}
+
+	items := []*checkedItem{}
+	for _, itemNode := range list.Content {
+		if itemNode.Kind != yaml.MappingNode {
+			report(itemNode, "expected a %s with fields", this.itemName)
+			continue
+		}
+
+		startCount := len(diagnostics)
+		values := map[string]*yaml.Node{}
+		for i := 0; i+1 < len(itemNode.Content); i += 2 {
+			keyNode := itemNode.Content[i]
+			valueNode := itemNode.Content[i+1]
+
+			f := this.findField(keyNode.Value)
+			if f == nil {
+				report(keyNode, "unknown field '%s' in %s", keyNode.Value, this.itemName)
+				continue
+			}
+			if _, ok := values[f.name]; ok {
+				report(keyNode, "field '%s' is given more than once", f.name)
+				continue
+			}
+			values[f.name] = valueNode
+
+			if !isKind(valueNode, f.kind) {
+				report(valueNode, "field '%s' must be %s", f.name, f.kind)
+				continue
+			}
+			if f.check != nil {
+				if message := f.check(valueNode); message != "" {
+					report(valueNode, "field '%s' %s", f.name, message)
+					continue
+				}
+			}
+			if f.unique {
+				if firstLine, ok := firstSeen[f.name][valueNode.Value]; ok {
+					report(valueNode, "duplicate %s '%s', first used on line %d", f.name, valueNode.Value, firstLine)
+				} else {
+					firstSeen[f.name][valueNode.Value] = valueNode.Line
+				}
+			}
+		}
+
+		for _, f := range this.fields {
+			if _, ok := values[f.name]; f.required && !ok {
+				report(itemNode, "%s is missing the required field '%s'", this.itemName, f.name)
+			}
+		}
+
+		if len(diagnostics) == startCount {
+			items = append(items, &checkedItem{node: itemNode, values: values})
+		}
+	}
+	return diagnostics, items
+}
+
+func (this *listSchema) findField(name string) *field {
+	for i := range this.fields {
+		if this.fields[i].name == name {
+			return &this.fields[i]
+		}
+	}
+	return nil
+}
+
+func isKind(node *yaml.Node, kind valueKind) bool {
+	switch kind {
+	case kindNumber:
+		return node.Kind == yaml.ScalarNode && (node.Tag == "!!int" || node.Tag == "!!float")
+	case kindBool:
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!bool"
+	case kindStringList:
+		if node.Kind != yaml.SequenceNode {
+			return false
+		}
+		for _, child := range node.Content {
+			if !isKind(child, kindString) {
+				return false
+			}
+		}
+		return true
+	case kindMapping:
+		return node.Kind == yaml.MappingNode
+	default:
+		return node.Kind == yaml.ScalarNode && node.Tag != "!!null"
+	}
+}
@@ -0,0 +1,11 @@
+package backendhealth
+
+type BackendHealth uint8
+
+const (
+	Healthy BackendHealth = iota + 1
+	Degraded
+	Down
+)
+
+//go:generate go-enum -type=BackendHealth
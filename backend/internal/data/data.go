@@ -1,6 +1,9 @@
 package data
 
 import (
+	"sedwards2009/llm-multitool/internal/data/backendhealth"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/data/priority"
 	"sedwards2009/llm-multitool/internal/data/responsestatus"
 	"sedwards2009/llm-multitool/internal/data/role"
 )
@@ -23,12 +26,40 @@ type AttachedFile struct {
 	Filename         string `json:"filename"`
 	MimeType         string `json:"mimeType"`
 	OriginalFilename string `json:"originalFilename"`
+
+	// SourceFilename holds the file as it was uploaded when Filename holds a
+	// converted version, such as a scaled down image.
+	SourceFilename string `json:"sourceFilename,omitempty"`
+	SourceMimeType string `json:"sourceMimeType,omitempty"`
+
+	// ThumbnailFilename holds a small preview of an image for the web UI.
+	ThumbnailFilename string `json:"thumbnailFilename,omitempty"`
+}
+
+// StorageStats reports the disk space used by sessions and attached files.
+type StorageStats struct {
+	SessionCount int   `json:"sessionCount"`
+	SessionBytes int64 `json:"sessionBytes"`
+
+	// AttachedFileReferences counts each session which refers to a file,
+	// while AttachedFileCount counts each stored file once.
+	AttachedFileCount      int   `json:"attachedFileCount"`
+	AttachedFileReferences int   `json:"attachedFileReferences"`
+	AttachedFileBytes      int64 `json:"attachedFileBytes"`
+	// DeduplicatedBytes is the space saved by storing files which several
+	// sessions use only once.
+	DeduplicatedBytes  int64 `json:"deduplicatedBytes"`
+	ExtractedTextBytes int64 `json:"extractedTextBytes"`
+
+	TotalBytes int64 `json:"totalBytes"`
 }
 
 type Session struct {
 	ID                string          `json:"id"`
+	Owner             string          `json:"owner"`
 	CreationTimestamp string          `json:"creationTimestamp"`
 	Title             string          `json:"title"`
+	TitleIsGenerated  bool            `json:"titleIsGenerated"`
 	Prompt            string          `json:"prompt"`
 	AttachedFiles     []*AttachedFile `json:"attachedFiles"`
 	Responses         []*Response     `json:"responses"`
@@ -39,6 +70,9 @@ type ModelSettings struct {
 	ModelID    string `json:"modelId"`
 	TemplateID string `json:"templateId"`
 	PresetID   string `json:"presetId"`
+	// KnowledgeCollection names the document collection which is searched
+	// for each new response. It is empty if none is attached.
+	KnowledgeCollection string `json:"knowledgeCollection"`
 }
 
 type ModelSettingsSnapshot struct {
@@ -46,6 +80,11 @@ type ModelSettingsSnapshot struct {
 	ModelName    string `json:"modelName"`
 	TemplateName string `json:"templateName"`
 	PresetName   string `json:"presetName"`
+
+	// ActualModelID and ActualModelName are set to the model which
+	// processed the request. They differ from ModelID after a failover.
+	ActualModelID   string `json:"actualModelId"`
+	ActualModelName string `json:"actualModelName"`
 }
 
 type ModelOverview struct {
@@ -60,6 +99,38 @@ type Model struct {
 	SupportsContinue bool `json:"supportsContinue"`
 	SupportsReply    bool `json:"supportsReply"`
 	SupportsImages   bool `json:"supportsImages"`
+	SupportsTools    bool `json:"supportsTools"`
+	// SupportsEmbeddings is set for models which turn text into embedding
+	// vectors.
+	SupportsEmbeddings bool `json:"supportsEmbeddings"`
+
+	// ContextLength is the model's context window in tokens, or 0 if it is
+	// unknown.
+	ContextLength int `json:"contextLength"`
+
+	// IsContextLengthSet is true if ContextLength was chosen in the model's
+	// settings or the backend config, rather than being the longest context
+	// the model was trained with.
+	IsContextLengthSet bool `json:"-"`
+
+	// Health is the health of the model's backend. A model stays listed
+	// while its backend is down.
+	Health backendhealth.BackendHealth `json:"health"`
+}
+
+type BackendOverview struct {
+	Backends []*BackendStatus `json:"backends"`
+}
+
+// BackendStatus is the result of the latest health check of a backend.
+// LastCheckTimestamp is empty if the backend hasn't been checked yet.
+type BackendStatus struct {
+	ID                 string                      `json:"id"`
+	Health             backendhealth.BackendHealth `json:"health"`
+	LastCheckTimestamp string                      `json:"lastCheckTimestamp"`
+	LatencyMs          int64                       `json:"latencyMs"`
+	Error              string                      `json:"error"`
+	ModelCount         int                         `json:"modelCount"`
 }
 
 type Response struct {
@@ -68,6 +139,114 @@ type Response struct {
 	Status                responsestatus.ResponseStatus `json:"status"`
 	Messages              []Message                     `json:"messages"`
 	ModelSettingsSnapshot *ModelSettingsSnapshot        `json:"modelSettingsSnapshot"`
+	Usage                 *Usage                        `json:"usage"`
+	Timing                *Timing                       `json:"timing"`
+	ContextReduction      *ContextReduction             `json:"contextReduction"`
+	Error                 *ResponseError                `json:"error"`
+	Citations             []*Citation                   `json:"citations"`
+}
+
+// Citation is a chunk of a document from a knowledge collection which was
+// given to the model with a response. Number is how the model refers to it.
+type Citation struct {
+	Number     int     `json:"number"`
+	Collection string  `json:"collection"`
+	Path       string  `json:"path"`
+	StartLine  int     `json:"startLine"`
+	EndLine    int     `json:"endLine"`
+	Score      float32 `json:"score"`
+	Text       string  `json:"text"`
+}
+
+// EmbedResponse holds one embedding vector for each of the texts given.
+type EmbedResponse struct {
+	Model      string      `json:"model"`
+	Embeddings [][]float32 `json:"embeddings"`
+	Usage      *Usage      `json:"usage"`
+}
+
+type KnowledgeOverview struct {
+	Collections []*KnowledgeCollection `json:"collections"`
+}
+
+// KnowledgeCollection describes a collection and its latest ingest.
+type KnowledgeCollection struct {
+	Name                string `json:"name"`
+	EmbeddingModel      string `json:"embeddingModel"`
+	FileCount           int    `json:"fileCount"`
+	ChunkCount          int    `json:"chunkCount"`
+	IsIngesting         bool   `json:"isIngesting"`
+	LastIngestTimestamp string `json:"lastIngestTimestamp"`
+	Error               string `json:"error"`
+}
+
+// ResponseError describes why the latest request for a response failed.
+// StatusCode is the HTTP status code from the backend, or 0 if there was
+// none. Secrets are removed from Message.
+type ResponseError struct {
+	Category   errorcategory.ErrorCategory `json:"category"`
+	StatusCode int                         `json:"statusCode"`
+	Message    string                      `json:"message"`
+}
+
+// ContextReduction records how the messages sent for a response were last
+// shortened to fit in the model's context window.
+type ContextReduction struct {
+	Strategy        string `json:"strategy"`
+	DroppedMessages int    `json:"droppedMessages"`
+	OriginalTokens  int    `json:"originalTokens"`
+	ReducedTokens   int    `json:"reducedTokens"`
+}
+
+// Usage counts the tokens used by a response. IsEstimated is set if the
+// backend didn't report the counts and they were estimated locally. Cost is
+// nil if no price is configured for the model.
+type Usage struct {
+	PromptTokens     int      `json:"promptTokens"`
+	CompletionTokens int      `json:"completionTokens"`
+	IsEstimated      bool     `json:"isEstimated"`
+	Cost             *float64 `json:"cost"`
+}
+
+// Timing holds the timings of the latest request made for a response, in
+// milliseconds. The load and eval durations are only known for backends
+// which report them.
+type Timing struct {
+	QueueWaitMs        int64   `json:"queueWaitMs"`
+	TimeToFirstTokenMs int64   `json:"timeToFirstTokenMs"`
+	DurationMs         int64   `json:"durationMs"`
+	TokensPerSecond    float64 `json:"tokensPerSecond"`
+	LoadDurationMs     *int64  `json:"loadDurationMs"`
+	EvalDurationMs     *int64  `json:"evalDurationMs"`
+}
+
+type QueueOverview struct {
+	Entries []*QueueEntry `json:"entries"`
+}
+
+// QueueEntry describes a request in the engine's queue. The effective
+// priority is raised as the request waits.
+type QueueEntry struct {
+	ModelID           string            `json:"modelId"`
+	Priority          priority.Priority `json:"priority"`
+	EffectivePriority priority.Priority `json:"effectivePriority"`
+	WaitMs            int64             `json:"waitMs"`
+	IsRunning         bool              `json:"isRunning"`
+}
+
+type UsageTotal struct {
+	Key              string  `json:"key"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	Cost             float64 `json:"cost"`
+}
+
+type UsageReport struct {
+	Total     *UsageTotal   `json:"total"`
+	ByDay     []*UsageTotal `json:"byDay"`
+	ByModel   []*UsageTotal `json:"byModel"`
+	BySession []*UsageTotal `json:"bySession"`
 }
 
 type Message struct {
@@ -75,6 +254,15 @@ type Message struct {
 	Role          role.Role       `json:"role"`
 	Text          string          `json:"text"`
 	AttachedFiles []*AttachedFile `json:"attachedFiles"`
+
+	// ToolCallID and ToolName are set on ToolCall and ToolResult messages.
+	ToolCallID string `json:"toolCallId"`
+	ToolName   string `json:"toolName"`
+
+	// Json holds the parsed reply when the template asked for JSON matching
+	// a schema. JsonError says why it is missing if the reply didn't match.
+	Json      any    `json:"json,omitempty"`
+	JsonError string `json:"jsonError,omitempty"`
 }
 
 type Template struct {
@@ -82,6 +270,9 @@ type Template struct {
 	Name           string `json:"name" yaml:"name"`
 	TemplateString string `json:"templateString" yaml:"template_string"`
 	Default        bool   `yaml:"default,omitempty"`
+
+	// JsonSchema, if set, asks the model to reply with JSON matching it.
+	JsonSchema map[string]any `json:"jsonSchema,omitempty" yaml:"json_schema,omitempty"`
 }
 
 type TemplateOverview struct {
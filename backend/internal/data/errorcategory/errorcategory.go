@@ -0,0 +1,14 @@
+package errorcategory
+
+type ErrorCategory uint8
+
+const (
+	Auth ErrorCategory = iota + 1
+	RateLimit
+	Network
+	BadRequest
+	ModelNotFound
+	Backend
+)
+
+//go:generate go-enum -type=ErrorCategory
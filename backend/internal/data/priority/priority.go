@@ -0,0 +1,11 @@
+package priority
+
+type Priority uint8
+
+const (
+	Interactive Priority = iota + 1
+	Batch
+	Background
+)
+
+//go:generate go-enum -type=Priority
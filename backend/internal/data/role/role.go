@@ -5,6 +5,14 @@ type Role uint8
 const (
 	User Role = iota + 1
 	Assistant
+	System
+
+	// ToolCall messages record a model's request to call a tool. The
+	// arguments are held in the text as JSON.
+	ToolCall
+
+	// ToolResult messages hold the output of a tool call.
+	ToolResult
 )
 
 //go:generate go-enum -type=Role
@@ -18,11 +18,14 @@ func _() {
 	var x [1]struct{}
 	_ = x[User-1]
 	_ = x[Assistant-2]
+	_ = x[System-3]
+	_ = x[ToolCall-4]
+	_ = x[ToolResult-5]
 }
 
-const _Role_name = "UserAssistant"
+const _Role_name = "UserAssistantSystemToolCallToolResult"
 
-var _Role_index = [...]uint8{0, 4, 13}
+var _Role_index = [...]uint8{0, 4, 13, 19, 27, 37}
 
 func _() {
 	var _nil_Role_value = func() (val Role) { return }()
@@ -46,11 +49,14 @@ func (i Role) New() *Role {
 	return &clone
 }
 
-var _Role_values = []Role{1, 2}
+var _Role_values = []Role{1, 2, 3, 4, 5}
 
 var _Role_name_to_values = map[string]Role{
-	_Role_name[0:4]:  1,
-	_Role_name[4:13]: 2,
+	_Role_name[0:4]:   1,
+	_Role_name[4:13]:  2,
+	_Role_name[13:19]: 3,
+	_Role_name[19:27]: 4,
+	_Role_name[27:37]: 5,
 }
 
 // ParseRoleString retrieves an enum value from the enum constants string name.
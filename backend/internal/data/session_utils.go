@@ -14,8 +14,48 @@ func (this *Session) GetAttachedFiles() []*AttachedFile {
 	return result
 }
 
+// GetAttachedFileNames returns the names of all of the files stored for the
+// session's attachments.
 func (this *Session) GetAttachedFileNames() []string {
-	return slices.Map(this.GetAttachedFiles(), func(af *AttachedFile) string {
-		return af.Filename
-	})
+	result := []string{}
+	for _, attachedFile := range this.GetAttachedFiles() {
+		result = append(result, attachedFile.StoredFilenames()...)
+	}
+	return result
+}
+
+// StoredFilenames returns the names of the files which hold the attachment,
+// its original upload and its thumbnail.
+func (this *AttachedFile) StoredFilenames() []string {
+	return slices.Filter([]string{this.Filename, this.SourceFilename, this.ThumbnailFilename},
+		func(filename string) bool {
+			return filename != ""
+		})
+}
+
+// Add returns the sum of two usages. Either may be nil.
+func (this *Usage) Add(other *Usage) *Usage {
+	if this == nil {
+		return other
+	}
+	if other == nil {
+		return this
+	}
+
+	result := &Usage{
+		PromptTokens:     this.PromptTokens + other.PromptTokens,
+		CompletionTokens: this.CompletionTokens + other.CompletionTokens,
+		IsEstimated:      this.IsEstimated || other.IsEstimated,
+	}
+	if this.Cost != nil || other.Cost != nil {
+		cost := 0.0
+		if this.Cost != nil {
+			cost += *this.Cost
+		}
+		if other.Cost != nil {
+			cost += *other.Cost
+		}
+		result.Cost = &cost
+	}
+	return result
 }
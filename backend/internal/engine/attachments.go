@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/extract"
+	"strings"
+)
+
+// ATTACHMENT_HEADER introduces the text of an attached file in a message.
+// The file's name is filled in.
+const ATTACHMENT_HEADER = "\n\n--- Attached file: %s ---\n"
+
+// withAttachmentTexts returns a copy of the request in which the attached
+// files which the model can't take directly are replaced by their text. Only
+// images are passed on, and only to models which support them.
+func withAttachmentTexts(work *types.Request, model *data.Model) *types.Request {
+	hasAttachments := false
+	for _, message := range work.Messages {
+		hasAttachments = hasAttachments || len(message.AttachedFiles) != 0
+	}
+	if !hasAttachments {
+		return work
+	}
+
+	messages := make([]data.Message, len(work.Messages))
+	for i, message := range work.Messages {
+		messages[i] = message
+		if len(message.AttachedFiles) == 0 {
+			continue
+		}
+
+		text := strings.Builder{}
+		text.WriteString(message.Text)
+		keptFiles := []*data.AttachedFile{}
+		for _, attachedFile := range message.AttachedFiles {
+			if extract.IsImage(attachedFile.MimeType) && model.SupportsImages {
+				keptFiles = append(keptFiles, attachedFile)
+				continue
+			}
+			text.WriteString(fmt.Sprintf(ATTACHMENT_HEADER, attachmentName(attachedFile)))
+			text.WriteString(attachmentText(work.AttachedFilesPath, attachedFile))
+		}
+		messages[i].Text = text.String()
+		messages[i].AttachedFiles = keptFiles
+	}
+
+	textWork := *work
+	textWork.Messages = messages
+	return &textWork
+}
+
+func attachmentName(attachedFile *data.AttachedFile) string {
+	if attachedFile.OriginalFilename != "" {
+		return attachedFile.OriginalFilename
+	}
+	return attachedFile.Filename
+}
+
+// attachmentText returns the text of an attached file, or a note saying why
+// the model can't see it.
+func attachmentText(attachedFilesPath string, attachedFile *data.AttachedFile) string {
+	if extract.IsImage(attachedFile.MimeType) {
+		return "[This model can't view images.]"
+	}
+	text, err := extract.ExtractCached(filepath.Join(attachedFilesPath, attachedFile.Filename),
+		attachedFile.MimeType)
+	if errors.Is(err, extract.ErrUnsupported) {
+		return fmt.Sprintf("[Files of type %s can't be read.]", attachedFile.MimeType)
+	}
+	if err != nil {
+		log.Printf("engine worker: Unable to extract the text of %s: %v\n", attachedFile.Filename, err)
+		return fmt.Sprintf("[The text of the file couldn't be extracted: %v]", err)
+	}
+	return text
+}
@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"strings"
+	"testing"
+)
+
+func TestWithAttachmentTexts(t *testing.T) {
+	directory := t.TempDir()
+	os.WriteFile(filepath.Join(directory, "a.csv"), []byte("name,age\nAnn,31"), 0600)
+	os.WriteFile(filepath.Join(directory, "b.png"), []byte("not really a png"), 0600)
+
+	attachedFiles := []*data.AttachedFile{
+		{Filename: "a.csv", MimeType: "text/csv", OriginalFilename: "people.csv"},
+		{Filename: "b.png", MimeType: "image/png", OriginalFilename: "photo.png"},
+	}
+	work := &types.Request{
+		AttachedFilesPath: directory,
+		Messages: []data.Message{
+			{Role: role.User, Text: "Who is the oldest?", AttachedFiles: attachedFiles},
+			{Role: role.Assistant},
+		},
+	}
+
+	textWork := withAttachmentTexts(work, &data.Model{SupportsImages: true})
+	message := textWork.Messages[0]
+	if !strings.Contains(message.Text, "--- Attached file: people.csv ---\nname,age\nAnn,31") {
+		t.Errorf("Expected the CSV text in the message, got %q", message.Text)
+	}
+	if len(message.AttachedFiles) != 1 || message.AttachedFiles[0].Filename != "b.png" {
+		t.Errorf("Expected only the image to stay attached, got %+v", message.AttachedFiles)
+	}
+	if len(work.Messages[0].AttachedFiles) != 2 || work.Messages[0].Text != "Who is the oldest?" {
+		t.Errorf("Expected the original request to be unchanged")
+	}
+
+	textWork = withAttachmentTexts(work, &data.Model{SupportsImages: false})
+	message = textWork.Messages[0]
+	if len(message.AttachedFiles) != 0 || !strings.Contains(message.Text, "photo.png ---\n[This model can't view images.]") {
+		t.Errorf("Expected the image to be described for a model without vision, got %q", message.Text)
+	}
+}
@@ -1,26 +1,144 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
+	"regexp"
+	"sedwards2009/llm-multitool/internal/redact"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 const VARIANT_OOBABOOGA = "oobabooga"
 const VARIANT_OLLAMA = "ollama"
+const VARIANT_LLAMACPP = "llamacpp"
+
+const CONTEXT_STRATEGY_DROP_OLDEST = "drop_oldest"
+const CONTEXT_STRATEGY_KEEP_LAST = "keep_last"
+const CONTEXT_STRATEGY_SUMMARIZE = "summarize"
 
 type EngineBackendConfig struct {
-	Name         string    `yaml:"name"`
-	Address      *string   `yaml:"address"`
-	ApiTokenFrom *string   `yaml:"api_token_from"`
-	ApiToken     string    `yaml:"api_token"`
-	Models       *[]string `yaml:"models"`
-	Variant      *string   `yaml:"variant"`
+	Name            string    `yaml:"name"`
+	Address         *string   `yaml:"address"`
+	ApiTokenFrom    *string   `yaml:"api_token_from"`
+	ApiTokenEnv     *string   `yaml:"api_token_env"`
+	ApiTokenCommand []string  `yaml:"api_token_command"`
+	ApiToken        string    `yaml:"api_token"`
+	Models          *[]string `yaml:"models"`
+	Variant         *string   `yaml:"variant"`
+
+	// Prices maps the backend's model names to their price.
+	Prices map[string]*ModelPrice `yaml:"prices"`
+
+	// ContextLengths maps the backend's model names to their context length
+	// in tokens. These override the lengths found when scanning models.
+	ContextLengths      map[string]int `yaml:"context_lengths"`
+	ContextStrategy     *string        `yaml:"context_strategy"`
+	ContextKeepTurns    *int           `yaml:"context_keep_turns"`
+	ContextSummaryModel *string        `yaml:"context_summary_model"`
+
+	RetryMaxAttempts    *int           `yaml:"retry_max_attempts"`
+	RetryInitialBackoff *time.Duration `yaml:"retry_initial_backoff"`
+	RetryMaxBackoff     *time.Duration `yaml:"retry_max_backoff"`
+	RetryStatusCodes    []int          `yaml:"retry_status_codes"`
+
+	// Failover maps the backend's model names to the IDs of the models to
+	// try, in order, if the model fails.
+	Failover map[string][]string `yaml:"failover"`
+
+	// ToolModels lists the names of the models which can call tools.
+	ToolModels []string `yaml:"tool_models"`
+
+	// EmbeddingModels lists the names of models which make embeddings, for
+	// when the backend can't tell.
+	EmbeddingModels []string `yaml:"embedding_models"`
+}
+
+const DEFAULT_RETRY_INITIAL_BACKOFF = 1 * time.Second
+const DEFAULT_RETRY_MAX_BACKOFF = 30 * time.Second
+
+// DEFAULT_RETRY_STATUS_CODES are the HTTP status codes of failures which may
+// go away if the request is tried again.
+var DEFAULT_RETRY_STATUS_CODES = []int{408, 429, 500, 502, 503, 504}
+
+// RetryPolicy says how often and when to retry a failed request.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	StatusCodes    []int
+}
+
+// RetryPolicy returns the backend's retry policy with defaults filled in.
+// Requests are only tried once unless retry_max_attempts is set.
+func (this *EngineBackendConfig) RetryPolicy() *RetryPolicy {
+	policy := &RetryPolicy{
+		MaxAttempts:    1,
+		InitialBackoff: DEFAULT_RETRY_INITIAL_BACKOFF,
+		MaxBackoff:     DEFAULT_RETRY_MAX_BACKOFF,
+		StatusCodes:    DEFAULT_RETRY_STATUS_CODES,
+	}
+	if this.RetryMaxAttempts != nil {
+		policy.MaxAttempts = *this.RetryMaxAttempts
+	}
+	if this.RetryInitialBackoff != nil {
+		policy.InitialBackoff = *this.RetryInitialBackoff
+	}
+	if this.RetryMaxBackoff != nil {
+		policy.MaxBackoff = *this.RetryMaxBackoff
+	}
+	if this.RetryStatusCodes != nil {
+		policy.StatusCodes = this.RetryStatusCodes
+	}
+	return policy
+}
+
+// IsRetryable returns true if a failure with an HTTP status code may be
+// retried. A status code of 0 means that the backend couldn't be reached,
+// which is always retryable.
+func (this *RetryPolicy) IsRetryable(statusCode int) bool {
+	if statusCode == 0 {
+		return true
+	}
+	for _, code := range this.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
 }
 
+// Backoff returns how long to wait after a failed attempt. `attempt` starts at 1.
+func (this *RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := this.InitialBackoff
+	for i := 1; i < attempt && backoff < this.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, this.MaxBackoff)
+}
+
+// ModelPrice is the price of a model in any currency per million tokens.
+type ModelPrice struct {
+	Prompt     float64 `yaml:"prompt"`
+	Completion float64 `yaml:"completion"`
+}
+
+// Cost calculates the cost of using a number of tokens.
+func (this *ModelPrice) Cost(promptTokens int, completionTokens int) float64 {
+	return (float64(promptTokens)*this.Prompt + float64(completionTokens)*this.Completion) / 1_000_000
+}
+
+const API_TOKEN_COMMAND_TIMEOUT = 30 * time.Second
+
+// ReadConfigFile reads the backend configurations from a YAML file. Backends
+// with invalid settings are left out of the result and reported in the
+// returned error, so callers can decide whether to use the remaining backends.
 func ReadConfigFile(file string) ([]*EngineBackendConfig, error) {
 	backendConfigs := &[]*EngineBackendConfig{}
 	f, err := os.ReadFile(file)
@@ -31,34 +149,197 @@ func ReadConfigFile(file string) ([]*EngineBackendConfig, error) {
 		return nil, fmt.Errorf("cannot unmarshal config file: %w", err)
 	}
 
-	checkVariantFields(backendConfigs)
-	loadApiTokens(backendConfigs, path.Dir(file))
-	return *backendConfigs, nil
+	basePath := path.Dir(file)
+	validConfigs := []*EngineBackendConfig{}
+	errs := []error{}
+	for _, config := range *backendConfigs {
+		if err := checkVariantField(config); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := expandAddress(config); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := checkContextFields(config); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := checkRetryFields(config); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := checkPrices(config); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := loadApiToken(config, basePath); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		validConfigs = append(validConfigs, config)
+	}
+	return validConfigs, errors.Join(errs...)
 }
 
-func checkVariantFields(backendConfigs *[]*EngineBackendConfig) {
-	for _, config := range *backendConfigs {
-		if config.Variant != nil {
-			if *config.Variant != VARIANT_OOBABOOGA && *config.Variant != VARIANT_OLLAMA {
-				fmt.Printf("Error reading backend config file. Found unknown variant '%s'.\n", *config.Variant)
-				config.Variant = nil
-			}
+func IsValidVariant(variant string) bool {
+	return variant == VARIANT_OOBABOOGA || variant == VARIANT_OLLAMA || variant == VARIANT_LLAMACPP
+}
+
+func checkVariantField(config *EngineBackendConfig) error {
+	if config.Variant != nil && !IsValidVariant(*config.Variant) {
+		return fmt.Errorf("backend '%s' has unknown variant '%s'", config.Name, *config.Variant)
+	}
+	return nil
+}
+
+func IsValidContextStrategy(strategy string) bool {
+	return strategy == CONTEXT_STRATEGY_DROP_OLDEST || strategy == CONTEXT_STRATEGY_KEEP_LAST ||
+		strategy == CONTEXT_STRATEGY_SUMMARIZE
+}
+
+func checkContextFields(config *EngineBackendConfig) error {
+	if config.ContextStrategy != nil && !IsValidContextStrategy(*config.ContextStrategy) {
+		return fmt.Errorf("backend '%s' has unknown context_strategy '%s'", config.Name, *config.ContextStrategy)
+	}
+	if config.ContextKeepTurns != nil && *config.ContextKeepTurns < 1 {
+		return fmt.Errorf("backend '%s' must have a context_keep_turns of at least 1", config.Name)
+	}
+	for modelName, length := range config.ContextLengths {
+		if length <= 0 {
+			return fmt.Errorf("backend '%s' has an invalid context length for model '%s'", config.Name, modelName)
 		}
 	}
+	return nil
 }
 
-func loadApiTokens(backendConfigs *[]*EngineBackendConfig, basePath string) {
-	for _, config := range *backendConfigs {
-		if config.ApiTokenFrom != nil {
-			apiTokenPath := path.Join(basePath, *config.ApiTokenFrom)
-			content, err := os.ReadFile(apiTokenPath)
-			if err != nil {
-				fmt.Printf("Error opening api_token_from file '%s':\n%s", apiTokenPath, err.Error())
-			} else {
-				config.ApiToken = strings.TrimSpace(string(content))
-			}
-		} else {
-			config.ApiToken = ""
+func checkRetryFields(config *EngineBackendConfig) error {
+	if config.RetryMaxAttempts != nil && *config.RetryMaxAttempts < 1 {
+		return fmt.Errorf("backend '%s' must have a retry_max_attempts of at least 1", config.Name)
+	}
+	if config.RetryInitialBackoff != nil && *config.RetryInitialBackoff <= 0 {
+		return fmt.Errorf("backend '%s' must have a positive retry_initial_backoff", config.Name)
+	}
+	if config.RetryMaxBackoff != nil && *config.RetryMaxBackoff <= 0 {
+		return fmt.Errorf("backend '%s' must have a positive retry_max_backoff", config.Name)
+	}
+	return nil
+}
+
+func checkPrices(config *EngineBackendConfig) error {
+	for modelName, price := range config.Prices {
+		if price == nil || price.Prompt < 0 || price.Completion < 0 {
+			return fmt.Errorf("backend '%s' has an invalid price for model '%s'", config.Name, modelName)
 		}
 	}
+	return nil
+}
+
+var variableRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandVariables replaces `${VAR}` references with the value of the
+// environment variable. Unset variables are an error.
+func ExpandVariables(text string) (string, error) {
+	missing := []string{}
+	result := variableRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		name := variableRegexp.FindStringSubmatch(match)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) != 0 {
+		return "", fmt.Errorf("environment variable(s) not set: %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+func expandAddress(config *EngineBackendConfig) error {
+	if config.Address == nil {
+		return nil
+	}
+	address, err := ExpandVariables(*config.Address)
+	if err != nil {
+		return fmt.Errorf("backend '%s' has an invalid address: %w", config.Name, err)
+	}
+	config.Address = &address
+	return nil
+}
+
+// CountApiTokenSources returns how many of the different ways of giving an
+// API token are used in a backend config. At most one is allowed.
+func CountApiTokenSources(config *EngineBackendConfig) int {
+	count := 0
+	if config.ApiToken != "" {
+		count++
+	}
+	if config.ApiTokenFrom != nil {
+		count++
+	}
+	if config.ApiTokenEnv != nil {
+		count++
+	}
+	if config.ApiTokenCommand != nil {
+		count++
+	}
+	return count
+}
+
+func loadApiToken(config *EngineBackendConfig, basePath string) error {
+	if CountApiTokenSources(config) > 1 {
+		return fmt.Errorf("backend '%s' may only use one of api_token, api_token_from, api_token_env and api_token_command",
+			config.Name)
+	}
+
+	if config.ApiTokenFrom != nil {
+		apiTokenPath := path.Join(basePath, *config.ApiTokenFrom)
+		content, err := os.ReadFile(apiTokenPath)
+		if err != nil {
+			return fmt.Errorf("backend '%s' cannot read api_token_from file '%s': %w", config.Name, apiTokenPath, err)
+		}
+		config.ApiToken = strings.TrimSpace(string(content))
+
+	} else if config.ApiTokenEnv != nil {
+		value, ok := os.LookupEnv(*config.ApiTokenEnv)
+		if !ok || strings.TrimSpace(value) == "" {
+			return fmt.Errorf("backend '%s' api_token_env variable '%s' is not set", config.Name, *config.ApiTokenEnv)
+		}
+		config.ApiToken = strings.TrimSpace(value)
+
+	} else if config.ApiTokenCommand != nil {
+		token, err := runApiTokenCommand(config.ApiTokenCommand, basePath)
+		if err != nil {
+			return fmt.Errorf("backend '%s' api_token_command failed: %w", config.Name, err)
+		}
+		config.ApiToken = token
+	}
+
+	redact.AddSecret(config.ApiToken)
+	return nil
+}
+
+// runApiTokenCommand runs an external command, such as a password manager,
+// and returns the first line of its output as the token.
+func runApiTokenCommand(command []string, basePath string) (string, error) {
+	if len(command) == 0 {
+		return "", errors.New("the command is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), API_TOKEN_COMMAND_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = basePath
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("'%s': %w", command[0], err)
+	}
+
+	token := strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0])
+	if token == "" {
+		return "", fmt.Errorf("'%s' didn't output a token", command[0])
+	}
+	return token, nil
 }
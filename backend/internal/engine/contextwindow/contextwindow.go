@@ -0,0 +1,154 @@
+package contextwindow
+
+import (
+	"fmt"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/tokens"
+	"strings"
+)
+
+const DEFAULT_KEEP_TURNS = 4
+
+// RESPONSE_RESERVE_DIVISOR sets aside part of the context window for the
+// model's reply. A divisor of 4 leaves a quarter of the window free.
+const RESPONSE_RESERVE_DIVISOR = 4
+
+const SUMMARY_PREFIX = "Summary of the earlier conversation:\n"
+
+// Summarizer turns a list of messages into a short summary.
+type Summarizer func(messages []data.Message) (string, error)
+
+// Settings describe how to shorten messages which don't fit.
+type Settings struct {
+	ContextLength int
+	Strategy      string
+	KeepTurns     int
+	Summarize     Summarizer
+}
+
+// Budget returns the number of tokens which the prompt messages may use.
+func Budget(contextLength int) int {
+	return contextLength - contextLength/RESPONSE_RESERVE_DIVISOR
+}
+
+// Fit shortens a list of messages so that they fit in the context window.
+// System messages and the latest turn are always kept. The messages are
+// returned unchanged with a nil reduction if they already fit.
+func Fit(messages []data.Message, settings *Settings) ([]data.Message, *data.ContextReduction) {
+	budget := Budget(settings.ContextLength)
+	originalTokens := tokens.EstimateMessages(messages)
+	if settings.ContextLength <= 0 || originalTokens <= budget {
+		return messages, nil
+	}
+
+	systemMessages, turns, latestTurn := splitTurns(messages)
+
+	strategy := settings.Strategy
+	var keptTurns [][]data.Message
+	switch strategy {
+	case config.CONTEXT_STRATEGY_KEEP_LAST:
+		keepTurns := settings.KeepTurns
+		if keepTurns < 1 {
+			keepTurns = DEFAULT_KEEP_TURNS
+		}
+		// The latest turn counts as one of the turns to keep.
+		keptTurns = turns[max(0, len(turns)-(keepTurns-1)):]
+	default:
+		keptTurns = dropOldestTurns(systemMessages, turns, latestTurn, budget)
+	}
+
+	droppedTurns := turns[:len(turns)-len(keptTurns)]
+	droppedMessages := joinTurns(droppedTurns)
+
+	if strategy == config.CONTEXT_STRATEGY_SUMMARIZE && len(droppedMessages) != 0 {
+		summary, err := settings.Summarize(droppedMessages)
+		if err == nil {
+			systemMessages = append(systemMessages, data.Message{Role: role.System, Text: SUMMARY_PREFIX + summary})
+		} else {
+			strategy = config.CONTEXT_STRATEGY_DROP_OLDEST
+		}
+	} else if strategy == "" {
+		strategy = config.CONTEXT_STRATEGY_DROP_OLDEST
+	}
+
+	result := []data.Message{}
+	result = append(result, systemMessages...)
+	result = append(result, joinTurns(keptTurns)...)
+	result = append(result, latestTurn...)
+
+	return result, &data.ContextReduction{
+		Strategy:        strategy,
+		DroppedMessages: len(droppedMessages),
+		OriginalTokens:  originalTokens,
+		ReducedTokens:   tokens.EstimateMessages(result),
+	}
+}
+
+// splitTurns separates the system messages from the rest of the
+// conversation, which is split into turns each starting with a user
+// message. The latest turn is the one which the model is replying to.
+func splitTurns(messages []data.Message) ([]data.Message, [][]data.Message, []data.Message) {
+	systemMessages := []data.Message{}
+	turns := [][]data.Message{}
+	for _, message := range messages {
+		if message.Role == role.System {
+			systemMessages = append(systemMessages, message)
+			continue
+		}
+		if message.Role == role.User || len(turns) == 0 {
+			turns = append(turns, []data.Message{})
+		}
+		turns[len(turns)-1] = append(turns[len(turns)-1], message)
+	}
+
+	if len(turns) == 0 {
+		return systemMessages, turns, []data.Message{}
+	}
+	return systemMessages, turns[:len(turns)-1], turns[len(turns)-1]
+}
+
+func joinTurns(turns [][]data.Message) []data.Message {
+	result := []data.Message{}
+	for _, turn := range turns {
+		result = append(result, turn...)
+	}
+	return result
+}
+
+// dropOldestTurns returns the newest turns which fit in the budget next to
+// the system messages and the latest turn.
+func dropOldestTurns(systemMessages []data.Message, turns [][]data.Message, latestTurn []data.Message,
+	budget int) [][]data.Message {
+
+	used := tokens.EstimateMessages(systemMessages) + tokens.EstimateMessages(latestTurn)
+	first := len(turns)
+	for first > 0 {
+		turnTokens := tokens.EstimateMessages(turns[first-1])
+		if used+turnTokens > budget {
+			break
+		}
+		used += turnTokens
+		first--
+	}
+	return turns[first:]
+}
+
+// FormatTranscript formats messages as plain text for a summarization prompt.
+func FormatTranscript(messages []data.Message) string {
+	builder := strings.Builder{}
+	for _, message := range messages {
+		name := "User"
+		switch message.Role {
+		case role.Assistant:
+			name = "Assistant"
+		case role.ToolCall:
+			name = "Tool call " + message.ToolName
+		case role.ToolResult:
+			name = "Tool result " + message.ToolName
+		}
+		fmt.Fprintf(&builder, "%s: %s\n\n", name, message.Text)
+	}
+	return builder.String()
+}
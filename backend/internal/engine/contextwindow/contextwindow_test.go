@@ -0,0 +1,93 @@
+package contextwindow
+
+import (
+	"errors"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"strings"
+	"testing"
+)
+
+// makeConversation builds a system message followed by `turns` user and
+// assistant pairs of about 100 tokens each, and the latest user message
+// with an empty reply.
+func makeConversation(turns int) []data.Message {
+	text := strings.Repeat("word ", 80)
+	messages := []data.Message{{Role: role.System, Text: "Be brief."}}
+	for i := 0; i < turns; i++ {
+		messages = append(messages, data.Message{Role: role.User, Text: text})
+		messages = append(messages, data.Message{Role: role.Assistant, Text: text})
+	}
+	messages = append(messages, data.Message{Role: role.User, Text: "Latest question"})
+	messages = append(messages, data.Message{Role: role.Assistant, Text: ""})
+	return messages
+}
+
+func TestFitUnchanged(t *testing.T) {
+	messages := makeConversation(2)
+	result, reduction := Fit(messages, &Settings{ContextLength: 8192, Strategy: config.CONTEXT_STRATEGY_DROP_OLDEST})
+	if reduction != nil || len(result) != len(messages) {
+		t.Errorf("Expected the messages to be unchanged.")
+	}
+}
+
+func TestFitDropOldest(t *testing.T) {
+	messages := makeConversation(10)
+	result, reduction := Fit(messages, &Settings{ContextLength: 1000, Strategy: config.CONTEXT_STRATEGY_DROP_OLDEST})
+
+	if reduction == nil || reduction.Strategy != config.CONTEXT_STRATEGY_DROP_OLDEST {
+		t.Fatalf("Expected drop_oldest to be applied, got %+v", reduction)
+	}
+	if reduction.ReducedTokens > Budget(1000) {
+		t.Errorf("Reduced messages use %d tokens which is over the budget", reduction.ReducedTokens)
+	}
+	if result[0].Role != role.System || result[len(result)-2].Text != "Latest question" {
+		t.Errorf("Expected the system message and latest question to be kept.")
+	}
+	if len(result)+reduction.DroppedMessages != len(messages) {
+		t.Errorf("Dropped message count %d doesn't match.", reduction.DroppedMessages)
+	}
+}
+
+func TestFitKeepLast(t *testing.T) {
+	messages := makeConversation(10)
+	result, reduction := Fit(messages, &Settings{ContextLength: 1000, Strategy: config.CONTEXT_STRATEGY_KEEP_LAST,
+		KeepTurns: 2})
+
+	// System message, one earlier turn and the latest turn.
+	if len(result) != 5 || reduction.DroppedMessages != 18 {
+		t.Errorf("Expected 5 messages to be kept, got %d", len(result))
+	}
+}
+
+func TestFitSummarize(t *testing.T) {
+	messages := makeConversation(10)
+	var summarized []data.Message
+	settings := &Settings{ContextLength: 1000, Strategy: config.CONTEXT_STRATEGY_SUMMARIZE,
+		Summarize: func(messages []data.Message) (string, error) {
+			summarized = messages
+			return "They talked.", nil
+		}}
+	result, reduction := Fit(messages, settings)
+
+	if reduction.Strategy != config.CONTEXT_STRATEGY_SUMMARIZE || len(summarized) != reduction.DroppedMessages {
+		t.Errorf("Expected the dropped messages to be summarized, got %+v", reduction)
+	}
+	if result[1].Role != role.System || result[1].Text != SUMMARY_PREFIX+"They talked." {
+		t.Errorf("Expected the summary after the system message, got '%s'", result[1].Text)
+	}
+}
+
+func TestFitSummarizeFailure(t *testing.T) {
+	messages := makeConversation(10)
+	settings := &Settings{ContextLength: 1000, Strategy: config.CONTEXT_STRATEGY_SUMMARIZE,
+		Summarize: func(messages []data.Message) (string, error) {
+			return "", errors.New("offline")
+		}}
+	_, reduction := Fit(messages, settings)
+
+	if reduction.Strategy != config.CONTEXT_STRATEGY_DROP_OLDEST {
+		t.Errorf("Expected a fall back to drop_oldest, got %s", reduction.Strategy)
+	}
+}
@@ -0,0 +1,111 @@
+package engine
+
+import (
+	"fmt"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/data/priority"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/metrics"
+	"sedwards2009/llm-multitool/internal/tokens"
+	"time"
+)
+
+// MAX_EMBED_BATCH_SIZE limits how many texts are sent to a backend at once.
+const MAX_EMBED_BATCH_SIZE = 64
+
+// processEmbedding runs an embeddings request. The texts are sent to the
+// backend in batches.
+func (this *Engine) processEmbedding(work *types.Request, model *data.Model, backend types.EngineBackend) {
+	embedder, ok := backend.(types.Embedder)
+	if !ok {
+		failWork(work, &types.ProcessError{
+			Category: errorcategory.BadRequest,
+			Err:      fmt.Errorf("the backend of model %s doesn't support embeddings", model.ID),
+		})
+		return
+	}
+
+	backendID := backend.ID()
+	metrics.RunningRequests.WithLabelValues(backendID).Inc()
+	defer metrics.RunningRequests.WithLabelValues(backendID).Dec()
+	startTime := time.Now()
+
+	work.SetStatusFunc(responsestatus.Running)
+	vectors := [][]float32{}
+	promptTokens := 0
+	for start := 0; start < len(work.EmbedTexts); start += MAX_EMBED_BATCH_SIZE {
+		batch := work.EmbedTexts[start:min(start+MAX_EMBED_BATCH_SIZE, len(work.EmbedTexts))]
+		batchVectors, err := embedder.Embed(model, batch)
+		this.recordRequestResult(backendID, err)
+		if err != nil {
+			metrics.Errors.WithLabelValues(backendID).Inc()
+			metrics.RequestDuration.WithLabelValues(backendID, responsestatus.Error.String()).
+				Observe(time.Since(startTime).Seconds())
+			failWork(work, err)
+			return
+		}
+		vectors = append(vectors, batchVectors...)
+		for _, text := range batch {
+			promptTokens += tokens.Estimate(text)
+		}
+	}
+	metrics.RequestDuration.WithLabelValues(backendID, responsestatus.Done.String()).
+		Observe(time.Since(startTime).Seconds())
+
+	if work.SetUsageFunc != nil {
+		usage := &data.Usage{PromptTokens: promptTokens, IsEstimated: true}
+		if price := this.getModelPrice(model); price != nil {
+			cost := price.Cost(usage.PromptTokens, 0)
+			usage.Cost = &cost
+		}
+		work.SetUsageFunc(usage)
+	}
+	work.SetEmbeddingsFunc(vectors)
+	work.SetStatusFunc(responsestatus.Done)
+	work.CompleteFunc()
+}
+
+// Embed queues a request to turn texts into embedding vectors and waits for
+// it. One vector is returned for each text, in the same order.
+func (this *Engine) Embed(modelID string, texts []string, requestPriority priority.Priority) ([][]float32,
+	*data.Usage, error) {
+
+	done := make(chan bool)
+	var vectors [][]float32
+	var usage *data.Usage
+	var processError *types.ProcessError
+	status := responsestatus.Pending
+
+	this.EnqueueRequest(&types.Request{
+		ModelSettings: &data.ModelSettings{ModelID: modelID},
+		EmbedTexts:    texts,
+		AppendFunc:    func(text string) bool { return true },
+		SetStatusFunc: func(newStatus responsestatus.ResponseStatus) {
+			status = newStatus
+		},
+		SetErrorFunc: func(err *types.ProcessError) {
+			processError = err
+		},
+		SetUsageFunc: func(newUsage *data.Usage) {
+			usage = newUsage
+		},
+		SetEmbeddingsFunc: func(newVectors [][]float32) {
+			vectors = newVectors
+		},
+		CompleteFunc: func() {
+			close(done)
+		},
+		Priority: requestPriority,
+	})
+	<-done
+
+	if processError != nil {
+		return nil, nil, processError
+	}
+	if status != responsestatus.Done {
+		return nil, nil, fmt.Errorf("the embeddings request failed")
+	}
+	return vectors, usage, nil
+}
@@ -1,14 +1,26 @@
 package engine
 
 import (
+	"fmt"
 	"log"
 	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/backendhealth"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/data/priority"
 	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
 	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/engine/contextwindow"
 	"sedwards2009/llm-multitool/internal/engine/ollama"
 	"sedwards2009/llm-multitool/internal/engine/openai"
 	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/metrics"
 	"sedwards2009/llm-multitool/internal/presets"
+	"sedwards2009/llm-multitool/internal/tokens"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Engine struct {
@@ -16,10 +28,32 @@ type Engine struct {
 	workQueue         []*types.Request
 	engineDoneChan    chan bool
 	isComputing       bool
+	runningWork       *types.Request
 	computeWorkerChan chan *types.Request
-	models            []*data.Model
-	engineBackends    []types.EngineBackend
-	presetDatabase    *presets.PresetDatabase
+	configFilePath    string
+
+	// resumeChans holds the requests in the queue which are waiting to carry
+	// on after a retry wait, rather than to start. Only the engine worker
+	// uses it.
+	resumeChans    map[*types.Request]chan bool
+	presetDatabase *presets.PresetDatabase
+
+	// lock guards `models`, `modelBackendIDs`, `engineBackends` and
+	// `backendConfigs` which are replaced when the config is reloaded while
+	// the compute worker is reading them. The models themselves are never
+	// changed once they are in `models`.
+	lock           sync.RWMutex
+	models         []*data.Model
+	engineBackends []types.EngineBackend
+	backendConfigs []*config.EngineBackendConfig
+
+	// modelBackendIDs maps the ID of each model which has been listed to
+	// the ID of its backend.
+	modelBackendIDs map[string]string
+
+	// healthLock guards `backendStates`, which is keyed by backend ID.
+	healthLock    sync.Mutex
+	backendStates map[string]*backendState
 }
 
 type messageType uint8
@@ -28,6 +62,9 @@ const (
 	messageType_Enqueue messageType = iota
 	messageType_ListModels
 	messageType_ScanModels
+	messageType_SetBackends
+	messageType_ListQueue
+	messageType_Resume
 )
 
 type message struct {
@@ -39,14 +76,31 @@ type listModelsPayload struct {
 	out chan *data.ModelOverview
 }
 
+type listQueuePayload struct {
+	out chan *data.QueueOverview
+}
+
+type resumePayload struct {
+	work   *types.Request
+	resume chan bool
+}
+
 type scanModelsPayload struct {
 	wait chan bool
 }
 
+type setBackendsPayload struct {
+	engineBackends []types.EngineBackend
+	backendConfigs []*config.EngineBackendConfig
+	wait           chan bool
+}
+
 func NewEngine(configFilePath string, presetDatabase *presets.PresetDatabase) *Engine {
 	backendConfigs, err := config.ReadConfigFile(configFilePath)
 	if err != nil {
 		log.Print(err)
+	}
+	if backendConfigs == nil {
 		backendConfigs = []*config.EngineBackendConfig{}
 	}
 
@@ -57,22 +111,30 @@ func NewEngine(configFilePath string, presetDatabase *presets.PresetDatabase) *E
 		isComputing:       false,
 		computeWorkerChan: make(chan *types.Request, 2),
 		models:            make([]*data.Model, 0),
+		configFilePath:    configFilePath,
+		resumeChans:       map[*types.Request]chan bool{},
 		presetDatabase:    presetDatabase,
 	}
+	engine.engineBackends = MakeBackends(backendConfigs)
+	engine.backendConfigs = backendConfigs
+
+	go engine.worker(engine.toWorkerChan)
+	go engine.healthWorker()
+	return engine
+}
 
-	engine.engineBackends = []types.EngineBackend{}
+func MakeBackends(backendConfigs []*config.EngineBackendConfig) []types.EngineBackend {
+	engineBackends := []types.EngineBackend{}
 	for _, backendConfig := range backendConfigs {
 		if backendConfig.Variant != nil && *backendConfig.Variant == config.VARIANT_OLLAMA {
 			backendInstance := ollama.New(backendConfig)
-			engine.engineBackends = append(engine.engineBackends, backendInstance)
+			engineBackends = append(engineBackends, backendInstance)
 		} else {
 			backendInstance := openai.New(backendConfig)
-			engine.engineBackends = append(engine.engineBackends, backendInstance)
+			engineBackends = append(engineBackends, backendInstance)
 		}
 	}
-
-	go engine.worker(engine.toWorkerChan)
-	return engine
+	return engineBackends
 }
 
 func (this *Engine) worker(in chan *message) {
@@ -91,22 +153,45 @@ func (this *Engine) worker(in chan *message) {
 				log.Printf("engine worker: enqueue %p", payload)
 				this.workQueue = append(this.workQueue, payload)
 				this.tryNextCompute()
+				metrics.QueueDepth.Set(float64(len(this.workQueue)))
+
+			case messageType_Resume:
+				payload := message.payload.(*resumePayload)
+				this.workQueue = append(this.workQueue, payload.work)
+				this.resumeChans[payload.work] = payload.resume
+				this.tryNextCompute()
+				metrics.QueueDepth.Set(float64(len(this.workQueue)))
 
 			case messageType_ListModels:
 				payload := message.payload.(*listModelsPayload)
-				payload.out <- &data.ModelOverview{
-					Models: this.models[:],
-				}
+				payload.out <- this.modelOverview()
+			case messageType_ListQueue:
+				payload := message.payload.(*listQueuePayload)
+				payload.out <- this.queueOverview()
+
 			case messageType_ScanModels:
 				payload := message.payload.(*scanModelsPayload)
 				this.scanModels()
 				payload.wait <- true
+
+			case messageType_SetBackends:
+				payload := message.payload.(*setBackendsPayload)
+				// Requests which are already running keep a reference to their
+				// old backend instance and finish on it.
+				this.lock.Lock()
+				this.engineBackends = payload.engineBackends
+				this.backendConfigs = payload.backendConfigs
+				this.lock.Unlock()
+				this.scanModels()
+				payload.wait <- true
 			}
 
 		case <-this.engineDoneChan:
 			log.Printf("engine worker: compute done")
 			this.isComputing = false
+			this.runningWork = nil
 			this.tryNextCompute()
+			metrics.QueueDepth.Set(float64(len(this.workQueue)))
 		}
 	}
 }
@@ -115,19 +200,128 @@ func (this *Engine) tryNextCompute() {
 	if this.isComputing || len(this.workQueue) == 0 {
 		return
 	}
-	nextWork := this.workQueue[0]
-
-	this.workQueue = this.workQueue[1:]
-	this.computeWorkerChan <- nextWork
+	now := time.Now()
+	nextIndex := 0
+	for i, request := range this.workQueue {
+		if effectivePriority(request, now) < effectivePriority(this.workQueue[nextIndex], now) {
+			nextIndex = i
+		}
+	}
+	nextWork := this.workQueue[nextIndex]
+
+	this.workQueue = append(this.workQueue[:nextIndex:nextIndex], this.workQueue[nextIndex+1:]...)
+	if resume, ok := this.resumeChans[nextWork]; ok {
+		delete(this.resumeChans, nextWork)
+		resume <- true
+	} else {
+		this.computeWorkerChan <- nextWork
+	}
 	this.isComputing = true
+	this.runningWork = nextWork
+}
+
+// AGING_INTERVAL is how long a request waits before it is treated as having
+// the next higher priority. Batch requests can age up to interactive, but
+// background requests only up to batch, so that they never delay interactive
+// work.
+const AGING_INTERVAL = 30 * time.Second
+
+func effectivePriority(request *types.Request, now time.Time) priority.Priority {
+	requestPriority := request.Priority
+	if requestPriority == 0 {
+		return priority.Interactive
+	}
+
+	highest := priority.Interactive
+	if requestPriority == priority.Background {
+		highest = priority.Batch
+	}
+	if requestPriority <= highest || request.EnqueueTime.IsZero() {
+		return requestPriority
+	}
+	steps := int(now.Sub(request.EnqueueTime) / AGING_INTERVAL)
+	return max(highest, requestPriority-priority.Priority(min(steps, int(requestPriority-highest))))
+}
+
+func (this *Engine) queueOverview() *data.QueueOverview {
+	now := time.Now()
+	makeEntry := func(request *types.Request, isRunning bool) *data.QueueEntry {
+		requestPriority := request.Priority
+		if requestPriority == 0 {
+			requestPriority = priority.Interactive
+		}
+		modelID := ""
+		if request.ModelSettings != nil {
+			modelID = request.ModelSettings.ModelID
+		}
+		return &data.QueueEntry{
+			ModelID:           modelID,
+			Priority:          requestPriority,
+			EffectivePriority: effectivePriority(request, now),
+			WaitMs:            now.Sub(request.EnqueueTime).Milliseconds(),
+			IsRunning:         isRunning,
+		}
+	}
+
+	entries := []*data.QueueEntry{}
+	if this.runningWork != nil {
+		entries = append(entries, makeEntry(this.runningWork, true))
+	}
+	for _, request := range this.workQueue {
+		entries = append(entries, makeEntry(request, false))
+	}
+	return &data.QueueOverview{Entries: entries}
 }
 
+// QueueOverview lists the running request followed by the waiting requests.
+func (this *Engine) QueueOverview() *data.QueueOverview {
+	returnChannel := make(chan *data.QueueOverview)
+	this.toWorkerChan <- &message{
+		messageType: messageType_ListQueue,
+		payload:     &listQueuePayload{out: returnChannel},
+	}
+	return <-returnChannel
+}
+
+// computeWorker starts the requests which the engine worker hands it. Only
+// one request runs at a time, but each gets its own goroutine so that it can
+// give up its turn while it waits to be retried.
 func (this *Engine) computeWorker(in chan *types.Request, done chan bool) {
 	for work := range in {
-		this.processWork(work, done)
+		go this.processWork(work, done)
 	}
 }
 
+// waitToRetry waits before a failed request is tried again. Other requests
+// may run in the meantime, and the request then queues again for its turn.
+// It returns false if the request was cancelled while waiting.
+func (this *Engine) waitToRetry(work *types.Request, backoff time.Duration) bool {
+	// Engines made in tests have no worker to hand the turn to.
+	hasWorker := this.toWorkerChan != nil
+	if hasWorker {
+		this.engineDoneChan <- true
+	}
+
+	isCancelled := false
+	timer := time.NewTimer(backoff)
+	select {
+	case <-timer.C:
+	case <-work.Cancel:
+		timer.Stop()
+		isCancelled = true
+	}
+
+	if hasWorker {
+		resume := make(chan bool, 1)
+		this.toWorkerChan <- &message{
+			messageType: messageType_Resume,
+			payload:     &resumePayload{work: work, resume: resume},
+		}
+		<-resume
+	}
+	return !isCancelled
+}
+
 func (this *Engine) processWork(work *types.Request, done chan bool) {
 	defer func() {
 		done <- true
@@ -135,21 +329,257 @@ func (this *Engine) processWork(work *types.Request, done chan bool) {
 
 	model := this.GetModel(work.ModelSettings.ModelID)
 	if model == nil {
-		log.Printf("engine worker: Unable to find model with ID %s\n", work.ModelSettings.ModelID)
+		if backendID := this.downBackendOf(work.ModelSettings.ModelID); backendID != "" {
+			failWork(work, &types.ProcessError{
+				Category: errorcategory.Network,
+				Err:      fmt.Errorf("backend %s is down", backendID),
+			})
+			return
+		}
+		failWork(work, &types.ProcessError{
+			Category: errorcategory.ModelNotFound,
+			Err:      fmt.Errorf("unable to find model with ID %s", work.ModelSettings.ModelID),
+		})
 		return
 	}
 
 	backend := this.getBackendByID(model.EngineID)
 	if backend == nil {
-		log.Printf("engine worker: Unable to find backend with ID %s\n", model.EngineID)
+		failWork(work, &types.ProcessError{
+			Category: errorcategory.Backend,
+			Err:      fmt.Errorf("unable to find backend with ID %s", model.EngineID),
+		})
+		return
+	}
+
+	if work.EmbedTexts != nil {
+		this.processEmbedding(work, model, backend)
 		return
 	}
 
-	preset := this.getPresetByID(work.ModelSettings.PresetID)
-	backend.Process(work, model, preset)
+	preset := work.Preset
+	if preset == nil {
+		preset = this.getPresetByID(work.ModelSettings.PresetID)
+	}
+	if work.JsonSchema != nil {
+		this.processStructured(work, model, preset)
+		return
+	}
+	this.processWithFailover(work, model, preset)
+}
+
+// failWork finishes a request which couldn't be given to a backend.
+func failWork(work *types.Request, err *types.ProcessError) {
+	log.Printf("engine worker: %v\n", err)
+	if work.SetErrorFunc != nil {
+		work.SetErrorFunc(err)
+	}
+	work.SetStatusFunc(responsestatus.Error)
+	work.CompleteFunc()
+}
+
+// fitContextWindow returns a copy of the request with the messages
+// shortened using the backend's context strategy if they don't fit in the
+// model's context window.
+func (this *Engine) fitContextWindow(work *types.Request, model *data.Model) *types.Request {
+	if model.ContextLength == 0 {
+		return work
+	}
+
+	settings := &contextwindow.Settings{
+		ContextLength: model.ContextLength,
+		Strategy:      config.CONTEXT_STRATEGY_DROP_OLDEST,
+		KeepTurns:     contextwindow.DEFAULT_KEEP_TURNS,
+	}
+	summaryModelID := model.ID
+	if backendConfig := this.getBackendConfig(model.EngineID); backendConfig != nil {
+		if backendConfig.ContextStrategy != nil {
+			settings.Strategy = *backendConfig.ContextStrategy
+		}
+		if backendConfig.ContextKeepTurns != nil {
+			settings.KeepTurns = *backendConfig.ContextKeepTurns
+		}
+		if backendConfig.ContextSummaryModel != nil {
+			summaryModelID = *backendConfig.ContextSummaryModel
+		}
+	}
+	settings.Summarize = func(messages []data.Message) (string, error) {
+		return this.summarize(summaryModelID, messages)
+	}
+
+	messages, reduction := contextwindow.Fit(work.Messages, settings)
+	if reduction == nil {
+		return work
+	}
+	log.Printf("engine worker: Shortened the messages for model %s from about %d to %d tokens using %s",
+		model.ID, reduction.OriginalTokens, reduction.ReducedTokens, reduction.Strategy)
+	if work.SetContextReductionFunc != nil {
+		work.SetContextReductionFunc(reduction)
+	}
+
+	reducedWork := *work
+	reducedWork.Messages = messages
+	return &reducedWork
+}
+
+const SUMMARY_PROMPT = "Summarize the following conversation in a few sentences. " +
+	"Keep any facts, names and decisions which later messages may refer to.\n\n"
+
+// summarize asks a model for a summary of some messages. This runs on the
+// compute worker and so blocks the queue while it runs.
+func (this *Engine) summarize(modelID string, messages []data.Message) (string, error) {
+	model := this.GetModel(modelID)
+	if model == nil {
+		return "", fmt.Errorf("summary model %s is not available", modelID)
+	}
+	backend := this.getBackendByID(model.EngineID)
+	if backend == nil {
+		return "", fmt.Errorf("backend %s for the summary model is not available", model.EngineID)
+	}
+
+	summary := strings.Builder{}
+	status := responsestatus.Done
+	request := &types.Request{
+		Messages: []data.Message{
+			{Role: role.User, Text: SUMMARY_PROMPT + contextwindow.FormatTranscript(messages)},
+			{Role: role.Assistant, Text: ""},
+		},
+		AppendFunc: func(text string) bool {
+			summary.WriteString(text)
+			return true
+		},
+		CompleteFunc: func() {},
+		SetStatusFunc: func(newStatus responsestatus.ResponseStatus) {
+			status = newStatus
+		},
+		ModelSettings: &data.ModelSettings{ModelID: modelID},
+	}
+	preset := &data.Preset{ID: "summary", Name: "summary", Temperature: 0.2, TopP: 0.9}
+	processInstrumented(backend, request, model, preset, this.getModelPrice(model))
+
+	if status != responsestatus.Done || strings.TrimSpace(summary.String()) == "" {
+		return "", fmt.Errorf("summary model %s failed", modelID)
+	}
+	return strings.TrimSpace(summary.String()), nil
+}
+
+// processInstrumented runs a request on a backend while recording its
+// timings and final status in the metrics. The usage and timings are passed
+// on to the request's callbacks. The token usage is estimated if the backend
+// doesn't report it, and is priced if `price` is not nil.
+func processInstrumented(backend types.EngineBackend, work *types.Request, model *data.Model,
+	preset *data.Preset, price *config.ModelPrice) {
+
+	backendID := backend.ID()
+	metrics.RunningRequests.WithLabelValues(backendID).Inc()
+	defer metrics.RunningRequests.WithLabelValues(backendID).Dec()
+
+	startTime := time.Now()
+	var firstTokenTime time.Time
+	tokenCount := 0
+	finalStatus := responsestatus.Done
+	var reportedUsage *data.Usage
+	var reportedTiming *data.Timing
+	completion := strings.Builder{}
+
+	instrumentedWork := *work
+	instrumentedWork.AppendFunc = func(text string) bool {
+		// Streams can start with an empty chunk, such as OpenAI's role delta.
+		if len(text) > 0 {
+			if tokenCount == 0 {
+				firstTokenTime = time.Now()
+				metrics.TimeToFirstToken.WithLabelValues(backendID).Observe(firstTokenTime.Sub(startTime).Seconds())
+			}
+			tokenCount++
+		}
+		completion.WriteString(text)
+		return work.AppendFunc(text)
+	}
+	instrumentedWork.SetStatusFunc = func(status responsestatus.ResponseStatus) {
+		finalStatus = status
+		work.SetStatusFunc(status)
+	}
+	instrumentedWork.SetErrorFunc = func(err *types.ProcessError) {
+		if work.SetErrorFunc != nil {
+			work.SetErrorFunc(err)
+		}
+	}
+	instrumentedWork.SetUsageFunc = func(usage *data.Usage) {
+		reportedUsage = usage
+	}
+	instrumentedWork.SetTimingFunc = func(timing *data.Timing) {
+		reportedTiming = timing
+	}
+	instrumentedWork.CompleteFunc = func() {
+		usage := reportedUsage
+		if usage == nil {
+			usage = &data.Usage{
+				PromptTokens:     tokens.EstimateMessages(work.Messages[:len(work.Messages)-1]),
+				CompletionTokens: tokens.Estimate(completion.String()),
+				IsEstimated:      true,
+			}
+		}
+		if price != nil {
+			cost := price.Cost(usage.PromptTokens, usage.CompletionTokens)
+			usage.Cost = &cost
+		}
+		if work.SetUsageFunc != nil {
+			work.SetUsageFunc(usage)
+		}
+		if work.SetTimingFunc != nil {
+			work.SetTimingFunc(makeTiming(reportedTiming, usage, work.EnqueueTime, startTime, firstTokenTime,
+				time.Now()))
+		}
+		work.CompleteFunc()
+	}
+
+	backend.Process(&instrumentedWork, model, preset)
+
+	endTime := time.Now()
+	if finalStatus == responsestatus.Error {
+		metrics.Errors.WithLabelValues(backendID).Inc()
+	}
+	metrics.RequestDuration.WithLabelValues(backendID, finalStatus.String()).Observe(endTime.Sub(startTime).Seconds())
+	generationTime := endTime.Sub(firstTokenTime).Seconds()
+	if tokenCount > 1 && generationTime > 0 {
+		metrics.TokensPerSecond.WithLabelValues(backendID).Observe(float64(tokenCount-1) / generationTime)
+	}
+}
+
+// makeTiming fills in the timings which the backend didn't report. The
+// generation speed is taken from the backend's eval duration if it is known.
+func makeTiming(reportedTiming *data.Timing, usage *data.Usage, enqueueTime time.Time, startTime time.Time,
+	firstTokenTime time.Time, endTime time.Time) *data.Timing {
+
+	timing := &data.Timing{}
+	if reportedTiming != nil {
+		timingCopy := *reportedTiming
+		timing = &timingCopy
+	}
+
+	if !enqueueTime.IsZero() {
+		timing.QueueWaitMs = startTime.Sub(enqueueTime).Milliseconds()
+	}
+	timing.DurationMs = endTime.Sub(startTime).Milliseconds()
+	if firstTokenTime.IsZero() {
+		return timing
+	}
+	timing.TimeToFirstTokenMs = firstTokenTime.Sub(startTime).Milliseconds()
+
+	generationSeconds := endTime.Sub(firstTokenTime).Seconds()
+	if timing.EvalDurationMs != nil && *timing.EvalDurationMs > 0 {
+		generationSeconds = float64(*timing.EvalDurationMs) / 1000
+	}
+	if generationSeconds > 0 {
+		timing.TokensPerSecond = float64(usage.CompletionTokens) / generationSeconds
+	}
+	return timing
 }
 
 func (this *Engine) GetModel(modelID string) *data.Model {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	for _, model := range this.models {
 		if model.ID == modelID {
 			return model
@@ -159,6 +589,9 @@ func (this *Engine) GetModel(modelID string) *data.Model {
 }
 
 func (this *Engine) getBackendByID(backendID string) types.EngineBackend {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	for _, backend := range this.engineBackends {
 		if backend.ID() == backendID {
 			return backend
@@ -167,6 +600,26 @@ func (this *Engine) getBackendByID(backendID string) types.EngineBackend {
 	return nil
 }
 
+func (this *Engine) getBackendConfig(backendID string) *config.EngineBackendConfig {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	for _, backendConfig := range this.backendConfigs {
+		if backendConfig.Name == backendID {
+			return backendConfig
+		}
+	}
+	return nil
+}
+
+func (this *Engine) getModelPrice(model *data.Model) *config.ModelPrice {
+	backendConfig := this.getBackendConfig(model.EngineID)
+	if backendConfig == nil {
+		return nil
+	}
+	return backendConfig.Prices[model.InternalModelID]
+}
+
 func (this *Engine) getPresetByID(presetID string) *data.Preset {
 	preset := this.presetDatabase.Get(presetID)
 	if preset == nil {
@@ -181,28 +634,86 @@ func (this *Engine) getPresetByID(presetID string) *data.Preset {
 }
 
 func (this *Engine) scanModels() {
+	this.lock.RLock()
+	engineBackends := this.engineBackends
+	this.lock.RUnlock()
+
 	allModels := []*data.Model{}
-	for _, backend := range this.engineBackends {
-		allModels = append(allModels, backend.ScanModels()...)
+	for _, backend := range engineBackends {
+		models := backend.ScanModels()
+		if len(models) == 0 && this.checkBackend(backend) == backendhealth.Down {
+			// Keep listing the models of a backend which is only down for a
+			// while. They are scanned again when it comes back.
+			models = this.listModelsOfBackend(backend.ID())
+		}
+		backendConfig := this.getBackendConfig(backend.ID())
+		for _, model := range models {
+			// Other goroutines may be reading the listed models, so the
+			// settings go on copies.
+			modelCopy := *model
+			if backendConfig != nil {
+				if contextLength, ok := backendConfig.ContextLengths[model.InternalModelID]; ok {
+					modelCopy.ContextLength = contextLength
+					modelCopy.IsContextLengthSet = true
+				}
+				modelCopy.SupportsTools = slices.Contains(backendConfig.ToolModels, model.InternalModelID)
+				if slices.Contains(backendConfig.EmbeddingModels, model.InternalModelID) {
+					modelCopy.SupportsEmbeddings = true
+				}
+			}
+			allModels = append(allModels, &modelCopy)
+		}
 	}
+
+	this.lock.Lock()
 	this.models = allModels
+	if this.modelBackendIDs == nil {
+		this.modelBackendIDs = map[string]string{}
+	}
+	for _, model := range allModels {
+		this.modelBackendIDs[model.ID] = model.EngineID
+	}
+	this.lock.Unlock()
 }
 
-func (this *Engine) Enqueue(attachedFilesPath string, messages []data.Message,
-	appendFunc func(string) bool, completeFunc func(),
-	setStatusFunc func(responsestatus.ResponseStatus), modelSettings *data.ModelSettings) {
+func (this *Engine) listModelsOfBackend(backendID string) []*data.Model {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
 
-	payload := &types.Request{
-		AttachedFilesPath: attachedFilesPath,
-		Messages:          messages,
-		AppendFunc:        appendFunc,
-		CompleteFunc:      completeFunc,
-		SetStatusFunc:     setStatusFunc,
-		ModelSettings:     modelSettings,
+	result := []*data.Model{}
+	for _, model := range this.models {
+		if model.EngineID == backendID {
+			result = append(result, model)
+		}
+	}
+	return result
+}
+
+// modelOverview returns copies of the models with the health of their
+// backends filled in.
+func (this *Engine) modelOverview() *data.ModelOverview {
+	this.lock.RLock()
+	models := this.models
+	this.lock.RUnlock()
+
+	overview := &data.ModelOverview{Models: []*data.Model{}}
+	for _, model := range models {
+		modelCopy := *model
+		modelCopy.Health = this.backendHealth(model.EngineID)
+		if modelCopy.Health == 0 {
+			modelCopy.Health = backendhealth.Healthy
+		}
+		overview.Models = append(overview.Models, &modelCopy)
 	}
+	return overview
+}
+
+// EnqueueRequest adds a fully filled in request to the work queue.
+func (this *Engine) EnqueueRequest(request *types.Request) {
+	request.EnqueueTime = time.Now()
 	message := &message{
 		messageType: messageType_Enqueue,
-		payload:     payload,
+		payload:     request,
 	}
 	this.toWorkerChan <- message
 }
@@ -227,7 +738,8 @@ func (this *Engine) validateModelID(modelID string) bool {
 			return true
 		}
 	}
-	return false
+	// Sessions may keep using a model while its backend is down.
+	return this.downBackendOf(modelID) != ""
 }
 
 func (this *Engine) ScanModels() {
@@ -239,7 +751,36 @@ func (this *Engine) ScanModels() {
 	<-returnChannel
 }
 
+// Reload rereads the backend config file and replaces the set of backends.
+// If the config file can't be read then the current backends are kept and
+// the error is returned.
+func (this *Engine) Reload() error {
+	backendConfigs, err := config.ReadConfigFile(this.configFilePath)
+	if err != nil {
+		return err
+	}
+
+	returnChannel := make(chan bool)
+	this.toWorkerChan <- &message{
+		messageType: messageType_SetBackends,
+		payload: &setBackendsPayload{
+			engineBackends: MakeBackends(backendConfigs),
+			backendConfigs: backendConfigs,
+			wait:           returnChannel,
+		},
+	}
+	<-returnChannel
+	return nil
+}
+
+func (this *Engine) ConfigFilePath() string {
+	return this.configFilePath
+}
+
 func (this *Engine) DefaultID() string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	for _, model := range this.models {
 		return model.ID
 	}
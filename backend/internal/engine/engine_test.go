@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/data/priority"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/metrics"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMakeTiming(t *testing.T) {
+	enqueueTime := time.Now()
+	startTime := enqueueTime.Add(2 * time.Second)
+	firstTokenTime := startTime.Add(500 * time.Millisecond)
+	endTime := firstTokenTime.Add(4 * time.Second)
+	usage := &data.Usage{CompletionTokens: 20}
+
+	timing := makeTiming(nil, usage, enqueueTime, startTime, firstTokenTime, endTime)
+	if timing.QueueWaitMs != 2000 || timing.TimeToFirstTokenMs != 500 || timing.DurationMs != 4500 {
+		t.Errorf("Unexpected timings: %+v", timing)
+	}
+	if timing.TokensPerSecond != 5 {
+		t.Errorf("Expected 5 tokens per second, got %f", timing.TokensPerSecond)
+	}
+
+	evalDurationMs := int64(2000)
+	timing = makeTiming(&data.Timing{EvalDurationMs: &evalDurationMs}, usage, enqueueTime, startTime,
+		firstTokenTime, endTime)
+	if timing.TokensPerSecond != 10 {
+		t.Errorf("Expected the eval duration to be used, got %f tokens per second", timing.TokensPerSecond)
+	}
+}
+
+func TestMakeTimingWithoutTokens(t *testing.T) {
+	startTime := time.Now()
+	timing := makeTiming(nil, &data.Usage{}, time.Time{}, startTime, time.Time{}, startTime.Add(time.Second))
+	if timing.QueueWaitMs != 0 || timing.TimeToFirstTokenMs != 0 || timing.TokensPerSecond != 0 {
+		t.Errorf("Expected only the duration to be set, got %+v", timing)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	background := &types.Request{Priority: priority.Background}
+	batch := &types.Request{Priority: priority.Batch}
+	interactive := &types.Request{Priority: priority.Interactive}
+	engine := &Engine{
+		workQueue:         []*types.Request{background, batch, interactive},
+		computeWorkerChan: make(chan *types.Request, 3),
+	}
+
+	for _, expected := range []*types.Request{interactive, batch, background} {
+		engine.isComputing = false
+		engine.tryNextCompute()
+		if next := <-engine.computeWorkerChan; next != expected {
+			t.Errorf("Expected a %s request to run next, got %s", expected.Priority, next.Priority)
+		}
+	}
+}
+
+func TestPriorityAging(t *testing.T) {
+	now := time.Now()
+	batch := &types.Request{Priority: priority.Batch, EnqueueTime: now.Add(-AGING_INTERVAL)}
+	interactive := &types.Request{Priority: priority.Interactive, EnqueueTime: now}
+	if effectivePriority(batch, now) != priority.Interactive {
+		t.Errorf("Expected a waiting batch request to age to interactive.")
+	}
+
+	engine := &Engine{
+		workQueue:         []*types.Request{interactive, batch},
+		computeWorkerChan: make(chan *types.Request, 2),
+	}
+	engine.tryNextCompute()
+	if <-engine.computeWorkerChan != interactive {
+		t.Errorf("Expected the earlier request to win a tie.")
+	}
+
+	background := &types.Request{Priority: priority.Background, EnqueueTime: now.Add(-10 * AGING_INTERVAL)}
+	if effectivePriority(background, now) != priority.Batch {
+		t.Errorf("Expected a background request to age no higher than batch, got %s",
+			effectivePriority(background, now))
+	}
+	if effectivePriority(&types.Request{}, now) != priority.Interactive {
+		t.Errorf("Expected requests without a priority to be interactive.")
+	}
+}
+
+func TestProcessWorkWithUnknownModel(t *testing.T) {
+	status := responsestatus.Pending
+	var responseError *data.ResponseError
+	isComplete := false
+	work := &types.Request{
+		CompleteFunc: func() {
+			isComplete = true
+		},
+		SetStatusFunc: func(newStatus responsestatus.ResponseStatus) {
+			status = newStatus
+		},
+		SetErrorFunc: func(err *types.ProcessError) {
+			responseError = err.ResponseError()
+		},
+		ModelSettings: &data.ModelSettings{ModelID: "missing"},
+	}
+
+	engine := &Engine{}
+	done := make(chan bool, 1)
+	engine.processWork(work, done)
+
+	if status != responsestatus.Error || !isComplete {
+		t.Errorf("Expected the request to be completed with an error, got %s", status)
+	}
+	if responseError == nil || responseError.Category != errorcategory.ModelNotFound {
+		t.Errorf("Unexpected error %+v", responseError)
+	}
+}
+
+func runInstrumented(backend types.EngineBackend) {
+	work := &types.Request{
+		Messages:      []data.Message{{Role: role.User, Text: "Hello"}, {Role: role.Assistant, Text: ""}},
+		AppendFunc:    func(text string) bool { return true },
+		CompleteFunc:  func() {},
+		SetStatusFunc: func(status responsestatus.ResponseStatus) {},
+	}
+	processInstrumented(backend, work, backend.ScanModels()[0], &data.Preset{}, nil)
+}
+
+// sampleCount returns how many values a histogram has observed.
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	metric := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(metric); err != nil {
+		t.Fatalf("Unable to read the histogram: %v", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestProcessInstrumentedMetrics(t *testing.T) {
+	backend := &fakeBackend{id: "instrumented", chunks: []string{"Hello", " there", "!"}, delay: 5 * time.Millisecond}
+	runInstrumented(backend)
+	runInstrumented(backend)
+
+	if count := sampleCount(t, metrics.RequestDuration.WithLabelValues("instrumented", "Done")); count != 2 {
+		t.Errorf("Expected 2 request durations, got %d", count)
+	}
+	if count := sampleCount(t, metrics.TimeToFirstToken.WithLabelValues("instrumented")); count != 2 {
+		t.Errorf("Expected 2 times to the first token, got %d", count)
+	}
+	if count := sampleCount(t, metrics.TokensPerSecond.WithLabelValues("instrumented")); count != 2 {
+		t.Errorf("Expected 2 generation speeds, got %d", count)
+	}
+	if errorCount := testutil.ToFloat64(metrics.Errors.WithLabelValues("instrumented")); errorCount != 0 {
+		t.Errorf("Expected no errors, got %g", errorCount)
+	}
+	if running := testutil.ToFloat64(metrics.RunningRequests.WithLabelValues("instrumented")); running != 0 {
+		t.Errorf("Expected no running requests afterwards, got %g", running)
+	}
+}
+
+func TestProcessInstrumentedErrorMetrics(t *testing.T) {
+	runInstrumented(&fakeBackend{id: "instrumented_error", statusCode: 500, failures: 1})
+
+	if errorCount := testutil.ToFloat64(metrics.Errors.WithLabelValues("instrumented_error")); errorCount != 1 {
+		t.Errorf("Expected 1 error, got %g", errorCount)
+	}
+	if count := sampleCount(t, metrics.RequestDuration.WithLabelValues("instrumented_error", "Error")); count != 1 {
+		t.Errorf("Expected 1 request duration with the error status, got %d", count)
+	}
+	if count := sampleCount(t, metrics.RequestDuration.WithLabelValues("instrumented_error", "Done")); count != 0 {
+		t.Errorf("Expected no request durations with the done status, got %d", count)
+	}
+	if count := sampleCount(t, metrics.TokensPerSecond.WithLabelValues("instrumented_error")); count != 0 {
+		t.Errorf("Expected no generation speeds, got %d", count)
+	}
+}
+
+func TestProcessInstrumentedSkipsEmptyChunks(t *testing.T) {
+	// The empty chunk isn't a token, which leaves one token and no speed.
+	runInstrumented(&fakeBackend{id: "instrumented_empty", chunks: []string{"", "Hello"}})
+
+	if count := sampleCount(t, metrics.TimeToFirstToken.WithLabelValues("instrumented_empty")); count != 1 {
+		t.Errorf("Expected 1 time to the first token, got %d", count)
+	}
+	if count := sampleCount(t, metrics.TokensPerSecond.WithLabelValues("instrumented_empty")); count != 0 {
+		t.Errorf("Expected no generation speeds, got %d", count)
+	}
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"errors"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"time"
+)
+
+// fakeBackend streams its chunks, or "Hello from <id>" if it has none, and
+// waits for `delay` before each chunk. The first `failures` calls fail with
+// `statusCode` instead. `calls` counts the calls.
+type fakeBackend struct {
+	id         string
+	chunks     []string
+	delay      time.Duration
+	statusCode int
+	failures   int
+	calls      int
+}
+
+func (this *fakeBackend) ID() string {
+	return this.id
+}
+
+func (this *fakeBackend) ScanModels() []*data.Model {
+	return []*data.Model{{ID: this.id + "_model", Name: "model", EngineID: this.id, InternalModelID: "model"}}
+}
+
+func (this *fakeBackend) CheckConnection() error {
+	return nil
+}
+
+func (this *fakeBackend) Process(work *types.Request, model *data.Model, preset *data.Preset) {
+	work.SetStatusFunc(responsestatus.Running)
+	defer work.CompleteFunc()
+	this.calls++
+	if this.failures > 0 {
+		this.failures--
+		work.SetErrorFunc(&types.ProcessError{StatusCode: this.statusCode, Err: errors.New("failed")})
+		work.SetStatusFunc(responsestatus.Error)
+		return
+	}
+
+	chunks := this.chunks
+	if len(chunks) == 0 {
+		chunks = []string{"Hello from " + this.id}
+	}
+	for _, chunk := range chunks {
+		time.Sleep(this.delay)
+		work.AppendFunc(chunk)
+	}
+	work.SetStatusFunc(responsestatus.Done)
+}
@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"log"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/backendhealth"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/redact"
+	"strings"
+	"time"
+)
+
+const HEALTH_CHECK_INTERVAL = 30 * time.Second
+
+// SLOW_CHECK_THRESHOLD is how long a backend may take to answer a health
+// check before it is considered degraded.
+const SLOW_CHECK_THRESHOLD = 3 * time.Second
+
+// DEGRADED_FAILURE_COUNT is the number of requests in a row which must fail
+// on a reachable backend before it is considered degraded.
+const DEGRADED_FAILURE_COUNT = 2
+
+type backendState struct {
+	status          *data.BackendStatus
+	requestFailures int
+}
+
+// healthWorker checks all of the backends at a regular interval. The models
+// are scanned again when a backend which was down comes back.
+func (this *Engine) healthWorker() {
+	for {
+		this.checkBackends()
+		time.Sleep(HEALTH_CHECK_INTERVAL)
+	}
+}
+
+func (this *Engine) checkBackends() {
+	this.lock.RLock()
+	engineBackends := this.engineBackends
+	this.lock.RUnlock()
+
+	isRecovered := false
+	for _, backend := range engineBackends {
+		previousHealth := this.backendHealth(backend.ID())
+		health := this.checkBackend(backend)
+		if previousHealth == backendhealth.Down && health != backendhealth.Down {
+			isRecovered = true
+		}
+	}
+	if isRecovered {
+		this.ScanModels()
+	}
+}
+
+// checkBackend checks the connection to a backend and records the result.
+func (this *Engine) checkBackend(backend types.EngineBackend) backendhealth.BackendHealth {
+	startTime := time.Now()
+	err := backend.CheckConnection()
+	latency := time.Since(startTime)
+
+	this.healthLock.Lock()
+	defer this.healthLock.Unlock()
+
+	state := this.getBackendState(backend.ID())
+	status := &data.BackendStatus{
+		ID:                 backend.ID(),
+		Health:             backendhealth.Healthy,
+		LastCheckTimestamp: startTime.UTC().Format(time.RFC3339),
+		LatencyMs:          latency.Milliseconds(),
+	}
+	if err != nil {
+		status.Health = backendhealth.Down
+		status.Error = redact.String(err.Error())
+	} else if latency > SLOW_CHECK_THRESHOLD || state.requestFailures >= DEGRADED_FAILURE_COUNT {
+		status.Health = backendhealth.Degraded
+	}
+
+	if state.status == nil || state.status.Health != status.Health {
+		log.Printf("engine: Backend %s is %s\n", backend.ID(), status.Health)
+	}
+	state.status = status
+	return status.Health
+}
+
+// getBackendState must be called with `healthLock` held.
+func (this *Engine) getBackendState(backendID string) *backendState {
+	if this.backendStates == nil {
+		this.backendStates = map[string]*backendState{}
+	}
+	state, ok := this.backendStates[backendID]
+	if !ok {
+		state = &backendState{}
+		this.backendStates[backendID] = state
+	}
+	return state
+}
+
+// backendHealth returns the health found by the latest check of a backend,
+// or 0 if it hasn't been checked.
+func (this *Engine) backendHealth(backendID string) backendhealth.BackendHealth {
+	this.healthLock.Lock()
+	defer this.healthLock.Unlock()
+
+	state, ok := this.backendStates[backendID]
+	if !ok || state.status == nil {
+		return 0
+	}
+	return state.status.Health
+}
+
+// recordRequestResult counts the requests in a row which failed because the
+// backend had trouble. Failures caused by the request itself don't count.
+func (this *Engine) recordRequestResult(backendID string, err *types.ProcessError) {
+	this.healthLock.Lock()
+	defer this.healthLock.Unlock()
+
+	state := this.getBackendState(backendID)
+	if err == nil {
+		state.requestFailures = 0
+		return
+	}
+	switch err.Classify() {
+	case errorcategory.Network, errorcategory.RateLimit, errorcategory.Backend:
+		state.requestFailures++
+	}
+}
+
+// BackendOverview returns the health of each backend. Backends which haven't
+// been checked yet are healthy if models were found on them.
+func (this *Engine) BackendOverview() *data.BackendOverview {
+	this.lock.RLock()
+	engineBackends := this.engineBackends
+	modelCounts := map[string]int{}
+	for _, model := range this.models {
+		modelCounts[model.EngineID]++
+	}
+	this.lock.RUnlock()
+
+	this.healthLock.Lock()
+	defer this.healthLock.Unlock()
+
+	overview := &data.BackendOverview{Backends: []*data.BackendStatus{}}
+	for _, backend := range engineBackends {
+		status := &data.BackendStatus{ID: backend.ID(), Health: backendhealth.Down}
+		if state, ok := this.backendStates[backend.ID()]; ok && state.status != nil {
+			statusCopy := *state.status
+			status = &statusCopy
+		} else if modelCounts[backend.ID()] != 0 {
+			status.Health = backendhealth.Healthy
+		}
+		status.ModelCount = modelCounts[backend.ID()]
+		overview.Backends = append(overview.Backends, status)
+	}
+	return overview
+}
+
+// downBackendOf returns the ID of the backend which a model ID belongs to if
+// that backend is down, or an empty string otherwise. The models of a backend
+// which is down may never have been listed.
+func (this *Engine) downBackendOf(modelID string) string {
+	backendID := this.backendIDOfModel(modelID)
+	if backendID == "" {
+		return ""
+	}
+	for _, status := range this.BackendOverview().Backends {
+		if status.ID == backendID && status.Health == backendhealth.Down {
+			return status.ID
+		}
+	}
+	return ""
+}
+
+// backendIDOfModel returns the ID of the backend which a model was listed by.
+// For a model which was never listed, the ID is taken from the front of the
+// model ID, preferring the longest backend ID so that a backend `local` isn't
+// mistaken for `local_gpu`.
+func (this *Engine) backendIDOfModel(modelID string) string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if backendID, ok := this.modelBackendIDs[modelID]; ok {
+		return backendID
+	}
+	result := ""
+	for _, backend := range this.engineBackends {
+		if strings.HasPrefix(modelID, backend.ID()+"_") && len(backend.ID()) > len(result) {
+			result = backend.ID()
+		}
+	}
+	return result
+}
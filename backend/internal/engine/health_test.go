@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"errors"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/backendhealth"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sync"
+	"testing"
+)
+
+// flakyBackend can be switched between up and down. Its ID is "flaky"
+// unless another is given.
+type flakyBackend struct {
+	lock sync.Mutex
+	isUp bool
+	id   string
+}
+
+func (this *flakyBackend) setUp(isUp bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.isUp = isUp
+}
+
+func (this *flakyBackend) ID() string {
+	if this.id != "" {
+		return this.id
+	}
+	return "flaky"
+}
+
+func (this *flakyBackend) ScanModels() []*data.Model {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if !this.isUp {
+		return []*data.Model{}
+	}
+	return []*data.Model{{ID: this.ID() + "_llama3", Name: this.ID() + " - llama3", EngineID: this.ID(),
+		InternalModelID: "llama3"}}
+}
+
+func (this *flakyBackend) CheckConnection() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if !this.isUp {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (this *flakyBackend) Process(work *types.Request, model *data.Model, preset *data.Preset) {
+}
+
+func TestBackendRecovery(t *testing.T) {
+	backend := &flakyBackend{}
+	engine := &Engine{
+		toWorkerChan:      make(chan *message, 16),
+		engineDoneChan:    make(chan bool, 16),
+		computeWorkerChan: make(chan *types.Request, 2),
+		engineBackends:    []types.EngineBackend{backend},
+	}
+	go engine.worker(engine.toWorkerChan)
+	engine.ScanModels()
+
+	status := engine.BackendOverview().Backends[0]
+	if status.Health != backendhealth.Down || status.Error != "connection refused" {
+		t.Errorf("Expected the backend to be down, got %+v", status)
+	}
+	if !engine.ValidateModelSettings(&data.ModelSettings{ModelID: "flaky_llama3"}) {
+		t.Errorf("Expected a model of a backend which is down to stay valid.")
+	}
+	if engine.ValidateModelSettings(&data.ModelSettings{ModelID: "other_llama3"}) {
+		t.Errorf("Expected a model of an unknown backend to be invalid.")
+	}
+
+	backend.setUp(true)
+	engine.checkBackends()
+	models := engine.ModelOverview().Models
+	if len(models) != 1 || models[0].Health != backendhealth.Healthy {
+		t.Fatalf("Expected the models to be scanned after the backend recovered, got %v", models)
+	}
+
+	backend.setUp(false)
+	engine.checkBackends()
+	engine.ScanModels()
+	models = engine.ModelOverview().Models
+	if len(models) != 1 || models[0].Health != backendhealth.Down {
+		t.Errorf("Expected the model to stay listed while its backend is down, got %v", models)
+	}
+}
+
+func TestDownBackendOfSimilarIDs(t *testing.T) {
+	local := &flakyBackend{id: "local", isUp: true}
+	localGpu := &flakyBackend{id: "local_gpu"}
+	engine := &Engine{
+		toWorkerChan:      make(chan *message, 16),
+		engineDoneChan:    make(chan bool, 16),
+		computeWorkerChan: make(chan *types.Request, 2),
+		engineBackends:    []types.EngineBackend{local, localGpu},
+	}
+	go engine.worker(engine.toWorkerChan)
+	engine.ScanModels()
+
+	if backendID := engine.downBackendOf("local_gpu_llama3"); backendID != "local_gpu" {
+		t.Errorf("Expected the model to belong to local_gpu, got '%s'", backendID)
+	}
+	if backendID := engine.downBackendOf("local_llama3"); backendID != "" {
+		t.Errorf("Expected the model of a healthy backend not to be down, got '%s'", backendID)
+	}
+
+	local.setUp(false)
+	localGpu.setUp(true)
+	engine.checkBackends()
+	if backendID := engine.downBackendOf("local_gpu_llama3"); backendID != "" {
+		t.Errorf("Expected the model of local_gpu not to be taken for one of local, got '%s'", backendID)
+	}
+}
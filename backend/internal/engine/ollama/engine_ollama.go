@@ -5,16 +5,23 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sedwards2009/llm-multitool/internal/data"
 	"sedwards2009/llm-multitool/internal/data/responsestatus"
 	"sedwards2009/llm-multitool/internal/data/role"
 	"sedwards2009/llm-multitool/internal/engine/config"
 	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/tools"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/bobg/go-generics/v2/slices"
 )
@@ -33,10 +40,42 @@ type model struct {
 	Name string `json:"name"`
 }
 
+type showPayload struct {
+	Model string `json:"model"`
+}
+
+type showResponse struct {
+	Parameters   string         `json:"parameters"`
+	ModelInfo    map[string]any `json:"model_info"`
+	Capabilities []string       `json:"capabilities"`
+}
+
 type chatMessage struct {
-	Role    string   `json:"role"`
-	Content string   `json:"content"`
-	Images  []string `json:"images"`
+	Role      string     `json:"role"`
+	Content   string     `json:"content"`
+	Images    []string   `json:"images"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	ToolName  string     `json:"tool_name,omitempty"`
+}
+
+type toolCall struct {
+	Function toolCallFunction `json:"function"`
+}
+
+type toolCallFunction struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+}
+
+type toolPayload struct {
+	Type     string              `json:"type"`
+	Function toolFunctionPayload `json:"function"`
+}
+
+type toolFunctionPayload struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
 }
 
 type chatPayload struct {
@@ -44,17 +83,42 @@ type chatPayload struct {
 	Messages  []chatMessage  `json:"messages"`
 	Options   optionsPayload `json:"options"`
 	KeepAlive int            `json:"keep_alive"`
+	Tools     []toolPayload  `json:"tools,omitempty"`
+
+	// Format holds a JSON schema which the reply must match.
+	Format map[string]any `json:"format,omitempty"`
 }
 
 type chatResponse struct {
 	Message *chatMessage `json:"message,omitempty"`
 
 	Done bool `json:"done"`
+
+	// These are only set in the final response. Durations are in nanoseconds.
+	PromptEvalCount int   `json:"prompt_eval_count"`
+	EvalCount       int   `json:"eval_count"`
+	LoadDuration    int64 `json:"load_duration"`
+	EvalDuration    int64 `json:"eval_duration"`
+}
+
+type embedPayload struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embedResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
 }
 
 type optionsPayload struct {
 	Temperature float32 `json:"temperature"`
 	TopP        float32 `json:"top_p"`
+
+	// NumCtx sets the context window. Without it Ollama uses a small default
+	// window and silently drops the start of longer conversations. It is
+	// only sent for chosen lengths, because the memory needed for the full
+	// trained length of a model can be more than the machine has.
+	NumCtx int `json:"num_ctx,omitempty"`
 }
 
 func New(config *config.EngineBackendConfig) *OllamaEngineBackend {
@@ -73,79 +137,200 @@ func (this *OllamaEngineBackend) Process(work *types.Request, model *data.Model,
 	work.SetStatusFunc(responsestatus.Running)
 	defer work.CompleteFunc()
 	log.Printf("OllamaEngineBackend Process(): Temperature: %f, TopP: %f\n", preset.Temperature, preset.TopP)
-	previousMessages := work.Messages[0 : len(work.Messages)-1]
+
+	messages := work.Messages
+	totals := &roundTotals{}
+	for round := 0; ; round++ {
+		// The model must answer without tools once it has used up its rounds.
+		useTools := work.Tools != nil && round < tools.MAX_ROUNDS
+		toolCalls, processError := this.streamRound(work, model, preset, messages, useTools, totals)
+		if processError != nil {
+			log.Printf("OllamaEngineBackend Process(): ChatStream error: %v\n", processError)
+			work.SetErrorFunc(processError)
+			work.SetStatusFunc(responsestatus.Error)
+			return
+		}
+		if len(toolCalls) == 0 {
+			break
+		}
+		messages = tools.InsertBeforeLast(messages, work.Tools.RunCalls(toolCalls, work.AddMessageFunc))
+	}
+
+	if totals.usage != nil {
+		work.SetUsageFunc(totals.usage)
+	}
+	if totals.evalDuration != 0 {
+		loadDurationMs := time.Duration(totals.loadDuration).Milliseconds()
+		evalDurationMs := time.Duration(totals.evalDuration).Milliseconds()
+		work.SetTimingFunc(&data.Timing{
+			LoadDurationMs: &loadDurationMs,
+			EvalDurationMs: &evalDurationMs,
+		})
+	}
+	work.SetStatusFunc(responsestatus.Done)
+	log.Printf("OllamaEngineBackend process(): ChatStream completed")
+}
+
+// roundTotals adds up the token counts and durations of all of the rounds of
+// a request. Durations are in nanoseconds.
+type roundTotals struct {
+	usage        *data.Usage
+	loadDuration int64
+	evalDuration int64
+}
+
+// streamRound sends the messages, except for the last one which receives
+// the reply, and streams the reply. It returns the tool calls which the model
+// made, if any.
+func (this *OllamaEngineBackend) streamRound(work *types.Request, model *data.Model, preset *data.Preset,
+	messages []data.Message, useTools bool, totals *roundTotals) ([]data.Message, *types.ProcessError) {
+
 	payload := &chatPayload{
 		Model:     model.InternalModelID,
 		KeepAlive: -1,
-		Messages: slices.Map(previousMessages, func(m data.Message) chatMessage {
-			mRole := "user"
-			if m.Role == role.Assistant {
-				mRole = "assistant"
-			}
-
-			images := []string{}
-			if len(m.AttachedFiles) != 0 {
-				images = slices.Map(m.AttachedFiles, func(af *data.AttachedFile) string {
-					return readFileBase64(filepath.Join(work.AttachedFilesPath, af.Filename))
-				})
-			}
-
-			return chatMessage{
-				Role:    mRole,
-				Content: m.Text,
-				Images:  images,
-			}
-		}),
+		Messages:  makeChatMessages(messages[0:len(messages)-1], work.AttachedFilesPath),
 		Options: optionsPayload{
 			Temperature: preset.Temperature,
 			TopP:        preset.TopP,
 		},
 	}
+	if model.IsContextLengthSet {
+		payload.Options.NumCtx = model.ContextLength
+	}
+	if useTools {
+		payload.Tools = makeTools(work.Tools)
+	}
+	payload.Format = work.JsonSchema
 
 	jsonData, _ := json.Marshal(payload)
 	bodyBytes := bytes.NewBuffer(jsonData)
 	url := *this.config.Address + "/api/chat"
 	resp, err := http.Post(url, "application/json", bodyBytes)
 	if err != nil {
-		log.Printf("OllamaEngineBackend Process(): ChatStream error: %v\n", err)
-		work.SetStatusFunc(responsestatus.Error)
-		return
+		return nil, &types.ProcessError{Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("OllamaEngineBackend Process(): Error: HTTP request failed with status code: %d\n", resp.StatusCode)
-		work.SetStatusFunc(responsestatus.Error)
-		return
+		return nil, &types.ProcessError{StatusCode: resp.StatusCode, Err: readErrorBody(resp.Body)}
 	}
 
+	toolCalls := []data.Message{}
 	scanner := bufio.NewScanner(resp.Body)
 	for scanner.Scan() {
 		line := scanner.Text()
 		response := &chatResponse{}
 		err := json.Unmarshal([]byte(line), &response)
 		if err != nil {
-			log.Printf("OllamaEngineBackend Process(): ChatStream error: %v\n", err)
-			work.SetStatusFunc(responsestatus.Error)
-			return
+			return nil, &types.ProcessError{StatusCode: resp.StatusCode, Err: err}
+		}
+		if response.Message != nil {
+			for _, call := range response.Message.ToolCalls {
+				arguments, _ := json.Marshal(call.Function.Arguments)
+				toolCalls = append(toolCalls, data.Message{
+					Role:     role.ToolCall,
+					Text:     string(arguments),
+					ToolName: call.Function.Name,
+				})
+			}
 		}
 		if response.Done {
+			if response.EvalCount != 0 {
+				totals.usage = totals.usage.Add(&data.Usage{
+					PromptTokens:     response.PromptEvalCount,
+					CompletionTokens: response.EvalCount,
+				})
+			}
+			totals.loadDuration += response.LoadDuration
+			totals.evalDuration += response.EvalDuration
 			break
 		}
-		if !work.AppendFunc(*&response.Message.Content) {
-			break
+		if response.Message == nil || response.Message.Content == "" {
+			continue
+		}
+		if !work.AppendFunc(response.Message.Content) {
+			// Aborted. Any tool calls are incomplete.
+			return nil, nil
 		}
 	}
 
 	// Check for errors that may have occurred during scanning.
 	if err := scanner.Err(); err != nil {
-		log.Printf("OllamaEngineBackend Process(): ChatStream error: %v\n", err)
-		work.SetStatusFunc(responsestatus.Error)
-		return
+		return nil, &types.ProcessError{Err: err}
 	}
+	return toolCalls, nil
+}
 
-	work.SetStatusFunc(responsestatus.Done)
-	log.Printf("OllamaEngineBackend process(): ChatStream completed")
+func makeTools(registry *tools.Registry) []toolPayload {
+	return slices.Map(registry.Definitions(), func(definition *tools.Definition) toolPayload {
+		return toolPayload{
+			Type: "function",
+			Function: toolFunctionPayload{
+				Name:        definition.Name,
+				Description: definition.Description,
+				Parameters:  definition.Parameters,
+			},
+		}
+	})
+}
+
+// makeChatMessages converts messages to the API's format. Consecutive tool
+// calls are sent as one assistant message.
+func makeChatMessages(messages []data.Message, attachedFilesPath string) []chatMessage {
+	result := []chatMessage{}
+	for _, m := range messages {
+		switch m.Role {
+		case role.ToolCall:
+			arguments := map[string]any{}
+			json.Unmarshal([]byte(m.Text), &arguments)
+			call := toolCall{Function: toolCallFunction{Name: m.ToolName, Arguments: arguments}}
+			if len(result) != 0 && len(result[len(result)-1].ToolCalls) != 0 {
+				result[len(result)-1].ToolCalls = append(result[len(result)-1].ToolCalls, call)
+			} else {
+				result = append(result, chatMessage{Role: "assistant", Images: []string{}, ToolCalls: []toolCall{call}})
+			}
+		case role.ToolResult:
+			result = append(result, chatMessage{Role: "tool", Content: m.Text, Images: []string{}, ToolName: m.ToolName})
+		default:
+			mRole := "user"
+			if m.Role == role.Assistant {
+				mRole = "assistant"
+			} else if m.Role == role.System {
+				mRole = "system"
+			}
+
+			images := []string{}
+			if len(m.AttachedFiles) != 0 {
+				images = slices.Map(m.AttachedFiles, func(af *data.AttachedFile) string {
+					return readFileBase64(filepath.Join(attachedFilesPath, af.Filename))
+				})
+			}
+
+			result = append(result, chatMessage{
+				Role:    mRole,
+				Content: m.Text,
+				Images:  images,
+			})
+		}
+	}
+	return result
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// readErrorBody reads the error message which Ollama sends with a failed request.
+func readErrorBody(body io.Reader) error {
+	content, err := io.ReadAll(io.LimitReader(body, 4096))
+	if err != nil {
+		return err
+	}
+	response := &errorResponse{}
+	if json.Unmarshal(content, response) == nil && response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return errors.New(strings.TrimSpace(string(content)))
 }
 
 func readFileBase64(filePath string) string {
@@ -157,6 +342,52 @@ func readFileBase64(filePath string) string {
 	return base64.StdEncoding.EncodeToString(content)
 }
 
+const EMBED_TIMEOUT = 60 * time.Second
+
+func (this *OllamaEngineBackend) Embed(model *data.Model, texts []string) ([][]float32, *types.ProcessError) {
+	jsonData, _ := json.Marshal(&embedPayload{Model: model.InternalModelID, Input: texts})
+	client := &http.Client{Timeout: EMBED_TIMEOUT}
+	resp, err := client.Post(*this.config.Address+"/api/embed", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, &types.ProcessError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &types.ProcessError{StatusCode: resp.StatusCode, Err: readErrorBody(resp.Body)}
+	}
+
+	response := &embedResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, &types.ProcessError{Err: err}
+	}
+	if len(response.Embeddings) != len(texts) {
+		return nil, &types.ProcessError{Err: fmt.Errorf("expected %d embeddings, got %d", len(texts),
+			len(response.Embeddings))}
+	}
+	return response.Embeddings, nil
+}
+
+const CONNECTION_CHECK_TIMEOUT = 10 * time.Second
+
+func (this *OllamaEngineBackend) CheckConnection() error {
+	if this.config.Address == nil {
+		return fmt.Errorf("no address is configured")
+	}
+
+	client := &http.Client{Timeout: CONNECTION_CHECK_TIMEOUT}
+	resp, err := client.Get(*this.config.Address + "/api/tags")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP request failed with status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (this *OllamaEngineBackend) ScanModels() []*data.Model {
 	url := *this.config.Address + "/api/tags"
 	resp, err := http.Get(url)
@@ -185,15 +416,84 @@ func (this *OllamaEngineBackend) ScanModels() []*data.Model {
 
 	result := []*data.Model{}
 	for _, modelInfo := range modelList.Models {
+		show := this.showModel(modelInfo.Name)
+		contextLength, isContextLengthSet := readContextLength(show)
 		result = append(result, &data.Model{
-			ID:               this.id + "_" + modelInfo.Name,
-			Name:             this.id + " - " + modelInfo.Name,
-			EngineID:         this.id,
-			InternalModelID:  modelInfo.Name,
-			SupportsContinue: false,
-			SupportsReply:    true,
-			SupportsImages:   true,
+			ID:                 this.id + "_" + modelInfo.Name,
+			Name:               this.id + " - " + modelInfo.Name,
+			EngineID:           this.id,
+			InternalModelID:    modelInfo.Name,
+			SupportsContinue:   false,
+			SupportsReply:      true,
+			SupportsImages:     true,
+			SupportsEmbeddings: isEmbeddingModel(show),
+			ContextLength:      contextLength,
+			IsContextLengthSet: isContextLengthSet,
 		})
 	}
 	return result
 }
+
+var numCtxRegexp = regexp.MustCompile(`(?m)^num_ctx\s+(\d+)`)
+
+// showModel asks Ollama for the details of a model. Returns nil if they
+// can't be read.
+func (this *OllamaEngineBackend) showModel(modelName string) *showResponse {
+	jsonData, _ := json.Marshal(&showPayload{Model: modelName})
+	resp, err := http.Post(*this.config.Address+"/api/show", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		log.Printf("OllamaEngineBackend showModel(): Error: %v\n", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	show := &showResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(show); err != nil {
+		log.Printf("OllamaEngineBackend showModel(): Error: %v\n", err)
+		return nil
+	}
+	return show
+}
+
+// readContextLength finds a model's context length. A `num_ctx` parameter
+// set in the model file takes precedence over the length the model was
+// trained with, and is reported as set. Returns 0 if the length is unknown.
+func readContextLength(show *showResponse) (int, bool) {
+	if show == nil {
+		return 0, false
+	}
+	if match := numCtxRegexp.FindStringSubmatch(show.Parameters); match != nil {
+		numCtx, _ := strconv.Atoi(match[1])
+		return numCtx, true
+	}
+	for key, value := range show.ModelInfo {
+		if strings.HasSuffix(key, ".context_length") {
+			if length, ok := value.(float64); ok {
+				return int(length), false
+			}
+		}
+	}
+	return 0, false
+}
+
+// isEmbeddingModel uses the capabilities which newer versions of Ollama
+// report. Older versions only give away embedding models by their pooling
+// type.
+func isEmbeddingModel(show *showResponse) bool {
+	if show == nil {
+		return false
+	}
+	if show.Capabilities != nil {
+		return slices.Contains(show.Capabilities, "embedding")
+	}
+	for key := range show.ModelInfo {
+		if strings.HasSuffix(key, ".pooling_type") {
+			return true
+		}
+	}
+	return false
+}
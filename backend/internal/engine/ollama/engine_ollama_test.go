@@ -0,0 +1,152 @@
+package ollama
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/tools"
+	"testing"
+)
+
+func TestToolCalls(t *testing.T) {
+	requests := []*chatPayload{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := &chatPayload{}
+		json.NewDecoder(r.Body).Decode(payload)
+		requests = append(requests, payload)
+		if len(requests) == 1 {
+			w.Write([]byte(`{"message": {"role": "assistant", "content": "", "tool_calls": [` +
+				`{"function": {"name": "calculator", "arguments": {"expression": "6 * 7"}}}]}, "done": false}` + "\n"))
+			w.Write([]byte(`{"done": true, "prompt_eval_count": 10, "eval_count": 5}` + "\n"))
+			return
+		}
+		w.Write([]byte(`{"message": {"role": "assistant", "content": "It is 42."}, "done": false}` + "\n"))
+		w.Write([]byte(`{"done": true, "prompt_eval_count": 20, "eval_count": 4}` + "\n"))
+	}))
+	defer server.Close()
+
+	registry, _ := tools.New(&tools.ToolsConfig{})
+	text := ""
+	status := responsestatus.Pending
+	added := []data.Message{}
+	var usage *data.Usage
+	work := &types.Request{
+		Messages: []data.Message{{Role: role.User, Text: "What is 6 * 7?"}, {Role: role.Assistant}},
+		AppendFunc: func(newText string) bool {
+			text += newText
+			return true
+		},
+		CompleteFunc: func() {},
+		SetStatusFunc: func(newStatus responsestatus.ResponseStatus) {
+			status = newStatus
+		},
+		SetUsageFunc: func(newUsage *data.Usage) {
+			usage = newUsage
+		},
+		SetTimingFunc: func(timing *data.Timing) {},
+		AddMessageFunc: func(message data.Message) {
+			added = append(added, message)
+		},
+		Tools: registry,
+	}
+
+	backend := New(&config.EngineBackendConfig{Name: "Ollama", Address: &server.URL})
+	backend.Process(work, &data.Model{InternalModelID: "llama3.1"}, &data.Preset{})
+
+	if status != responsestatus.Done || text != "It is 42." {
+		t.Fatalf("Unexpected result '%s' with status %s", text, status)
+	}
+	if len(added) != 2 || added[0].Role != role.ToolCall || added[1].Role != role.ToolResult || added[1].Text != "42" {
+		t.Errorf("Expected the tool call and its result to be recorded, got %+v", added)
+	}
+	if len(requests) != 2 || len(requests[0].Tools) == 0 {
+		t.Fatalf("Expected two requests offering tools, got %d", len(requests))
+	}
+	second := requests[1].Messages
+	if len(second) != 3 || len(second[1].ToolCalls) != 1 || second[2].Role != "tool" || second[2].Content != "42" {
+		t.Errorf("Expected the tool call and result to be sent back, got %+v", second)
+	}
+	if usage == nil || usage.PromptTokens != 30 || usage.CompletionTokens != 9 {
+		t.Errorf("Expected the usage of both rounds to be added up, got %+v", usage)
+	}
+}
+
+func TestJsonSchemaFormat(t *testing.T) {
+	var payload *chatPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload = &chatPayload{}
+		json.NewDecoder(r.Body).Decode(payload)
+		w.Write([]byte(`{"message": {"role": "assistant", "content": "{}"}, "done": true}` + "\n"))
+	}))
+	defer server.Close()
+
+	work := &types.Request{
+		Messages:      []data.Message{{Role: role.User, Text: "Hi"}, {Role: role.Assistant}},
+		AppendFunc:    func(text string) bool { return true },
+		CompleteFunc:  func() {},
+		SetStatusFunc: func(status responsestatus.ResponseStatus) {},
+		SetUsageFunc:  func(usage *data.Usage) {},
+		SetTimingFunc: func(timing *data.Timing) {},
+		JsonSchema:    map[string]any{"type": "object"},
+	}
+	backend := New(&config.EngineBackendConfig{Name: "Ollama", Address: &server.URL})
+	backend.Process(work, &data.Model{InternalModelID: "llama3.1", ContextLength: 8192, IsContextLengthSet: true},
+		&data.Preset{})
+
+	if payload == nil || payload.Format["type"] != "object" {
+		t.Errorf("Expected the schema to be sent as the format, got %+v", payload)
+	}
+	if payload != nil && payload.Options.NumCtx != 8192 {
+		t.Errorf("Expected the model's context length to be sent as num_ctx, got %d", payload.Options.NumCtx)
+	}
+
+	// The trained length of the model is only used to fit the messages.
+	backend.Process(work, &data.Model{InternalModelID: "llama3.1", ContextLength: 131072}, &data.Preset{})
+	if payload == nil || payload.Options.NumCtx != 0 {
+		t.Errorf("Expected the trained context length not to be sent, got %+v", payload)
+	}
+}
+
+func TestReadContextLength(t *testing.T) {
+	show := &showResponse{Parameters: "stop \"<|eot_id|>\"\nnum_ctx 8192",
+		ModelInfo: map[string]any{"llama.context_length": 131072.0}}
+	if length, isSet := readContextLength(show); length != 8192 || !isSet {
+		t.Errorf("Expected the length from the model file, got %d %v", length, isSet)
+	}
+	show.Parameters = ""
+	if length, isSet := readContextLength(show); length != 131072 || isSet {
+		t.Errorf("Expected the trained length, got %d %v", length, isSet)
+	}
+}
+
+func TestEmbed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := &embedPayload{}
+		json.NewDecoder(r.Body).Decode(payload)
+		if r.URL.Path != "/api/embed" || payload.Model != "nomic-embed-text" || len(payload.Input) != 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"embeddings": [[0.1, 0.2], [0.3, 0.4]]}`))
+	}))
+	defer server.Close()
+
+	backend := New(&config.EngineBackendConfig{Name: "Ollama", Address: &server.URL})
+	vectors, err := backend.Embed(&data.Model{InternalModelID: "nomic-embed-text"}, []string{"one", "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) != 2 || vectors[1][0] != 0.3 {
+		t.Errorf("Unexpected vectors %v", vectors)
+	}
+
+	if _, err := backend.Embed(&data.Model{InternalModelID: "other"}, []string{"one"}); err == nil ||
+		err.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a failed request to be an error, got %v", err)
+	}
+}
@@ -1,15 +1,23 @@
 package openai
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"sedwards2009/llm-multitool/internal/data"
 	"sedwards2009/llm-multitool/internal/data/responsestatus"
 	"sedwards2009/llm-multitool/internal/data/role"
 	"sedwards2009/llm-multitool/internal/engine/config"
 	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/jsonschema"
+	"sedwards2009/llm-multitool/internal/tools"
+	"strings"
+	"time"
 
 	"github.com/bobg/go-generics/v2/slices"
 
@@ -38,6 +46,37 @@ func (this *OpenAiEngineBackend) formatApiConfig() openai.ClientConfig {
 	return apiConfig
 }
 
+func (this *OpenAiEngineBackend) isVariant(variant string) bool {
+	return this.config.Variant != nil && *this.config.Variant == variant
+}
+
+// grammarClient adds a GBNF grammar to the requests which it sends. llama.cpp
+// uses it to constrain the output to JSON matching a schema.
+type grammarClient struct {
+	grammar string
+}
+
+func (this *grammarClient) Do(request *http.Request) (*http.Response, error) {
+	if request.Body != nil && request.Method == http.MethodPost {
+		body, err := io.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		payload := map[string]any{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, err
+		}
+		payload["grammar"] = this.grammar
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		request.ContentLength = int64(len(body))
+	}
+	return http.DefaultClient.Do(request)
+}
+
 func (this *OpenAiEngineBackend) ID() string {
 	return this.id
 }
@@ -47,50 +86,242 @@ func (this *OpenAiEngineBackend) Process(work *types.Request, model *data.Model,
 	work.SetStatusFunc(responsestatus.Running)
 	defer work.CompleteFunc()
 
-	c := openai.NewClientWithConfig(this.formatApiConfig())
-	ctx := context.Background()
+	apiConfig := this.formatApiConfig()
+	if work.JsonSchema != nil && this.isVariant(config.VARIANT_LLAMACPP) {
+		apiConfig.HTTPClient = &grammarClient{grammar: jsonschema.Grammar(work.JsonSchema)}
+	}
+	c := openai.NewClientWithConfig(apiConfig)
+	messages := work.Messages
+	var usage *data.Usage
+	for round := 0; ; round++ {
+		// The model must answer without tools once it has used up its rounds.
+		useTools := work.Tools != nil && round < tools.MAX_ROUNDS
+		toolCalls, roundUsage, err := this.streamRound(c, work, model, preset, messages, useTools)
+		usage = usage.Add(roundUsage)
+		if err != nil {
+			log.Printf("OpenAiEngineBackend process(): ChatCompletionStream error: %v\n", err)
+			work.SetErrorFunc(makeProcessError(err))
+			work.SetStatusFunc(responsestatus.Error)
+			return
+		}
+		if len(toolCalls) == 0 {
+			break
+		}
+		messages = tools.InsertBeforeLast(messages, work.Tools.RunCalls(toolCalls, work.AddMessageFunc))
+	}
+
+	if usage != nil {
+		work.SetUsageFunc(usage)
+	}
+	work.SetStatusFunc(responsestatus.Done)
+	log.Printf("OpenAiEngineBackend process(): ChatCompletionStream completed")
+}
+
+// streamRound sends the messages and streams the reply. It returns the tool
+// calls which the model made, if any.
+func (this *OpenAiEngineBackend) streamRound(c *openai.Client, work *types.Request, model *data.Model,
+	preset *data.Preset, messages []data.Message, useTools bool) ([]data.Message, *data.Usage, error) {
 
 	req := openai.ChatCompletionRequest{
-		Model: model.InternalModelID,
-		Messages: slices.Map(work.Messages, func(m data.Message) openai.ChatCompletionMessage {
-			openaiRole := openai.ChatMessageRoleUser
-			if m.Role == role.Assistant {
-				openaiRole = openai.ChatMessageRoleAssistant
-			}
-			return openai.ChatCompletionMessage{
-				Role:    openaiRole,
-				Content: m.Text,
-			}
-		}),
-		Stream: true,
+		Model:         model.InternalModelID,
+		Messages:      makeChatMessages(messages),
+		Stream:        true,
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
 
 		Temperature: preset.Temperature,
 		TopP:        preset.TopP,
 	}
-	stream, err := c.CreateChatCompletionStream(ctx, req)
+	if useTools {
+		req.Tools = makeTools(work.Tools)
+	}
+	if work.JsonSchema != nil && !this.isVariant(config.VARIANT_LLAMACPP) {
+		schema, _ := json.Marshal(work.JsonSchema)
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
+			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
+			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
+				Name:   "reply",
+				Schema: json.RawMessage(schema),
+			},
+		}
+	}
+
+	stream, err := c.CreateChatCompletionStream(context.Background(), req)
 	if err != nil {
-		log.Printf("OpenAiEngineBackend process(): ChatCompletionStream error: %v\n", err)
-		return
+		return nil, nil, err
 	}
 	defer stream.Close()
 
+	var usage *data.Usage
+	toolCalls := []data.Message{}
 	for {
 		response, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
 			break
 		}
-
 		if err != nil {
-			log.Printf("OpenAiEngineBackend process(): ChatCompletionStream error: %v\n", err)
-			work.SetStatusFunc(responsestatus.Error)
-			break
+			return nil, usage, err
 		}
-		if !work.AppendFunc(response.Choices[0].Delta.Content) {
-			break
+		if response.Usage != nil {
+			usage = &data.Usage{
+				PromptTokens:     response.Usage.PromptTokens,
+				CompletionTokens: response.Usage.CompletionTokens,
+			}
+		}
+		// The chunk carrying the usage has no choices.
+		if len(response.Choices) == 0 {
+			continue
+		}
+		delta := response.Choices[0].Delta
+		for i, toolCall := range delta.ToolCalls {
+			toolCalls = addToolCallDelta(toolCalls, i, toolCall)
+		}
+		if delta.Content == "" {
+			continue
+		}
+		if !work.AppendFunc(delta.Content) {
+			// Aborted. Any tool calls are incomplete.
+			return nil, usage, nil
 		}
 	}
-	work.SetStatusFunc(responsestatus.Done)
-	log.Printf("OpenAiEngineBackend process(): ChatCompletionStream completed")
+	return toolCalls, usage, nil
+}
+
+// addToolCallDelta adds a streamed fragment of a tool call. The arguments
+// arrive in pieces which are joined in the message text.
+func addToolCallDelta(toolCalls []data.Message, position int, toolCall openai.ToolCall) []data.Message {
+	index := position
+	if toolCall.Index != nil {
+		index = *toolCall.Index
+	}
+	for len(toolCalls) <= index {
+		toolCalls = append(toolCalls, data.Message{Role: role.ToolCall})
+	}
+	if toolCall.ID != "" {
+		toolCalls[index].ToolCallID = toolCall.ID
+	}
+	if toolCall.Function.Name != "" {
+		toolCalls[index].ToolName = toolCall.Function.Name
+	}
+	toolCalls[index].Text += toolCall.Function.Arguments
+	return toolCalls
+}
+
+func makeTools(registry *tools.Registry) []openai.Tool {
+	return slices.Map(registry.Definitions(), func(definition *tools.Definition) openai.Tool {
+		return openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        definition.Name,
+				Description: definition.Description,
+				Parameters:  definition.Parameters,
+			},
+		}
+	})
+}
+
+// makeChatMessages converts messages to the API's format. Consecutive tool
+// calls are sent as one assistant message.
+func makeChatMessages(messages []data.Message) []openai.ChatCompletionMessage {
+	result := []openai.ChatCompletionMessage{}
+	for _, m := range messages {
+		switch m.Role {
+		case role.ToolCall:
+			toolCall := openai.ToolCall{
+				ID:       m.ToolCallID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: m.ToolName, Arguments: m.Text},
+			}
+			if len(result) != 0 && len(result[len(result)-1].ToolCalls) != 0 {
+				result[len(result)-1].ToolCalls = append(result[len(result)-1].ToolCalls, toolCall)
+			} else {
+				result = append(result, openai.ChatCompletionMessage{
+					Role:      openai.ChatMessageRoleAssistant,
+					ToolCalls: []openai.ToolCall{toolCall},
+				})
+			}
+		case role.ToolResult:
+			result = append(result, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    m.Text,
+				ToolCallID: m.ToolCallID,
+			})
+		default:
+			openaiRole := openai.ChatMessageRoleUser
+			if m.Role == role.Assistant {
+				openaiRole = openai.ChatMessageRoleAssistant
+			} else if m.Role == role.System {
+				openaiRole = openai.ChatMessageRoleSystem
+			}
+			result = append(result, openai.ChatCompletionMessage{
+				Role:    openaiRole,
+				Content: m.Text,
+			})
+		}
+	}
+	return result
+}
+
+// makeProcessError extracts the HTTP status code from an error returned by
+// the OpenAI client.
+func makeProcessError(err error) *types.ProcessError {
+	var apiError *openai.APIError
+	if errors.As(err, &apiError) {
+		return &types.ProcessError{StatusCode: apiError.HTTPStatusCode, Err: err}
+	}
+	var requestError *openai.RequestError
+	if errors.As(err, &requestError) {
+		return &types.ProcessError{StatusCode: requestError.HTTPStatusCode, Err: err}
+	}
+	return &types.ProcessError{Err: err}
+}
+
+const EMBED_TIMEOUT = 60 * time.Second
+
+// isEmbeddingModelName guesses from its name whether a model makes
+// embeddings, because the models endpoint doesn't say. Other models can be
+// listed in the backend's `embedding_models`.
+func isEmbeddingModelName(modelID string) bool {
+	return strings.Contains(strings.ToLower(modelID), "embed")
+}
+
+func (this *OpenAiEngineBackend) Embed(model *data.Model, texts []string) ([][]float32, *types.ProcessError) {
+	c := openai.NewClientWithConfig(this.formatApiConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), EMBED_TIMEOUT)
+	defer cancel()
+
+	response, err := c.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+		Input: texts,
+		Model: openai.EmbeddingModel(model.InternalModelID),
+	})
+	if err != nil {
+		return nil, makeProcessError(err)
+	}
+	if len(response.Data) != len(texts) {
+		return nil, &types.ProcessError{Err: fmt.Errorf("expected %d embeddings, got %d", len(texts),
+			len(response.Data))}
+	}
+
+	result := make([][]float32, len(texts))
+	for _, embedding := range response.Data {
+		if embedding.Index < 0 || embedding.Index >= len(result) {
+			return nil, &types.ProcessError{Err: fmt.Errorf("embedding index %d is out of range", embedding.Index)}
+		}
+		result[embedding.Index] = embedding.Embedding
+	}
+	return result, nil
+}
+
+const CONNECTION_CHECK_TIMEOUT = 10 * time.Second
+
+func (this *OpenAiEngineBackend) CheckConnection() error {
+	c := openai.NewClientWithConfig(this.formatApiConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), CONNECTION_CHECK_TIMEOUT)
+	defer cancel()
+
+	if _, err := c.ListModels(ctx); err != nil {
+		return fmt.Errorf("cannot list models: %w", err)
+	}
+	return nil
 }
 
 func (this *OpenAiEngineBackend) ScanModels() []*data.Model {
@@ -124,16 +355,17 @@ func (this *OpenAiEngineBackend) ScanModels() []*data.Model {
 		}
 
 		result = append(result, &data.Model{
-			ID:               this.id + "_" + modelInfo.ID,
-			Name:             this.id + " - " + modelInfo.ID,
-			EngineID:         this.id,
-			InternalModelID:  modelInfo.ID,
-			SupportsContinue: true,
-			SupportsReply:    true,
-			SupportsImages:   false,
+			ID:                 this.id + "_" + modelInfo.ID,
+			Name:               this.id + " - " + modelInfo.ID,
+			EngineID:           this.id,
+			InternalModelID:    modelInfo.ID,
+			SupportsContinue:   true,
+			SupportsReply:      true,
+			SupportsImages:     false,
+			SupportsEmbeddings: isEmbeddingModelName(modelInfo.ID),
 		})
 
-		if this.config.Variant != nil && *this.config.Variant == config.VARIANT_OOBABOOGA {
+		if this.isVariant(config.VARIANT_OOBABOOGA) {
 			// We only take the first one because Oobabooga doesn't
 			// support loading different models on the fly.
 			break
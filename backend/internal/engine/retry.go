@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/engine/types"
+)
+
+// attempt holds back the results of one try at processing a request. The
+// streamed text is passed straight on, but everything which finishes the
+// request is kept in `deferred` until it is known that the request won't be
+// tried again.
+type attempt struct {
+	model       *data.Model
+	hasStreamed bool
+	status      responsestatus.ResponseStatus
+	err         *types.ProcessError
+	deferred    []func()
+}
+
+// isFinal returns true if the attempt succeeded or can't be tried again
+// because text has already reached the caller.
+func (this *attempt) isFinal() bool {
+	return this.status != responsestatus.Error || this.hasStreamed
+}
+
+func (this *attempt) statusCode() int {
+	if this.err == nil {
+		return 0
+	}
+	return this.err.StatusCode
+}
+
+// processError returns the reason for the failure, even when the backend
+// didn't report one.
+func (this *attempt) processError() *types.ProcessError {
+	if this.err == nil {
+		return &types.ProcessError{Category: errorcategory.Backend, Err: fmt.Errorf("request failed")}
+	}
+	return this.err
+}
+
+// commit passes the results of the attempt on to the request.
+func (this *attempt) commit(work *types.Request) {
+	if work.SetActualModelFunc != nil {
+		work.SetActualModelFunc(this.model)
+	}
+	for _, f := range this.deferred {
+		f()
+	}
+}
+
+// processWithFailover runs a request and retries it according to the
+// backend's retry policy. If the model keeps failing before any text has been
+// streamed, the models in the backend's failover list are tried in turn. The
+// queue moves on while a request waits to be retried.
+func (this *Engine) processWithFailover(work *types.Request, model *data.Model, preset *data.Preset) {
+	var lastAttempt *attempt
+	for _, candidate := range this.failoverCandidates(model) {
+		backend := this.getBackendByID(candidate.EngineID)
+		if backend == nil {
+			log.Printf("engine worker: Unable to find backend with ID %s\n", candidate.EngineID)
+			continue
+		}
+		policy := &config.RetryPolicy{MaxAttempts: 1}
+		if backendConfig := this.getBackendConfig(candidate.EngineID); backendConfig != nil {
+			policy = backendConfig.RetryPolicy()
+		}
+
+		for attemptNumber := 1; ; attemptNumber++ {
+			lastAttempt = this.runAttempt(backend, work, candidate, preset)
+			if lastAttempt.isFinal() {
+				lastAttempt.commit(work)
+				return
+			}
+			if attemptNumber >= policy.MaxAttempts || !policy.IsRetryable(lastAttempt.statusCode()) {
+				break
+			}
+			backoff := policy.Backoff(attemptNumber)
+			log.Printf("engine worker: Model %s failed, retrying in %v\n", candidate.ID, backoff)
+			if !this.waitToRetry(work, backoff) {
+				log.Printf("engine worker: Request for model %s was cancelled while waiting to retry\n", candidate.ID)
+				lastAttempt.commit(work)
+				return
+			}
+		}
+		log.Printf("engine worker: Giving up on model %s\n", candidate.ID)
+	}
+
+	if lastAttempt == nil {
+		failWork(work, &types.ProcessError{
+			Category: errorcategory.Backend,
+			Err:      fmt.Errorf("unable to find a backend for model %s", model.ID),
+		})
+		return
+	}
+	lastAttempt.commit(work)
+}
+
+// failoverCandidates returns the model followed by the available models
+// from its backend's failover list.
+func (this *Engine) failoverCandidates(model *data.Model) []*data.Model {
+	candidates := []*data.Model{model}
+	backendConfig := this.getBackendConfig(model.EngineID)
+	if backendConfig == nil {
+		return candidates
+	}
+	for _, modelID := range backendConfig.Failover[model.InternalModelID] {
+		failoverModel := this.GetModel(modelID)
+		if failoverModel == nil {
+			log.Printf("engine worker: Unable to find failover model with ID %s\n", modelID)
+			continue
+		}
+		if failoverModel.ID != model.ID {
+			candidates = append(candidates, failoverModel)
+		}
+	}
+	return candidates
+}
+
+// runAttempt processes a request once on a model.
+func (this *Engine) runAttempt(backend types.EngineBackend, work *types.Request, model *data.Model,
+	preset *data.Preset) *attempt {
+
+	result := &attempt{model: model}
+	later := func(f func()) { result.deferred = append(result.deferred, f) }
+
+	attemptWork := *work
+	attemptWork.AppendFunc = func(text string) bool {
+		if text != "" {
+			result.hasStreamed = true
+		}
+		return work.AppendFunc(text)
+	}
+	if model.SupportsTools && work.Tools != nil {
+		// Tools may have side effects, so a request which has called one
+		// can't be tried again.
+		attemptWork.AddMessageFunc = func(message data.Message) {
+			result.hasStreamed = true
+			work.AddMessageFunc(message)
+		}
+	} else {
+		attemptWork.Tools = nil
+	}
+	attemptWork.SetStatusFunc = func(status responsestatus.ResponseStatus) {
+		if status == responsestatus.Running {
+			work.SetStatusFunc(status)
+			return
+		}
+		result.status = status
+		later(func() { work.SetStatusFunc(status) })
+	}
+	attemptWork.SetErrorFunc = func(err *types.ProcessError) {
+		result.err = err
+		if work.SetErrorFunc != nil {
+			later(func() { work.SetErrorFunc(err) })
+		}
+	}
+	if work.SetUsageFunc != nil {
+		attemptWork.SetUsageFunc = func(usage *data.Usage) {
+			later(func() { work.SetUsageFunc(usage) })
+		}
+	}
+	if work.SetTimingFunc != nil {
+		attemptWork.SetTimingFunc = func(timing *data.Timing) {
+			later(func() { work.SetTimingFunc(timing) })
+		}
+	}
+	if work.SetContextReductionFunc != nil {
+		attemptWork.SetContextReductionFunc = func(reduction *data.ContextReduction) {
+			later(func() { work.SetContextReductionFunc(reduction) })
+		}
+	}
+	attemptWork.CompleteFunc = func() {
+		later(work.CompleteFunc)
+	}
+
+	textWork := withAttachmentTexts(&attemptWork, model)
+	processInstrumented(backend, this.fitContextWindow(textWork, model), model, preset, this.getModelPrice(model))
+	if result.status == responsestatus.Error {
+		this.recordRequestResult(backend.ID(), result.processError())
+	} else {
+		this.recordRequestResult(backend.ID(), nil)
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"testing"
+	"time"
+)
+
+func newFailoverTestEngine(primary *fakeBackend, secondary *fakeBackend) *Engine {
+	maxAttempts := 2
+	backoff := time.Millisecond
+	engine := &Engine{
+		engineBackends: []types.EngineBackend{primary, secondary},
+		backendConfigs: []*config.EngineBackendConfig{
+			{
+				Name:                primary.id,
+				RetryMaxAttempts:    &maxAttempts,
+				RetryInitialBackoff: &backoff,
+				Failover:            map[string][]string{"model": {secondary.id + "_model"}},
+			},
+			{Name: secondary.id},
+		},
+	}
+	engine.scanModels()
+	return engine
+}
+
+func runFailoverRequest(engine *Engine) (string, []responsestatus.ResponseStatus, *data.Model) {
+	text := ""
+	statuses := []responsestatus.ResponseStatus{}
+	var actualModel *data.Model
+	work := &types.Request{
+		Messages: []data.Message{{Role: role.User, Text: "Hi"}, {Role: role.Assistant, Text: ""}},
+		AppendFunc: func(newText string) bool {
+			text += newText
+			return true
+		},
+		CompleteFunc: func() {},
+		SetStatusFunc: func(status responsestatus.ResponseStatus) {
+			statuses = append(statuses, status)
+		},
+		SetActualModelFunc: func(model *data.Model) {
+			actualModel = model
+		},
+	}
+	model := engine.GetModel("primary_model")
+	engine.processWithFailover(work, model, &data.Preset{})
+	return text, statuses, actualModel
+}
+
+func TestRetry(t *testing.T) {
+	primary := &fakeBackend{id: "primary", statusCode: 503, failures: 1}
+	secondary := &fakeBackend{id: "secondary"}
+	text, statuses, actualModel := runFailoverRequest(newFailoverTestEngine(primary, secondary))
+
+	if primary.calls != 2 || secondary.calls != 0 {
+		t.Errorf("Expected the primary backend to be retried, got %d and %d calls", primary.calls, secondary.calls)
+	}
+	if text != "Hello from primary" || actualModel.ID != "primary_model" {
+		t.Errorf("Unexpected result '%s' from model %s", text, actualModel.ID)
+	}
+	if statuses[len(statuses)-1] != responsestatus.Done {
+		t.Errorf("Expected the Error status of the first attempt to be hidden, got %v", statuses)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	primary := &fakeBackend{id: "primary", statusCode: 401, failures: 5}
+	secondary := &fakeBackend{id: "secondary"}
+	text, statuses, actualModel := runFailoverRequest(newFailoverTestEngine(primary, secondary))
+
+	if primary.calls != 1 {
+		t.Errorf("Expected a status which isn't retryable to not be retried, got %d calls", primary.calls)
+	}
+	if text != "Hello from secondary" || actualModel.ID != "secondary_model" {
+		t.Errorf("Unexpected result '%s' from model %s", text, actualModel.ID)
+	}
+	for _, status := range statuses {
+		if status == responsestatus.Error {
+			t.Errorf("Expected no Error status, got %v", statuses)
+		}
+	}
+}
+
+func TestFailoverGivesUp(t *testing.T) {
+	primary := &fakeBackend{id: "primary", statusCode: 503, failures: 5}
+	secondary := &fakeBackend{id: "secondary", statusCode: 503, failures: 5}
+	_, statuses, actualModel := runFailoverRequest(newFailoverTestEngine(primary, secondary))
+
+	if primary.calls != 2 || secondary.calls != 1 {
+		t.Errorf("Unexpected number of calls %d and %d", primary.calls, secondary.calls)
+	}
+	if statuses[len(statuses)-1] != responsestatus.Error || actualModel.ID != "secondary_model" {
+		t.Errorf("Expected the last failure to be reported, got %v from %s", statuses, actualModel.ID)
+	}
+}
+
+func TestRetryWaitLetsOthersRunAndCanBeCancelled(t *testing.T) {
+	primary := &fakeBackend{id: "primary", statusCode: 503, failures: 5}
+	secondary := &fakeBackend{id: "secondary"}
+	maxAttempts := 3
+	backoff := time.Minute
+	engine := &Engine{
+		toWorkerChan:      make(chan *message, 16),
+		engineDoneChan:    make(chan bool, 16),
+		computeWorkerChan: make(chan *types.Request, 2),
+		resumeChans:       map[*types.Request]chan bool{},
+		engineBackends:    []types.EngineBackend{primary, secondary},
+		backendConfigs: []*config.EngineBackendConfig{
+			{Name: primary.id, RetryMaxAttempts: &maxAttempts, RetryInitialBackoff: &backoff},
+			{Name: secondary.id},
+		},
+	}
+	go engine.worker(engine.toWorkerChan)
+
+	makeRequest := func(modelID string, cancel chan struct{}, status *responsestatus.ResponseStatus,
+		done chan bool) *types.Request {
+		return &types.Request{
+			Messages:      []data.Message{{Role: role.User, Text: "Hi"}, {Role: role.Assistant, Text: ""}},
+			AppendFunc:    func(text string) bool { return true },
+			CompleteFunc:  func() { close(done) },
+			SetStatusFunc: func(newStatus responsestatus.ResponseStatus) { *status = newStatus },
+			ModelSettings: &data.ModelSettings{ModelID: modelID},
+			Preset:        &data.Preset{},
+			Cancel:        cancel,
+		}
+	}
+
+	cancel := make(chan struct{})
+	retriedStatus := responsestatus.Pending
+	retriedDone := make(chan bool)
+	engine.EnqueueRequest(makeRequest("primary_model", cancel, &retriedStatus, retriedDone))
+	otherStatus := responsestatus.Pending
+	otherDone := make(chan bool)
+	engine.EnqueueRequest(makeRequest("secondary_model", nil, &otherStatus, otherDone))
+
+	select {
+	case <-otherDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected another request to run while the first waits to be retried")
+	}
+	if otherStatus != responsestatus.Done {
+		t.Errorf("Expected the other request to succeed, got %s", otherStatus)
+	}
+
+	close(cancel)
+	select {
+	case <-retriedDone:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected cancelling to end the wait")
+	}
+	if retriedStatus != responsestatus.Error || primary.calls != 1 {
+		t.Errorf("Expected the cancelled request to fail without another attempt, got %s after %d calls",
+			retriedStatus, primary.calls)
+	}
+}
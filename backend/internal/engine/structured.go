@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/jsonschema"
+	"slices"
+	"strings"
+)
+
+// REPAIR_PROMPT asks a model to fix a reply which didn't match the JSON
+// schema. The reason is filled in.
+const REPAIR_PROMPT = "Your reply doesn't match the required JSON schema: %v\n" +
+	"Reply again with only the corrected JSON and no other text."
+
+// processStructured runs a request which asks for JSON. The Done status and
+// completion are held back until the reply has been checked against the
+// schema, and repaired if needed.
+func (this *Engine) processStructured(work *types.Request, model *data.Model, preset *data.Preset) {
+	reply := strings.Builder{}
+	isDone := false
+	isAborted := false
+
+	structuredWork := *work
+	structuredWork.AppendFunc = func(text string) bool {
+		reply.WriteString(text)
+		if !work.AppendFunc(text) {
+			isAborted = true
+			return false
+		}
+		return true
+	}
+	structuredWork.SetStatusFunc = func(status responsestatus.ResponseStatus) {
+		if status == responsestatus.Done {
+			isDone = true
+			return
+		}
+		work.SetStatusFunc(status)
+	}
+	structuredWork.CompleteFunc = func() {}
+
+	this.processWithFailover(&structuredWork, model, preset)
+
+	if isDone {
+		if !isAborted {
+			work.SetStructuredOutputFunc(this.checkStructuredOutput(work, model, preset, reply.String()))
+		}
+		work.SetStatusFunc(responsestatus.Done)
+	}
+	work.CompleteFunc()
+}
+
+// checkStructuredOutput parses a reply and checks it against the request's
+// schema. A reply which doesn't match is sent back to the model once to be
+// repaired.
+func (this *Engine) checkStructuredOutput(work *types.Request, model *data.Model, preset *data.Preset,
+	reply string) *types.StructuredOutput {
+
+	value, err := jsonschema.ParseAndValidate(work.JsonSchema, reply)
+	if err == nil {
+		return &types.StructuredOutput{Text: reply, Value: value}
+	}
+	log.Printf("engine worker: Reply from model %s doesn't match the JSON schema, asking for a repair: %v\n",
+		model.ID, err)
+
+	repaired, repairErr := this.repairStructuredOutput(work, model, preset, reply, err)
+	if repairErr != nil {
+		log.Printf("engine worker: Unable to repair the reply from model %s: %v\n", model.ID, repairErr)
+		return &types.StructuredOutput{Text: reply, Err: err}
+	}
+	value, err = jsonschema.ParseAndValidate(work.JsonSchema, repaired)
+	if err != nil {
+		log.Printf("engine worker: Repaired reply from model %s still doesn't match the JSON schema: %v\n",
+			model.ID, err)
+		return &types.StructuredOutput{Text: reply, Err: err}
+	}
+	return &types.StructuredOutput{Text: repaired, Value: value, IsRepaired: true}
+}
+
+// repairStructuredOutput shows the model its reply and what is wrong with it,
+// and returns the new reply. Its usage is added to the request's.
+func (this *Engine) repairStructuredOutput(work *types.Request, model *data.Model, preset *data.Preset,
+	reply string, reason error) (string, error) {
+
+	messages := slices.Clone(work.Messages[:len(work.Messages)-1])
+	messages = append(messages,
+		data.Message{Role: role.Assistant, Text: reply},
+		data.Message{Role: role.User, Text: fmt.Sprintf(REPAIR_PROMPT, reason)},
+		data.Message{Role: role.Assistant, Text: ""})
+
+	repaired := strings.Builder{}
+	status := responsestatus.Pending
+	request := &types.Request{
+		Messages:          messages,
+		AttachedFilesPath: work.AttachedFilesPath,
+		AppendFunc: func(text string) bool {
+			repaired.WriteString(text)
+			return true
+		},
+		CompleteFunc: func() {},
+		SetStatusFunc: func(newStatus responsestatus.ResponseStatus) {
+			status = newStatus
+		},
+		ModelSettings: work.ModelSettings,
+		Preset:        work.Preset,
+		Priority:      work.Priority,
+		Cancel:        work.Cancel,
+		SetUsageFunc:  work.SetUsageFunc,
+		JsonSchema:    work.JsonSchema,
+		EnqueueTime:   work.EnqueueTime,
+	}
+	this.processWithFailover(request, model, preset)
+
+	if status != responsestatus.Done {
+		return "", fmt.Errorf("the repair request ended with status %s", status)
+	}
+	return repaired.String(), nil
+}
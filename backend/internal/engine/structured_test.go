@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"strings"
+	"testing"
+)
+
+// scriptedBackend replies with each of its replies in turn and records the
+// requests it was given.
+type scriptedBackend struct {
+	replies  []string
+	requests []*types.Request
+}
+
+func (this *scriptedBackend) ID() string {
+	return "scripted"
+}
+
+func (this *scriptedBackend) ScanModels() []*data.Model {
+	return []*data.Model{{ID: "scripted_model", Name: "model", EngineID: "scripted", InternalModelID: "model"}}
+}
+
+func (this *scriptedBackend) CheckConnection() error {
+	return nil
+}
+
+func (this *scriptedBackend) Process(work *types.Request, model *data.Model, preset *data.Preset) {
+	work.SetStatusFunc(responsestatus.Running)
+	defer work.CompleteFunc()
+	reply := this.replies[len(this.requests)]
+	this.requests = append(this.requests, work)
+	work.AppendFunc(reply)
+	work.SetStatusFunc(responsestatus.Done)
+}
+
+var ANSWER_SCHEMA = map[string]any{
+	"type":       "object",
+	"properties": map[string]any{"answer": map[string]any{"type": "integer"}},
+	"required":   []any{"answer"},
+}
+
+func runStructuredRequest(backend *scriptedBackend) (string, []responsestatus.ResponseStatus, *types.StructuredOutput) {
+	engine := &Engine{
+		engineBackends: []types.EngineBackend{backend},
+		backendConfigs: []*config.EngineBackendConfig{{Name: "scripted"}},
+	}
+	engine.scanModels()
+
+	text := ""
+	statuses := []responsestatus.ResponseStatus{}
+	var output *types.StructuredOutput
+	work := &types.Request{
+		Messages: []data.Message{{Role: role.User, Text: "What is 6 times 7?"}, {Role: role.Assistant, Text: ""}},
+		AppendFunc: func(newText string) bool {
+			text += newText
+			return true
+		},
+		CompleteFunc: func() {},
+		SetStatusFunc: func(status responsestatus.ResponseStatus) {
+			statuses = append(statuses, status)
+		},
+		JsonSchema: ANSWER_SCHEMA,
+		SetStructuredOutputFunc: func(structuredOutput *types.StructuredOutput) {
+			output = structuredOutput
+			statuses = append(statuses, responsestatus.Pending)
+		},
+	}
+	engine.processStructured(work, engine.GetModel("scripted_model"), &data.Preset{})
+	return text, statuses, output
+}
+
+func TestStructuredOutput(t *testing.T) {
+	backend := &scriptedBackend{replies: []string{`{"answer": 42}`}}
+	text, statuses, output := runStructuredRequest(backend)
+
+	if text != `{"answer": 42}` || len(backend.requests) != 1 {
+		t.Errorf("Unexpected text '%s' after %d requests", text, len(backend.requests))
+	}
+	if output == nil || output.Err != nil || output.IsRepaired {
+		t.Fatalf("Expected the reply to be valid, got %+v", output)
+	}
+	if output.Value.(map[string]any)["answer"] != 42.0 {
+		t.Errorf("Unexpected value %v", output.Value)
+	}
+	// The output is set before the Done status.
+	if statuses[len(statuses)-2] != responsestatus.Pending || statuses[len(statuses)-1] != responsestatus.Done {
+		t.Errorf("Unexpected statuses %v", statuses)
+	}
+}
+
+func TestStructuredOutputRepair(t *testing.T) {
+	backend := &scriptedBackend{replies: []string{`{"answer": "42"}`, `{"answer": 42}`}}
+	text, _, output := runStructuredRequest(backend)
+
+	if len(backend.requests) != 2 {
+		t.Fatalf("Expected a repair request, got %d requests", len(backend.requests))
+	}
+	messages := backend.requests[1].Messages
+	if messages[1].Text != `{"answer": "42"}` || !strings.Contains(messages[2].Text, "expected integer") {
+		t.Errorf("Expected the repair request to show the reply and the problem, got %+v", messages)
+	}
+	if text != `{"answer": "42"}` {
+		t.Errorf("Expected the repaired reply not to be streamed, got '%s'", text)
+	}
+	if output.Err != nil || !output.IsRepaired || output.Text != `{"answer": 42}` {
+		t.Errorf("Expected the repaired reply, got %+v", output)
+	}
+}
+
+func TestStructuredOutputRepairFails(t *testing.T) {
+	backend := &scriptedBackend{replies: []string{"42", "The answer is 42"}}
+	_, statuses, output := runStructuredRequest(backend)
+
+	if output.Err == nil || output.Value != nil || output.Text != "42" {
+		t.Errorf("Expected an error and the original reply, got %+v", output)
+	}
+	if statuses[len(statuses)-1] != responsestatus.Done {
+		t.Errorf("Expected the response to still be done, got %v", statuses)
+	}
+}
@@ -5,5 +5,12 @@ import "sedwards2009/llm-multitool/internal/data"
 type EngineBackend interface {
 	ID() string
 	ScanModels() []*data.Model
+	CheckConnection() error
 	Process(work *Request, model *data.Model, preset *data.Preset)
 }
+
+// Embedder is implemented by backends which can turn texts into embedding
+// vectors. One vector is returned for each text, in the same order.
+type Embedder interface {
+	Embed(model *data.Model, texts []string) ([][]float32, *ProcessError)
+}
@@ -0,0 +1,65 @@
+package types
+
+import (
+	"fmt"
+	"net/http"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/redact"
+)
+
+// ProcessError describes why a backend failed to process a request.
+// StatusCode is the HTTP status code returned by the backend's API, or 0 if
+// no response was received. Category may be left at zero, in which case it
+// is worked out from the status code.
+type ProcessError struct {
+	Category   errorcategory.ErrorCategory
+	StatusCode int
+	Err        error
+}
+
+func (this *ProcessError) Error() string {
+	if this.StatusCode == 0 {
+		return this.Err.Error()
+	}
+	return fmt.Sprintf("HTTP status %d: %v", this.StatusCode, this.Err)
+}
+
+func (this *ProcessError) Unwrap() error {
+	return this.Err
+}
+
+// ResponseError converts the error into the form which is stored on a
+// response, with any secrets removed from the message.
+func (this *ProcessError) ResponseError() *data.ResponseError {
+	return &data.ResponseError{
+		Category:   this.Classify(),
+		StatusCode: this.StatusCode,
+		Message:    redact.String(this.Err.Error()),
+	}
+}
+
+// Classify returns the error's category.
+func (this *ProcessError) Classify() errorcategory.ErrorCategory {
+	if this.Category != 0 {
+		return this.Category
+	}
+	return categorize(this.StatusCode)
+}
+
+func categorize(statusCode int) errorcategory.ErrorCategory {
+	switch {
+	case statusCode == 0 || statusCode == http.StatusRequestTimeout:
+		return errorcategory.Network
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return errorcategory.Auth
+	case statusCode == http.StatusTooManyRequests:
+		return errorcategory.RateLimit
+	case statusCode == http.StatusNotFound:
+		return errorcategory.ModelNotFound
+	case statusCode >= 400 && statusCode < 500:
+		return errorcategory.BadRequest
+	default:
+		return errorcategory.Backend
+	}
+}
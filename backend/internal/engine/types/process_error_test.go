@@ -0,0 +1,40 @@
+package types
+
+import (
+	"errors"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/redact"
+	"testing"
+)
+
+func TestResponseErrorCategory(t *testing.T) {
+	cases := map[int]errorcategory.ErrorCategory{
+		0:   errorcategory.Network,
+		401: errorcategory.Auth,
+		403: errorcategory.Auth,
+		404: errorcategory.ModelNotFound,
+		400: errorcategory.BadRequest,
+		429: errorcategory.RateLimit,
+		503: errorcategory.Backend,
+	}
+	for statusCode, expected := range cases {
+		err := &ProcessError{StatusCode: statusCode, Err: errors.New("failed")}
+		if category := err.ResponseError().Category; category != expected {
+			t.Errorf("Expected status %d to be %s, got %s", statusCode, expected, category)
+		}
+	}
+
+	err := &ProcessError{Category: errorcategory.ModelNotFound, Err: errors.New("failed")}
+	if err.ResponseError().Category != errorcategory.ModelNotFound {
+		t.Errorf("Expected an explicit category to be kept.")
+	}
+}
+
+func TestResponseErrorIsRedacted(t *testing.T) {
+	redact.AddSecret("sk-test-secret")
+	err := &ProcessError{StatusCode: 401, Err: errors.New("Incorrect API key provided: sk-test-secret")}
+	responseError := err.ResponseError()
+	if responseError.Message != "Incorrect API key provided: "+redact.REPLACEMENT || responseError.StatusCode != 401 {
+		t.Errorf("Unexpected error %+v", responseError)
+	}
+}
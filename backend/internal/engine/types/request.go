@@ -2,7 +2,10 @@ package types
 
 import (
 	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/priority"
 	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/tools"
+	"time"
 )
 
 type Request struct {
@@ -12,4 +15,76 @@ type Request struct {
 	CompleteFunc      func()
 	SetStatusFunc     func(status responsestatus.ResponseStatus)
 	ModelSettings     *data.ModelSettings
+
+	// Preset, if set, is used instead of looking up ModelSettings.PresetID.
+	Preset *data.Preset
+
+	// Priority decides the order in which waiting requests are run. The
+	// zero value is treated as priority.Interactive.
+	Priority priority.Priority
+
+	// SetUsageFunc receives the token usage just before CompleteFunc is
+	// called. It may be nil. Backends which get token counts from their API
+	// report them here and the engine estimates them otherwise.
+	SetUsageFunc func(usage *data.Usage)
+
+	// SetTimingFunc receives the timings just before CompleteFunc is
+	// called. It may be nil. Backends may report the timings measured by
+	// their API and the engine fills in the rest.
+	SetTimingFunc func(timing *data.Timing)
+
+	// SetContextReductionFunc is called before processing if the messages
+	// had to be shortened to fit in the model's context window. It may be nil.
+	SetContextReductionFunc func(reduction *data.ContextReduction)
+
+	// SetErrorFunc receives the reason for a failure just before the Error
+	// status is set. It may be nil.
+	SetErrorFunc func(err *ProcessError)
+
+	// SetActualModelFunc receives the model which processed the request,
+	// which differs from the requested one after a failover. It is called
+	// before CompleteFunc and may be nil.
+	SetActualModelFunc func(model *data.Model)
+
+	// Tools, if set, may be called by models which support tools. It is
+	// removed from the request for other models.
+	Tools *tools.Registry
+
+	// AddMessageFunc inserts a message before the last message, which is
+	// the one receiving the reply. It is used to record tool calls and their
+	// results, and must be set if Tools is set.
+	AddMessageFunc func(message data.Message)
+
+	// EmbedTexts, if set, makes this an embeddings request. Messages and
+	// AppendFunc are not used and the vectors, one per text, are passed to
+	// SetEmbeddingsFunc before CompleteFunc is called.
+	EmbedTexts        []string
+	SetEmbeddingsFunc func(vectors [][]float32)
+
+	// JsonSchema, if set, asks the model to reply with JSON matching the
+	// schema. The reply is checked once the model has finished, and the
+	// model is asked once to repair it if it doesn't match. The result is
+	// passed to SetStructuredOutputFunc, which must be set, before the Done
+	// status.
+	JsonSchema              map[string]any
+	SetStructuredOutputFunc func(output *StructuredOutput)
+
+	// Cancel, if set, is closed when the request is no longer wanted, such
+	// as when its response is aborted or deleted. It cuts short the wait
+	// before a failed request is tried again.
+	Cancel <-chan struct{}
+
+	// EnqueueTime is set by the engine when the request is queued.
+	EnqueueTime time.Time
+}
+
+// StructuredOutput is the result of checking a reply against the request's
+// JSON schema. Text is the reply which was checked, which differs from the
+// streamed text if the model repaired it. Value holds the parsed JSON, or
+// Err says why the reply doesn't match.
+type StructuredOutput struct {
+	Text       string
+	Value      any
+	Err        error
+	IsRepaired bool
 }
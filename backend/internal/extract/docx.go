@@ -0,0 +1,77 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// MAX_DOCUMENT_XML_SIZE guards against a small DOCX which expands into a
+// huge document.
+const MAX_DOCUMENT_XML_SIZE = 256 * 1024 * 1024
+
+// docxToText returns the text of a Word document. Paragraphs become lines
+// and table cells are separated by tabs.
+func docxToText(content []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", errors.New("the file is not a valid DOCX document")
+	}
+	var documentFile *zip.File
+	for _, file := range archive.File {
+		if file.Name == "word/document.xml" {
+			documentFile = file
+			break
+		}
+	}
+	if documentFile == nil {
+		return "", errors.New("the DOCX document has no word/document.xml")
+	}
+
+	reader, err := documentFile.Open()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	result := strings.Builder{}
+	decoder := xml.NewDecoder(io.LimitReader(reader, MAX_DOCUMENT_XML_SIZE))
+	isInText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "t":
+				isInText = true
+			case "tab":
+				result.WriteString("\t")
+			case "br", "cr":
+				result.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch element.Name.Local {
+			case "t":
+				isInText = false
+			case "p":
+				result.WriteString("\n")
+			case "tc":
+				result.WriteString("\t")
+			}
+		case xml.CharData:
+			if isInText {
+				result.Write(element)
+			}
+		}
+	}
+	return cleanWhitespace(result.String()), nil
+}
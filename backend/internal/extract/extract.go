@@ -0,0 +1,237 @@
+// Package extract gets the text out of uploaded documents so that it can be
+// given to models which can't read the files themselves.
+package extract
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// MAX_TEXT_LENGTH is the most text, in bytes, which is kept from one file.
+// About 12k tokens.
+const MAX_TEXT_LENGTH = 48 * 1024
+
+const TRUNCATION_MARKER = "\n[... the rest of the file has been cut off ...]"
+
+// MAX_FILE_SIZE is the largest file which is read.
+const MAX_FILE_SIZE = 64 * 1024 * 1024
+
+// CACHE_SUFFIX is added to the name of a file to give the name of the file
+// holding its extracted text.
+const CACHE_SUFFIX = ".extracted.txt"
+
+const (
+	MIME_TYPE_HTML = "text/html"
+	MIME_TYPE_PDF  = "application/pdf"
+	MIME_TYPE_DOCX = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+)
+
+// TEXT_MIME_TYPES are the types outside of `text/` which hold plain text.
+var TEXT_MIME_TYPES = []string{
+	"application/json", "application/xml", "application/yaml", "application/x-yaml", "application/toml",
+	"application/javascript", "application/x-javascript", "application/typescript", "application/x-sh",
+	"application/sql", "application/x-httpd-php", "application/x-python-code",
+}
+
+var ErrUnsupported = errors.New("the file type is not supported")
+
+// IsImage returns true for image MIME types, which are sent to models as
+// images rather than as text.
+func IsImage(mimeType string) bool {
+	return strings.HasPrefix(baseType(mimeType), "image/")
+}
+
+// IsSupported returns true if text can be extracted from files of the MIME
+// type. Files without a useful type are checked for text when they are read.
+func IsSupported(mimeType string) bool {
+	mimeType = baseType(mimeType)
+	switch {
+	case mimeType == MIME_TYPE_HTML || mimeType == MIME_TYPE_PDF || mimeType == MIME_TYPE_DOCX:
+		return true
+	case isText(mimeType) || isUnknown(mimeType):
+		return true
+	}
+	return false
+}
+
+// baseType removes any parameters such as `; charset=utf-8`.
+func baseType(mimeType string) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// IsText returns true if files of the MIME type hold plain text.
+func IsText(mimeType string) bool {
+	return isText(baseType(mimeType))
+}
+
+func isText(mimeType string) bool {
+	if strings.HasPrefix(mimeType, "text/") {
+		return true
+	}
+	for _, textType := range TEXT_MIME_TYPES {
+		if mimeType == textType {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnknown(mimeType string) bool {
+	return mimeType == "" || mimeType == "application/octet-stream"
+}
+
+// Extract reads a file and returns its text, cut down to MAX_TEXT_LENGTH.
+func Extract(path string, mimeType string) (string, error) {
+	content, err := readFile(path)
+	if err != nil {
+		return "", err
+	}
+	text, err := ExtractBytes(content, mimeType)
+	if err != nil {
+		return "", err
+	}
+	return Truncate(text, MAX_TEXT_LENGTH), nil
+}
+
+// ExtractCached is like Extract, but keeps the text in a file next to the
+// original so that it is only extracted once.
+func ExtractCached(path string, mimeType string) (string, error) {
+	cachePath := CachePath(path)
+	if cacheInfo, err := os.Stat(cachePath); err == nil {
+		if info, err := os.Stat(path); err == nil && !cacheInfo.ModTime().Before(info.ModTime()) {
+			if text, err := os.ReadFile(cachePath); err == nil {
+				return string(text), nil
+			}
+		}
+	}
+
+	text, err := Extract(path, mimeType)
+	if err != nil {
+		return "", err
+	}
+	// The text can always be extracted again, so a failure to cache it
+	// doesn't matter.
+	os.WriteFile(cachePath, []byte(text), 0600)
+	return text, nil
+}
+
+// CachePath returns the path of the file which caches the text of a file.
+func CachePath(path string) string {
+	return path + CACHE_SUFFIX
+}
+
+// ExtractBytes returns the text in the contents of a file.
+func ExtractBytes(content []byte, mimeType string) (text string, err error) {
+	// The files come from users, so a bug in a parser must only fail this
+	// file and not stop the program.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			text = ""
+			err = fmt.Errorf("unable to read the file: %v", recovered)
+		}
+	}()
+
+	mimeType = baseType(mimeType)
+	switch {
+	case mimeType == MIME_TYPE_HTML:
+		return htmlToText(content)
+	case mimeType == MIME_TYPE_PDF:
+		return pdfToText(content)
+	case mimeType == MIME_TYPE_DOCX:
+		return docxToText(content)
+	case isText(mimeType):
+		return decodeText(content), nil
+	case isUnknown(mimeType) && looksLikeText(content):
+		return decodeText(content), nil
+	}
+	return "", ErrUnsupported
+}
+
+func readFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(io.LimitReader(file, MAX_FILE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > MAX_FILE_SIZE {
+		return nil, fmt.Errorf("the file is larger than %d MB", MAX_FILE_SIZE/1024/1024)
+	}
+	return content, nil
+}
+
+// looksLikeText guesses whether a file of unknown type is text by checking
+// that its start is valid UTF-8 without any control characters.
+func looksLikeText(content []byte) bool {
+	sample := content
+	if len(sample) > 8192 {
+		sample = sample[:8192]
+		// Don't count a character which was cut in half.
+		for i := 0; i < utf8.UTFMax && len(sample) > 0 && !utf8.Valid(sample); i++ {
+			sample = sample[:len(sample)-1]
+		}
+	}
+	if !utf8.Valid(sample) {
+		return false
+	}
+	for _, b := range sample {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeText removes a byte order mark and replaces invalid UTF-8, such as
+// text in another encoding.
+func decodeText(content []byte) string {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	return strings.ToValidUTF8(string(content), "�")
+}
+
+// Truncate cuts text down to at most `maxLength` bytes, at a line break if
+// there is one near the end, and marks that it was cut.
+func Truncate(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+	cut := maxLength - len(TRUNCATION_MARKER)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if newline := strings.LastIndexByte(text[:cut], '\n'); newline > cut*9/10 {
+		cut = newline
+	}
+	return text[:cut] + TRUNCATION_MARKER
+}
+
+// cleanWhitespace trims the lines of text and removes runs of blank lines.
+func cleanWhitespace(text string) string {
+	lines := strings.Split(text, "\n")
+	result := []string{}
+	blankLines := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(line) == "" {
+			blankLines++
+			if blankLines > 1 {
+				continue
+			}
+			line = ""
+		} else {
+			blankLines = 0
+		}
+		result = append(result, line)
+	}
+	return strings.TrimSpace(strings.Join(result, "\n"))
+}
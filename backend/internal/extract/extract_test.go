@@ -0,0 +1,165 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlainText(t *testing.T) {
+	text, err := ExtractBytes([]byte("\xef\xbb\xbfname,age\nAnn,31\n"), "text/csv")
+	if err != nil || text != "name,age\nAnn,31\n" {
+		t.Errorf("Unexpected text %q (%v)", text, err)
+	}
+
+	// Source files often arrive without a MIME type.
+	text, err = ExtractBytes([]byte("package main\n"), "")
+	if err != nil || text != "package main\n" {
+		t.Errorf("Expected text without a type to be read, got %q (%v)", text, err)
+	}
+	if _, err := ExtractBytes([]byte("\x00\x01\x02binary"), "application/octet-stream"); err != ErrUnsupported {
+		t.Errorf("Expected binary data to be unsupported, got %v", err)
+	}
+	if _, err := ExtractBytes([]byte("PK"), "application/zip"); err != ErrUnsupported {
+		t.Errorf("Expected a zip file to be unsupported, got %v", err)
+	}
+}
+
+func TestHtml(t *testing.T) {
+	page := `<html><head><title>Skipped</title><style>p { color: red }</style></head>
+<body><h1>Title</h1><p>First   paragraph with <b>bold</b>
+text.</p><script>alert("no")</script><ul><li>One</li><li>Two &amp; three</li></ul></body></html>`
+	text, err := ExtractBytes([]byte(page), "text/html; charset=utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Title\n\nFirst paragraph with bold text.\n\n- One\n- Two & three"
+	if text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+}
+
+func TestDocx(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	archive := zip.NewWriter(buffer)
+	writer, _ := archive.Create("word/document.xml")
+	writer.Write([]byte(`<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>Hello</w:t></w:r><w:r><w:t xml:space="preserve"> world</w:t></w:r></w:p>
+<w:p><w:r><w:t>Second</w:t><w:tab/><w:t>line</w:t></w:r></w:p>
+</w:body></w:document>`))
+	archive.Close()
+
+	text, err := ExtractBytes(buffer.Bytes(), MIME_TYPE_DOCX)
+	if err != nil || text != "Hello world\nSecond\tline" {
+		t.Errorf("Unexpected text %q (%v)", text, err)
+	}
+	if _, err := ExtractBytes([]byte("not a zip"), MIME_TYPE_DOCX); err == nil {
+		t.Errorf("Expected an invalid DOCX to be an error")
+	}
+}
+
+// makePdf writes a PDF with one page. Its content stream is compressed and
+// font F2 has a ToUnicode map which maps two byte codes to letters.
+func makePdf(content string) []byte {
+	compressed := &bytes.Buffer{}
+	writer := zlib.NewWriter(compressed)
+	writer.Write([]byte(content))
+	writer.Close()
+
+	cmap := "/CIDInit /ProcSet findresource begin 12 dict begin begincmap\n" +
+		"1 begincodespacerange <0000> <FFFF> endcodespacerange\n" +
+		"1 beginbfchar <0001> <0048> endbfchar\n" +
+		"1 beginbfrange <0002> <0003> <0069> endbfrange\n" +
+		"endcmap CMapName currentdict /CMap defineresource pop end end"
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> /Contents 4 0 R >>",
+		fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		"<< /Type /Font /Subtype /Type0 /BaseFont /Custom /ToUnicode 7 0 R >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(cmap), cmap),
+	}
+	result := &bytes.Buffer{}
+	result.WriteString("%PDF-1.4\n")
+	for i, object := range objects {
+		fmt.Fprintf(result, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	result.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return result.Bytes()
+}
+
+func TestPdf(t *testing.T) {
+	content := "BT /F1 12 Tf 72 712 Td (Hello \\(PDF\\)) Tj 0 -14 Td [(Sec) -300 (ond)] TJ ET\n" +
+		"BT /F2 12 Tf 72 680 Td <000100020003> Tj ET"
+	text, err := ExtractBytes(makePdf(content), MIME_TYPE_PDF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Hello (PDF)\nSec ond\nHij"
+	if text != expected {
+		t.Errorf("Expected %q, got %q", expected, text)
+	}
+
+	if _, err := ExtractBytes(makePdf("0 0 m 10 10 l S"), MIME_TYPE_PDF); err == nil {
+		t.Errorf("Expected a PDF without text to be an error")
+	}
+	if _, err := ExtractBytes([]byte("not a pdf"), MIME_TYPE_PDF); err == nil {
+		t.Errorf("Expected a file which isn't a PDF to be an error")
+	}
+}
+
+func TestPdfBadObjectStream(t *testing.T) {
+	// The object stream header gives a negative offset.
+	content := []byte("%PDF-1.5\n1 0 obj\n<< /Type /ObjStm /N 1 /First 6 /Length 18 >>\nstream\n" +
+		"2 -10 (abcdefghij)\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	objects := readPdfObjects(content)
+	objects.readObjectStreams()
+	if objects[2] != nil {
+		t.Errorf("Expected the object with a negative offset to be skipped")
+	}
+	if _, err := ExtractBytes(content, MIME_TYPE_PDF); err == nil {
+		t.Errorf("Expected a PDF without text to be an error")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	text := strings.Repeat("line of text\n", 100)
+	truncated := Truncate(text, 200)
+	if len(truncated) > 200 || !strings.HasSuffix(truncated, TRUNCATION_MARKER) {
+		t.Errorf("Expected the text to be cut to 200 bytes with a marker, got %q", truncated)
+	}
+	if !strings.HasSuffix(strings.TrimSuffix(truncated, TRUNCATION_MARKER), "line of text") {
+		t.Errorf("Expected the text to be cut at the end of a line, got %q", truncated)
+	}
+	if Truncate("short", 200) != "short" {
+		t.Errorf("Expected short text to be kept")
+	}
+}
+
+func TestExtractCached(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.md")
+	os.WriteFile(path, []byte("# Notes"), 0600)
+
+	text, err := ExtractCached(path, "text/markdown")
+	if err != nil || text != "# Notes" {
+		t.Fatalf("Unexpected text %q (%v)", text, err)
+	}
+	cached, err := os.ReadFile(CachePath(path))
+	if err != nil || string(cached) != "# Notes" {
+		t.Fatalf("Expected the text to be cached, got %q (%v)", cached, err)
+	}
+
+	// The cached text is used from now on.
+	os.WriteFile(CachePath(path), []byte("# Cached"), 0600)
+	if text, _ := ExtractCached(path, "text/markdown"); text != "# Cached" {
+		t.Errorf("Expected the cached text, got %q", text)
+	}
+}
@@ -0,0 +1,114 @@
+package extract
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// htmlToText returns the readable text of an HTML page. Block elements
+// start new lines, list items are marked and scripts and styles are left
+// out.
+func htmlToText(content []byte) (string, error) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(content))
+	result := strings.Builder{}
+	skipDepth := 0
+	preDepth := 0
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				return cleanWhitespace(result.String()), nil
+			}
+			return "", tokenizer.Err()
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := atom.Lookup(name)
+			switch {
+			case isSkippedElement(tag):
+				if tokenType == html.StartTagToken {
+					skipDepth++
+				}
+			case tag == atom.Br:
+				result.WriteString("\n")
+			case tag == atom.Li:
+				result.WriteString("\n- ")
+			case tag == atom.Td || tag == atom.Th:
+				result.WriteString("\t")
+			case isBlockElement(tag):
+				result.WriteString("\n\n")
+			}
+			if tag == atom.Pre && tokenType == html.StartTagToken {
+				preDepth++
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := atom.Lookup(name)
+			switch {
+			case isSkippedElement(tag):
+				if skipDepth > 0 {
+					skipDepth--
+				}
+			case isBlockElement(tag):
+				result.WriteString("\n\n")
+			}
+			if tag == atom.Pre && preDepth > 0 {
+				preDepth--
+			}
+
+		case html.TextToken:
+			if skipDepth > 0 {
+				continue
+			}
+			text := string(tokenizer.Text())
+			if preDepth == 0 {
+				text = collapseSpaces(text)
+			}
+			result.WriteString(text)
+		}
+	}
+}
+
+func isSkippedElement(tag atom.Atom) bool {
+	switch tag {
+	case atom.Script, atom.Style, atom.Head, atom.Noscript, atom.Template, atom.Svg:
+		return true
+	}
+	return false
+}
+
+func isBlockElement(tag atom.Atom) bool {
+	switch tag {
+	case atom.P, atom.Div, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Ul, atom.Ol,
+		atom.Table, atom.Tr, atom.Pre, atom.Blockquote, atom.Section, atom.Article, atom.Header,
+		atom.Footer, atom.Nav, atom.Aside, atom.Main, atom.Figure, atom.Hr, atom.Dl, atom.Dt, atom.Dd:
+		return true
+	}
+	return false
+}
+
+// collapseSpaces turns runs of whitespace into single spaces, as a browser
+// does.
+func collapseSpaces(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		if text == "" {
+			return ""
+		}
+		return " "
+	}
+	result := strings.Join(fields, " ")
+	if strings.TrimLeft(text, " \t\r\n") != text {
+		result = " " + result
+	}
+	if strings.TrimRight(text, " \t\r\n") != text {
+		result += " "
+	}
+	return result
+}
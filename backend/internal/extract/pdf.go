@@ -0,0 +1,817 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// This reads enough of a PDF to find the text drawn on each page. It handles
+// compressed streams, object streams and fonts with a ToUnicode map, which
+// covers the PDFs made by most word processors. Scanned pages have no text
+// to find.
+
+// MAX_DECODED_STREAM_SIZE guards against a small stream which expands into
+// a huge one.
+const MAX_DECODED_STREAM_SIZE = 64 * 1024 * 1024
+
+var (
+	pdfObjectHeaderPattern = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	pdfStreamPattern       = regexp.MustCompile(`>>\s*stream\r?\n`)
+	pdfReferencePattern    = regexp.MustCompile(`(\d+)\s+\d+\s+R`)
+	pdfFilterPattern       = regexp.MustCompile(`/Filter\s*(\[[^\]]*\]|/[A-Za-z0-9]+)`)
+	pdfNamePattern         = regexp.MustCompile(`/([A-Za-z0-9]+)`)
+	pdfLengthPattern       = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfEncryptPattern      = regexp.MustCompile(`/Encrypt\s*(\d+\s+\d+\s+R|<<)`)
+	pdfToUnicodePattern    = regexp.MustCompile(`/ToUnicode\s+(\d+)\s+\d+\s+R`)
+	pdfFontDictPattern     = regexp.MustCompile(`/Font\s*<<([^>]*)>>`)
+	pdfFontRefPattern      = regexp.MustCompile(`/Font\s+(\d+)\s+\d+\s+R`)
+	pdfFontEntryPattern    = regexp.MustCompile(`/([^\s/<>\[\]()]+)\s+(\d+)\s+\d+\s+R`)
+	pdfResourcesPattern    = regexp.MustCompile(`/Resources\s+(\d+)\s+\d+\s+R`)
+	pdfContentsPattern     = regexp.MustCompile(`/Contents\s*(\[[^\]]*\]|\d+\s+\d+\s+R)`)
+	pdfKidsPattern         = regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`)
+	pdfPagesRefPattern     = regexp.MustCompile(`/Pages\s+(\d+)\s+\d+\s+R`)
+	pdfCatalogPattern      = regexp.MustCompile(`/Type\s*/Catalog\b`)
+	pdfPageTreePattern     = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfPagePattern         = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfObjectStreamPattern = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+)
+
+// pdfObject is an object in a PDF. `dict` is its text up to any stream,
+// which is kept as it is in the file.
+type pdfObject struct {
+	number int
+	dict   []byte
+	stream []byte
+}
+
+type pdfObjects map[int]*pdfObject
+
+func pdfToText(content []byte) (string, error) {
+	header := content
+	if len(header) > 1024 {
+		header = header[:1024]
+	}
+	if !bytes.Contains(header, []byte("%PDF-")) {
+		return "", errors.New("the file is not a PDF")
+	}
+	if pdfEncryptPattern.Match(content) {
+		return "", errors.New("encrypted PDFs are not supported")
+	}
+
+	objects := readPdfObjects(content)
+	objects.readObjectStreams()
+	fontMaps := objects.readFontMaps()
+
+	result := strings.Builder{}
+	for _, page := range objects.pages() {
+		fonts := objects.pageFonts(page, fontMaps)
+		for _, contents := range objects.pageContents(page) {
+			result.WriteString(contentToText(contents.decodedStream(), fonts))
+			result.WriteString("\n")
+		}
+		result.WriteString("\n")
+	}
+
+	text := cleanWhitespace(result.String())
+	if text == "" {
+		return "", errors.New("no text was found in the PDF, it may only hold scanned images")
+	}
+	return text, nil
+}
+
+// readPdfObjects finds the objects in a PDF by looking for their headers
+// rather than trusting the cross reference table, which is often wrong.
+// Objects which appear again later, as in an updated file, replace the
+// earlier ones.
+func readPdfObjects(content []byte) pdfObjects {
+	objects := pdfObjects{}
+	position := 0
+	for position < len(content) {
+		match := pdfObjectHeaderPattern.FindSubmatchIndex(content[position:])
+		if match == nil {
+			break
+		}
+		number, _ := strconv.Atoi(string(content[position+match[2] : position+match[3]]))
+		start := position + match[1]
+
+		end := bytes.Index(content[start:], []byte("endobj"))
+		if end == -1 {
+			end = len(content)
+		} else {
+			end += start
+		}
+		object := &pdfObject{number: number, dict: content[start:end]}
+
+		if streamMatch := pdfStreamPattern.FindIndex(content[start:end]); streamMatch != nil {
+			object.dict = content[start : start+streamMatch[0]+2]
+			dataStart := start + streamMatch[1]
+			dataEnd := findStreamEnd(content, dataStart, object.dict)
+			object.stream = content[dataStart:dataEnd]
+			end = dataEnd
+			if objectEnd := bytes.Index(content[dataEnd:], []byte("endobj")); objectEnd != -1 {
+				end = dataEnd + objectEnd
+			}
+		}
+		objects[number] = object
+		position = end
+		if position < len(content) {
+			position += len("endobj")
+		}
+	}
+	return objects
+}
+
+// findStreamEnd uses the stream's length if it is given directly and looks
+// right, and otherwise looks for `endstream`.
+func findStreamEnd(content []byte, dataStart int, dict []byte) int {
+	if match := pdfLengthPattern.FindSubmatch(dict); match != nil && len(match[2]) == 0 {
+		length, _ := strconv.Atoi(string(match[1]))
+		dataEnd := dataStart + length
+		if dataEnd <= len(content) &&
+			bytes.HasPrefix(bytes.TrimLeft(content[dataEnd:], "\r\n \t"), []byte("endstream")) {
+			return dataEnd
+		}
+	}
+	dataEnd := bytes.Index(content[dataStart:], []byte("endstream"))
+	if dataEnd == -1 {
+		return len(content)
+	}
+	return dataStart + len(bytes.TrimRight(content[dataStart:dataStart+dataEnd], "\r\n"))
+}
+
+// decodedStream returns the contents of the object's stream, or nil if it
+// has none or it uses a filter which isn't supported, as images do.
+func (this *pdfObject) decodedStream() []byte {
+	if this == nil || this.stream == nil {
+		return nil
+	}
+	filters := []string{}
+	if match := pdfFilterPattern.FindSubmatch(this.dict); match != nil {
+		for _, name := range pdfNamePattern.FindAllSubmatch(match[1], -1) {
+			filters = append(filters, string(name[1]))
+		}
+	}
+
+	data := this.stream
+	for _, filter := range filters {
+		switch filter {
+		case "FlateDecode", "Fl":
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil
+			}
+			// Keep what was decoded of a damaged stream.
+			decoded, _ := io.ReadAll(io.LimitReader(reader, MAX_DECODED_STREAM_SIZE))
+			if len(decoded) == 0 {
+				return nil
+			}
+			data = decoded
+		case "ASCIIHexDecode", "AHx":
+			data = decodeHex(data)
+		default:
+			return nil
+		}
+	}
+	return data
+}
+
+// readObjectStreams adds the objects which are packed into object streams.
+func (this pdfObjects) readObjectStreams() {
+	objectStreams := []*pdfObject{}
+	for _, object := range this {
+		if pdfObjectStreamPattern.Match(object.dict) {
+			objectStreams = append(objectStreams, object)
+		}
+	}
+
+	for _, objectStream := range objectStreams {
+		data := objectStream.decodedStream()
+		first := dictInteger(objectStream.dict, "First")
+		if data == nil || first <= 0 || first > len(data) {
+			continue
+		}
+		header := strings.Fields(string(data[:first]))
+		for i := 0; i+1 < len(header); i += 2 {
+			number, err1 := strconv.Atoi(header[i])
+			offset, err2 := strconv.Atoi(header[i+1])
+			if err1 != nil || err2 != nil || offset < 0 {
+				break
+			}
+			end := len(data)
+			if i+3 < len(header) {
+				if nextOffset, err := strconv.Atoi(header[i+3]); err == nil && nextOffset >= 0 {
+					end = first + nextOffset
+				}
+			}
+			start := first + offset
+			if start < first || start > end || end > len(data) {
+				continue
+			}
+			if _, exists := this[number]; !exists {
+				this[number] = &pdfObject{number: number, dict: data[start:end]}
+			}
+		}
+	}
+}
+
+func dictInteger(dict []byte, key string) int {
+	match := regexp.MustCompile(`/` + key + `\s+(\d+)`).FindSubmatch(dict)
+	if match == nil {
+		return 0
+	}
+	value, _ := strconv.Atoi(string(match[1]))
+	return value
+}
+
+func references(text []byte) []int {
+	result := []int{}
+	for _, match := range pdfReferencePattern.FindAllSubmatch(text, -1) {
+		number, _ := strconv.Atoi(string(match[1]))
+		result = append(result, number)
+	}
+	return result
+}
+
+// readFontMaps returns the ToUnicode maps of the fonts by object number.
+func (this pdfObjects) readFontMaps() map[int]*cmap {
+	result := map[int]*cmap{}
+	for number, object := range this {
+		match := pdfToUnicodePattern.FindSubmatch(object.dict)
+		if match == nil {
+			continue
+		}
+		cmapNumber, _ := strconv.Atoi(string(match[1]))
+		if cmapObject := this[cmapNumber]; cmapObject != nil {
+			result[number] = parseCMap(cmapObject.decodedStream())
+		}
+	}
+	return result
+}
+
+// fontEntries returns the fonts named in the font resources of a dictionary.
+func (this pdfObjects) fontEntries(dict []byte) map[string]int {
+	fontDicts := [][]byte{}
+	for _, match := range pdfFontDictPattern.FindAllSubmatch(dict, -1) {
+		fontDicts = append(fontDicts, match[1])
+	}
+	for _, match := range pdfFontRefPattern.FindAllSubmatch(dict, -1) {
+		number, _ := strconv.Atoi(string(match[1]))
+		if object := this[number]; object != nil {
+			fontDicts = append(fontDicts, object.dict)
+		}
+	}
+
+	result := map[string]int{}
+	for _, fontDict := range fontDicts {
+		for _, match := range pdfFontEntryPattern.FindAllSubmatch(fontDict, -1) {
+			number, _ := strconv.Atoi(string(match[2]))
+			result[string(match[1])] = number
+		}
+	}
+	return result
+}
+
+// pageFonts returns the ToUnicode maps of a page's fonts by resource name.
+// Pages which inherit their resources get the fonts of the whole file.
+func (this pdfObjects) pageFonts(page *pdfObject, fontMaps map[int]*cmap) map[string]*cmap {
+	dict := page.dict
+	if match := pdfResourcesPattern.FindSubmatch(page.dict); match != nil {
+		number, _ := strconv.Atoi(string(match[1]))
+		if resources := this[number]; resources != nil {
+			dict = append(append([]byte{}, dict...), resources.dict...)
+		}
+	}
+	entries := this.fontEntries(dict)
+	if len(entries) == 0 {
+		for _, object := range this.sortedObjects() {
+			for name, number := range this.fontEntries(object.dict) {
+				entries[name] = number
+			}
+		}
+	}
+
+	result := map[string]*cmap{}
+	for name, number := range entries {
+		if fontMap := fontMaps[number]; fontMap != nil {
+			result[name] = fontMap
+		}
+	}
+	return result
+}
+
+func (this pdfObjects) sortedObjects() []*pdfObject {
+	result := []*pdfObject{}
+	for _, object := range this {
+		result = append(result, object)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].number < result[j].number })
+	return result
+}
+
+// pages returns the pages in order by walking the page tree. If the tree
+// can't be found, the page objects are taken in the order they are numbered.
+func (this pdfObjects) pages() []*pdfObject {
+	result := []*pdfObject{}
+	visited := map[int]bool{}
+	var walk func(number int)
+	walk = func(number int) {
+		object := this[number]
+		if object == nil || visited[number] {
+			return
+		}
+		visited[number] = true
+		if pdfPageTreePattern.Match(object.dict) {
+			if match := pdfKidsPattern.FindSubmatch(object.dict); match != nil {
+				for _, kid := range references(match[1]) {
+					walk(kid)
+				}
+			}
+		} else if pdfPagePattern.Match(object.dict) {
+			result = append(result, object)
+		}
+	}
+
+	for _, object := range this.sortedObjects() {
+		if !pdfCatalogPattern.Match(object.dict) {
+			continue
+		}
+		if match := pdfPagesRefPattern.FindSubmatch(object.dict); match != nil {
+			number, _ := strconv.Atoi(string(match[1]))
+			walk(number)
+		}
+	}
+	if len(result) != 0 {
+		return result
+	}
+
+	for _, object := range this.sortedObjects() {
+		if pdfPagePattern.Match(object.dict) {
+			result = append(result, object)
+		}
+	}
+	return result
+}
+
+// pageContents returns the content streams of a page.
+func (this pdfObjects) pageContents(page *pdfObject) []*pdfObject {
+	match := pdfContentsPattern.FindSubmatch(page.dict)
+	if match == nil {
+		return nil
+	}
+	result := []*pdfObject{}
+	for _, number := range references(match[1]) {
+		object := this[number]
+		if object == nil {
+			continue
+		}
+		if object.stream == nil {
+			// The contents may be an array held in its own object.
+			for _, element := range references(object.dict) {
+				if elementObject := this[element]; elementObject != nil {
+					result = append(result, elementObject)
+				}
+			}
+			continue
+		}
+		result = append(result, object)
+	}
+	return result
+}
+
+// contentToText runs the text operators of a page's content stream.
+func contentToText(content []byte, fonts map[string]*cmap) string {
+	result := strings.Builder{}
+	newLine := func() {
+		if result.Len() != 0 && !strings.HasSuffix(result.String(), "\n") {
+			result.WriteString("\n")
+		}
+	}
+	space := func() {
+		text := result.String()
+		if text != "" && !strings.HasSuffix(text, " ") && !strings.HasSuffix(text, "\n") {
+			result.WriteString(" ")
+		}
+	}
+
+	var font *cmap
+	lastY := 0.0
+	operands := []any{}
+	lexer := &pdfLexer{data: content}
+	for {
+		token, ok := lexer.next()
+		if !ok {
+			break
+		}
+		operator, isOperator := token.(pdfOperator)
+		if !isOperator {
+			operands = append(operands, token)
+			continue
+		}
+
+		switch operator {
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[len(operands)-2].(pdfName); ok {
+					font = fonts[string(name)]
+				}
+			}
+		case "Tj", "'", "\"":
+			if operator != "Tj" {
+				newLine()
+			}
+			if len(operands) != 0 {
+				if text, ok := operands[len(operands)-1].(pdfString); ok {
+					result.WriteString(font.decode(text))
+				}
+			}
+		case "TJ":
+			if len(operands) != 0 {
+				elements, _ := operands[len(operands)-1].([]any)
+				for _, element := range elements {
+					switch value := element.(type) {
+					case pdfString:
+						result.WriteString(font.decode(value))
+					case float64:
+						// A large gap between glyphs is a space.
+						if value < -200 {
+							space()
+						}
+					}
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				x, _ := operands[len(operands)-2].(float64)
+				y, _ := operands[len(operands)-1].(float64)
+				if y != 0 {
+					newLine()
+				} else if x > 0 {
+					space()
+				}
+			}
+		case "Tm":
+			if len(operands) >= 6 {
+				y, _ := operands[len(operands)-1].(float64)
+				if y != lastY {
+					newLine()
+				}
+				lastY = y
+			}
+		case "T*":
+			newLine()
+		case "ET":
+			space()
+		}
+		operands = operands[:0]
+	}
+	return result.String()
+}
+
+// cmap maps the character codes of a font to Unicode.
+type cmap struct {
+	codeLength int
+	mapping    map[uint32]string
+}
+
+// parseCMap reads the mappings of a ToUnicode CMap.
+func parseCMap(content []byte) *cmap {
+	result := &cmap{mapping: map[uint32]string{}}
+	operands := []any{}
+	lexer := &pdfLexer{data: content}
+	for {
+		token, ok := lexer.next()
+		if !ok {
+			break
+		}
+		operator, isOperator := token.(pdfOperator)
+		if !isOperator {
+			operands = append(operands, token)
+			continue
+		}
+
+		switch operator {
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				source, ok1 := operands[i].(pdfString)
+				destination, ok2 := operands[i+1].(pdfString)
+				if ok1 && ok2 {
+					result.add(source, decodeUtf16(destination))
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				low, ok1 := operands[i].(pdfString)
+				high, ok2 := operands[i+1].(pdfString)
+				if !ok1 || !ok2 {
+					continue
+				}
+				result.addRange(low, high, operands[i+2])
+			}
+		}
+		operands = operands[:0]
+	}
+	return result
+}
+
+func (this *cmap) add(source []byte, text string) {
+	if this.codeLength == 0 {
+		this.codeLength = len(source)
+	}
+	this.mapping[codeOf(source)] = text
+}
+
+func (this *cmap) addRange(low []byte, high []byte, destination any) {
+	start := codeOf(low)
+	end := codeOf(high)
+	if end < start || end-start > 0xffff {
+		return
+	}
+	for code := start; code <= end; code++ {
+		source := make([]byte, len(low))
+		for i := range source {
+			source[i] = byte(code >> (8 * (len(source) - 1 - i)))
+		}
+		switch value := destination.(type) {
+		case pdfString:
+			// The last unit of the destination counts up through the range.
+			units := utf16Units(value)
+			if len(units) == 0 {
+				return
+			}
+			units[len(units)-1] += uint16(code - start)
+			this.add(source, string(utf16.Decode(units)))
+		case []any:
+			if index := int(code - start); index < len(value) {
+				if text, ok := value[index].(pdfString); ok {
+					this.add(source, decodeUtf16(text))
+				}
+			}
+		}
+	}
+}
+
+// decode converts the codes in a string to text. Without a map, the codes
+// are taken to be Latin-1, which is close to the standard PDF encoding.
+func (this *cmap) decode(text []byte) string {
+	if this == nil || this.codeLength == 0 {
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	result := strings.Builder{}
+	for i := 0; i+this.codeLength <= len(text); i += this.codeLength {
+		result.WriteString(this.mapping[codeOf(text[i:i+this.codeLength])])
+	}
+	return result.String()
+}
+
+func codeOf(source []byte) uint32 {
+	code := uint32(0)
+	for _, b := range source {
+		code = code<<8 | uint32(b)
+	}
+	return code
+}
+
+func utf16Units(text []byte) []uint16 {
+	units := []uint16{}
+	for i := 0; i+1 < len(text); i += 2 {
+		units = append(units, uint16(text[i])<<8|uint16(text[i+1]))
+	}
+	return units
+}
+
+func decodeUtf16(text []byte) string {
+	return string(utf16.Decode(utf16Units(text)))
+}
+
+type pdfOperator string
+type pdfName string
+type pdfString []byte
+
+// pdfDictionary stands in for a dictionary in a content stream, which is
+// skipped.
+type pdfDictionary struct{}
+
+// pdfLexer splits a content stream or CMap into tokens.
+type pdfLexer struct {
+	data     []byte
+	position int
+}
+
+func isPdfWhitespace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPdfDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) != -1
+}
+
+func (this *pdfLexer) skipWhitespace() {
+	for this.position < len(this.data) {
+		c := this.data[this.position]
+		if c == '%' {
+			for this.position < len(this.data) && this.data[this.position] != '\n' &&
+				this.data[this.position] != '\r' {
+				this.position++
+			}
+			continue
+		}
+		if !isPdfWhitespace(c) {
+			return
+		}
+		this.position++
+	}
+}
+
+// next returns the next token, which is a pdfOperator, pdfName, pdfString,
+// float64, array of tokens or pdfDictionary.
+func (this *pdfLexer) next() (any, bool) {
+	this.skipWhitespace()
+	if this.position >= len(this.data) {
+		return nil, false
+	}
+
+	c := this.data[this.position]
+	switch {
+	case c == '(':
+		return this.readLiteralString(), true
+	case c == '<' && this.position+1 < len(this.data) && this.data[this.position+1] == '<':
+		this.skipDictionary()
+		return pdfDictionary{}, true
+	case c == '<':
+		end := bytes.IndexByte(this.data[this.position:], '>')
+		if end == -1 {
+			end = len(this.data) - this.position
+		}
+		text := decodeHex(this.data[this.position+1 : this.position+end])
+		this.position += end + 1
+		return pdfString(text), true
+	case c == '[':
+		this.position++
+		elements := []any{}
+		for {
+			token, ok := this.next()
+			if !ok || token == pdfOperator("]") {
+				return elements, true
+			}
+			elements = append(elements, token)
+		}
+	case c == ']' || c == '>' || c == '{' || c == '}' || c == ')':
+		this.position++
+		return pdfOperator(string(c)), true
+	case c == '/':
+		this.position++
+		return pdfName(this.readRegular()), true
+	}
+
+	word := this.readRegular()
+	if number, err := strconv.ParseFloat(word, 64); err == nil {
+		return number, true
+	}
+	if word == "BI" {
+		this.skipInlineImage()
+	}
+	return pdfOperator(word), true
+}
+
+func (this *pdfLexer) readRegular() string {
+	start := this.position
+	for this.position < len(this.data) {
+		c := this.data[this.position]
+		if isPdfWhitespace(c) || isPdfDelimiter(c) {
+			break
+		}
+		this.position++
+	}
+	return string(this.data[start:this.position])
+}
+
+func (this *pdfLexer) readLiteralString() pdfString {
+	this.position++
+	result := []byte{}
+	depth := 1
+	for this.position < len(this.data) {
+		c := this.data[this.position]
+		this.position++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return result
+			}
+		case '\\':
+			if this.position >= len(this.data) {
+				return result
+			}
+			escaped := this.data[this.position]
+			this.position++
+			switch escaped {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if this.position < len(this.data) && this.data[this.position] == '\n' {
+					this.position++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					value := int(escaped - '0')
+					for i := 0; i < 2 && this.position < len(this.data); i++ {
+						digit := this.data[this.position]
+						if digit < '0' || digit > '7' {
+							break
+						}
+						value = value*8 + int(digit-'0')
+						this.position++
+					}
+					c = byte(value)
+				} else {
+					c = escaped
+				}
+			}
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func (this *pdfLexer) skipDictionary() {
+	depth := 0
+	for this.position+1 < len(this.data) {
+		switch {
+		case this.data[this.position] == '<' && this.data[this.position+1] == '<':
+			depth++
+			this.position += 2
+		case this.data[this.position] == '>' && this.data[this.position+1] == '>':
+			depth--
+			this.position += 2
+			if depth == 0 {
+				return
+			}
+		case this.data[this.position] == '(':
+			this.readLiteralString()
+		default:
+			this.position++
+		}
+	}
+	this.position = len(this.data)
+}
+
+// skipInlineImage moves past the data of an inline image, which ends with
+// `EI` on its own.
+func (this *pdfLexer) skipInlineImage() {
+	for this.position+2 < len(this.data) {
+		if isPdfWhitespace(this.data[this.position]) && this.data[this.position+1] == 'E' &&
+			this.data[this.position+2] == 'I' &&
+			(this.position+3 == len(this.data) || isPdfWhitespace(this.data[this.position+3])) {
+			this.position += 3
+			return
+		}
+		this.position++
+	}
+	this.position = len(this.data)
+}
+
+func decodeHex(text []byte) []byte {
+	digits := []byte{}
+	for _, c := range text {
+		if isHexDigit(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	result := make([]byte, len(digits)/2)
+	for i := range result {
+		value, _ := strconv.ParseUint(string(digits[i*2:i*2+2]), 16, 8)
+		result[i] = byte(value)
+	}
+	return result
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
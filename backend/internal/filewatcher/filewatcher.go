@@ -0,0 +1,79 @@
+package filewatcher
+
+import (
+	"os"
+	"time"
+)
+
+// FileWatcher polls a set of files and calls the function of a file when it
+// has been modified, created or deleted.
+type FileWatcher struct {
+	changedFuncs map[string]func()
+	modTimes     map[string]time.Time
+	pollInterval time.Duration
+	stopChan     chan bool
+}
+
+const POLL_INTERVAL = 2 * time.Second
+
+// New watches the files which are the keys of `changedFuncs`. Empty paths
+// are ignored.
+func New(changedFuncs map[string]func()) *FileWatcher {
+	return newWithInterval(changedFuncs, POLL_INTERVAL)
+}
+
+func newWithInterval(changedFuncs map[string]func(), pollInterval time.Duration) *FileWatcher {
+	watchedFuncs := map[string]func(){}
+	for filePath, changed := range changedFuncs {
+		if filePath != "" {
+			watchedFuncs[filePath] = changed
+		}
+	}
+
+	this := &FileWatcher{
+		changedFuncs: watchedFuncs,
+		modTimes:     make(map[string]time.Time),
+		pollInterval: pollInterval,
+		stopChan:     make(chan bool),
+	}
+	this.poll()
+	go this.worker()
+	return this
+}
+
+func (this *FileWatcher) worker() {
+	ticker := time.NewTicker(this.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, filePath := range this.poll() {
+				this.changedFuncs[filePath]()
+			}
+		case <-this.stopChan:
+			return
+		}
+	}
+}
+
+// poll records the current modification times and returns the files whose
+// times differ from the previous poll.
+func (this *FileWatcher) poll() []string {
+	changedPaths := []string{}
+	for filePath := range this.changedFuncs {
+		modTime := time.Time{}
+		if info, err := os.Stat(filePath); err == nil {
+			modTime = info.ModTime()
+		}
+		if previous, ok := this.modTimes[filePath]; ok && !previous.Equal(modTime) {
+			changedPaths = append(changedPaths, filePath)
+		}
+		this.modTimes[filePath] = modTime
+	}
+	return changedPaths
+}
+
+func (this *FileWatcher) Stop() {
+	this.stopChan <- true
+}
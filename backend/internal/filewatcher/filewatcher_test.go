@@ -0,0 +1,44 @@
+package filewatcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestChangeCallsOnce(t *testing.T) {
+	directory := t.TempDir()
+	filePath := filepath.Join(directory, "templates.yaml")
+	os.WriteFile(filePath, []byte("- id: one\n"), 0644)
+	otherFilePath := filepath.Join(directory, "presets.yaml")
+	os.WriteFile(otherFilePath, []byte("- id: one\n"), 0644)
+
+	var count atomic.Int32
+	var otherCount atomic.Int32
+	watcher := newWithInterval(map[string]func(){
+		filePath:      func() { count.Add(1) },
+		otherFilePath: func() { otherCount.Add(1) },
+		"":            func() { t.Errorf("Expected an empty path to be ignored") },
+	}, 10*time.Millisecond)
+	defer watcher.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if count.Load() != 0 {
+		t.Fatalf("Expected no calls before the file is changed, got %d", count.Load())
+	}
+
+	os.WriteFile(filePath, []byte("- id: two\n"), 0644)
+	// Make the change visible even where modification times are coarse.
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filePath, later, later)
+
+	time.Sleep(100 * time.Millisecond)
+	if count.Load() != 1 {
+		t.Errorf("Expected one call after the file is changed, got %d", count.Load())
+	}
+	if otherCount.Load() != 0 {
+		t.Errorf("Expected no calls for the file which didn't change, got %d", otherCount.Load())
+	}
+}
@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sedwards2009/llm-multitool/internal/data/errorcategory"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/redact"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MAX_EMBEDDING_INPUTS is the most texts which may be sent in one request,
+// the same as OpenAI's limit.
+const MAX_EMBEDDING_INPUTS = 2048
+
+type embeddingsRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`
+	EncodingFormat string          `json:"encoding_format"`
+
+	// Priority is an extension to the OpenAI API, as for chat completions.
+	Priority string `json:"priority"`
+}
+
+type embedding struct {
+	Object    string `json:"object"`
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"`
+}
+
+type embeddingsUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type embeddingsResponse struct {
+	Object string           `json:"object"`
+	Data   []*embedding     `json:"data"`
+	Model  string           `json:"model"`
+	Usage  *embeddingsUsage `json:"usage"`
+}
+
+// ParseEmbeddingInput accepts the texts to embed as either one string or a
+// list of strings.
+func ParseEmbeddingInput(raw json.RawMessage) ([]string, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []string{text}, nil
+	}
+	var texts []string
+	if err := json.Unmarshal(raw, &texts); err != nil {
+		return nil, fmt.Errorf("'input' must be a string or a list of strings")
+	}
+	if len(texts) == 0 {
+		return nil, fmt.Errorf("'input' must not be empty")
+	}
+	if len(texts) > MAX_EMBEDDING_INPUTS {
+		return nil, fmt.Errorf("'input' may hold at most %d texts", MAX_EMBEDDING_INPUTS)
+	}
+	return texts, nil
+}
+
+// EmbeddingErrorStatus picks the HTTP status for a failed embeddings request.
+func EmbeddingErrorStatus(err error) int {
+	var processError *types.ProcessError
+	if errors.As(err, &processError) {
+		switch processError.Classify() {
+		case errorcategory.ModelNotFound:
+			return http.StatusNotFound
+		case errorcategory.BadRequest:
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusBadGateway
+}
+
+// encodeBase64 packs a vector as little endian 32 bit floats, which is how
+// OpenAI's clients ask for embeddings by default.
+func encodeBase64(vector []float32) string {
+	packed := make([]byte, len(vector)*4)
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(packed[i*4:], math.Float32bits(value))
+	}
+	return base64.StdEncoding.EncodeToString(packed)
+}
+
+func (this *Gateway) handleEmbeddingsPost(c *gin.Context) {
+	request := &embeddingsRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		writeError(c, http.StatusBadRequest, "invalid_request_error", "", "Couldn't parse the JSON POST body.")
+		return
+	}
+
+	model := this.llmEngine.GetModel(request.Model)
+	if model == nil {
+		writeError(c, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			fmt.Sprintf("The model '%s' does not exist.", request.Model))
+		return
+	}
+	texts, err := ParseEmbeddingInput(request.Input)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	if request.EncodingFormat != "" && request.EncodingFormat != "float" && request.EncodingFormat != "base64" {
+		writeError(c, http.StatusBadRequest, "invalid_request_error", "",
+			fmt.Sprintf("unsupported encoding format '%s'", request.EncodingFormat))
+		return
+	}
+	requestPriority, err := ParsePriority(request.Priority)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+
+	vectors, usage, err := this.llmEngine.Embed(model.ID, texts, requestPriority)
+	if err != nil {
+		writeError(c, EmbeddingErrorStatus(err), "api_error", "", redact.String(err.Error()))
+		return
+	}
+
+	response := &embeddingsResponse{
+		Object: "list",
+		Data:   []*embedding{},
+		Model:  model.ID,
+		Usage:  &embeddingsUsage{},
+	}
+	if usage != nil {
+		response.Usage = &embeddingsUsage{PromptTokens: usage.PromptTokens, TotalTokens: usage.PromptTokens}
+	}
+	for i, vector := range vectors {
+		var value any = vector
+		if request.EncodingFormat == "base64" {
+			value = encodeBase64(vector)
+		}
+		response.Data = append(response.Data, &embedding{Object: "embedding", Index: i, Embedding: value})
+	}
+	c.JSON(http.StatusOK, response)
+}
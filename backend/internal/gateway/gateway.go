@@ -0,0 +1,454 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sedwards2009/llm-multitool/internal/auth"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/priority"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/mem_storage"
+	"sedwards2009/llm-multitool/internal/presets"
+	"sedwards2009/llm-multitool/internal/template"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Gateway serves an OpenAI compatible API which sends requests through the
+// engine's queue to whichever backend provides the requested model.
+type Gateway struct {
+	llmEngine      *engine.Engine
+	presetDatabase *presets.PresetDatabase
+
+	// sessionStorage is nil if gateway calls are not recorded as sessions.
+	sessionStorage *mem_storage.SimpleStorage
+}
+
+func New(llmEngine *engine.Engine, presetDatabase *presets.PresetDatabase,
+	sessionStorage *mem_storage.SimpleStorage) *Gateway {
+
+	return &Gateway{
+		llmEngine:      llmEngine,
+		presetDatabase: presetDatabase,
+		sessionStorage: sessionStorage,
+	}
+}
+
+func (this *Gateway) Register(r gin.IRoutes) {
+	r.GET("/v1/models", this.handleModelsGet)
+	r.POST("/v1/chat/completions", this.handleChatCompletionsPost)
+	r.POST("/v1/embeddings", this.handleEmbeddingsPost)
+}
+
+type modelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type modelList struct {
+	Object string       `json:"object"`
+	Data   []*modelInfo `json:"data"`
+}
+
+type chatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model       string         `json:"model"`
+	Messages    []*chatMessage `json:"messages"`
+	Stream      bool           `json:"stream"`
+	Temperature *float32       `json:"temperature"`
+	TopP        *float32       `json:"top_p"`
+
+	// Priority is an extension to the OpenAI API. It is one of
+	// "interactive", "batch" or "background" and defaults to "batch".
+	Priority string `json:"priority"`
+}
+
+type responseMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type choice struct {
+	Index        int              `json:"index"`
+	Message      *responseMessage `json:"message,omitempty"`
+	Delta        *responseMessage `json:"delta,omitempty"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+type usageInfo struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type chatCompletionResponse struct {
+	ID      string     `json:"id"`
+	Object  string     `json:"object"`
+	Created int64      `json:"created"`
+	Model   string     `json:"model"`
+	Choices []*choice  `json:"choices"`
+	Usage   *usageInfo `json:"usage,omitempty"`
+}
+
+type errorDetail struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+func writeError(c *gin.Context, status int, errorType string, code string, message string) {
+	c.JSON(status, &errorResponse{Error: errorDetail{Message: message, Type: errorType, Code: code}})
+}
+
+func (this *Gateway) handleModelsGet(c *gin.Context) {
+	result := &modelList{Object: "list", Data: []*modelInfo{}}
+	for _, model := range this.llmEngine.ModelOverview().Models {
+		result.Data = append(result.Data, &modelInfo{
+			ID:      model.ID,
+			Object:  "model",
+			OwnedBy: model.EngineID,
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// parseContent accepts message content as either a plain string or a list
+// of content parts, of which only the text parts are used.
+func parseContent(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", fmt.Errorf("content must be a string or a list of content parts")
+	}
+	texts := []string{}
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func parseRole(roleName string) (role.Role, error) {
+	switch roleName {
+	case "user":
+		return role.User, nil
+	case "assistant":
+		return role.Assistant, nil
+	case "system", "developer":
+		return role.System, nil
+	}
+	return 0, fmt.Errorf("unsupported message role '%s'", roleName)
+}
+
+// ParsePriority reads the priority extension of the API. Requests default to
+// the batch priority.
+func ParsePriority(priorityName string) (priority.Priority, error) {
+	switch priorityName {
+	case "interactive":
+		return priority.Interactive, nil
+	case "batch", "":
+		return priority.Batch, nil
+	case "background":
+		return priority.Background, nil
+	}
+	return 0, fmt.Errorf("unsupported priority '%s'", priorityName)
+}
+
+func (this *Gateway) makePreset(request *chatCompletionRequest) *data.Preset {
+	preset := &data.Preset{ID: "api", Name: "API", Temperature: 0.7, TopP: 0.7}
+	if defaultPreset := this.presetDatabase.Get(this.presetDatabase.DefaultID()); defaultPreset != nil {
+		presetCopy := *defaultPreset
+		preset = &presetCopy
+	}
+	if request.Temperature != nil {
+		preset.Temperature = *request.Temperature
+	}
+	if request.TopP != nil {
+		preset.TopP = *request.TopP
+	}
+	return preset
+}
+
+// streamEvent is sent from the engine's callbacks to the HTTP handler.
+type streamEvent struct {
+	text     string
+	isDone   bool
+	isFailed bool
+	usage    *data.Usage
+	err      *data.ResponseError
+}
+
+func (this *Gateway) handleChatCompletionsPost(c *gin.Context) {
+	request := &chatCompletionRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		writeError(c, http.StatusBadRequest, "invalid_request_error", "", "Couldn't parse the JSON POST body.")
+		return
+	}
+
+	model := this.llmEngine.GetModel(request.Model)
+	if model == nil {
+		writeError(c, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			fmt.Sprintf("The model '%s' does not exist.", request.Model))
+		return
+	}
+	if len(request.Messages) == 0 {
+		writeError(c, http.StatusBadRequest, "invalid_request_error", "", "'messages' must not be empty.")
+		return
+	}
+
+	messages := []data.Message{}
+	for _, m := range request.Messages {
+		messageRole, err := parseRole(m.Role)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+		text, err := parseContent(m.Content)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+			return
+		}
+		messages = append(messages, data.Message{ID: uuid.NewString(), Role: messageRole, Text: text})
+	}
+	messages = append(messages, data.Message{ID: uuid.NewString(), Role: role.Assistant, Text: ""})
+
+	requestPriority, err := ParsePriority(request.Priority)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+
+	preset := this.makePreset(request)
+	events := make(chan streamEvent, 64)
+	requestContext := c.Request.Context()
+	var finalStatus responsestatus.ResponseStatus
+	var finalUsage *data.Usage
+	var finalError *data.ResponseError
+
+	this.llmEngine.EnqueueRequest(&types.Request{
+		Messages: messages,
+		AppendFunc: func(text string) bool {
+			select {
+			case events <- streamEvent{text: text}:
+				return true
+			case <-requestContext.Done():
+				return false
+			}
+		},
+		CompleteFunc: func() {
+			select {
+			case events <- streamEvent{isDone: true, isFailed: finalStatus != responsestatus.Done, usage: finalUsage,
+				err: finalError}:
+			case <-requestContext.Done():
+			}
+		},
+		SetStatusFunc: func(status responsestatus.ResponseStatus) {
+			finalStatus = status
+		},
+		SetUsageFunc: func(usage *data.Usage) {
+			finalUsage = usage
+		},
+		SetErrorFunc: func(err *types.ProcessError) {
+			finalError = err.ResponseError()
+		},
+		ModelSettings: &data.ModelSettings{ModelID: model.ID, PresetID: preset.ID},
+		Preset:        preset,
+		Priority:      requestPriority,
+		Cancel:        requestContext.Done(),
+	})
+
+	completionID := "chatcmpl-" + uuid.NewString()
+	created := time.Now().Unix()
+	var output string
+	var usage *data.Usage
+	var isFailed bool
+	if request.Stream {
+		output, usage, isFailed = this.streamCompletion(c, events, completionID, created, model.ID)
+	} else {
+		output, usage, isFailed = this.collectCompletion(c, events, completionID, created, model.ID)
+	}
+
+	if this.sessionStorage != nil {
+		// The engine may still hold `messages` if the client went away.
+		messages = append([]data.Message{}, messages...)
+		messages[len(messages)-1].Text = output
+		status := responsestatus.Done
+		if isFailed {
+			status = responsestatus.Error
+		}
+		this.recordSession(auth.User(c), model, preset, messages, status, usage)
+	}
+}
+
+func (this *Gateway) collectCompletion(c *gin.Context, events chan streamEvent, completionID string,
+	created int64, modelID string) (string, *data.Usage, bool) {
+
+	builder := strings.Builder{}
+	for {
+		select {
+		case event := <-events:
+			if !event.isDone {
+				builder.WriteString(event.text)
+				continue
+			}
+
+			if event.isFailed {
+				writeError(c, http.StatusBadGateway, "api_error", "", failureMessage(event))
+				return builder.String(), event.usage, true
+			}
+			finishReason := "stop"
+			c.JSON(http.StatusOK, &chatCompletionResponse{
+				ID:      completionID,
+				Object:  "chat.completion",
+				Created: created,
+				Model:   modelID,
+				Choices: []*choice{{
+					Index:        0,
+					Message:      &responseMessage{Role: "assistant", Content: builder.String()},
+					FinishReason: &finishReason,
+				}},
+				Usage: makeUsageInfo(event.usage),
+			})
+			return builder.String(), event.usage, false
+
+		case <-c.Request.Context().Done():
+			return builder.String(), nil, true
+		}
+	}
+}
+
+func (this *Gateway) streamCompletion(c *gin.Context, events chan streamEvent, completionID string,
+	created int64, modelID string) (string, *data.Usage, bool) {
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	writeChunk := func(delta *responseMessage, finishReason *string) {
+		chunk := &chatCompletionResponse{
+			ID:      completionID,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   modelID,
+			Choices: []*choice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+		}
+		jsonData, _ := json.Marshal(chunk)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", jsonData)
+		c.Writer.Flush()
+	}
+
+	writeChunk(&responseMessage{Role: "assistant"}, nil)
+
+	builder := strings.Builder{}
+	for {
+		select {
+		case event := <-events:
+			if !event.isDone {
+				builder.WriteString(event.text)
+				writeChunk(&responseMessage{Content: event.text}, nil)
+				continue
+			}
+
+			if event.isFailed {
+				// There is no finish reason for errors, so OpenAI's clients
+				// expect an error object in place of the last chunk.
+				jsonData, _ := json.Marshal(&errorResponse{Error: errorDetail{Message: failureMessage(event),
+					Type: "api_error"}})
+				fmt.Fprintf(c.Writer, "data: %s\n\n", jsonData)
+			} else {
+				finishReason := "stop"
+				writeChunk(&responseMessage{}, &finishReason)
+			}
+			fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+			c.Writer.Flush()
+			return builder.String(), event.usage, event.isFailed
+
+		case <-c.Request.Context().Done():
+			return builder.String(), nil, true
+		}
+	}
+}
+
+// failureMessage describes why the backend failed to make a completion.
+func failureMessage(event streamEvent) string {
+	if event.err != nil {
+		return event.err.Message
+	}
+	return "The backend failed to generate a response."
+}
+
+func makeUsageInfo(usage *data.Usage) *usageInfo {
+	if usage == nil {
+		return nil
+	}
+	return &usageInfo{
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		TotalTokens:      usage.PromptTokens + usage.CompletionTokens,
+	}
+}
+
+// recordSession stores a gateway call as a session so that it can be
+// reviewed later in the web UI.
+func (this *Gateway) recordSession(owner string, model *data.Model, preset *data.Preset, messages []data.Message,
+	status responsestatus.ResponseStatus, usage *data.Usage) {
+
+	session := this.sessionStorage.NewSession()
+	session.Owner = owner
+
+	firstUserText := ""
+	for _, m := range messages {
+		if m.Role == role.User {
+			firstUserText = m.Text
+			break
+		}
+	}
+	session.Prompt = firstUserText
+	session.Title = template.TruncateTitle("API - " + strings.Split(firstUserText, "\n")[0])
+
+	session.ModelSettings = &data.ModelSettings{ModelID: model.ID, PresetID: preset.ID}
+	session.Responses = append(session.Responses, &data.Response{
+		ID:                uuid.NewString(),
+		CreationTimestamp: time.Now().UTC().Format(time.RFC3339),
+		Status:            status,
+		Messages:          messages,
+		ModelSettingsSnapshot: &data.ModelSettingsSnapshot{
+			ModelSettings: *session.ModelSettings,
+			ModelName:     model.Name,
+			PresetName:    preset.Name,
+		},
+		Usage: usage,
+	})
+	this.sessionStorage.WriteSession(session)
+	log.Printf("Gateway: Recorded API call as session %s", session.ID)
+}
@@ -0,0 +1,225 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/engine"
+	"sedwards2009/llm-multitool/internal/mem_storage"
+	"sedwards2009/llm-multitool/internal/presets"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testPresetsYaml = `
+- id: chat
+  name: Chat
+  temperature: 0.5
+  top_p: 0.5
+  default: true
+`
+
+// newStandInOllama returns a server which answers like Ollama with a fixed
+// reply, or with an error to the prompt "Fail".
+func newStandInOllama() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models": [{"name": "llama3"}]}`))
+		case "/api/chat":
+			body, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(body), `"Fail"`) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "the model failed"}`))
+				return
+			}
+			w.Write([]byte(`{"message": {"role": "assistant", "content": "Hello"}, "done": false}` + "\n"))
+			w.Write([]byte(`{"message": {"role": "assistant", "content": " world"}, "done": false}` + "\n"))
+			w.Write([]byte(`{"done": true, "prompt_eval_count": 12, "eval_count": 2}` + "\n"))
+		case "/api/embed":
+			// Each text's vector holds its length.
+			payload := struct {
+				Input []string `json:"input"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&payload)
+			embeddings := [][]float32{}
+			for _, text := range payload.Input {
+				embeddings = append(embeddings, []float32{float32(len(text)), 1})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"embeddings": embeddings})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func makeTestRouter(t *testing.T, serverURL string, storage *mem_storage.SimpleStorage) *gin.Engine {
+	configPath := filepath.Join(t.TempDir(), "backend.yaml")
+	os.WriteFile(configPath, []byte("- name: Ollama\n  address: \""+serverURL+"\"\n  variant: ollama\n"), 0644)
+
+	presetDatabase, _ := presets.MakePresentDatabaseFromBytes([]byte(testPresetsYaml), "(test)")
+	llmEngine := engine.NewEngine(configPath, presetDatabase)
+	llmEngine.ScanModels()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	New(llmEngine, presetDatabase, storage).Register(r)
+	return r
+}
+
+func TestModelsAndCompletion(t *testing.T) {
+	server := newStandInOllama()
+	defer server.Close()
+	storage := mem_storage.New(t.TempDir())
+	r := makeTestRouter(t, server.URL, storage)
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if !strings.Contains(recorder.Body.String(), `"id":"Ollama_llama3"`) {
+		t.Errorf("Model list is missing the model: %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	body := `{"model": "Ollama_llama3", "messages": [{"role": "system", "content": "Be brief."},
+		{"role": "user", "content": "Hi"}]}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+	var response chatCompletionResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Couldn't parse response '%s': %v", recorder.Body.String(), err)
+	}
+	if response.Choices[0].Message.Content != "Hello world" {
+		t.Errorf("Expected 'Hello world', got '%s'", response.Choices[0].Message.Content)
+	}
+	if response.Usage == nil || response.Usage.PromptTokens != 12 || response.Usage.TotalTokens != 14 {
+		t.Errorf("Expected the usage reported by the backend, got %+v", response.Usage)
+	}
+
+	summaries := storage.SessionOverview().SessionSummaries
+	if len(summaries) != 1 || summaries[0].Title != "API - Hi" {
+		t.Errorf("Expected the call to be recorded as a session.")
+	}
+}
+
+func TestStreamingCompletion(t *testing.T) {
+	server := newStandInOllama()
+	defer server.Close()
+	r := makeTestRouter(t, server.URL, nil)
+
+	recorder := httptest.NewRecorder()
+	body := `{"model": "Ollama_llama3", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+	content := ""
+	isDoneSeen := false
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "data: ")
+		if line == "" {
+			continue
+		}
+		if line == "[DONE]" {
+			isDoneSeen = true
+			continue
+		}
+		var chunk chatCompletionResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			t.Fatalf("Couldn't parse chunk '%s': %v", line, err)
+		}
+		content += chunk.Choices[0].Delta.Content
+	}
+
+	if content != "Hello world" || !isDoneSeen {
+		t.Errorf("Expected 'Hello world' followed by [DONE], got '%s' (done: %v)", content, isDoneSeen)
+	}
+}
+
+func TestStreamingCompletionError(t *testing.T) {
+	server := newStandInOllama()
+	defer server.Close()
+	r := makeTestRouter(t, server.URL, nil)
+
+	recorder := httptest.NewRecorder()
+	body := `{"model": "Ollama_llama3", "stream": true, "messages": [{"role": "user", "content": "Fail"}]}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+	lines := []string{}
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if line != "" {
+			lines = append(lines, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if len(lines) < 2 || lines[len(lines)-1] != "[DONE]" {
+		t.Fatalf("Expected the stream to end with [DONE], got %q", lines)
+	}
+	var errorEvent errorResponse
+	json.Unmarshal([]byte(lines[len(lines)-2]), &errorEvent)
+	if !strings.Contains(errorEvent.Error.Message, "the model failed") || errorEvent.Error.Type != "api_error" {
+		t.Errorf("Expected an error object before [DONE], got %q", lines[len(lines)-2])
+	}
+	if strings.Contains(recorder.Body.String(), `"finish_reason":"error"`) {
+		t.Errorf("Expected no 'error' finish reason, got %s", recorder.Body.String())
+	}
+}
+
+func TestUnknownModel(t *testing.T) {
+	server := newStandInOllama()
+	defer server.Close()
+	r := makeTestRouter(t, server.URL, nil)
+
+	recorder := httptest.NewRecorder()
+	body := `{"model": "nope", "messages": [{"role": "user", "content": "Hi"}]}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", recorder.Code)
+	}
+}
+
+func TestEmbeddings(t *testing.T) {
+	server := newStandInOllama()
+	defer server.Close()
+	r := makeTestRouter(t, server.URL, nil)
+
+	// More texts than fit in one batch to the backend.
+	texts := []string{}
+	for i := 0; i < 70; i++ {
+		texts = append(texts, strings.Repeat("x", i))
+	}
+	input, _ := json.Marshal(texts)
+	recorder := httptest.NewRecorder()
+	body := `{"model": "Ollama_llama3", "input": ` + string(input) + `}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(body)))
+
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Couldn't parse response '%s': %v", recorder.Body.String(), err)
+	}
+	if len(response.Data) != 70 || response.Data[69].Index != 69 || response.Data[69].Embedding[0] != 69 {
+		t.Errorf("Unexpected embeddings %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	body = `{"model": "Ollama_llama3", "input": "abc", "encoding_format": "base64"}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(body)))
+	if !strings.Contains(recorder.Body.String(), `"embedding":"AABAQAAAgD8="`) {
+		t.Errorf("Expected a base64 embedding, got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	body = `{"model": "Ollama_llama3", "input": []}`
+	r.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(body)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected empty input to be refused, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,163 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// BASE_RULES are the GBNF rules for JSON values which don't depend on the
+// schema.
+const BASE_RULES = `space ::= | " " | "\n" [ \t]{0,20}
+string ::= "\"" char* "\"" space
+char ::= [^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F]{4})
+number ::= "-"? ("0" | [1-9] [0-9]*) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space
+integer ::= "-"? ("0" | [1-9] [0-9]*) space
+boolean ::= ("true" | "false") space
+null ::= "null" space
+value ::= object | array | string | number | boolean | null
+object ::= "{" space (string ":" space value ("," space string ":" space value)*)? "}" space
+array ::= "[" space (value ("," space value)*)? "]" space
+`
+
+// Grammar converts a schema into a GBNF grammar, the format used by
+// llama.cpp to constrain what a model generates. The grammar covers the
+// structure of the schema. Limits such as `minimum` and `maxLength` are left
+// to Validate.
+func Grammar(schema map[string]any) string {
+	builder := &grammarBuilder{}
+	root := builder.rule(schema)
+	result := strings.Builder{}
+	result.WriteString("root ::= " + root + "\n")
+	for _, rule := range builder.rules {
+		result.WriteString(rule + "\n")
+	}
+	result.WriteString(BASE_RULES)
+	return result.String()
+}
+
+type grammarBuilder struct {
+	rules []string
+}
+
+// addRule adds a named rule and returns its name.
+func (this *grammarBuilder) addRule(body string) string {
+	name := fmt.Sprintf("rule%d", len(this.rules)+1)
+	this.rules = append(this.rules, name+" ::= "+body)
+	return name
+}
+
+// rule returns the expression which matches values of a schema.
+func (this *grammarBuilder) rule(schema map[string]any) string {
+	if constant, ok := schema["const"]; ok {
+		return jsonLiteral(constant)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		options := []string{}
+		for _, option := range enum {
+			options = append(options, jsonLiteral(option))
+		}
+		return this.addRule(strings.Join(options, " | "))
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		if subschemas, ok := schema[keyword].([]any); ok {
+			options := []string{}
+			for _, subschema := range subschemas {
+				options = append(options, this.rule(asSchema(subschema)))
+			}
+			return this.addRule(strings.Join(options, " | "))
+		}
+	}
+
+	types, err := schemaTypes(schema)
+	if err != nil {
+		return "value"
+	}
+	options := []string{}
+	for _, schemaType := range types {
+		switch schemaType {
+		case "object":
+			options = append(options, this.objectRule(schema))
+		case "array":
+			options = append(options, this.arrayRule(schema))
+		default:
+			options = append(options, schemaType)
+		}
+	}
+	if len(options) == 1 {
+		return options[0]
+	}
+	return this.addRule(strings.Join(options, " | "))
+}
+
+// objectRule returns the rule for an object with known properties. The
+// required properties come first and the optional ones follow, each at most
+// once. Properties are sorted by name as a schema's order isn't kept.
+func (this *grammarBuilder) objectRule(schema map[string]any) string {
+	properties, _ := schema["properties"].(map[string]any)
+	if len(properties) == 0 {
+		return "object"
+	}
+	required, _ := stringList(schema["required"])
+
+	names := []string{}
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	requiredParts := []string{}
+	optionalParts := []string{}
+	for _, name := range names {
+		part := jsonLiteral(name) + " \":\" space " + this.rule(asSchema(properties[name]))
+		if slices.Contains(required, name) {
+			requiredParts = append(requiredParts, part)
+		} else {
+			optionalParts = append(optionalParts, part)
+		}
+	}
+
+	// Each optional rule matches its property, optionally followed by any
+	// of the later ones, or else just the later ones.
+	optionalRule := ""
+	for i := len(optionalParts) - 1; i >= 0; i-- {
+		if optionalRule == "" {
+			optionalRule = this.addRule(optionalParts[i])
+		} else {
+			optionalRule = this.addRule(fmt.Sprintf("%s (\",\" space %s)? | %s", optionalParts[i], optionalRule,
+				optionalRule))
+		}
+	}
+
+	body := strings.Join(requiredParts, " \",\" space ")
+	switch {
+	case optionalRule == "":
+	case body == "":
+		body = optionalRule + "?"
+	default:
+		body += " (\",\" space " + optionalRule + ")?"
+	}
+	return this.addRule("\"{\" space " + body + " \"}\" space")
+}
+
+func (this *grammarBuilder) arrayRule(schema map[string]any) string {
+	items, ok := schema["items"].(map[string]any)
+	if !ok {
+		return "array"
+	}
+	item := this.rule(items)
+	return this.addRule(fmt.Sprintf("\"[\" space (%s (\",\" space %s)*)? \"]\" space", item, item))
+}
+
+// jsonLiteral returns a GBNF string literal which matches a value written
+// as JSON.
+func jsonLiteral(value any) string {
+	text, err := json.Marshal(value)
+	if err != nil {
+		return "null"
+	}
+	literal, _ := json.Marshal(string(text))
+	return string(literal) + " space"
+}
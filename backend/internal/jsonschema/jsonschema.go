@@ -0,0 +1,413 @@
+// Package jsonschema checks values against the commonly used subset of JSON
+// Schema which models are asked to follow, and turns schemas into grammars
+// for backends which constrain their output that way.
+package jsonschema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var TYPES = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// UNSUPPORTED_KEYWORDS are keywords which would be silently ignored if they
+// were allowed, giving output which the schema's author didn't intend.
+var UNSUPPORTED_KEYWORDS = []string{"$ref", "$defs", "definitions", "pattern", "patternProperties",
+	"dependentRequired", "dependentSchemas", "if", "then", "else", "not"}
+
+// CheckSchema reports whether a schema can be used to ask for structured
+// output. The top level must describe an object, as some APIs require.
+func CheckSchema(schema map[string]any) error {
+	if schemaType, _ := schema["type"].(string); schemaType != "object" {
+		return errors.New("the JSON schema must have type \"object\" at the top level")
+	}
+	return checkSchema(schema, "")
+}
+
+func checkSchema(schema map[string]any, path string) error {
+	for _, keyword := range UNSUPPORTED_KEYWORDS {
+		if _, ok := schema[keyword]; ok {
+			return fmt.Errorf("%s: the JSON schema keyword '%s' is not supported", describePath(path), keyword)
+		}
+	}
+	if _, ok := schema["type"]; ok {
+		types, err := schemaTypes(schema)
+		if err != nil {
+			return fmt.Errorf("%s: %w", describePath(path), err)
+		}
+		for _, schemaType := range types {
+			if !slices.Contains(TYPES, schemaType) {
+				return fmt.Errorf("%s: unknown type '%s'", describePath(path), schemaType)
+			}
+		}
+	}
+
+	if value, ok := schema["properties"]; ok {
+		properties, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: 'properties' must be an object", describePath(path))
+		}
+		for name, property := range properties {
+			if err := checkSubschema(property, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	if value, ok := schema["required"]; ok {
+		if _, err := stringList(value); err != nil {
+			return fmt.Errorf("%s: 'required' must be a list of strings", describePath(path))
+		}
+	}
+	if value, ok := schema["additionalProperties"]; ok {
+		if _, isBool := value.(bool); !isBool {
+			if err := checkSubschema(value, path+".*"); err != nil {
+				return err
+			}
+		}
+	}
+	if value, ok := schema["items"]; ok {
+		if err := checkSubschema(value, path+"[]"); err != nil {
+			return err
+		}
+	}
+	if value, ok := schema["enum"]; ok {
+		if _, isList := value.([]any); !isList {
+			return fmt.Errorf("%s: 'enum' must be a list", describePath(path))
+		}
+	}
+	for _, keyword := range []string{"anyOf", "oneOf", "allOf"} {
+		value, ok := schema[keyword]
+		if !ok {
+			continue
+		}
+		subschemas, isList := value.([]any)
+		if !isList || len(subschemas) == 0 {
+			return fmt.Errorf("%s: '%s' must be a list of schemas", describePath(path), keyword)
+		}
+		for _, subschema := range subschemas {
+			if err := checkSubschema(subschema, path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"minimum", "maximum", "minLength", "maxLength", "minItems", "maxItems"} {
+		if value, ok := schema[keyword]; ok {
+			if _, isNumber := toFloat(value); !isNumber {
+				return fmt.Errorf("%s: '%s' must be a number", describePath(path), keyword)
+			}
+		}
+	}
+	return nil
+}
+
+func checkSubschema(value any, path string) error {
+	subschema, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: the schema must be an object", describePath(path))
+	}
+	return checkSchema(subschema, path)
+}
+
+// ValidationError describes where a value doesn't match its schema. Path is
+// empty for the top level, or like `.items[2].name`.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (this *ValidationError) Error() string {
+	return describePath(this.Path) + ": " + this.Message
+}
+
+func describePath(path string) string {
+	if path == "" {
+		return "the top level"
+	}
+	return "'" + strings.TrimPrefix(path, ".") + "'"
+}
+
+// Parse reads the JSON in a model's reply. Models sometimes wrap it in a
+// Markdown code block even when asked not to, so that is removed first.
+func Parse(text string) (any, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") && len(text) >= 6 {
+		text = strings.TrimSuffix(text, "```")
+		if newline := strings.IndexByte(text, '\n'); newline != -1 {
+			text = text[newline+1:]
+		} else {
+			text = strings.TrimPrefix(text, "```")
+		}
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return nil, fmt.Errorf("the reply is not valid JSON: %w", err)
+	}
+	return value, nil
+}
+
+// ParseAndValidate reads the JSON in a model's reply and checks it against
+// a schema.
+func ParseAndValidate(schema map[string]any, text string) (any, error) {
+	value, err := Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := Validate(schema, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Validate checks a value decoded by encoding/json against a schema. The
+// first mismatch found is returned as a *ValidationError.
+func Validate(schema map[string]any, value any) error {
+	return validate(schema, value, "")
+}
+
+func validate(schema map[string]any, value any, path string) error {
+	fail := func(format string, args ...any) error {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if _, ok := schema["type"]; ok {
+		types, _ := schemaTypes(schema)
+		if !slices.ContainsFunc(types, func(schemaType string) bool { return hasType(value, schemaType) }) {
+			return fail("expected %s, got %s", strings.Join(types, " or "), typeOf(value))
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		isAllowed := slices.ContainsFunc(enum, func(option any) bool {
+			return reflect.DeepEqual(normalize(option), normalize(value))
+		})
+		if !isAllowed {
+			return fail("the value %s is not one of the allowed values", describeValue(value))
+		}
+	}
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(normalize(constant), normalize(value)) {
+		return fail("the value must be %s", describeValue(constant))
+	}
+
+	switch typedValue := value.(type) {
+	case map[string]any:
+		if err := validateObject(schema, typedValue, path); err != nil {
+			return err
+		}
+	case []any:
+		if minItems, ok := toFloat(schema["minItems"]); ok && float64(len(typedValue)) < minItems {
+			return fail("expected at least %v items, got %d", minItems, len(typedValue))
+		}
+		if maxItems, ok := toFloat(schema["maxItems"]); ok && float64(len(typedValue)) > maxItems {
+			return fail("expected at most %v items, got %d", maxItems, len(typedValue))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range typedValue {
+				if err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(typedValue))
+		if minLength, ok := toFloat(schema["minLength"]); ok && length < minLength {
+			return fail("expected at least %v characters", minLength)
+		}
+		if maxLength, ok := toFloat(schema["maxLength"]); ok && length > maxLength {
+			return fail("expected at most %v characters", maxLength)
+		}
+	case float64:
+		if minimum, ok := toFloat(schema["minimum"]); ok && typedValue < minimum {
+			return fail("%v is less than the minimum %v", typedValue, minimum)
+		}
+		if maximum, ok := toFloat(schema["maximum"]); ok && typedValue > maximum {
+			return fail("%v is more than the maximum %v", typedValue, maximum)
+		}
+	}
+
+	if subschemas, ok := schema["allOf"].([]any); ok {
+		for _, subschema := range subschemas {
+			if err := validate(asSchema(subschema), value, path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, keyword := range []string{"anyOf", "oneOf"} {
+		subschemas, ok := schema[keyword].([]any)
+		if !ok {
+			continue
+		}
+		matches := 0
+		var firstErr error
+		for _, subschema := range subschemas {
+			if err := validate(asSchema(subschema), value, path); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				matches++
+			}
+		}
+		if matches == 0 {
+			return fail("the value doesn't match any of the allowed schemas (%v)", firstErr)
+		}
+		if keyword == "oneOf" && matches > 1 {
+			return fail("the value matches more than one of the schemas in 'oneOf'")
+		}
+	}
+	return nil
+}
+
+func validateObject(schema map[string]any, object map[string]any, path string) error {
+	properties, _ := schema["properties"].(map[string]any)
+	required, _ := stringList(schema["required"])
+	for _, name := range required {
+		if _, ok := object[name]; !ok {
+			return &ValidationError{Path: path, Message: fmt.Sprintf("the property '%s' is missing", name)}
+		}
+	}
+
+	// Check the properties in a fixed order so that the same error is always
+	// reported first.
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if propertySchema, ok := properties[name]; ok {
+			if err := validate(asSchema(propertySchema), object[name], path+"."+name); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return &ValidationError{Path: path, Message: fmt.Sprintf("the property '%s' is not allowed", name)}
+			}
+		case map[string]any:
+			if err := validate(additional, object[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schemaTypes returns the schema's `type`, which may be one type or a list.
+func schemaTypes(schema map[string]any) ([]string, error) {
+	switch schemaType := schema["type"].(type) {
+	case string:
+		return []string{schemaType}, nil
+	case []any:
+		types, err := stringList(schemaType)
+		if err == nil && len(types) != 0 {
+			return types, nil
+		}
+	}
+	return nil, errors.New("'type' must be a string or a list of strings")
+}
+
+func hasType(value any, schemaType string) bool {
+	switch schemaType {
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	default:
+		return typeOf(value) == schemaType
+	}
+}
+
+func typeOf(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func describeValue(value any) string {
+	text, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(text)
+}
+
+// normalize converts the numbers in a value decoded from YAML into float64
+// so that it can be compared with one decoded from JSON.
+func normalize(value any) any {
+	switch typedValue := value.(type) {
+	case []any:
+		result := make([]any, len(typedValue))
+		for i, item := range typedValue {
+			result[i] = normalize(item)
+		}
+		return result
+	case map[string]any:
+		result := make(map[string]any, len(typedValue))
+		for key, item := range typedValue {
+			result[key] = normalize(item)
+		}
+		return result
+	}
+	if number, ok := toFloat(value); ok {
+		return number
+	}
+	return value
+}
+
+func toFloat(value any) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case uint64:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+func asSchema(value any) map[string]any {
+	schema, _ := value.(map[string]any)
+	return schema
+}
+
+func stringList(value any) ([]string, error) {
+	items, ok := value.([]any)
+	if !ok {
+		return nil, errors.New("expected a list")
+	}
+	result := []string{}
+	for _, item := range items {
+		text, ok := item.(string)
+		if !ok {
+			return nil, errors.New("expected a list of strings")
+		}
+		result = append(result, text)
+	}
+	return result, nil
+}
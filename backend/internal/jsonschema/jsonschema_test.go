@@ -0,0 +1,99 @@
+package jsonschema
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The schema is read from YAML, as it is for templates.
+const PERSON_SCHEMA = `
+type: object
+properties:
+  name:
+    type: string
+    minLength: 1
+  age:
+    type: integer
+    minimum: 0
+  role:
+    enum: [admin, user]
+  tags:
+    type: array
+    items:
+      type: string
+required: [name, age]
+additionalProperties: false
+`
+
+func readSchema(t *testing.T, text string) map[string]any {
+	schema := map[string]any{}
+	if err := yaml.Unmarshal([]byte(text), &schema); err != nil {
+		t.Fatal(err)
+	}
+	return schema
+}
+
+func TestCheckSchema(t *testing.T) {
+	if err := CheckSchema(readSchema(t, PERSON_SCHEMA)); err != nil {
+		t.Errorf("Expected the schema to be usable, got %v", err)
+	}
+	if err := CheckSchema(map[string]any{"type": "array"}); err == nil {
+		t.Errorf("Expected a schema which isn't for an object to be rejected")
+	}
+	if err := CheckSchema(readSchema(t, "type: object\nproperties:\n  a:\n    type: text\n")); err == nil {
+		t.Errorf("Expected an unknown type to be rejected")
+	}
+	if err := CheckSchema(readSchema(t, "type: object\nproperties:\n  a:\n    $ref: '#/x'\n")); err == nil {
+		t.Errorf("Expected $ref to be rejected")
+	}
+}
+
+func TestParseAndValidate(t *testing.T) {
+	schema := readSchema(t, PERSON_SCHEMA)
+
+	value, err := ParseAndValidate(schema, "```json\n{\"name\": \"Ann\", \"age\": 31, \"role\": \"admin\"}\n```")
+	if err != nil {
+		t.Fatalf("Expected the reply to be valid, got %v", err)
+	}
+	if value.(map[string]any)["name"] != "Ann" {
+		t.Errorf("Unexpected value %v", value)
+	}
+
+	cases := map[string]string{
+		`{"name": "Ann"`:                           "not valid JSON",
+		`{"name": "Ann"}`:                          "'age' is missing",
+		`{"name": "Ann", "age": 3.5}`:              "expected integer, got number",
+		`{"name": "Ann", "age": -1}`:               "less than the minimum",
+		`{"name": "", "age": 1}`:                   "at least 1 characters",
+		`{"name": "Ann", "age": 1, "role": "x"}`:   "not one of the allowed values",
+		`{"name": "Ann", "age": 1, "tags": [1]}`:   "'tags[0]': expected string",
+		`{"name": "Ann", "age": 1, "extra": true}`: "'extra' is not allowed",
+	}
+	for text, expected := range cases {
+		_, err := ParseAndValidate(schema, text)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %s to fail with '%s', got %v", text, expected, err)
+		}
+	}
+}
+
+func TestGrammar(t *testing.T) {
+	grammar := Grammar(readSchema(t, PERSON_SCHEMA))
+
+	if !strings.HasPrefix(grammar, "root ::= ") {
+		t.Errorf("Expected the grammar to start with the root rule:\n%s", grammar)
+	}
+	// The required properties come first, in order, and the optional ones
+	// follow.
+	for _, part := range []string{
+		`"\"age\"" space ":" space integer "," space "\"name\"" space ":" space string`,
+		`"\"admin\"" space | "\"user\"" space`,
+		`"[" space (string ("," space string)*)? "]" space`,
+	} {
+		if !strings.Contains(grammar, part) {
+			t.Errorf("Expected the grammar to contain %s:\n%s", part, grammar)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package knowledge
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Chunk is a piece of a document and its embedding. Lines are counted
+// from 1.
+type Chunk struct {
+	Path      string    `json:"path"`
+	StartLine int       `json:"startLine"`
+	EndLine   int       `json:"endLine"`
+	Text      string    `json:"text"`
+	Vector    []float32 `json:"vector"`
+}
+
+// SplitIntoChunks cuts a document into chunks of whole lines which are at
+// most `chunkSize` bytes long. Each chunk starts with the last lines of the
+// previous one, up to `overlap` bytes, so that text which spans a boundary
+// can still be found. Lines which are longer than a chunk are cut up.
+func SplitIntoChunks(path string, content string, chunkSize int, overlap int) []*Chunk {
+	lines := splitLongLines(strings.Split(content, "\n"), chunkSize)
+
+	result := []*Chunk{}
+	start := 0
+	for start < len(lines) {
+		end := start
+		size := 0
+		for end < len(lines) && (end == start || size+len(lines[end].text)+1 <= chunkSize) {
+			size += len(lines[end].text) + 1
+			end++
+		}
+
+		text := joinLines(lines[start:end])
+		if strings.TrimSpace(text) != "" {
+			result = append(result, &Chunk{
+				Path:      path,
+				StartLine: lines[start].number,
+				EndLine:   lines[end-1].number,
+				Text:      text,
+			})
+		}
+		if end == len(lines) {
+			break
+		}
+
+		// Step back over the lines which are repeated in the next chunk, but
+		// always move forward.
+		next := end
+		overlapSize := 0
+		for next-1 > start && overlapSize+len(lines[next-1].text)+1 <= overlap {
+			overlapSize += len(lines[next-1].text) + 1
+			next--
+		}
+		start = next
+	}
+	return result
+}
+
+type line struct {
+	number int
+	text   string
+}
+
+// splitLongLines numbers the lines and cuts any which are longer than
+// `chunkSize` into pieces, keeping UTF-8 characters whole.
+func splitLongLines(texts []string, chunkSize int) []line {
+	result := []line{}
+	for i, text := range texts {
+		for len(text) > chunkSize {
+			cut := chunkSize
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = chunkSize
+			}
+			result = append(result, line{number: i + 1, text: text[:cut]})
+			text = text[cut:]
+		}
+		result = append(result, line{number: i + 1, text: text})
+	}
+	return result
+}
+
+func joinLines(lines []line) string {
+	texts := []string{}
+	for _, line := range lines {
+		texts = append(texts, line.text)
+	}
+	return strings.Join(texts, "\n")
+}
@@ -0,0 +1,504 @@
+package knowledge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/priority"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const DEFAULT_CHUNK_SIZE = 1500
+
+const DEFAULT_CHUNK_OVERLAP = 200
+
+const DEFAULT_TOP_K = 4
+
+// MAX_FILE_SIZE is the largest file which is ingested. Bigger files are
+// usually generated and not worth searching.
+const MAX_FILE_SIZE = 1024 * 1024
+
+// EMBED_BATCH_SIZE is how many chunks are sent to the embeddings endpoint at
+// once.
+const EMBED_BATCH_SIZE = 32
+
+// STORE_DIRECTORY is the directory below the storage path which holds the
+// vectors of the collections.
+const STORE_DIRECTORY = "knowledge"
+
+var ErrCollectionNotFound = errors.New("knowledge collection not found")
+
+var collectionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// FILE_EXTENSIONS are the kinds of files which are ingested.
+var FILE_EXTENSIONS = []string{
+	".md", ".markdown", ".txt", ".rst", ".adoc",
+	".go", ".py", ".js", ".jsx", ".ts", ".tsx", ".java", ".kt", ".c", ".h", ".cpp", ".hpp", ".cs", ".rs",
+	".rb", ".php", ".swift", ".scala", ".sh", ".sql", ".html", ".css", ".scss", ".vue", ".svelte",
+	".json", ".yaml", ".yml", ".toml", ".xml",
+}
+
+const CONTEXT_INTRODUCTION = "Answer using the following excerpts from the %s document collection where " +
+	"they are relevant. Cite the excerpts which you use by their numbers, like [1].\n\n"
+
+type CollectionConfig struct {
+	Name      string `yaml:"name"`
+	Directory string `yaml:"directory"`
+	// EmbeddingModel overrides the model given for all collections.
+	EmbeddingModel string `yaml:"embedding_model"`
+}
+
+type KnowledgeConfig struct {
+	EmbeddingModel string              `yaml:"embedding_model"`
+	ChunkSize      int                 `yaml:"chunk_size"`
+	ChunkOverlap   int                 `yaml:"chunk_overlap"`
+	TopK           int                 `yaml:"top_k"`
+	Collections    []*CollectionConfig `yaml:"collections"`
+}
+
+func ReadConfigFile(file string) (*KnowledgeConfig, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read knowledge config file: %w", err)
+	}
+	knowledgeConfig := &KnowledgeConfig{}
+	if err := yaml.Unmarshal(content, knowledgeConfig); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal knowledge config file '%s': %w", file, err)
+	}
+
+	// Relative directories are relative to the config file.
+	for _, collectionConfig := range knowledgeConfig.Collections {
+		if collectionConfig.Directory != "" && !path.IsAbs(collectionConfig.Directory) {
+			collectionConfig.Directory = path.Join(path.Dir(file), collectionConfig.Directory)
+		}
+	}
+	return knowledgeConfig, nil
+}
+
+// EmbedFunc turns texts into embedding vectors with a model. Ingests use the
+// background priority and searches the interactive one.
+type EmbedFunc func(modelID string, texts []string, requestPriority priority.Priority) ([][]float32, error)
+
+// storedFile is a file of a collection as it was last ingested.
+type storedFile struct {
+	Hash   string   `json:"hash"`
+	Chunks []*Chunk `json:"chunks"`
+}
+
+// store is what is saved of a collection.
+type store struct {
+	EmbeddingModel      string                 `json:"embeddingModel"`
+	LastIngestTimestamp string                 `json:"lastIngestTimestamp"`
+	Files               map[string]*storedFile `json:"files"`
+}
+
+type collection struct {
+	config         *CollectionConfig
+	embeddingModel string
+	store          *store
+	isIngesting    bool
+	err            string
+}
+
+// Knowledge holds the document collections. It is safe to use from several
+// goroutines.
+type Knowledge struct {
+	storePath    string
+	chunkSize    int
+	chunkOverlap int
+	topK         int
+	embedFunc    EmbedFunc
+
+	// lock guards the state of the collections.
+	lock        sync.RWMutex
+	collections map[string]*collection
+}
+
+// New sets up the collections and loads the vectors which were saved by
+// earlier ingests. Nothing is ingested yet.
+func New(knowledgeConfig *KnowledgeConfig, storagePath string, embedFunc EmbedFunc) (*Knowledge, error) {
+	this := &Knowledge{
+		storePath:    filepath.Join(storagePath, STORE_DIRECTORY),
+		chunkSize:    valueOrDefault(knowledgeConfig.ChunkSize, DEFAULT_CHUNK_SIZE),
+		chunkOverlap: valueOrDefault(knowledgeConfig.ChunkOverlap, DEFAULT_CHUNK_OVERLAP),
+		topK:         valueOrDefault(knowledgeConfig.TopK, DEFAULT_TOP_K),
+		embedFunc:    embedFunc,
+		collections:  map[string]*collection{},
+	}
+	if this.chunkOverlap >= this.chunkSize {
+		return nil, fmt.Errorf("the chunk overlap must be smaller than the chunk size")
+	}
+
+	for _, collectionConfig := range knowledgeConfig.Collections {
+		if !collectionNameRegexp.MatchString(collectionConfig.Name) {
+			return nil, fmt.Errorf("knowledge collection name '%s' may only contain letters, digits, '_' and '-'",
+				collectionConfig.Name)
+		}
+		if _, ok := this.collections[collectionConfig.Name]; ok {
+			return nil, fmt.Errorf("knowledge collection '%s' is configured twice", collectionConfig.Name)
+		}
+		if collectionConfig.Directory == "" {
+			return nil, fmt.Errorf("knowledge collection '%s' needs a directory", collectionConfig.Name)
+		}
+		embeddingModel := collectionConfig.EmbeddingModel
+		if embeddingModel == "" {
+			embeddingModel = knowledgeConfig.EmbeddingModel
+		}
+		if embeddingModel == "" {
+			return nil, fmt.Errorf("knowledge collection '%s' needs an embedding model", collectionConfig.Name)
+		}
+
+		this.collections[collectionConfig.Name] = &collection{
+			config:         collectionConfig,
+			embeddingModel: embeddingModel,
+			store:          this.loadStore(collectionConfig.Name),
+		}
+	}
+	return this, nil
+}
+
+func valueOrDefault(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func (this *Knowledge) storeFilePath(name string) string {
+	return filepath.Join(this.storePath, name+".json")
+}
+
+// loadStore reads the saved vectors of a collection. A missing or unreadable
+// file gives an empty store, which is filled by the next ingest.
+func (this *Knowledge) loadStore(name string) *store {
+	emptyStore := &store{Files: map[string]*storedFile{}}
+	content, err := os.ReadFile(this.storeFilePath(name))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Knowledge: Unable to read the store of %s: %v", name, err)
+		}
+		return emptyStore
+	}
+	loadedStore := &store{}
+	if err := json.Unmarshal(content, loadedStore); err != nil || loadedStore.Files == nil {
+		log.Printf("Knowledge: Unable to parse the store of %s: %v", name, err)
+		return emptyStore
+	}
+	return loadedStore
+}
+
+func (this *Knowledge) saveStore(name string, newStore *store) error {
+	if err := os.MkdirAll(this.storePath, 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(newStore)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash can't leave half a
+	// store behind.
+	tempPath := this.storeFilePath(name) + "." + uuid.NewString()
+	if err := os.WriteFile(tempPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, this.storeFilePath(name))
+}
+
+// Exists returns true if a collection with the name is configured.
+func (this *Knowledge) Exists(name string) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	_, ok := this.collections[name]
+	return ok
+}
+
+func (this *Knowledge) Overview() *data.KnowledgeOverview {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	overview := &data.KnowledgeOverview{Collections: []*data.KnowledgeCollection{}}
+	for name, collection := range this.collections {
+		chunkCount := 0
+		for _, file := range collection.store.Files {
+			chunkCount += len(file.Chunks)
+		}
+		overview.Collections = append(overview.Collections, &data.KnowledgeCollection{
+			Name:                name,
+			EmbeddingModel:      collection.embeddingModel,
+			FileCount:           len(collection.store.Files),
+			ChunkCount:          chunkCount,
+			IsIngesting:         collection.isIngesting,
+			LastIngestTimestamp: collection.store.LastIngestTimestamp,
+			Error:               collection.err,
+		})
+	}
+	sort.Slice(overview.Collections, func(i, j int) bool {
+		return overview.Collections[i].Name < overview.Collections[j].Name
+	})
+	return overview
+}
+
+// IngestAll ingests each of the collections in turn.
+func (this *Knowledge) IngestAll() {
+	this.lock.RLock()
+	names := []string{}
+	for name := range this.collections {
+		names = append(names, name)
+	}
+	this.lock.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := this.Ingest(name); err != nil {
+			log.Printf("Knowledge: Unable to ingest %s: %v", name, err)
+		}
+	}
+}
+
+// Ingest reads the files of a collection's directory, embeds the chunks of
+// the files which have changed since the last ingest and saves the result.
+// Nothing is done if the collection is already being ingested.
+func (this *Knowledge) Ingest(name string) error {
+	this.lock.Lock()
+	collection, ok := this.collections[name]
+	if !ok {
+		this.lock.Unlock()
+		return ErrCollectionNotFound
+	}
+	if collection.isIngesting {
+		this.lock.Unlock()
+		return nil
+	}
+	collection.isIngesting = true
+	oldStore := collection.store
+	this.lock.Unlock()
+
+	log.Printf("Knowledge: Ingesting %s from %s", name, collection.config.Directory)
+	newStore, err := this.buildStore(collection, oldStore)
+	if err == nil {
+		err = this.saveStore(name, newStore)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	collection.isIngesting = false
+	if err != nil {
+		collection.err = err.Error()
+		return err
+	}
+	collection.err = ""
+	collection.store = newStore
+	log.Printf("Knowledge: Ingested %d files into %s", len(newStore.Files), name)
+	return nil
+}
+
+func (this *Knowledge) buildStore(collection *collection, oldStore *store) (*store, error) {
+	files, err := readDirectory(collection.config.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	newStore := &store{
+		EmbeddingModel:      collection.embeddingModel,
+		LastIngestTimestamp: time.Now().UTC().Format(time.RFC3339),
+		Files:               map[string]*storedFile{},
+	}
+	// Vectors of different models can't be compared.
+	canReuse := oldStore.EmbeddingModel == collection.embeddingModel
+
+	newChunks := []*Chunk{}
+	for relativePath, content := range files {
+		hashBytes := sha256.Sum256(content)
+		hash := hex.EncodeToString(hashBytes[:])
+		if oldFile, ok := oldStore.Files[relativePath]; ok && canReuse && oldFile.Hash == hash {
+			newStore.Files[relativePath] = oldFile
+			continue
+		}
+		chunks := SplitIntoChunks(relativePath, string(content), this.chunkSize, this.chunkOverlap)
+		newStore.Files[relativePath] = &storedFile{Hash: hash, Chunks: chunks}
+		newChunks = append(newChunks, chunks...)
+	}
+
+	for start := 0; start < len(newChunks); start += EMBED_BATCH_SIZE {
+		batch := newChunks[start:min(start+EMBED_BATCH_SIZE, len(newChunks))]
+		texts := []string{}
+		for _, chunk := range batch {
+			texts = append(texts, chunk.Path+"\n"+chunk.Text)
+		}
+		vectors, err := this.embedFunc(collection.embeddingModel, texts, priority.Background)
+		if err != nil {
+			return nil, err
+		}
+		for i, chunk := range batch {
+			chunk.Vector = normalize(vectors[i])
+		}
+	}
+	return newStore, nil
+}
+
+// readDirectory returns the contents of the text files below a directory,
+// keyed by their relative paths. Hidden files and directories are skipped.
+func readDirectory(directory string) (map[string][]byte, error) {
+	result := map[string][]byte{}
+	err := filepath.WalkDir(directory, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if (filePath != directory && strings.HasPrefix(name, ".")) || name == "node_modules" {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !isTextFileName(name) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() > MAX_FILE_SIZE {
+			return nil
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil || !utf8.Valid(content) {
+			return nil
+		}
+		relativePath, err := filepath.Rel(directory, filePath)
+		if err != nil {
+			return err
+		}
+		result[filepath.ToSlash(relativePath)] = content
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory '%s': %w", directory, err)
+	}
+	return result, nil
+}
+
+func isTextFileName(name string) bool {
+	extension := strings.ToLower(filepath.Ext(name))
+	for _, textExtension := range FILE_EXTENSIONS {
+		if extension == textExtension {
+			return true
+		}
+	}
+	return false
+}
+
+func normalize(vector []float32) []float32 {
+	var sum float64
+	for _, value := range vector {
+		sum += float64(value) * float64(value)
+	}
+	if sum == 0 {
+		return vector
+	}
+	length := float32(math.Sqrt(sum))
+	result := make([]float32, len(vector))
+	for i, value := range vector {
+		result[i] = value / length
+	}
+	return result
+}
+
+// Search returns the chunks of a collection which are most similar to a
+// query as citations, best first.
+func (this *Knowledge) Search(name string, query string) ([]*data.Citation, error) {
+	this.lock.RLock()
+	collection, ok := this.collections[name]
+	if !ok {
+		this.lock.RUnlock()
+		return nil, ErrCollectionNotFound
+	}
+	currentStore := collection.store
+	this.lock.RUnlock()
+
+	if len(currentStore.Files) == 0 {
+		return []*data.Citation{}, nil
+	}
+	vectors, err := this.embedFunc(currentStore.EmbeddingModel, []string{query}, priority.Interactive)
+	if err != nil {
+		return nil, err
+	}
+	queryVector := normalize(vectors[0])
+
+	type match struct {
+		chunk *Chunk
+		score float32
+	}
+	matches := []match{}
+	for _, file := range currentStore.Files {
+		for _, chunk := range file.Chunks {
+			matches = append(matches, match{chunk: chunk, score: dotProduct(queryVector, chunk.Vector)})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	result := []*data.Citation{}
+	for i, match := range matches[:min(this.topK, len(matches))] {
+		result = append(result, &data.Citation{
+			Number:     i + 1,
+			Collection: name,
+			Path:       match.chunk.Path,
+			StartLine:  match.chunk.StartLine,
+			EndLine:    match.chunk.EndLine,
+			Score:      match.score,
+			Text:       match.chunk.Text,
+		})
+	}
+	return result, nil
+}
+
+func dotProduct(a []float32, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var result float32
+	for i := range a {
+		result += a[i] * b[i]
+	}
+	return result
+}
+
+// AddCitations returns a copy of the messages with a system message in front
+// which holds the citations. The messages are returned as they are if there
+// are no citations.
+func AddCitations(messages []data.Message, citations []*data.Citation) []data.Message {
+	if len(citations) == 0 {
+		return messages
+	}
+
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf(CONTEXT_INTRODUCTION, citations[0].Collection))
+	for _, citation := range citations {
+		builder.WriteString(fmt.Sprintf("[%d] %s (lines %d-%d)\n%s\n\n", citation.Number, citation.Path,
+			citation.StartLine, citation.EndLine, citation.Text))
+	}
+
+	result := []data.Message{{
+		ID:   uuid.NewString(),
+		Role: role.System,
+		Text: strings.TrimSpace(builder.String()),
+	}}
+	return append(result, messages...)
+}
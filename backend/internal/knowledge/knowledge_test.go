@@ -0,0 +1,119 @@
+package knowledge
+
+import (
+	"os"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/priority"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"strings"
+	"testing"
+)
+
+func TestSplitIntoChunks(t *testing.T) {
+	content := "one\ntwo\nthree\nfour\nfive\nsix"
+	chunks := SplitIntoChunks("numbers.txt", content, 10, 4)
+
+	if len(chunks) != 4 {
+		t.Fatalf("Expected 4 chunks, got %d", len(chunks))
+	}
+	if chunks[0].Text != "one\ntwo" || chunks[0].StartLine != 1 || chunks[0].EndLine != 2 {
+		t.Errorf("Unexpected first chunk %+v", chunks[0])
+	}
+	// The last line of each chunk is repeated at the start of the next.
+	if chunks[1].Text != "two\nthree" || chunks[1].StartLine != 2 {
+		t.Errorf("Unexpected second chunk %+v", chunks[1])
+	}
+	if chunks[3].EndLine != 6 {
+		t.Errorf("Expected the last chunk to end at line 6, got %d", chunks[3].EndLine)
+	}
+
+	for _, chunk := range SplitIntoChunks("long.txt", strings.Repeat("x", 25), 10, 0) {
+		if len(chunk.Text) > 10 || chunk.StartLine != 1 {
+			t.Errorf("Expected a long line to be cut into pieces, got %+v", chunk)
+		}
+	}
+}
+
+// fakeEmbed makes a vector which counts a few words, so that texts about the
+// same things are similar.
+var WORDS = []string{"cat", "dog", "install", "error"}
+
+func fakeEmbed(calls *int) EmbedFunc {
+	return func(modelID string, texts []string, requestPriority priority.Priority) ([][]float32, error) {
+		*calls += len(texts)
+		result := [][]float32{}
+		for _, text := range texts {
+			vector := make([]float32, len(WORDS))
+			for i, word := range WORDS {
+				vector[i] = float32(strings.Count(strings.ToLower(text), word))
+			}
+			result = append(result, vector)
+		}
+		return result, nil
+	}
+}
+
+func TestIngestAndSearch(t *testing.T) {
+	directory := t.TempDir()
+	os.WriteFile(filepath.Join(directory, "pets.md"), []byte("The cat sat on the mat.\nCats and a cat."), 0644)
+	os.MkdirAll(filepath.Join(directory, "guide"), 0755)
+	os.WriteFile(filepath.Join(directory, "guide", "install.txt"), []byte("To install, run the installer."), 0644)
+	os.WriteFile(filepath.Join(directory, "image.png"), []byte("cat"), 0644)
+	os.MkdirAll(filepath.Join(directory, ".git"), 0755)
+	os.WriteFile(filepath.Join(directory, ".git", "notes.txt"), []byte("cat"), 0644)
+
+	calls := 0
+	knowledgeConfig := &KnowledgeConfig{
+		EmbeddingModel: "test",
+		TopK:           1,
+		Collections:    []*CollectionConfig{{Name: "docs", Directory: directory}},
+	}
+	storagePath := t.TempDir()
+	knowledge, err := New(knowledgeConfig, storagePath, fakeEmbed(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := knowledge.Ingest("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if overview := knowledge.Overview(); overview.Collections[0].FileCount != 2 {
+		t.Errorf("Expected 2 files to be ingested, got %+v", overview.Collections[0])
+	}
+
+	citations, err := knowledge.Search("docs", "How do I install it?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(citations) != 1 || citations[0].Path != "guide/install.txt" || citations[0].Number != 1 {
+		t.Errorf("Expected the install guide to be found, got %+v", citations)
+	}
+
+	// Unchanged files aren't embedded again, also after a restart.
+	calls = 0
+	knowledge, _ = New(knowledgeConfig, storagePath, fakeEmbed(&calls))
+	os.WriteFile(filepath.Join(directory, "pets.md"), []byte("A dog."), 0644)
+	if err := knowledge.Ingest("docs"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected only the changed file to be embedded, got %d calls", calls)
+	}
+
+	if _, err := knowledge.Search("missing", "cat"); err != ErrCollectionNotFound {
+		t.Errorf("Expected an unknown collection to be an error, got %v", err)
+	}
+}
+
+func TestAddCitations(t *testing.T) {
+	messages := []data.Message{{Role: role.User, Text: "Question"}}
+	if result := AddCitations(messages, nil); len(result) != 1 {
+		t.Errorf("Expected no message to be added without citations")
+	}
+
+	citations := []*data.Citation{{Number: 1, Collection: "docs", Path: "a.md", StartLine: 1, EndLine: 3, Text: "Answer"}}
+	result := AddCitations(messages, citations)
+	if len(result) != 2 || result[0].Role != role.System || !strings.Contains(result[0].Text, "[1] a.md (lines 1-3)\nAnswer") {
+		t.Errorf("Unexpected messages %+v", result)
+	}
+}
@@ -0,0 +1,498 @@
+package mcp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/redact"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PROTOCOL_VERSION = "2024-11-05"
+
+const REQUEST_TIMEOUT = 60 * time.Second
+
+// MAX_MESSAGE_SIZE limits the length of one line from a server.
+const MAX_MESSAGE_SIZE = 16 * 1024 * 1024
+
+type ServerConfig struct {
+	Name      string            `yaml:"name"`
+	Command   []string          `yaml:"command"`
+	Env       map[string]string `yaml:"env"`
+	Directory string            `yaml:"directory"`
+}
+
+type Tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type Resource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	MimeType    string `json:"mimeType"`
+}
+
+type Prompt struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Arguments   []*PromptArgument `json:"arguments"`
+}
+
+type PromptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+}
+
+type PromptMessage struct {
+	Role    string   `json:"role"`
+	Content *Content `json:"content"`
+}
+
+// Content is a piece of a tool result or prompt message. Only text is
+// passed on to models.
+type Content struct {
+	Type     string            `json:"type"`
+	Text     string            `json:"text"`
+	Resource *ResourceContents `json:"resource"`
+}
+
+type ResourceContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// Overview lists the running servers.
+type Overview struct {
+	Servers []*ServerOverview `json:"servers"`
+}
+
+// ServerOverview lists what a server offers.
+type ServerOverview struct {
+	Name      string      `json:"name"`
+	Tools     []*Tool     `json:"tools"`
+	Resources []*Resource `json:"resources"`
+	Prompts   []*Prompt   `json:"prompts"`
+}
+
+type rpcMessage struct {
+	JsonRpc string           `json:"jsonrpc"`
+	ID      *int64           `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  any              `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *rpcErrorMessage `json:"error,omitempty"`
+}
+
+type rpcErrorMessage struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Client talks to a Model Context Protocol server which it runs as a child
+// process. Messages are JSON-RPC 2.0, one per line, over stdin and stdout.
+type Client struct {
+	name string
+	cmd  *exec.Cmd
+
+	writeLock sync.Mutex
+	stdin     io.WriteCloser
+
+	// lock guards `pending`, `nextID` and `err`.
+	lock    sync.Mutex
+	pending map[int64]chan *rpcMessage
+	nextID  int64
+	err     error
+
+	// stopped is closed when the server's output ends.
+	stopped chan struct{}
+
+	capabilities map[string]any
+	overview     *ServerOverview
+}
+
+// Start launches a server and performs the initialization handshake.
+func Start(serverConfig *ServerConfig) (*Client, error) {
+	if serverConfig.Name == "" || len(serverConfig.Command) == 0 {
+		return nil, errors.New("MCP servers need a name and a command")
+	}
+
+	cmd := exec.Command(serverConfig.Command[0], serverConfig.Command[1:]...)
+	cmd.Dir = serverConfig.Directory
+	cmd.Env = os.Environ()
+	for name, value := range serverConfig.Env {
+		expanded, err := config.ExpandVariables(value)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable '%s' of MCP server '%s' can't be expanded: %w", name,
+				serverConfig.Name, err)
+		}
+		if expanded != value {
+			redact.AddSecret(expanded)
+		}
+		cmd.Env = append(cmd.Env, name+"="+expanded)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start MCP server '%s': %w", serverConfig.Name, err)
+	}
+
+	this := &Client{
+		name:    serverConfig.Name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[int64]chan *rpcMessage{},
+		stopped: make(chan struct{}),
+	}
+	go this.readLoop(stdout)
+	go this.logStderr(stderr)
+
+	if err := this.initialize(); err != nil {
+		this.Close()
+		return nil, fmt.Errorf("cannot initialize MCP server '%s': %w", serverConfig.Name, err)
+	}
+	this.overview = this.readOverview()
+	log.Printf("MCP: Started server %s", this.name)
+	return this, nil
+}
+
+func (this *Client) Name() string {
+	return this.name
+}
+
+// Stopped returns a channel which is closed when the server stops.
+func (this *Client) Stopped() <-chan struct{} {
+	return this.stopped
+}
+
+// IsRunning returns false once the server has stopped.
+func (this *Client) IsRunning() bool {
+	select {
+	case <-this.stopped:
+		return false
+	default:
+		return true
+	}
+}
+
+func (this *Client) initialize() error {
+	result := &struct {
+		Capabilities map[string]any `json:"capabilities"`
+	}{}
+	err := this.request("initialize", map[string]any{
+		"protocolVersion": PROTOCOL_VERSION,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "llm-multitool", "version": "1.0"},
+	}, result)
+	if err != nil {
+		return err
+	}
+	this.capabilities = result.Capabilities
+	return this.send(&rpcMessage{JsonRpc: "2.0", Method: "notifications/initialized"})
+}
+
+// hasCapability returns true if the server said it offers something, such
+// as "tools".
+func (this *Client) hasCapability(name string) bool {
+	_, ok := this.capabilities[name]
+	return ok
+}
+
+// Close stops the server.
+func (this *Client) Close() {
+	this.stdin.Close()
+	done := make(chan bool)
+	go func() {
+		this.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		this.cmd.Process.Kill()
+	}
+}
+
+func (this *Client) send(message *rpcMessage) error {
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	_, err = this.stdin.Write(append(jsonData, '\n'))
+	return err
+}
+
+// request sends a request and decodes the result into `result`.
+func (this *Client) request(method string, params any, result any) error {
+	this.lock.Lock()
+	if this.err != nil {
+		this.lock.Unlock()
+		return this.err
+	}
+	this.nextID++
+	id := this.nextID
+	responseChan := make(chan *rpcMessage, 1)
+	this.pending[id] = responseChan
+	this.lock.Unlock()
+
+	defer func() {
+		this.lock.Lock()
+		delete(this.pending, id)
+		this.lock.Unlock()
+	}()
+
+	if err := this.send(&rpcMessage{JsonRpc: "2.0", ID: &id, Method: method, Params: params}); err != nil {
+		return err
+	}
+
+	select {
+	case response, ok := <-responseChan:
+		if !ok || response == nil {
+			return this.closedError()
+		}
+		if response.Error != nil {
+			return fmt.Errorf("%s failed: %s", method, response.Error.Message)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(response.Result, result)
+	case <-time.After(REQUEST_TIMEOUT):
+		return fmt.Errorf("%s timed out", method)
+	}
+}
+
+func (this *Client) closedError() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.err
+}
+
+func (this *Client) readLoop(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), MAX_MESSAGE_SIZE)
+	for scanner.Scan() {
+		message := &rpcMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), message); err != nil {
+			log.Printf("MCP: Server %s sent a message which isn't JSON: %v", this.name, err)
+			continue
+		}
+
+		if message.Method != "" {
+			this.handleServerMessage(message)
+			continue
+		}
+		if message.ID == nil {
+			continue
+		}
+		this.lock.Lock()
+		responseChan, ok := this.pending[*message.ID]
+		this.lock.Unlock()
+		if ok {
+			// A server which answers a request twice mustn't block the loop.
+			select {
+			case responseChan <- message:
+			default:
+			}
+		}
+	}
+
+	log.Printf("MCP: Server %s has stopped", this.name)
+	this.lock.Lock()
+	this.err = fmt.Errorf("MCP server '%s' has stopped", this.name)
+	pendingChans := this.pending
+	this.pending = map[int64]chan *rpcMessage{}
+	this.lock.Unlock()
+
+	// Closing never blocks, even when a reply is still waiting in the buffer.
+	for _, responseChan := range pendingChans {
+		close(responseChan)
+	}
+	close(this.stopped)
+}
+
+// handleServerMessage answers requests from the server. Notifications, such
+// as list changes, are ignored.
+func (this *Client) handleServerMessage(message *rpcMessage) {
+	if message.ID == nil {
+		return
+	}
+	response := &rpcMessage{JsonRpc: "2.0", ID: message.ID}
+	if message.Method == "ping" {
+		response.Result = json.RawMessage("{}")
+	} else {
+		response.Error = &rpcErrorMessage{Code: -32601, Message: "method not found"}
+	}
+	if err := this.send(response); err != nil {
+		log.Printf("MCP: Unable to reply to server %s: %v", this.name, err)
+	}
+}
+
+func (this *Client) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Printf("MCP %s: %s", this.name, scanner.Text())
+	}
+}
+
+// listAll collects the items of a paginated list method.
+func listAll[T any](this *Client, method string, key string) ([]T, error) {
+	result := []T{}
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		page := map[string]json.RawMessage{}
+		if err := this.request(method, params, &page); err != nil {
+			return nil, err
+		}
+		items := []T{}
+		if err := json.Unmarshal(page[key], &items); err != nil {
+			return nil, fmt.Errorf("%s returned a bad list: %w", method, err)
+		}
+		result = append(result, items...)
+
+		cursor = ""
+		if nextCursor, ok := page["nextCursor"]; ok {
+			json.Unmarshal(nextCursor, &cursor)
+		}
+		if cursor == "" {
+			return result, nil
+		}
+	}
+}
+
+func (this *Client) ListTools() ([]*Tool, error) {
+	if !this.hasCapability("tools") {
+		return []*Tool{}, nil
+	}
+	return listAll[*Tool](this, "tools/list", "tools")
+}
+
+func (this *Client) ListResources() ([]*Resource, error) {
+	if !this.hasCapability("resources") {
+		return []*Resource{}, nil
+	}
+	return listAll[*Resource](this, "resources/list", "resources")
+}
+
+func (this *Client) ListPrompts() ([]*Prompt, error) {
+	if !this.hasCapability("prompts") {
+		return []*Prompt{}, nil
+	}
+	return listAll[*Prompt](this, "prompts/list", "prompts")
+}
+
+// CallTool calls a tool and returns the text of its result. A result which
+// the server flags as an error is returned as an error.
+func (this *Client) CallTool(name string, arguments map[string]any) (string, error) {
+	result := &struct {
+		Content []*Content `json:"content"`
+		IsError bool       `json:"isError"`
+	}{}
+	if err := this.request("tools/call", map[string]any{"name": name, "arguments": arguments}, result); err != nil {
+		return "", err
+	}
+	text := joinContents(result.Content)
+	if result.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+// ReadResource returns the text of a resource.
+func (this *Client) ReadResource(uri string) (string, error) {
+	result := &struct {
+		Contents []*ResourceContents `json:"contents"`
+	}{}
+	if err := this.request("resources/read", map[string]any{"uri": uri}, result); err != nil {
+		return "", err
+	}
+	texts := []string{}
+	for _, contents := range result.Contents {
+		texts = append(texts, contents.Text)
+	}
+	return strings.Join(texts, "\n\n"), nil
+}
+
+// GetPrompt fills in a prompt's arguments and returns its messages.
+func (this *Client) GetPrompt(name string, arguments map[string]string) ([]*PromptMessage, error) {
+	result := &struct {
+		Messages []*PromptMessage `json:"messages"`
+	}{}
+	if err := this.request("prompts/get", map[string]any{"name": name, "arguments": arguments}, result); err != nil {
+		return nil, err
+	}
+	return result.Messages, nil
+}
+
+// Overview lists the server's tools, resources and prompts as they were
+// when the server started.
+func (this *Client) Overview() *ServerOverview {
+	return this.overview
+}
+
+// readOverview asks the server for its tools, resources and prompts. Lists
+// which can't be read are left empty.
+func (this *Client) readOverview() *ServerOverview {
+	overview := &ServerOverview{Name: this.name}
+	var err error
+	if overview.Tools, err = this.ListTools(); err != nil {
+		log.Printf("MCP: Unable to list the tools of %s: %v", this.name, err)
+		overview.Tools = []*Tool{}
+	}
+	if overview.Resources, err = this.ListResources(); err != nil {
+		log.Printf("MCP: Unable to list the resources of %s: %v", this.name, err)
+		overview.Resources = []*Resource{}
+	}
+	if overview.Prompts, err = this.ListPrompts(); err != nil {
+		log.Printf("MCP: Unable to list the prompts of %s: %v", this.name, err)
+		overview.Prompts = []*Prompt{}
+	}
+	return overview
+}
+
+func joinContents(contents []*Content) string {
+	texts := []string{}
+	for _, content := range contents {
+		if content == nil {
+			continue
+		}
+		switch {
+		case content.Type == "text":
+			texts = append(texts, content.Text)
+		case content.Resource != nil:
+			texts = append(texts, content.Resource.Text)
+		default:
+			texts = append(texts, fmt.Sprintf("[%s content]", content.Type))
+		}
+	}
+	return strings.Join(texts, "\n\n")
+}
@@ -0,0 +1,170 @@
+package mcp
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sedwards2009/llm-multitool/internal/template"
+	"testing"
+	"time"
+)
+
+// The test binary doubles as a fake MCP server when this is set.
+const FAKE_SERVER_VARIABLE = "MCP_FAKE_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(FAKE_SERVER_VARIABLE) == "1" {
+		runFakeServer()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runFakeServer() {
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		request := struct {
+			ID     *int64         `json:"id"`
+			Method string         `json:"method"`
+			Params map[string]any `json:"params"`
+		}{}
+		json.Unmarshal(scanner.Bytes(), &request)
+		if request.ID == nil {
+			continue
+		}
+
+		var result any
+		switch request.Method {
+		case "initialize":
+			result = map[string]any{
+				"protocolVersion": PROTOCOL_VERSION,
+				"capabilities":    map[string]any{"tools": map[string]any{}, "resources": map[string]any{}, "prompts": map[string]any{}},
+				"serverInfo":      map[string]any{"name": "fake", "version": "1"},
+			}
+		case "tools/list":
+			result = map[string]any{"tools": []any{
+				map[string]any{"name": "echo", "description": "Echo the text",
+					"inputSchema": map[string]any{"type": "object"}},
+			}}
+		case "tools/call":
+			arguments := request.Params["arguments"].(map[string]any)
+			text, _ := arguments["text"].(string)
+			if text == "exit" {
+				os.Exit(0)
+			}
+			result = map[string]any{
+				"content": []any{map[string]any{"type": "text", "text": text}},
+				"isError": text == "",
+			}
+		case "resources/list":
+			result = map[string]any{"resources": []any{
+				map[string]any{"uri": "memo://one", "name": "One"},
+			}}
+		case "resources/read":
+			result = map[string]any{"contents": []any{
+				map[string]any{"uri": request.Params["uri"], "text": "contents of " + request.Params["uri"].(string)},
+			}}
+		case "prompts/list":
+			result = map[string]any{"prompts": []any{
+				map[string]any{"name": "summarize", "arguments": []any{map[string]any{"name": "text"}}},
+			}}
+		case "prompts/get":
+			arguments := request.Params["arguments"].(map[string]any)
+			result = map[string]any{"messages": []any{
+				map[string]any{"role": "user",
+					"content": map[string]any{"type": "text", "text": "Summarize: " + arguments["text"].(string)}},
+			}}
+		}
+		encoder.Encode(map[string]any{"jsonrpc": "2.0", "id": *request.ID, "result": result})
+	}
+}
+
+func startFakeServer(t *testing.T) *Client {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Start(&ServerConfig{
+		Name:    "fake",
+		Command: []string{executable},
+		Env:     map[string]string{FAKE_SERVER_VARIABLE: "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func TestTools(t *testing.T) {
+	client := startFakeServer(t)
+
+	serverTools, err := client.ListTools()
+	if err != nil || len(serverTools) != 1 || serverTools[0].Name != "echo" {
+		t.Fatalf("Expected the echo tool, got %v (%v)", serverTools, err)
+	}
+
+	text, err := client.CallTool("echo", map[string]any{"text": "hello"})
+	if err != nil || text != "hello" {
+		t.Errorf("Expected hello, got %s (%v)", text, err)
+	}
+	if _, err := client.CallTool("echo", map[string]any{}); err == nil {
+		t.Errorf("Expected a tool result flagged as an error to be an error")
+	}
+}
+
+func TestResources(t *testing.T) {
+	client := startFakeServer(t)
+
+	resources, err := client.ListResources()
+	if err != nil || len(resources) != 1 || resources[0].URI != "memo://one" {
+		t.Fatalf("Expected one resource, got %v (%v)", resources, err)
+	}
+
+	text, err := client.ReadResource("memo://one")
+	if err != nil || text != "contents of memo://one" {
+		t.Errorf("Unexpected resource contents %s (%v)", text, err)
+	}
+}
+
+func TestPromptToTemplate(t *testing.T) {
+	client := startFakeServer(t)
+
+	newTemplate, err := client.PromptToTemplate("summarize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newTemplate.Name != "fake: summarize" {
+		t.Errorf("Unexpected template name %s", newTemplate.Name)
+	}
+	if newTemplate.TemplateString != "Summarize: "+template.PROMPT_PARAM {
+		t.Errorf("Unexpected template string %s", newTemplate.TemplateString)
+	}
+
+	if _, err := client.PromptToTemplate("missing"); err == nil {
+		t.Errorf("Expected an unknown prompt to be an error")
+	}
+}
+
+func TestServerStops(t *testing.T) {
+	client := startFakeServer(t)
+	if client.Overview() == nil || len(client.Overview().Tools) != 1 {
+		t.Fatalf("Expected the overview to be read at start, got %v", client.Overview())
+	}
+
+	if _, err := client.CallTool("echo", map[string]any{"text": "exit"}); err == nil {
+		t.Fatalf("Expected a call to a server which stops to be an error")
+	}
+	select {
+	case <-client.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the client to notice that the server stopped")
+	}
+	if client.IsRunning() {
+		t.Errorf("Expected a stopped server not to be running")
+	}
+	if _, err := client.ListTools(); err == nil {
+		t.Errorf("Expected requests to a stopped server to fail")
+	}
+}
@@ -0,0 +1,58 @@
+package mcp
+
+import (
+	"fmt"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/template"
+	"strings"
+)
+
+// PromptToTemplate turns a prompt of the server into a template. The first
+// argument of the prompt becomes the template's prompt parameter. Other
+// arguments are left empty. If the prompt has no arguments then the user's
+// prompt is put after its text.
+func (this *Client) PromptToTemplate(name string) (*data.Template, error) {
+	prompts, err := this.ListPrompts()
+	if err != nil {
+		return nil, err
+	}
+	var prompt *Prompt
+	for _, candidate := range prompts {
+		if candidate.Name == name {
+			prompt = candidate
+			break
+		}
+	}
+	if prompt == nil {
+		return nil, fmt.Errorf("MCP server '%s' has no prompt named '%s'", this.name, name)
+	}
+
+	arguments := map[string]string{}
+	for i, argument := range prompt.Arguments {
+		if i == 0 {
+			arguments[argument.Name] = template.PROMPT_PARAM
+		} else {
+			arguments[argument.Name] = ""
+		}
+	}
+	messages, err := this.GetPrompt(name, arguments)
+	if err != nil {
+		return nil, err
+	}
+
+	texts := []string{}
+	for _, message := range messages {
+		if message.Content != nil && message.Content.Type == "text" {
+			texts = append(texts, message.Content.Text)
+		}
+	}
+	templateString := strings.Join(texts, "\n\n")
+	if !strings.Contains(templateString, template.PROMPT_PARAM) {
+		templateString = strings.TrimSpace(templateString + "\n\n" + template.PROMPT_PARAM)
+	}
+
+	return &data.Template{
+		Name:           this.name + ": " + prompt.Name,
+		TemplateString: templateString,
+	}, nil
+}
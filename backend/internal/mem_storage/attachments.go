@@ -0,0 +1,222 @@
+package mem_storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/extract"
+	"strings"
+)
+
+// ATTACHED_FILE_PATTERN matches the names of attached files: the SHA-256 of
+// their contents, or `<session ID>_<UUID>` as they were named before, plus an
+// extension. Nothing else in the storage directory is ever removed as an
+// orphan.
+var ATTACHED_FILE_PATTERN = regexp.MustCompile(
+	`^([0-9a-f]{64}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}_[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})(\.[^.]*)?$`)
+
+var EXTENSION_PATTERN = regexp.MustCompile(`^\.[a-z0-9]{1,10}$`)
+
+// TEMP_FILE_PREFIX starts the names of files which are still being written.
+const TEMP_FILE_PREFIX = ".upload-"
+
+func isAttachedFileName(filename string) bool {
+	return ATTACHED_FILE_PATTERN.MatchString(filename)
+}
+
+// StoreAttachedFile writes the contents of an attached file and returns its
+// name, which is made from the SHA-256 of the contents and the extension of
+// `filenameHint`. Identical files are only stored once. The file is kept
+// until a session has referred to it and then stopped, or until the upload
+// is given up with ReleasePendingFile.
+func (this *SimpleStorage) StoreAttachedFile(content []byte, filenameHint string) (string, error) {
+	sum := sha256.Sum256(content)
+	extension := strings.ToLower(filepath.Ext(filenameHint))
+	if !EXTENSION_PATTERN.MatchString(extension) {
+		extension = ""
+	}
+	filename := hex.EncodeToString(sum[:]) + extension
+
+	// The file is written under a temporary name so that a half written file
+	// is never mistaken for a complete one.
+	tempFile, err := os.CreateTemp(this.storagePath, TEMP_FILE_PREFIX+"*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tempFile.Write(content)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	path := filepath.Join(this.storagePath, filename)
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(tempFile.Name())
+	} else if err := os.Rename(tempFile.Name(), path); err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	// Until the session which uploaded it refers to it, the file must not be
+	// removed when another session stops using the same contents.
+	this.pendingFiles[filename]++
+	return filename, nil
+}
+
+// ReleasePendingFile gives up an upload which won't be referred to by a
+// session after all, such as when a later check of the request fails. The
+// file is removed unless it is in use elsewhere.
+func (this *SimpleStorage) ReleasePendingFile(filename string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.pendingFiles[filename] == 0 {
+		return
+	}
+	this.consumePendingFile(filename)
+	if this.pendingFiles[filename] == 0 && this.fileReferences[filename] == 0 {
+		this.removeAttachedFile(filename)
+	}
+}
+
+func (this *SimpleStorage) consumePendingFile(filename string) {
+	if this.pendingFiles[filename] <= 1 {
+		delete(this.pendingFiles, filename)
+		return
+	}
+	this.pendingFiles[filename]--
+}
+
+// attachedFileCounts returns the names of the files which a session refers
+// to, with how many times it refers to each.
+func attachedFileCounts(session *data.Session) map[string]int {
+	result := map[string]int{}
+	if session == nil {
+		return result
+	}
+	for _, filename := range session.GetAttachedFileNames() {
+		result[filename]++
+	}
+	return result
+}
+
+// updateFileReferences counts the references of a session which is being
+// replaced by a new version, and removes the files which no session refers
+// to any more. `previousSession` is nil for a new session.
+func (this *SimpleStorage) updateFileReferences(previousSession *data.Session, newSession *data.Session) {
+	previousFilenames := attachedFileCounts(previousSession)
+	currentFilenames := attachedFileCounts(newSession)
+	for filename, count := range currentFilenames {
+		if previousFilenames[filename] == 0 {
+			this.fileReferences[filename]++
+		}
+		// Each new mention of a file takes up one of its pending uploads.
+		for i := previousFilenames[filename]; i < count && this.pendingFiles[filename] > 0; i++ {
+			this.consumePendingFile(filename)
+		}
+	}
+	for filename := range previousFilenames {
+		if currentFilenames[filename] == 0 {
+			this.releaseAttachedFile(filename)
+		}
+	}
+}
+
+func (this *SimpleStorage) releaseAttachedFile(filename string) {
+	this.fileReferences[filename]--
+	if this.fileReferences[filename] > 0 {
+		return
+	}
+	delete(this.fileReferences, filename)
+	if this.pendingFiles[filename] == 0 {
+		this.removeAttachedFile(filename)
+	}
+}
+
+// removeAttachedFile deletes an attached file and the text extracted from it.
+func (this *SimpleStorage) removeAttachedFile(filename string) {
+	path := filepath.Join(this.storagePath, filename)
+	os.Remove(path)
+	os.Remove(extract.CachePath(path))
+}
+
+// RemoveOrphanedFiles deletes the attached files which no session refers
+// to, such as those left behind when the program stopped before a session
+// was written. It must be called before any new files are uploaded, and only
+// by the server which owns the storage directory.
+func (this *SimpleStorage) RemoveOrphanedFiles() {
+	entries, err := os.ReadDir(this.storagePath)
+	if err != nil {
+		log.Printf("Unable to look for orphaned files: %v", err)
+		return
+	}
+
+	count := 0
+	size := int64(0)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		filename := entry.Name()
+		attachedFilename := strings.TrimSuffix(filename, extract.CACHE_SUFFIX)
+		isTempFile := strings.HasPrefix(filename, TEMP_FILE_PREFIX)
+		if !isTempFile && (!isAttachedFileName(attachedFilename) || this.fileReferences[attachedFilename] > 0) {
+			continue
+		}
+
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		if err := os.Remove(filepath.Join(this.storagePath, filename)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Unable to remove orphaned file %s: %v", filename, err)
+			continue
+		}
+		count++
+	}
+	if count != 0 {
+		log.Printf("Removed %d orphaned attached files (%d bytes).", count, size)
+	}
+}
+
+// Stats reports how much space the sessions and their attached files use.
+func (this *SimpleStorage) Stats() *data.StorageStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	stats := &data.StorageStats{SessionCount: len(this.sessions)}
+	for id := range this.sessions {
+		stats.SessionBytes += fileSize(this.sessionFilepath(id))
+	}
+	for filename, references := range this.fileReferences {
+		path := filepath.Join(this.storagePath, filename)
+		size := fileSize(path)
+		stats.AttachedFileCount++
+		stats.AttachedFileReferences += references
+		stats.AttachedFileBytes += size
+		stats.DeduplicatedBytes += size * int64(references-1)
+		stats.ExtractedTextBytes += fileSize(extract.CachePath(path))
+	}
+	stats.TotalBytes = stats.SessionBytes + stats.AttachedFileBytes + stats.ExtractedTextBytes
+	return stats
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Unable to read the size of %s: %v", path, err)
+		}
+		return 0
+	}
+	return info.Size()
+}
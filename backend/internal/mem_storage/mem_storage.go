@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/metrics"
 	"sort"
 	"strings"
 	"sync"
@@ -24,15 +25,23 @@ type SimpleStorage struct {
 	sessions    map[string]*data.Session
 	lock        sync.Mutex
 	writeChan   chan writeMessage
+
+	// fileReferences counts the sessions which refer to each attached file.
+	fileReferences map[string]int
+	// pendingFiles counts the uploads of each file which have been stored
+	// but not yet referred to by a session or released.
+	pendingFiles map[string]int
 }
 
 const WRITE_BACK_QUEUE_LENGTH = 128
 
 func New(storagePath string) *SimpleStorage {
 	instance := &SimpleStorage{
-		storagePath: storagePath,
-		sessions:    make(map[string]*data.Session, 16),
-		writeChan:   make(chan writeMessage, WRITE_BACK_QUEUE_LENGTH),
+		storagePath:    storagePath,
+		sessions:       make(map[string]*data.Session, 16),
+		writeChan:      make(chan writeMessage, WRITE_BACK_QUEUE_LENGTH),
+		fileReferences: map[string]int{},
+		pendingFiles:   map[string]int{},
 	}
 	instance.scan()
 	go instance.writer(instance.writeChan)
@@ -51,11 +60,13 @@ func (this *SimpleStorage) scan() {
 
 	for _, entry := range entries {
 		if entry.Type().IsRegular() {
-			if strings.HasSuffix(entry.Name(), ".json") {
+			// Attached JSON files are not sessions.
+			if strings.HasSuffix(entry.Name(), ".json") && !isAttachedFileName(entry.Name()) {
 				jsonPath := filepath.Join(this.storagePath, entry.Name())
 				newSession := this.readSessionFromFile(jsonPath)
 				if newSession != nil {
 					this.cacheSession(newSession)
+					this.updateFileReferences(nil, newSession)
 				}
 			}
 		}
@@ -105,26 +116,13 @@ func (this *SimpleStorage) DeleteSession(id string) {
 
 	delete(this.sessions, id)
 	os.Remove(this.sessionFilepath(id))
-
-	for _, attachedFile := range session.AttachedFiles {
-		os.Remove(filepath.Join(this.storagePath, attachedFile.Filename))
-	}
+	this.updateFileReferences(session, nil)
 }
 
 func (this *SimpleStorage) sessionFilepath(sessionId string) string {
 	return filepath.Join(this.storagePath, sessionId+".json")
 }
 
-func (this *SimpleStorage) SessionMakeAttachedFileFilepath(sessionId string, originalFilename string) (string, string) {
-	extension := ""
-	if originalFilename != "" {
-		extension = filepath.Ext(originalFilename)
-	}
-
-	filename := sessionId + "_" + uuid.NewString() + extension
-	return filename, filepath.Join(this.storagePath, filename)
-}
-
 func (this *SimpleStorage) sessionSummary(session *data.Session) *data.SessionSummary {
 	newSummary := &data.SessionSummary{
 		ID:                session.ID,
@@ -135,6 +133,19 @@ func (this *SimpleStorage) sessionSummary(session *data.Session) *data.SessionSu
 }
 
 func (this *SimpleStorage) SessionOverview() *data.SessionOverview {
+	return this.sessionOverview(func(session *data.Session) bool {
+		return true
+	})
+}
+
+// SessionOverviewForOwner lists only the sessions belonging to one user.
+func (this *SimpleStorage) SessionOverviewForOwner(owner string) *data.SessionOverview {
+	return this.sessionOverview(func(session *data.Session) bool {
+		return session.Owner == owner
+	})
+}
+
+func (this *SimpleStorage) sessionOverview(filter func(*data.Session) bool) *data.SessionOverview {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
@@ -142,6 +153,9 @@ func (this *SimpleStorage) SessionOverview() *data.SessionOverview {
 	sessionOverview.SessionSummaries = make([]*data.SessionSummary, 0)
 
 	for s := range this.sessions {
+		if !filter(this.sessions[s]) {
+			continue
+		}
 		sessionSummary := this.sessionSummary(this.sessions[s])
 		sessionOverview.SessionSummaries = append(sessionOverview.SessionSummaries, sessionSummary)
 	}
@@ -160,8 +174,10 @@ func copySession(srcSession *data.Session) *data.Session {
 
 	copy := &data.Session{
 		ID:                srcSession.ID,
+		Owner:             srcSession.Owner,
 		CreationTimestamp: srcSession.CreationTimestamp,
 		Title:             srcSession.Title,
+		TitleIsGenerated:  srcSession.TitleIsGenerated,
 		Prompt:            srcSession.Prompt,
 		Responses:         copyResponses(srcSession.Responses),
 		ModelSettings:     copyModelSettings(srcSession.ModelSettings),
@@ -185,7 +201,68 @@ func copyResponse(srcResponse *data.Response) *data.Response {
 		Status:                srcResponse.Status,
 		Messages:              copyMessages(srcResponse.Messages),
 		ModelSettingsSnapshot: copyModelSettingsSnapshot(srcResponse.ModelSettingsSnapshot),
+		Usage:                 copyUsage(srcResponse.Usage),
+		Timing:                copyTiming(srcResponse.Timing),
+		ContextReduction:      copyContextReduction(srcResponse.ContextReduction),
+		Error:                 copyResponseError(srcResponse.Error),
+		Citations:             copyCitations(srcResponse.Citations),
+	}
+}
+
+func copyCitations(citations []*data.Citation) []*data.Citation {
+	if citations == nil {
+		return nil
+	}
+	result := []*data.Citation{}
+	for _, citation := range citations {
+		citationCopy := *citation
+		result = append(result, &citationCopy)
+	}
+	return result
+}
+
+func copyResponseError(responseError *data.ResponseError) *data.ResponseError {
+	if responseError == nil {
+		return nil
+	}
+	errorCopy := *responseError
+	return &errorCopy
+}
+
+func copyContextReduction(reduction *data.ContextReduction) *data.ContextReduction {
+	if reduction == nil {
+		return nil
+	}
+	reductionCopy := *reduction
+	return &reductionCopy
+}
+
+func copyTiming(timing *data.Timing) *data.Timing {
+	if timing == nil {
+		return nil
+	}
+	timingCopy := *timing
+	if timing.LoadDurationMs != nil {
+		loadDurationMs := *timing.LoadDurationMs
+		timingCopy.LoadDurationMs = &loadDurationMs
+	}
+	if timing.EvalDurationMs != nil {
+		evalDurationMs := *timing.EvalDurationMs
+		timingCopy.EvalDurationMs = &evalDurationMs
 	}
+	return &timingCopy
+}
+
+func copyUsage(usage *data.Usage) *data.Usage {
+	if usage == nil {
+		return nil
+	}
+	usageCopy := *usage
+	if usage.Cost != nil {
+		cost := *usage.Cost
+		usageCopy.Cost = &cost
+	}
+	return &usageCopy
 }
 
 func copyMessages(srcMessages []data.Message) []data.Message {
@@ -198,9 +275,10 @@ func copyMessages(srcMessages []data.Message) []data.Message {
 
 func copyModelSettings(settings *data.ModelSettings) *data.ModelSettings {
 	return &data.ModelSettings{
-		ModelID:    settings.ModelID,
-		PresetID:   settings.PresetID,
-		TemplateID: settings.TemplateID,
+		ModelID:             settings.ModelID,
+		PresetID:            settings.PresetID,
+		TemplateID:          settings.TemplateID,
+		KnowledgeCollection: settings.KnowledgeCollection,
 	}
 }
 
@@ -210,13 +288,16 @@ func copyModelSettingsSnapshot(snapshot *data.ModelSettingsSnapshot) *data.Model
 	}
 	return &data.ModelSettingsSnapshot{
 		ModelSettings: data.ModelSettings{
-			ModelID:    snapshot.ModelSettings.ModelID,
-			PresetID:   snapshot.PresetID,
-			TemplateID: snapshot.TemplateID,
+			ModelID:             snapshot.ModelSettings.ModelID,
+			PresetID:            snapshot.PresetID,
+			TemplateID:          snapshot.TemplateID,
+			KnowledgeCollection: snapshot.KnowledgeCollection,
 		},
-		ModelName:    snapshot.ModelName,
-		PresetName:   snapshot.PresetName,
-		TemplateName: snapshot.TemplateName,
+		ModelName:       snapshot.ModelName,
+		PresetName:      snapshot.PresetName,
+		TemplateName:    snapshot.TemplateName,
+		ActualModelID:   snapshot.ActualModelID,
+		ActualModelName: snapshot.ActualModelName,
 	}
 }
 
@@ -249,10 +330,7 @@ func (this *SimpleStorage) WriteSession(session *data.Session) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
-	storedSession := this.sessions[session.ID]
-	if storedSession != nil {
-		this.garbageCollectFiles(storedSession, session)
-	}
+	this.updateFileReferences(this.sessions[session.ID], session)
 
 	sessionCopy := copySession(session)
 	this.cacheSession(sessionCopy)
@@ -260,14 +338,16 @@ func (this *SimpleStorage) WriteSession(session *data.Session) {
 	this.writeChan <- writeMessage{session: sessionCopy}
 }
 
-func (this *SimpleStorage) garbageCollectFiles(previousSession *data.Session, newSesion *data.Session) {
-	previousFilenames := previousSession.GetAttachedFileNames()
-	currentFilenames := newSesion.GetAttachedFileNames()
-	sort.Strings(currentFilenames)
-	for _, filename := range previousFilenames {
-		isFound := sort.SearchStrings(currentFilenames, filename) < len(currentFilenames)
-		if !isFound {
-			os.Remove(filepath.Join(this.GetStoragePath(), filename))
+// ClaimUnownedSessions gives sessions which don't have an owner, such as
+// those created before authentication was enabled, to `owner`.
+func (this *SimpleStorage) ClaimUnownedSessions(owner string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, session := range this.sessions {
+		if session.Owner == "" {
+			session.Owner = owner
+			this.writeChan <- writeMessage{session: copySession(session)}
 		}
 	}
 }
@@ -302,6 +382,7 @@ func (this *SimpleStorage) writer(workChan chan writeMessage) {
 		} else {
 			workPool[session.ID] = SessionDeadline{deadline: time.Now().Add(WRITE_BACK_DELAY), session: session}
 		}
+		metrics.StoragePendingWrites.Set(float64(len(workPool)))
 	}
 
 	running := true
@@ -344,6 +425,7 @@ func (this *SimpleStorage) writer(workChan chan writeMessage) {
 					log.Printf("Writing %s back to disk.\n", deadlineSession.session.ID)
 					this.writeToDisk(deadlineSession.session)
 					delete(workPool, deadlineSession.session.ID)
+					metrics.StoragePendingWrites.Set(float64(len(workPool)))
 					break
 				}
 			}
@@ -354,10 +436,16 @@ func (this *SimpleStorage) writer(workChan chan writeMessage) {
 		log.Printf("Writing %s back to disk.\n", deadlineSession.session.ID)
 		this.writeToDisk(deadlineSession.session)
 	}
+	metrics.StoragePendingWrites.Set(0)
 	stopChan <- true
 }
 
 func (this *SimpleStorage) writeToDisk(session *data.Session) {
+	startTime := time.Now()
+	defer func() {
+		metrics.StorageWriteBackDuration.Observe(time.Since(startTime).Seconds())
+	}()
+
 	jsonData, err := json.Marshal(session)
 	if err != nil {
 		log.Fatalf("Couldn't marshal Session object: %v", err)
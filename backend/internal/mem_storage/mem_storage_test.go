@@ -2,6 +2,7 @@ package mem_storage
 
 import (
 	"os"
+	"path/filepath"
 	"sedwards2009/llm-multitool/internal/data"
 	"testing"
 )
@@ -78,8 +79,10 @@ func TestFileUpload(t *testing.T) {
 	storage = New(tempDir)
 	session2 := storage.ReadSession(sessionID)
 
-	filename, filepath := storage.SessionMakeAttachedFileFilepath(sessionID, "empty.txt")
-	os.WriteFile(filepath, []byte("Some text"), 0666)
+	filename, err := storage.StoreAttachedFile([]byte("Some text"), "empty.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
 	session2.AttachedFiles = append(session2.AttachedFiles,
 		&data.AttachedFile{Filename: filename, MimeType: "text/plain", OriginalFilename: "empty.txt"})
 
@@ -97,6 +100,110 @@ func TestFileUpload(t *testing.T) {
 	expectCountFiles(t, tempDir, 1)
 }
 
+func TestMessageFilesKept(t *testing.T) {
+	tempDir := t.TempDir()
+	storage := New(tempDir)
+	session := storage.NewSession()
+
+	filename, _ := storage.StoreAttachedFile([]byte("PNG"), "screenshot.png")
+	path := filepath.Join(tempDir, filename)
+	attachedFile := &data.AttachedFile{Filename: filename, MimeType: "image/png"}
+	session.AttachedFiles = []*data.AttachedFile{attachedFile}
+	session.Responses = []*data.Response{{ID: "r1", Messages: []data.Message{
+		{ID: "m1", Text: "First"},
+		{ID: "m2", Text: "Look at this", AttachedFiles: []*data.AttachedFile{attachedFile}},
+	}}}
+	storage.WriteSession(session)
+
+	// The message still refers to the file.
+	session.AttachedFiles = []*data.AttachedFile{}
+	storage.WriteSession(session)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected a file attached to a message to be kept, %v", err)
+	}
+
+	session.Responses[0].Messages = session.Responses[0].Messages[:1]
+	storage.WriteSession(session)
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected the file to be removed once nothing refers to it")
+	}
+	storage.Stop()
+}
+
+func TestDeduplication(t *testing.T) {
+	tempDir := t.TempDir()
+	storage := New(tempDir)
+
+	filename, _ := storage.StoreAttachedFile([]byte("Same bytes"), "first.TXT")
+	filename2, _ := storage.StoreAttachedFile([]byte("Same bytes"), "second.txt")
+	if filename != filename2 || filepath.Ext(filename) != ".txt" {
+		t.Fatalf("Expected identical files to share a name, got %s and %s", filename, filename2)
+	}
+	path := filepath.Join(tempDir, filename)
+
+	session := storage.NewSession()
+	session.AttachedFiles = []*data.AttachedFile{{Filename: filename, MimeType: "text/plain"}}
+	storage.WriteSession(session)
+	// The second session only refers to the file from a message.
+	session2 := storage.NewSession()
+	session2.Responses = []*data.Response{{ID: "r1", Messages: []data.Message{
+		{ID: "m1", AttachedFiles: []*data.AttachedFile{{Filename: filename, MimeType: "text/plain"}}},
+	}}}
+	storage.WriteSession(session2)
+
+	stats := storage.Stats()
+	if stats.AttachedFileCount != 1 || stats.AttachedFileReferences != 2 || stats.AttachedFileBytes != 10 ||
+		stats.DeduplicatedBytes != 10 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	storage.DeleteSession(session.ID)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the file to be kept while another session uses it, %v", err)
+	}
+	storage.DeleteSession(session2.ID)
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected the file to be removed with the last session using it")
+	}
+	storage.Stop()
+}
+
+func TestOrphanedFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	storage := New(tempDir)
+	session := storage.NewSession()
+	kept, _ := storage.StoreAttachedFile([]byte("kept"), "kept.txt")
+	session.AttachedFiles = []*data.AttachedFile{{Filename: kept, MimeType: "text/plain"}}
+	storage.WriteSession(session)
+	// This file is never referred to, as if the program stopped early.
+	orphan, _ := storage.StoreAttachedFile([]byte("orphan"), "orphan.txt")
+	storage.Stop()
+
+	os.WriteFile(filepath.Join(tempDir, kept+".extracted.txt"), []byte("kept"), 0666)
+	os.WriteFile(filepath.Join(tempDir, orphan+".extracted.txt"), []byte("orphan"), 0666)
+	os.WriteFile(filepath.Join(tempDir, "templates.yaml"), []byte("[]"), 0666)
+	os.Mkdir(filepath.Join(tempDir, "knowledge"), 0777)
+
+	New(tempDir).Stop()
+	if _, err := os.Stat(filepath.Join(tempDir, orphan)); err != nil {
+		t.Errorf("Expected orphaned files to be kept until they are asked to be removed")
+	}
+
+	storage = New(tempDir)
+	storage.RemoveOrphanedFiles()
+	storage.Stop()
+	for _, filename := range []string{kept, kept + ".extracted.txt", "templates.yaml", "knowledge"} {
+		if _, err := os.Stat(filepath.Join(tempDir, filename)); err != nil {
+			t.Errorf("Expected %s to be kept, %v", filename, err)
+		}
+	}
+	for _, filename := range []string{orphan, orphan + ".extracted.txt"} {
+		if _, err := os.Stat(filepath.Join(tempDir, filename)); err == nil {
+			t.Errorf("Expected the orphaned file %s to be removed", filename)
+		}
+	}
+}
+
 func expectCountFiles(t *testing.T, dirpath string, expected int) {
 	found := countFiles(t, dirpath)
 	if found != expected {
@@ -112,3 +219,56 @@ func countFiles(t *testing.T, dirpath string) int {
 	}
 	return len(entries)
 }
+
+func TestPendingUploadsOfSameFile(t *testing.T) {
+	tempDir := t.TempDir()
+	storage := New(tempDir)
+
+	// Two sessions upload the same bytes before either is written.
+	filename, _ := storage.StoreAttachedFile([]byte("Same bytes"), "a.txt")
+	storage.StoreAttachedFile([]byte("Same bytes"), "b.txt")
+	path := filepath.Join(tempDir, filename)
+
+	session := storage.NewSession()
+	session.AttachedFiles = []*data.AttachedFile{{Filename: filename, MimeType: "text/plain"}}
+	storage.WriteSession(session)
+	session.AttachedFiles = []*data.AttachedFile{}
+	storage.WriteSession(session)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the file to be kept for the second upload, %v", err)
+	}
+
+	session2 := storage.NewSession()
+	session2.AttachedFiles = []*data.AttachedFile{{Filename: filename, MimeType: "text/plain"}}
+	storage.WriteSession(session2)
+	storage.DeleteSession(session2.ID)
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("Expected the file to be removed with the last session using it")
+	}
+	storage.Stop()
+}
+
+func TestReleasePendingFile(t *testing.T) {
+	tempDir := t.TempDir()
+	storage := New(tempDir)
+
+	filename, _ := storage.StoreAttachedFile([]byte("PNG"), "screenshot.png")
+	path := filepath.Join(tempDir, filename)
+	session := storage.NewSession()
+	session.AttachedFiles = []*data.AttachedFile{{Filename: filename, MimeType: "image/png"}}
+	storage.WriteSession(session)
+
+	// A failed upload of the same bytes leaves the file for the session.
+	storage.StoreAttachedFile([]byte("PNG"), "again.png")
+	storage.ReleasePendingFile(filename)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the file in use by a session to be kept, %v", err)
+	}
+
+	unusedFilename, _ := storage.StoreAttachedFile([]byte("Unused"), "unused.txt")
+	storage.ReleasePendingFile(unusedFilename)
+	if _, err := os.Stat(filepath.Join(tempDir, unusedFilename)); err == nil {
+		t.Errorf("Expected a released upload to be removed")
+	}
+	storage.Stop()
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const NAMESPACE = "llm_multitool"
+
+var QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: NAMESPACE,
+	Name:      "engine_queue_depth",
+	Help:      "Number of requests waiting in the engine's work queue.",
+})
+
+var RunningRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: NAMESPACE,
+	Name:      "engine_running_requests",
+	Help:      "Number of requests currently being processed per backend.",
+}, []string{"backend"})
+
+var TimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Name:      "engine_time_to_first_token_seconds",
+	Help:      "Time from the start of processing until the first token arrives.",
+	Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60},
+}, []string{"backend"})
+
+var TokensPerSecond = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Name:      "engine_tokens_per_second",
+	Help:      "Generation speed after the first token. Each streamed chunk is counted as one token.",
+	Buckets:   []float64{1, 2, 5, 10, 20, 40, 80, 160},
+}, []string{"backend"})
+
+var RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Name:      "engine_request_duration_seconds",
+	Help:      "Total time taken to process a request.",
+	Buckets:   []float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300},
+}, []string{"backend", "status"})
+
+var Errors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: NAMESPACE,
+	Name:      "engine_errors_total",
+	Help:      "Number of requests which ended in an error per backend.",
+}, []string{"backend"})
+
+var WebsocketListeners = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: NAMESPACE,
+	Name:      "broadcaster_listeners",
+	Help:      "Number of listeners registered with the session change broadcaster.",
+})
+
+var StorageWriteBackDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Name:      "storage_write_back_seconds",
+	Help:      "Time taken to write a session back to disk.",
+	Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+})
+
+var StoragePendingWrites = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: NAMESPACE,
+	Name:      "storage_pending_writes",
+	Help:      "Number of sessions waiting in the storage writer's pool to be written to disk.",
+})
@@ -1,24 +1,39 @@
 package presets
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sedwards2009/llm-multitool/internal/data"
+	"strings"
+	"sync"
 
+	"github.com/bobg/go-generics/v2/slices"
+	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
 )
 
 type PresetDatabase struct {
-	presets []*data.Preset
+	presets  []*data.Preset
+	filePath string
+	lock     sync.RWMutex
 }
 
+const MAX_TEMPERATURE = 2.0
+
+var ErrPresetNotFound = errors.New("preset not found")
+var ErrPresetExists = errors.New("a preset with this ID already exists")
+var ErrInvalidPreset = errors.New("invalid preset")
+
 func MakePresetDatabase(fileName string) (*PresetDatabase, error) {
 	fileContents, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot read presets file '%s': %w", fileName, err)
 	}
-	return MakePresentDatabaseFromBytes(fileContents, fileName)
+	this, err := MakePresentDatabaseFromBytes(fileContents, fileName)
+	this.filePath = fileName
+	return this, err
 }
 
 func MakePresentDatabaseFromBytes(yamlBytes []byte, fileName string) (*PresetDatabase, error) {
@@ -36,9 +51,55 @@ func (this *PresetDatabase) readPresentsYamlString(yamlContent []byte, fileName
 	return nil
 }
 
+// SetFilePath sets the file which changes to the presets are written to.
+// An empty path means that changes are only kept in memory.
+func (this *PresetDatabase) SetFilePath(filePath string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.filePath = filePath
+}
+
+func (this *PresetDatabase) FilePath() string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.filePath
+}
+
+// Reload rereads the presets file. The current presets are kept if the file
+// can't be read or parsed. A missing file is not an error because it may
+// not have been written yet.
+func (this *PresetDatabase) Reload() error {
+	filePath := this.FilePath()
+	if filePath == "" {
+		return nil
+	}
+
+	fileContents, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("Cannot read presets file '%s': %w", filePath, err)
+	}
+	newDatabase, err := MakePresentDatabaseFromBytes(fileContents, filePath)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.presets = newDatabase.presets
+	return nil
+}
+
 func (this *PresetDatabase) PresetOverview() *data.PresetOverview {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	presets := make([]*data.Preset, len(this.presets))
+	copy(presets, this.presets)
 	return &data.PresetOverview{
-		Presets: this.presets,
+		Presets: presets,
 	}
 }
 
@@ -47,16 +108,29 @@ func (this *PresetDatabase) Exists(presetID string) bool {
 }
 
 func (this *PresetDatabase) Get(presetID string) *data.Preset {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	preset := this.getPresetByID(presetID)
+	if preset == nil {
+		log.Printf("PresetDatabase could not find preset %s", presetID)
+	}
+	return preset
+}
+
+func (this *PresetDatabase) getPresetByID(presetID string) *data.Preset {
 	for _, preset := range this.presets {
 		if preset.ID == presetID {
 			return preset
 		}
 	}
-	log.Printf("PresetDatabase could not find preset %s", presetID)
 	return nil
 }
 
 func (this *PresetDatabase) DefaultID() string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	for _, preset := range this.presets {
 		if preset.Default {
 			return preset.ID
@@ -64,3 +138,112 @@ func (this *PresetDatabase) DefaultID() string {
 	}
 	return ""
 }
+
+// validatePreset checks that a preset has a name and usable generation parameters.
+func validatePreset(preset *data.Preset) error {
+	if strings.TrimSpace(preset.Name) == "" {
+		return errors.New("preset name must not be empty")
+	}
+	if preset.Temperature < 0 || preset.Temperature > MAX_TEMPERATURE {
+		return fmt.Errorf("temperature must be between 0 and %.1f", MAX_TEMPERATURE)
+	}
+	if preset.TopP < 0 || preset.TopP > 1 {
+		return errors.New("top_p must be between 0 and 1")
+	}
+	return nil
+}
+
+// Add adds a new preset and persists the change. A new ID is generated if
+// the preset doesn't have one.
+func (this *PresetDatabase) Add(preset *data.Preset) error {
+	if err := validatePreset(preset); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPreset, err)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if preset.ID == "" {
+		preset.ID = uuid.NewString()
+	} else if this.getPresetByID(preset.ID) != nil {
+		return ErrPresetExists
+	}
+
+	newPresets := this.withDefaultCleared(preset)
+	newPresets = append(newPresets, preset)
+	return this.commit(newPresets)
+}
+
+// Update replaces the preset having the same ID and persists the change.
+func (this *PresetDatabase) Update(preset *data.Preset) error {
+	if err := validatePreset(preset); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPreset, err)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	index := slices.IndexFunc(this.presets, func(p *data.Preset) bool {
+		return p.ID == preset.ID
+	})
+	if index == -1 {
+		return ErrPresetNotFound
+	}
+
+	newPresets := this.withDefaultCleared(preset)
+	newPresets[index] = preset
+	return this.commit(newPresets)
+}
+
+// Delete removes a preset and persists the change.
+func (this *PresetDatabase) Delete(presetID string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	newPresets := slices.Filter(this.presets, func(p *data.Preset) bool {
+		return p.ID != presetID
+	})
+	if len(newPresets) == len(this.presets) {
+		return ErrPresetNotFound
+	}
+	return this.commit(newPresets)
+}
+
+// withDefaultCleared returns a copy of the preset list. If `preset` is the
+// new default, then the default flag is removed from the others.
+func (this *PresetDatabase) withDefaultCleared(preset *data.Preset) []*data.Preset {
+	return slices.Map(this.presets, func(p *data.Preset) *data.Preset {
+		if preset.Default && p.Default && p.ID != preset.ID {
+			pCopy := *p
+			pCopy.Default = false
+			return &pCopy
+		}
+		return p
+	})
+}
+
+func (this *PresetDatabase) commit(newPresets []*data.Preset) error {
+	if this.filePath != "" {
+		if err := writeYamlFile(this.filePath, newPresets); err != nil {
+			return err
+		}
+	}
+	this.presets = newPresets
+	return nil
+}
+
+func writeYamlFile(filePath string, value any) error {
+	yamlBytes, err := yaml.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Cannot marshal presets: %w", err)
+	}
+
+	tempPath := filePath + ".tmp"
+	if err := os.WriteFile(tempPath, yamlBytes, 0644); err != nil {
+		return fmt.Errorf("Cannot write presets file '%s': %w", tempPath, err)
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return fmt.Errorf("Cannot write presets file '%s': %w", filePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package presets
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/data"
+	"strings"
+	"testing"
+)
+
+const testPresetsYaml = `
+- id: chat
+  name: Chat
+  temperature: 0.8
+  top_p: 0.9
+  default: true
+- id: precise
+  name: Precise
+  temperature: 0.1
+  top_p: 0.5
+`
+
+func TestAddUpdateDeleteRoundTrip(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "presets.yaml")
+	db, _ := MakePresentDatabaseFromBytes([]byte(testPresetsYaml), "(test)")
+	db.SetFilePath(filePath)
+
+	newPreset := &data.Preset{Name: "Creative", Temperature: 1.2, TopP: 1, Default: true}
+	if err := db.Add(newPreset); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if newPreset.ID == "" {
+		t.Errorf("Add didn't assign an ID to the new preset.")
+	}
+	if db.DefaultID() != newPreset.ID {
+		t.Errorf("Expected the new preset to become the default.")
+	}
+
+	db2, err := MakePresetDatabase(filePath)
+	if err != nil {
+		t.Fatalf("Couldn't read back presets file: %v", err)
+	}
+	if len(db2.PresetOverview().Presets) != 3 {
+		t.Errorf("Round-trip failed: Expected %d presets, got %d", 3, len(db2.PresetOverview().Presets))
+	}
+	if db2.DefaultID() != newPreset.ID || db2.Get(newPreset.ID).Temperature != 1.2 {
+		t.Errorf("Round-trip failed: Unexpected preset %+v", db2.Get(newPreset.ID))
+	}
+
+	if err := db2.Update(&data.Preset{ID: "precise", Name: "Exact", Temperature: 0, TopP: 0.1}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if db2.Get("precise").Name != "Exact" {
+		t.Errorf("Update failed: Expected '%s', got '%s'", "Exact", db2.Get("precise").Name)
+	}
+
+	if err := db2.Delete(newPreset.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	db3, _ := MakePresetDatabase(filePath)
+	if len(db3.PresetOverview().Presets) != 2 || db3.Get("precise").Name != "Exact" {
+		t.Errorf("Expected 2 presets after delete, got %d", len(db3.PresetOverview().Presets))
+	}
+}
+
+func TestInvalidPresets(t *testing.T) {
+	db, _ := MakePresentDatabaseFromBytes([]byte(testPresetsYaml), "(test)")
+
+	invalidPresets := []*data.Preset{
+		{Name: " ", Temperature: 0.5, TopP: 0.5},
+		{Name: "Hot", Temperature: MAX_TEMPERATURE + 0.1, TopP: 0.5},
+		{Name: "Cold", Temperature: -0.1, TopP: 0.5},
+		{Name: "Wide", Temperature: 0.5, TopP: 1.1},
+	}
+	for _, preset := range invalidPresets {
+		if err := db.Add(preset); !errors.Is(err, ErrInvalidPreset) {
+			t.Errorf("Expected preset %+v to be rejected, got %v", preset, err)
+		}
+	}
+	if err := db.Update(&data.Preset{ID: "chat", Name: "", TopP: 0.5}); !errors.Is(err, ErrInvalidPreset) {
+		t.Errorf("Expected an update without a name to be rejected, got %v", err)
+	}
+	if len(db.PresetOverview().Presets) != 2 || db.Get("chat").Name != "Chat" {
+		t.Errorf("Expected invalid presets to leave the database unchanged.")
+	}
+
+	if err := db.Add(&data.Preset{ID: "chat", Name: "Dup"}); err != ErrPresetExists {
+		t.Errorf("Expected ErrPresetExists, got %v", err)
+	}
+	if err := db.Update(&data.Preset{ID: "missing", Name: "Missing"}); err != ErrPresetNotFound {
+		t.Errorf("Expected ErrPresetNotFound, got %v", err)
+	}
+	if err := db.Delete("missing"); err != ErrPresetNotFound {
+		t.Errorf("Expected ErrPresetNotFound, got %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "presets.yaml")
+	os.WriteFile(filePath, []byte(testPresetsYaml), 0644)
+	db, err := MakePresetDatabase(filePath)
+	if err != nil {
+		t.Fatalf("MakePresetDatabase failed: %v", err)
+	}
+
+	os.WriteFile(filePath, []byte("- id: only\n  name: Only\n"), 0644)
+	if err := db.Reload(); err != nil || len(db.PresetOverview().Presets) != 1 {
+		t.Errorf("Expected the reloaded file to have 1 preset (%v)", err)
+	}
+
+	os.WriteFile(filePath, []byte("not: [valid"), 0644)
+	if err := db.Reload(); err == nil || db.Get("only") == nil {
+		t.Errorf("Expected a broken file to keep the current presets.")
+	}
+}
+
+func TestPresetJsonNames(t *testing.T) {
+	// The field names are part of the existing API.
+	jsonBytes, _ := json.Marshal(&data.Preset{ID: "chat", Name: "Chat", Temperature: 0.5, TopP: 0.5, Default: true})
+	for _, name := range []string{`"id"`, `"name"`, `"Temperature"`, `"TopP"`, `"Default"`} {
+		if !strings.Contains(string(jsonBytes), name) {
+			t.Errorf("Expected %s in %s", name, jsonBytes)
+		}
+	}
+}
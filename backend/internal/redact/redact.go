@@ -0,0 +1,60 @@
+package redact
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+const REPLACEMENT = "[REDACTED]"
+
+// Secrets shorter than this are not redacted because replacing them would
+// mangle ordinary text.
+const MIN_SECRET_LENGTH = 4
+
+var secrets = []string{}
+var lock sync.RWMutex
+
+// AddSecret registers a value which must not appear in logs.
+func AddSecret(secret string) {
+	if len(secret) < MIN_SECRET_LENGTH {
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// String replaces all registered secrets in a string.
+func String(text string) string {
+	lock.RLock()
+	defer lock.RUnlock()
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, REPLACEMENT)
+	}
+	return text
+}
+
+type redactingWriter struct {
+	out io.Writer
+}
+
+// NewWriter returns a writer which redacts registered secrets before
+// passing the text on. It is meant for log output where each Write() is a
+// complete line.
+func NewWriter(out io.Writer) io.Writer {
+	return &redactingWriter{out: out}
+}
+
+func (this *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := this.out.Write([]byte(String(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -1,29 +1,41 @@
 package template
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/jsonschema"
 	"strings"
+	"sync"
 
 	"github.com/bobg/go-generics/v2/slices"
+	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
 )
 
 type TemplateDatabase struct {
 	templates []*data.Template
+	filePath  string
+	lock      sync.RWMutex
 }
 
 const PROMPT_PARAM = "{{prompt}}"
 
 const TITLE_LENGTH = 40
 
+var ErrTemplateNotFound = errors.New("template not found")
+var ErrTemplateExists = errors.New("a template with this ID already exists")
+var ErrInvalidTemplate = errors.New("invalid template")
+
 func MakeTemplateDatabase(fileName string) (*TemplateDatabase, error) {
 	fileContents, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot read templates file '%s': %w", fileName, err)
 	}
-	return MakeTemplateDatabaseFromBytes(fileContents, fileName)
+	this, err := MakeTemplateDatabaseFromBytes(fileContents, fileName)
+	this.filePath = fileName
+	return this, err
 }
 
 func MakeTemplateDatabaseFromBytes(yamlBytes []byte, fileName string) (*TemplateDatabase, error) {
@@ -41,13 +53,62 @@ func (this *TemplateDatabase) readTemplatesYamlString(yamlContent []byte, fileNa
 	return nil
 }
 
+// SetFilePath sets the file which changes to the templates are written to.
+// An empty path means that changes are only kept in memory.
+func (this *TemplateDatabase) SetFilePath(filePath string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.filePath = filePath
+}
+
+func (this *TemplateDatabase) FilePath() string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.filePath
+}
+
+// Reload rereads the templates file. The current templates are kept if the file
+// can't be read or parsed. A missing file is not an error because it may
+// not have been written yet.
+func (this *TemplateDatabase) Reload() error {
+	filePath := this.FilePath()
+	if filePath == "" {
+		return nil
+	}
+
+	fileContents, err := os.ReadFile(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("Cannot read templates file '%s': %w", filePath, err)
+	}
+	newDatabase, err := MakeTemplateDatabaseFromBytes(fileContents, filePath)
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.templates = newDatabase.templates
+	return nil
+}
+
 func (this *TemplateDatabase) TemplateOverview() *data.TemplateOverview {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	templates := make([]*data.Template, len(this.templates))
+	copy(templates, this.templates)
 	return &data.TemplateOverview{
-		Templates: this.templates[:],
+		Templates: templates,
 	}
 }
 
 func (this *TemplateDatabase) DefaultID() string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
 	for _, template := range this.templates {
 		if template.Default {
 			return template.ID
@@ -57,7 +118,7 @@ func (this *TemplateDatabase) DefaultID() string {
 }
 
 func (this *TemplateDatabase) ApplyTemplate(templateID string, promptText string) string {
-	template := this.getTemplateByID(templateID)
+	template := this.Get(templateID)
 	if template == nil {
 		return promptText
 	}
@@ -66,6 +127,8 @@ func (this *TemplateDatabase) ApplyTemplate(templateID string, promptText string
 }
 
 func (this *TemplateDatabase) Get(templateID string) *data.Template {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
 	return this.getTemplateByID(templateID)
 }
 
@@ -79,17 +142,138 @@ func (this *TemplateDatabase) getTemplateByID(templateID string) *data.Template
 	return matches[0]
 }
 
+// TruncateTitle cuts a title down to TITLE_LENGTH characters without
+// splitting a multibyte character.
+func TruncateTitle(title string) string {
+	runes := []rune(title)
+	if len(runes) <= TITLE_LENGTH {
+		return title
+	}
+	return string(runes[:TITLE_LENGTH])
+}
+
 func (this *TemplateDatabase) MakeTitle(templateID string, promptText string) string {
 	lines := strings.Split(promptText, "\n")
-	firstLine := lines[0]
-	if len(firstLine) > TITLE_LENGTH {
-		firstLine = lines[0][:TITLE_LENGTH]
-	}
+	firstLine := TruncateTitle(lines[0])
 
-	template := this.getTemplateByID(templateID)
+	template := this.Get(templateID)
 	if template == nil {
 		return firstLine
 	}
 
 	return fmt.Sprintf("%s - %s", template.Name, firstLine)
 }
+
+// validateTemplate checks that a template has the fields needed to be used.
+func validateTemplate(template *data.Template) error {
+	if strings.TrimSpace(template.Name) == "" {
+		return errors.New("template name must not be empty")
+	}
+	if strings.TrimSpace(template.TemplateString) == "" {
+		return errors.New("template string must not be empty")
+	}
+	if !strings.Contains(template.TemplateString, PROMPT_PARAM) {
+		return fmt.Errorf("template string must contain %s", PROMPT_PARAM)
+	}
+	if template.JsonSchema != nil {
+		if err := jsonschema.CheckSchema(template.JsonSchema); err != nil {
+			return fmt.Errorf("template JSON schema is invalid: %w", err)
+		}
+	}
+	return nil
+}
+
+// Add adds a new template and persists the change. A new ID is generated if
+// the template doesn't have one.
+func (this *TemplateDatabase) Add(template *data.Template) error {
+	if err := validateTemplate(template); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if template.ID == "" {
+		template.ID = uuid.NewString()
+	} else if this.getTemplateByID(template.ID) != nil {
+		return ErrTemplateExists
+	}
+
+	newTemplates := this.withDefaultCleared(template)
+	newTemplates = append(newTemplates, template)
+	return this.commit(newTemplates)
+}
+
+// Update replaces the template having the same ID and persists the change.
+func (this *TemplateDatabase) Update(template *data.Template) error {
+	if err := validateTemplate(template); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidTemplate, err)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	index := slices.IndexFunc(this.templates, func(t *data.Template) bool {
+		return t.ID == template.ID
+	})
+	if index == -1 {
+		return ErrTemplateNotFound
+	}
+
+	newTemplates := this.withDefaultCleared(template)
+	newTemplates[index] = template
+	return this.commit(newTemplates)
+}
+
+// Delete removes a template and persists the change.
+func (this *TemplateDatabase) Delete(templateID string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	newTemplates := slices.Filter(this.templates, func(t *data.Template) bool {
+		return t.ID != templateID
+	})
+	if len(newTemplates) == len(this.templates) {
+		return ErrTemplateNotFound
+	}
+	return this.commit(newTemplates)
+}
+
+// withDefaultCleared returns a copy of the template list. If `template` is
+// the new default, then the default flag is removed from the others.
+func (this *TemplateDatabase) withDefaultCleared(template *data.Template) []*data.Template {
+	return slices.Map(this.templates, func(t *data.Template) *data.Template {
+		if template.Default && t.Default && t.ID != template.ID {
+			tCopy := *t
+			tCopy.Default = false
+			return &tCopy
+		}
+		return t
+	})
+}
+
+func (this *TemplateDatabase) commit(newTemplates []*data.Template) error {
+	if this.filePath != "" {
+		if err := writeYamlFile(this.filePath, newTemplates); err != nil {
+			return err
+		}
+	}
+	this.templates = newTemplates
+	return nil
+}
+
+func writeYamlFile(filePath string, value any) error {
+	yamlBytes, err := yaml.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("Cannot marshal templates: %w", err)
+	}
+
+	tempPath := filePath + ".tmp"
+	if err := os.WriteFile(tempPath, yamlBytes, 0644); err != nil {
+		return fmt.Errorf("Cannot write templates file '%s': %w", tempPath, err)
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		return fmt.Errorf("Cannot write templates file '%s': %w", filePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package template
+
+import (
+	"errors"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/data"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+const testTemplatesYaml = `
+- id: instruct
+  name: Instruct
+  template_string: "{{prompt}}"
+  default: true
+`
+
+func TestAddUpdateDeleteRoundTrip(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "templates.yaml")
+	db, _ := MakeTemplateDatabaseFromBytes([]byte(testTemplatesYaml), "(test)")
+	db.SetFilePath(filePath)
+
+	newTemplate := &data.Template{Name: "Shout", TemplateString: "Say this loudly: {{prompt}}", Default: true}
+	if err := db.Add(newTemplate); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if newTemplate.ID == "" {
+		t.Errorf("Add didn't assign an ID to the new template.")
+	}
+	if db.DefaultID() != newTemplate.ID {
+		t.Errorf("Expected the new template to become the default.")
+	}
+
+	db2, err := MakeTemplateDatabase(filePath)
+	if err != nil {
+		t.Fatalf("Couldn't read back templates file: %v", err)
+	}
+	if len(db2.TemplateOverview().Templates) != 2 {
+		t.Errorf("Round-trip failed: Expected %d templates, got %d", 2, len(db2.TemplateOverview().Templates))
+	}
+
+	if err := db2.Update(&data.Template{ID: "instruct", Name: "Plain", TemplateString: "{{prompt}}"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if db2.Get("instruct").Name != "Plain" {
+		t.Errorf("Update failed: Expected '%s', got '%s'", "Plain", db2.Get("instruct").Name)
+	}
+
+	if err := db2.Delete(newTemplate.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	db3, _ := MakeTemplateDatabase(filePath)
+	if len(db3.TemplateOverview().Templates) != 1 {
+		t.Errorf("Expected 1 template after delete, got %d", len(db3.TemplateOverview().Templates))
+	}
+}
+
+func TestInvalidTemplates(t *testing.T) {
+	db, _ := MakeTemplateDatabaseFromBytes([]byte(testTemplatesYaml), "(test)")
+
+	if err := db.Add(&data.Template{Name: "No prompt", TemplateString: "Hello"}); !errors.Is(err, ErrInvalidTemplate) {
+		t.Errorf("Expected a template without {{prompt}} to be rejected.")
+	}
+	invalidSchema := &data.Template{Name: "List", TemplateString: "{{prompt}}", JsonSchema: map[string]any{"type": "array"}}
+	if err := db.Add(invalidSchema); !errors.Is(err, ErrInvalidTemplate) {
+		t.Errorf("Expected a template with a JSON schema for an array to be rejected.")
+	}
+	if err := db.Add(&data.Template{ID: "instruct", Name: "Dup", TemplateString: "{{prompt}}"}); err != ErrTemplateExists {
+		t.Errorf("Expected ErrTemplateExists, got %v", err)
+	}
+	if err := db.Delete("missing"); err != ErrTemplateNotFound {
+		t.Errorf("Expected ErrTemplateNotFound, got %v", err)
+	}
+}
+
+func TestMakeTitleKeepsMultibyteCharacters(t *testing.T) {
+	database, _ := MakeTemplateDatabaseFromBytes([]byte(testTemplatesYaml), "templates.yaml")
+	title := database.MakeTitle("instruct", strings.Repeat("日本語", 20)+"\nsecond line")
+
+	if !utf8.ValidString(title) {
+		t.Errorf("Title '%s' is not valid UTF-8", title)
+	}
+	if title != "Instruct - "+strings.Repeat("日本語", 13)+"日" {
+		t.Errorf("Unexpected title '%s'", title)
+	}
+}
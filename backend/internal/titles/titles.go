@@ -0,0 +1,145 @@
+package titles
+
+import (
+	"log"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/priority"
+	"sedwards2009/llm-multitool/internal/data/responsestatus"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/engine"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/mem_storage"
+	"strings"
+)
+
+const TITLE_PROMPT = "Write a short title of at most six words for the conversation below. " +
+	"Reply with only the title.\n\n"
+
+// EXCERPT_LENGTH limits how much of the conversation is sent to the title
+// model, which is expected to be small and fast.
+const EXCERPT_LENGTH = 2000
+
+const MAX_TITLE_LENGTH = 80
+
+const TRIM_CHARACTERS = " \t\"'`*#"
+
+// Generator asks a model for session titles in the background. Title
+// requests are queued with the background priority so that they don't delay
+// the user's own requests.
+type Generator struct {
+	llmEngine      *engine.Engine
+	sessionStorage *mem_storage.SimpleStorage
+	modelID        string
+	changedFunc    func(sessionID string)
+}
+
+func New(llmEngine *engine.Engine, sessionStorage *mem_storage.SimpleStorage, modelID string,
+	changedFunc func(sessionID string)) *Generator {
+
+	return &Generator{
+		llmEngine:      llmEngine,
+		sessionStorage: sessionStorage,
+		modelID:        modelID,
+		changedFunc:    changedFunc,
+	}
+}
+
+// RequestTitle queues a request for a title based on a response. Nothing is
+// done if the session already has a generated title or if the response
+// didn't complete.
+func (this *Generator) RequestTitle(sessionID string, responseID string) {
+	session := this.sessionStorage.ReadSession(sessionID)
+	if session == nil || session.TitleIsGenerated {
+		return
+	}
+	response := findResponse(session, responseID)
+	if response == nil || response.Status != responsestatus.Done {
+		return
+	}
+
+	builder := strings.Builder{}
+	status := responsestatus.Done
+	this.llmEngine.EnqueueRequest(&types.Request{
+		Messages: []data.Message{
+			{Role: role.User, Text: TITLE_PROMPT + makeExcerpt(response.Messages)},
+			{Role: role.Assistant, Text: ""},
+		},
+		AppendFunc: func(text string) bool {
+			builder.WriteString(text)
+			return true
+		},
+		CompleteFunc: func() {
+			title := CleanTitle(builder.String())
+			if status != responsestatus.Done || title == "" {
+				log.Printf("Titles: Unable to generate a title for session %s", sessionID)
+				return
+			}
+			this.setTitle(sessionID, title)
+		},
+		SetStatusFunc: func(newStatus responsestatus.ResponseStatus) {
+			status = newStatus
+		},
+		ModelSettings: &data.ModelSettings{ModelID: this.modelID},
+		Priority:      priority.Background,
+	})
+}
+
+func (this *Generator) setTitle(sessionID string, title string) {
+	session := this.sessionStorage.ReadSession(sessionID)
+	if session == nil || session.TitleIsGenerated {
+		return
+	}
+	session.Title = title
+	session.TitleIsGenerated = true
+	this.sessionStorage.WriteSession(session)
+	this.changedFunc(sessionID)
+}
+
+func findResponse(session *data.Session, responseID string) *data.Response {
+	for _, response := range session.Responses {
+		if response.ID == responseID {
+			return response
+		}
+	}
+	return nil
+}
+
+func makeExcerpt(messages []data.Message) string {
+	builder := strings.Builder{}
+	for _, message := range messages {
+		if message.Role == role.ToolCall || message.Role == role.ToolResult {
+			continue
+		}
+		name := "User"
+		if message.Role == role.Assistant {
+			name = "Assistant"
+		}
+		builder.WriteString(name + ": " + message.Text + "\n\n")
+	}
+	excerpt := []rune(builder.String())
+	if len(excerpt) > EXCERPT_LENGTH {
+		excerpt = excerpt[:EXCERPT_LENGTH]
+	}
+	return string(excerpt)
+}
+
+// CleanTitle removes the quotes, markdown and extra lines which models like
+// to add around a title.
+func CleanTitle(text string) string {
+	title := ""
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			title = line
+			break
+		}
+	}
+	title = strings.Trim(title, TRIM_CHARACTERS)
+	title = strings.TrimPrefix(title, "Title:")
+	title = strings.Trim(title, TRIM_CHARACTERS+".")
+
+	runes := []rune(title)
+	if len(runes) > MAX_TITLE_LENGTH {
+		title = string(runes[:MAX_TITLE_LENGTH])
+	}
+	return title
+}
@@ -0,0 +1,28 @@
+package titles
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanTitle(t *testing.T) {
+	cases := map[string]string{
+		"Sorting a list in Go":                  "Sorting a list in Go",
+		"\"Sorting a list in Go\"":              "Sorting a list in Go",
+		"\n**Title: Sorting a list in Go.**\n":  "Sorting a list in Go",
+		"# Sorting a list\nHere is your title!": "Sorting a list",
+		"  ":                                    "",
+	}
+	for input, expected := range cases {
+		if title := CleanTitle(input); title != expected {
+			t.Errorf("CleanTitle(%q) gave %q, expected %q", input, title, expected)
+		}
+	}
+}
+
+func TestCleanTitleLength(t *testing.T) {
+	title := CleanTitle(strings.Repeat("é", MAX_TITLE_LENGTH+10))
+	if len([]rune(title)) != MAX_TITLE_LENGTH {
+		t.Errorf("Expected the title to be cut to %d characters, got %d", MAX_TITLE_LENGTH, len([]rune(title)))
+	}
+}
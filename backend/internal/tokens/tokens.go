@@ -0,0 +1,30 @@
+package tokens
+
+import (
+	"sedwards2009/llm-multitool/internal/data"
+	"unicode/utf8"
+)
+
+// CHARACTERS_PER_TOKEN is a rough average for English text and code which
+// is used when a backend doesn't report token counts.
+const CHARACTERS_PER_TOKEN = 4
+
+// MESSAGE_OVERHEAD approximates the tokens used to mark the start and role
+// of each message in a chat.
+const MESSAGE_OVERHEAD = 4
+
+// Estimate approximates the number of tokens in a piece of text.
+func Estimate(text string) int {
+	length := utf8.RuneCountInString(text)
+	return (length + CHARACTERS_PER_TOKEN - 1) / CHARACTERS_PER_TOKEN
+}
+
+// EstimateMessages approximates the number of tokens needed to send a list
+// of messages to a model.
+func EstimateMessages(messages []data.Message) int {
+	total := 0
+	for _, message := range messages {
+		total += Estimate(message.Text) + MESSAGE_OVERHEAD
+	}
+	return total
+}
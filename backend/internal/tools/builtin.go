@@ -0,0 +1,220 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type currentTimeTool struct{}
+
+func (this *currentTimeTool) Definition() *Definition {
+	return &Definition{
+		Name:        "current_time",
+		Description: "Get the current date and time.",
+		Parameters: makeParameters(map[string]any{
+			"timezone": map[string]any{
+				"type":        "string",
+				"description": "An IANA time zone such as Europe/Amsterdam. The server's local time zone is used if not given.",
+			},
+		}),
+	}
+}
+
+func (this *currentTimeTool) Call(arguments map[string]any) (string, error) {
+	now := time.Now()
+	if _, ok := arguments["timezone"]; ok {
+		timezone, err := stringArgument(arguments, "timezone")
+		if err != nil {
+			return "", err
+		}
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown time zone '%s'", timezone)
+		}
+		now = now.In(location)
+	}
+	return now.Format("Monday, 2 January 2006 15:04:05 MST (2006-01-02T15:04:05Z07:00)"), nil
+}
+
+// MAX_READ_FILE_SIZE limits how much of a file the read_file tool returns.
+const MAX_READ_FILE_SIZE = 64 * 1024
+
+// readFileTool reads files below one directory.
+type readFileTool struct {
+	directory string
+}
+
+func (this *readFileTool) Definition() *Definition {
+	return &Definition{
+		Name: "read_file",
+		Description: "Read a text file, or list a directory, from the shared file area. " +
+			"Paths are relative to the root of the area. Use \".\" to list the root.",
+		Parameters: makeParameters(map[string]any{
+			"path": map[string]any{
+				"type":        "string",
+				"description": "Path of the file or directory",
+			},
+		}, "path"),
+	}
+}
+
+func (this *readFileTool) Call(arguments map[string]any) (string, error) {
+	relativePath, err := stringArgument(arguments, "path")
+	if err != nil {
+		return "", err
+	}
+	fullPath, err := this.resolve(relativePath)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("'%s' doesn't exist", relativePath)
+	}
+	if info.IsDir() {
+		return listDirectory(fullPath)
+	}
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", fmt.Errorf("'%s' can't be read", relativePath)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, MAX_READ_FILE_SIZE+1))
+	if err != nil {
+		return "", fmt.Errorf("'%s' can't be read", relativePath)
+	}
+	if len(content) > MAX_READ_FILE_SIZE {
+		return string(content[:MAX_READ_FILE_SIZE]) + TRUNCATION_MARKER, nil
+	}
+	return string(content), nil
+}
+
+// resolve turns a path given by a model into a path below the directory.
+// Symbolic links which lead out of the directory are refused.
+func (this *readFileTool) resolve(relativePath string) (string, error) {
+	root, err := filepath.EvalSymlinks(this.directory)
+	if err != nil {
+		return "", fmt.Errorf("the file area is not available")
+	}
+	fullPath, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Clean("/"+relativePath)))
+	if err != nil {
+		return "", fmt.Errorf("'%s' doesn't exist", relativePath)
+	}
+	if fullPath != root && !strings.HasPrefix(fullPath, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' is outside of the file area", relativePath)
+	}
+	return fullPath, nil
+}
+
+func listDirectory(directory string) (string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return "", err
+	}
+	builder := strings.Builder{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		builder.WriteString(name + "\n")
+	}
+	return builder.String(), nil
+}
+
+const DEFAULT_SHELL_TIMEOUT = 10 * time.Second
+
+const SHELL_PATH = "/usr/local/bin:/usr/bin:/bin"
+
+// shellTool runs shell commands in a sandbox with a time limit and a minimal
+// environment. See sandboxCommand for what the sandbox allows.
+type shellTool struct {
+	directory string
+	timeout   time.Duration
+}
+
+// newShellTool checks that the scratch directory exists and that the
+// sandbox can be set up on this system.
+func newShellTool(directory string, timeout time.Duration) (*shellTool, error) {
+	absDirectory, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	resolvedDirectory, err := filepath.EvalSymlinks(absDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("the directory of the shell tool is not available: %w", err)
+	}
+
+	this := &shellTool{directory: resolvedDirectory, timeout: timeout}
+	output, err := this.run("true")
+	if err != nil {
+		return nil, fmt.Errorf("the sandbox of the shell tool can't be set up: %w", err)
+	}
+	if output != "" {
+		return nil, fmt.Errorf("the sandbox of the shell tool can't be set up: %s", strings.TrimSpace(output))
+	}
+	return this, nil
+}
+
+func shellEnvironment(directory string) []string {
+	return []string{"PATH=" + SHELL_PATH, "HOME=" + directory, "TMPDIR=" + directory, "LANG=C.UTF-8"}
+}
+
+func (this *shellTool) Definition() *Definition {
+	return &Definition{
+		Name: "shell",
+		Description: fmt.Sprintf("Run a command with /bin/sh in a scratch directory and return its output. "+
+			"There is no network access and only the scratch directory is writable. "+
+			"Commands are stopped after %v.", this.timeout),
+		Parameters: makeParameters(map[string]any{
+			"command": map[string]any{
+				"type":        "string",
+				"description": "The shell command to run",
+			},
+		}, "command"),
+	}
+}
+
+func (this *shellTool) Call(arguments map[string]any) (string, error) {
+	command, err := stringArgument(arguments, "command")
+	if err != nil {
+		return "", err
+	}
+	return this.run(command)
+}
+
+func (this *shellTool) run(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+	cmd, err := sandboxCommand(ctx, this.directory, command)
+	if err != nil {
+		return "", err
+	}
+	cmd.WaitDelay = time.Second
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return output.String() + fmt.Sprintf("\n[stopped after %v]", this.timeout), nil
+	}
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		return output.String() + fmt.Sprintf("\n[exit code %d]", exitError.ExitCode()), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
@@ -0,0 +1,242 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type calculatorTool struct{}
+
+func (this *calculatorTool) Definition() *Definition {
+	return &Definition{
+		Name: "calculator",
+		Description: "Evaluate an arithmetic expression. Supports + - * / % ^, parentheses, " +
+			"the constants pi and e, and the functions sqrt, abs, ln, log10, exp, sin, cos, tan, floor, ceil and round.",
+		Parameters: makeParameters(map[string]any{
+			"expression": map[string]any{
+				"type":        "string",
+				"description": "The expression, for example (2 + 3) * sqrt(16)",
+			},
+		}, "expression"),
+	}
+}
+
+func (this *calculatorTool) Call(arguments map[string]any) (string, error) {
+	expression, err := stringArgument(arguments, "expression")
+	if err != nil {
+		return "", err
+	}
+	result, err := Evaluate(expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'g', -1, 64), nil
+}
+
+var calculatorFunctions = map[string]func(float64) float64{
+	"sqrt":  math.Sqrt,
+	"abs":   math.Abs,
+	"ln":    math.Log,
+	"log10": math.Log10,
+	"exp":   math.Exp,
+	"sin":   math.Sin,
+	"cos":   math.Cos,
+	"tan":   math.Tan,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"round": math.Round,
+}
+
+var calculatorConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+// Evaluate computes the value of an arithmetic expression.
+func Evaluate(expression string) (float64, error) {
+	parser := &expressionParser{text: []rune(expression)}
+	result, err := parser.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	parser.skipSpace()
+	if parser.position != len(parser.text) {
+		return 0, fmt.Errorf("unexpected '%c' at position %d", parser.text[parser.position], parser.position+1)
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, fmt.Errorf("the result is not a finite number")
+	}
+	return result, nil
+}
+
+// expressionParser is a recursive descent parser which evaluates as it goes.
+type expressionParser struct {
+	text     []rune
+	position int
+}
+
+func (this *expressionParser) skipSpace() {
+	for this.position < len(this.text) && unicode.IsSpace(this.text[this.position]) {
+		this.position++
+	}
+}
+
+// next returns the next character after any white space, or 0 at the end.
+func (this *expressionParser) next() rune {
+	this.skipSpace()
+	if this.position >= len(this.text) {
+		return 0
+	}
+	return this.text[this.position]
+}
+
+func (this *expressionParser) parseSum() (float64, error) {
+	result, err := this.parseProduct()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		operator := this.next()
+		if operator != '+' && operator != '-' {
+			return result, nil
+		}
+		this.position++
+		operand, err := this.parseProduct()
+		if err != nil {
+			return 0, err
+		}
+		if operator == '+' {
+			result += operand
+		} else {
+			result -= operand
+		}
+	}
+}
+
+func (this *expressionParser) parseProduct() (float64, error) {
+	result, err := this.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		operator := this.next()
+		if operator != '*' && operator != '/' && operator != '%' {
+			return result, nil
+		}
+		this.position++
+		operand, err := this.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch operator {
+		case '*':
+			result *= operand
+		case '/':
+			if operand == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			result /= operand
+		default:
+			if operand == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			result = math.Mod(result, operand)
+		}
+	}
+}
+
+func (this *expressionParser) parseUnary() (float64, error) {
+	switch this.next() {
+	case '-':
+		this.position++
+		result, err := this.parseUnary()
+		return -result, err
+	case '+':
+		this.position++
+		return this.parseUnary()
+	}
+	return this.parsePower()
+}
+
+// parsePower handles `^`, which is right associative.
+func (this *expressionParser) parsePower() (float64, error) {
+	base, err := this.parseAtom()
+	if err != nil {
+		return 0, err
+	}
+	if this.next() != '^' {
+		return base, nil
+	}
+	this.position++
+	exponent, err := this.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (this *expressionParser) parseAtom() (float64, error) {
+	c := this.next()
+	switch {
+	case c == 0:
+		return 0, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		this.position++
+		result, err := this.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if this.next() != ')' {
+			return 0, fmt.Errorf("missing ')'")
+		}
+		this.position++
+		return result, nil
+	case unicode.IsDigit(c) || c == '.':
+		return this.parseNumber()
+	case unicode.IsLetter(c):
+		return this.parseName()
+	}
+	return 0, fmt.Errorf("unexpected '%c' at position %d", c, this.position+1)
+}
+
+func (this *expressionParser) parseNumber() (float64, error) {
+	start := this.position
+	for this.position < len(this.text) &&
+		(unicode.IsDigit(this.text[this.position]) || this.text[this.position] == '.') {
+		this.position++
+	}
+	number := string(this.text[start:this.position])
+	result, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a valid number", number)
+	}
+	return result, nil
+}
+
+func (this *expressionParser) parseName() (float64, error) {
+	start := this.position
+	for this.position < len(this.text) &&
+		(unicode.IsLetter(this.text[this.position]) || unicode.IsDigit(this.text[this.position])) {
+		this.position++
+	}
+	name := strings.ToLower(string(this.text[start:this.position]))
+
+	if value, ok := calculatorConstants[name]; ok {
+		return value, nil
+	}
+	function, ok := calculatorFunctions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown name '%s'", name)
+	}
+	if this.next() != '(' {
+		return 0, fmt.Errorf("missing '(' after %s", name)
+	}
+	argument, err := this.parseAtom()
+	if err != nil {
+		return 0, err
+	}
+	return function(argument), nil
+}
@@ -0,0 +1,160 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sedwards2009/llm-multitool/internal/engine/config"
+	"sedwards2009/llm-multitool/internal/redact"
+	"strings"
+	"time"
+)
+
+const HTTP_TOOL_TIMEOUT = 30 * time.Second
+
+var placeholderRegexp = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// httpTool calls a web API which is described in the tools config. Arguments
+// named in the URL as `{name}` are put into it. Any other arguments are sent
+// as a JSON body, or as query parameters for GET requests.
+type httpTool struct {
+	config  *HttpToolConfig
+	method  string
+	headers map[string]string
+}
+
+func newHttpTool(toolConfig *HttpToolConfig) (*httpTool, error) {
+	if toolConfig.Name == "" || toolConfig.Url == "" {
+		return nil, fmt.Errorf("HTTP tools need a name and a url")
+	}
+	method := strings.ToUpper(toolConfig.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	headers := map[string]string{}
+	for name, value := range toolConfig.Headers {
+		expanded, err := config.ExpandVariables(value)
+		if err != nil {
+			return nil, fmt.Errorf("header '%s' of HTTP tool '%s' can't be expanded: %w", name, toolConfig.Name, err)
+		}
+		if expanded != value {
+			redact.AddSecret(expanded)
+		}
+		headers[name] = expanded
+	}
+
+	for _, match := range placeholderRegexp.FindAllStringSubmatch(toolConfig.Url, -1) {
+		if _, ok := toolConfig.Parameters[match[1]]; !ok {
+			return nil, fmt.Errorf("the url of HTTP tool '%s' uses the unknown parameter '%s'", toolConfig.Name,
+				match[1])
+		}
+	}
+
+	return &httpTool{
+		config:  toolConfig,
+		method:  method,
+		headers: headers,
+	}, nil
+}
+
+func (this *httpTool) Definition() *Definition {
+	properties := map[string]any{}
+	required := []string{}
+	for name, parameter := range this.config.Parameters {
+		parameterType := parameter.Type
+		if parameterType == "" {
+			parameterType = "string"
+		}
+		properties[name] = map[string]any{
+			"type":        parameterType,
+			"description": parameter.Description,
+		}
+		if parameter.Required {
+			required = append(required, name)
+		}
+	}
+	return &Definition{
+		Name:        this.config.Name,
+		Description: this.config.Description,
+		Parameters:  makeParameters(properties, required...),
+	}
+}
+
+func (this *httpTool) Call(arguments map[string]any) (string, error) {
+	otherArguments := map[string]any{}
+	for name, value := range arguments {
+		otherArguments[name] = value
+	}
+	fillPlaceholders := func(part string, escape func(string) string) string {
+		return placeholderRegexp.ReplaceAllStringFunc(part, func(match string) string {
+			name := match[1 : len(match)-1]
+			delete(otherArguments, name)
+			value, ok := arguments[name]
+			if !ok {
+				return ""
+			}
+			return escape(fmt.Sprint(value))
+		})
+	}
+	// Placeholders in the path and in the query need different escaping.
+	requestUrl := this.config.Url
+	query := ""
+	if index := strings.Index(requestUrl, "?"); index != -1 {
+		requestUrl, query = requestUrl[:index], requestUrl[index+1:]
+	}
+	requestUrl = fillPlaceholders(requestUrl, url.PathEscape)
+	query = fillPlaceholders(query, url.QueryEscape)
+
+	var body io.Reader
+	if this.method == http.MethodGet {
+		extraQuery := url.Values{}
+		for name, value := range otherArguments {
+			extraQuery.Set(name, fmt.Sprint(value))
+		}
+		if len(extraQuery) != 0 {
+			if query != "" {
+				query += "&"
+			}
+			query += extraQuery.Encode()
+		}
+	} else if len(otherArguments) != 0 {
+		jsonData, _ := json.Marshal(otherArguments)
+		body = bytes.NewBuffer(jsonData)
+	}
+	if query != "" {
+		requestUrl += "?" + query
+	}
+
+	request, err := http.NewRequest(this.method, requestUrl, body)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range this.headers {
+		request.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: HTTP_TOOL_TIMEOUT}
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, MAX_RESULT_LENGTH+1))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("HTTP request failed with status code %d: %s", resp.StatusCode,
+			strings.TrimSpace(string(content)))
+	}
+	return string(content), nil
+}
@@ -0,0 +1,123 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"sedwards2009/llm-multitool/internal/mcp"
+	"strings"
+)
+
+// MAX_TOOL_NAME_LENGTH is the longest tool name which the APIs accept.
+const MAX_TOOL_NAME_LENGTH = 64
+
+// MAX_LISTED_RESOURCES limits how many resources are named in the
+// description of a server's read_resource tool.
+const MAX_LISTED_RESOURCES = 50
+
+var toolNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// McpToolName makes the name under which a tool of an MCP server is
+// registered. The server name is put in front to keep tools of different
+// servers apart.
+func McpToolName(serverName string, toolName string) string {
+	name := toolNameRegexp.ReplaceAllString(serverName+"_"+toolName, "_")
+	if len(name) > MAX_TOOL_NAME_LENGTH {
+		name = name[:MAX_TOOL_NAME_LENGTH]
+	}
+	return name
+}
+
+// mcpTool passes calls on to a tool of an MCP server.
+type mcpTool struct {
+	client *mcp.Client
+	tool   *mcp.Tool
+}
+
+func (this *mcpTool) Definition() *Definition {
+	parameters := this.tool.InputSchema
+	if parameters == nil {
+		parameters = makeParameters(map[string]any{})
+	}
+	return &Definition{
+		Name:        McpToolName(this.client.Name(), this.tool.Name),
+		Description: this.tool.Description,
+		Parameters:  parameters,
+	}
+}
+
+func (this *mcpTool) Call(arguments map[string]any) (string, error) {
+	return this.client.CallTool(this.tool.Name, arguments)
+}
+
+// mcpResourceTool lets models read the resources of an MCP server.
+type mcpResourceTool struct {
+	client    *mcp.Client
+	resources []*mcp.Resource
+}
+
+func (this *mcpResourceTool) Definition() *Definition {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("Read a resource from %s. The available resources are:\n", this.client.Name()))
+	for i, resource := range this.resources {
+		if i == MAX_LISTED_RESOURCES {
+			builder.WriteString("- ...\n")
+			break
+		}
+		builder.WriteString("- " + resource.URI)
+		if resource.Description != "" {
+			builder.WriteString(": " + resource.Description)
+		} else if resource.Name != "" {
+			builder.WriteString(": " + resource.Name)
+		}
+		builder.WriteString("\n")
+	}
+	return &Definition{
+		Name:        McpToolName(this.client.Name(), "read_resource"),
+		Description: builder.String(),
+		Parameters: makeParameters(map[string]any{
+			"uri": map[string]any{
+				"type":        "string",
+				"description": "URI of the resource",
+			},
+		}, "uri"),
+	}
+}
+
+func (this *mcpResourceTool) Call(arguments map[string]any) (string, error) {
+	uri, err := stringArgument(arguments, "uri")
+	if err != nil {
+		return "", err
+	}
+	return this.client.ReadResource(uri)
+}
+
+// RegisterMcpServer adds the tools of an MCP server to the registry. If the
+// server has resources then a tool to read them is added too.
+func (this *Registry) RegisterMcpServer(client *mcp.Client) {
+	overview := client.Overview()
+	for _, tool := range overview.Tools {
+		this.Register(&mcpTool{client: client, tool: tool})
+	}
+	if len(overview.Resources) != 0 {
+		this.Register(&mcpResourceTool{client: client, resources: overview.Resources})
+	}
+}
+
+// UnregisterMcpServer removes the tools of an MCP server, such as after it
+// has stopped.
+func (this *Registry) UnregisterMcpServer(client *mcp.Client) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for name, tool := range this.tools {
+		switch serverTool := tool.(type) {
+		case *mcpTool:
+			if serverTool.client == client {
+				delete(this.tools, name)
+			}
+		case *mcpResourceTool:
+			if serverTool.client == client {
+				delete(this.tools, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SANDBOX_VARIABLE is set when the server binary is started as the helper
+// which sets up the shell tool's sandbox. It holds the scratch directory.
+const SANDBOX_VARIABLE = "LLM_MULTITOOL_SANDBOX"
+
+// sandboxCommand prepares a shell command which runs in new user, mount,
+// network, PID, IPC and UTS namespaces. The command has no network, only
+// sees the system directories, read only, and the scratch directory, and
+// can't see the processes of the host. Everything it starts is killed when it ends.
+func sandboxCommand(ctx context.Context, directory string, command string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, executable, command)
+	cmd.Dir = directory
+	cmd.Env = append(shellEnvironment(directory), SANDBOX_VARIABLE+"="+directory)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		Setpgid:     true,
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	// The command is PID 1 of its namespace. Killing it takes everything
+	// else in the namespace with it.
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd, nil
+}
+
+// RunSandboxHelper takes over the process if it was started by
+// sandboxCommand. It must be called at the start of main(), before anything
+// else is set up.
+func RunSandboxHelper() {
+	directory := os.Getenv(SANDBOX_VARIABLE)
+	if directory == "" {
+		return
+	}
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "sandbox: expected one command")
+		os.Exit(126)
+	}
+	err := enterSandbox(directory, os.Args[1])
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(126)
+}
+
+// SANDBOX_SYSTEM_PATHS are the parts of the host which the shell sees, read
+// only, besides its scratch directory. Paths missing on the host are left
+// out. Everything else, such as the server's config and session storage, is
+// hidden.
+var SANDBOX_SYSTEM_PATHS = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc",
+	"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+// SANDBOX_ROOT is where the sandbox's root is put together before it
+// replaces the host's. The mount over it is only seen in the sandbox.
+const SANDBOX_ROOT = "/tmp"
+
+// enterSandbox locks down the namespaces and replaces the process with the
+// shell. It only returns if something fails.
+func enterSandbox(directory string, command string) error {
+	// Capabilities belong to threads. Everything up to the exec has to
+	// happen on this one.
+	runtime.LockOSThread()
+
+	// Keep the mounts below from propagating back to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("cannot make mounts private: %w", err)
+	}
+
+	// Copies of the mounts are taken first, as the new root may cover them.
+	// The scratch directory comes last in case it is below a system path.
+	type sandboxMount struct {
+		path string
+		tree int
+		link string
+	}
+	mounts := []*sandboxMount{}
+	for _, path := range append(SANDBOX_SYSTEM_PATHS, directory) {
+		info, err := os.Lstat(path)
+		if err != nil {
+			if path == directory {
+				return fmt.Errorf("cannot find the scratch directory: %w", err)
+			}
+			continue
+		}
+		// Such as /bin on systems where it points into /usr.
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("cannot read link %s: %w", path, err)
+			}
+			mounts = append(mounts, &sandboxMount{path: path, link: link})
+			continue
+		}
+		tree, err := unix.OpenTree(unix.AT_FDCWD, path,
+			unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+		if err != nil {
+			return fmt.Errorf("cannot copy the mount of %s: %w", path, err)
+		}
+		defer unix.Close(tree)
+		mounts = append(mounts, &sandboxMount{path: path, tree: tree})
+	}
+
+	if err := unix.Mount("tmpfs", SANDBOX_ROOT, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("cannot create the new root: %w", err)
+	}
+	for _, mount := range mounts {
+		target := filepath.Join(SANDBOX_ROOT, mount.path)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if mount.link != "" {
+			if err := os.Symlink(mount.link, target); err != nil {
+				return err
+			}
+			continue
+		}
+		// A mount needs something of the same type to go over.
+		if err := os.Mkdir(target, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		var stat unix.Stat_t
+		if err := unix.Fstat(mount.tree, &stat); err != nil {
+			return err
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, nil, 0644); err != nil {
+				return err
+			}
+		}
+		if err := unix.MoveMount(mount.tree, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+			return fmt.Errorf("cannot mount %s: %w", mount.path, err)
+		}
+	}
+	for _, path := range []string{"/proc", "/.old"} {
+		if err := os.MkdirAll(filepath.Join(SANDBOX_ROOT, path), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.PivotRoot(SANDBOX_ROOT, filepath.Join(SANDBOX_ROOT, "/.old")); err != nil {
+		return fmt.Errorf("cannot change the root: %w", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return err
+	}
+	// A fresh /proc only shows the processes in the sandbox. The kernel
+	// only allows this while the host's /proc is still mounted, and refuses
+	// it where parts of the host's /proc are hidden, such as in containers.
+	// The host's /proc is then used, read only.
+	if err := unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		if tree, err := unix.OpenTree(unix.AT_FDCWD, "/.old/proc",
+			unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE); err == nil {
+			unix.MoveMount(tree, "", unix.AT_FDCWD, "/proc", unix.MOVE_MOUNT_F_EMPTY_PATH)
+			unix.Close(tree)
+		}
+	}
+	if err := unix.Unmount("/.old", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("cannot hide the old root: %w", err)
+	}
+	if err := os.Remove("/.old"); err != nil {
+		return err
+	}
+
+	if err := unix.MountSetattr(unix.AT_FDCWD, "/", unix.AT_RECURSIVE,
+		&unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("cannot make the file system read only: %w", err)
+	}
+	if err := unix.MountSetattr(unix.AT_FDCWD, directory, 0,
+		&unix.MountAttr{Attr_clr: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("cannot make the scratch directory writable: %w", err)
+	}
+	if err := unix.Chdir(directory); err != nil {
+		return fmt.Errorf("cannot change to the scratch directory: %w", err)
+	}
+
+	// Drop every capability so that the shell can't undo the mounts.
+	for capability := 0; capability <= unix.CAP_LAST_CAP; capability++ {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(capability), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("cannot drop capabilities: %w", err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot clear ambient capabilities: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("cannot set no_new_privs: %w", err)
+	}
+	capabilities := [2]unix.CapUserData{}
+	if err := unix.Capset(&unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}, &capabilities[0]); err != nil {
+		return fmt.Errorf("cannot clear capabilities: %w", err)
+	}
+
+	return syscall.Exec("/bin/sh", []string{"sh", "-c", command}, shellEnvironment(directory))
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package tools
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+func sandboxCommand(ctx context.Context, directory string, command string) (*exec.Cmd, error) {
+	return nil, errors.New("the shell tool is only available on Linux")
+}
+
+// RunSandboxHelper does nothing because the sandbox needs Linux.
+func RunSandboxHelper() {
+}
@@ -0,0 +1,281 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"sedwards2009/llm-multitool/internal/mcp"
+	"sedwards2009/llm-multitool/internal/redact"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Definition describes a tool to a model. Parameters is a JSON Schema object.
+type Definition struct {
+	Name        string
+	Description string
+	Parameters  map[string]any
+}
+
+// Tool is something a model may call. `arguments` are the decoded JSON
+// arguments which the model gave. The returned text is sent back to the
+// model.
+type Tool interface {
+	Definition() *Definition
+	Call(arguments map[string]any) (string, error)
+}
+
+// MAX_RESULT_LENGTH limits how much of a tool's output is sent back to the
+// model.
+const MAX_RESULT_LENGTH = 16 * 1024
+
+const TRUNCATION_MARKER = "\n[output truncated]"
+
+type ShellConfig struct {
+	Enabled   bool           `yaml:"enabled"`
+	Directory string         `yaml:"directory"`
+	Timeout   *time.Duration `yaml:"timeout"`
+}
+
+type ParameterConfig struct {
+	Type        string `yaml:"type"`
+	Description string `yaml:"description"`
+	Required    bool   `yaml:"required"`
+}
+
+type HttpToolConfig struct {
+	Name        string                      `yaml:"name"`
+	Description string                      `yaml:"description"`
+	Method      string                      `yaml:"method"`
+	Url         string                      `yaml:"url"`
+	Headers     map[string]string           `yaml:"headers"`
+	Parameters  map[string]*ParameterConfig `yaml:"parameters"`
+}
+
+type ToolsConfig struct {
+	ReadFileDirectory *string             `yaml:"read_file_directory"`
+	Shell             *ShellConfig        `yaml:"shell"`
+	HttpTools         []*HttpToolConfig   `yaml:"http_tools"`
+	McpServers        []*mcp.ServerConfig `yaml:"mcp_servers"`
+}
+
+func ReadConfigFile(file string) (*ToolsConfig, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read tools config file: %w", err)
+	}
+	toolsConfig := &ToolsConfig{}
+	if err := yaml.Unmarshal(content, toolsConfig); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal tools config file '%s': %w", file, err)
+	}
+
+	// Relative directories are relative to the config file.
+	if toolsConfig.ReadFileDirectory != nil && !path.IsAbs(*toolsConfig.ReadFileDirectory) {
+		directory := path.Join(path.Dir(file), *toolsConfig.ReadFileDirectory)
+		toolsConfig.ReadFileDirectory = &directory
+	}
+	if toolsConfig.Shell != nil && toolsConfig.Shell.Directory != "" && !path.IsAbs(toolsConfig.Shell.Directory) {
+		toolsConfig.Shell.Directory = path.Join(path.Dir(file), toolsConfig.Shell.Directory)
+	}
+	for _, serverConfig := range toolsConfig.McpServers {
+		if serverConfig.Directory != "" && !path.IsAbs(serverConfig.Directory) {
+			serverConfig.Directory = path.Join(path.Dir(file), serverConfig.Directory)
+		}
+	}
+	return toolsConfig, nil
+}
+
+// Registry holds the tools which models may call. It is safe to use from
+// several goroutines.
+type Registry struct {
+	lock  sync.RWMutex
+	tools map[string]Tool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		tools: map[string]Tool{},
+	}
+}
+
+// New makes a registry with the built in tools and the HTTP tools from a
+// config. The calculator and current time tools are always available. Reading
+// files and running shell commands are only available if they are
+// configured.
+func New(toolsConfig *ToolsConfig) (*Registry, error) {
+	registry := NewRegistry()
+	registry.Register(&calculatorTool{})
+	registry.Register(&currentTimeTool{})
+
+	if toolsConfig.ReadFileDirectory != nil {
+		registry.Register(&readFileTool{directory: *toolsConfig.ReadFileDirectory})
+	}
+	if toolsConfig.Shell != nil && toolsConfig.Shell.Enabled {
+		if toolsConfig.Shell.Directory == "" {
+			return nil, fmt.Errorf("the shell tool needs a directory to run commands in")
+		}
+		timeout := DEFAULT_SHELL_TIMEOUT
+		if toolsConfig.Shell.Timeout != nil {
+			timeout = *toolsConfig.Shell.Timeout
+		}
+		shell, err := newShellTool(toolsConfig.Shell.Directory, timeout)
+		if err != nil {
+			return nil, err
+		}
+		registry.Register(shell)
+	}
+
+	for _, httpToolConfig := range toolsConfig.HttpTools {
+		httpTool, err := newHttpTool(httpToolConfig)
+		if err != nil {
+			return nil, err
+		}
+		registry.Register(httpTool)
+	}
+	return registry, nil
+}
+
+// Register adds a tool, replacing any tool with the same name.
+func (this *Registry) Register(tool Tool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.tools[tool.Definition().Name] = tool
+}
+
+// Unregister removes a tool.
+func (this *Registry) Unregister(name string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.tools, name)
+}
+
+func (this *Registry) Get(name string) Tool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.tools[name]
+}
+
+// Definitions returns the definitions of all of the tools sorted by name.
+func (this *Registry) Definitions() []*Definition {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	result := []*Definition{}
+	for _, tool := range this.tools {
+		result = append(result, tool.Definition())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Call runs a tool with arguments in JSON format and returns the text to
+// send back to the model. Failures are described in the text so that the
+// model can react to them.
+func (this *Registry) Call(name string, arguments string) string {
+	tool := this.Get(name)
+	if tool == nil {
+		return fmt.Sprintf("Error: there is no tool named '%s'.", name)
+	}
+
+	decodedArguments := map[string]any{}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &decodedArguments); err != nil {
+			return fmt.Sprintf("Error: the arguments are not a valid JSON object: %v", err)
+		}
+	}
+
+	log.Printf("Tools: Calling %s", name)
+	result, err := tool.Call(decodedArguments)
+	if err != nil {
+		log.Printf("Tools: %s failed: %v", name, err)
+		return redact.String("Error: " + err.Error())
+	}
+	return redact.String(truncate(result))
+}
+
+func truncate(text string) string {
+	if len(text) <= MAX_RESULT_LENGTH {
+		return text
+	}
+	return strings.ToValidUTF8(text[:MAX_RESULT_LENGTH], "") + TRUNCATION_MARKER
+}
+
+// makeParameters builds a JSON Schema object from a set of properties.
+func makeParameters(properties map[string]any, required ...string) map[string]any {
+	if required == nil {
+		required = []string{}
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+func stringArgument(arguments map[string]any, name string) (string, error) {
+	value, ok := arguments[name]
+	if !ok {
+		return "", fmt.Errorf("the '%s' argument is missing", name)
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("the '%s' argument must be a string", name)
+	}
+	return text, nil
+}
+
+// MAX_ROUNDS is how many times in a row a model may call tools before it is
+// asked to answer without them.
+const MAX_ROUNDS = 8
+
+// RunCalls calls the tools which a model asked for in ToolCall messages.
+// The calls and their results are passed to `addMessageFunc` to be recorded
+// and are returned in the order which the APIs expect: first all of the
+// calls and then all of the results.
+func (this *Registry) RunCalls(calls []data.Message, addMessageFunc func(message data.Message)) []data.Message {
+	result := []data.Message{}
+	for _, call := range calls {
+		if call.ID == "" {
+			call.ID = uuid.NewString()
+		}
+		if call.ToolCallID == "" {
+			call.ToolCallID = "call_" + uuid.NewString()
+		}
+		call.Role = role.ToolCall
+		addMessageFunc(call)
+		result = append(result, call)
+	}
+
+	results := []data.Message{}
+	for _, call := range result {
+		toolResult := data.Message{
+			ID:         uuid.NewString(),
+			Role:       role.ToolResult,
+			Text:       this.Call(call.ToolName, call.Text),
+			ToolCallID: call.ToolCallID,
+			ToolName:   call.ToolName,
+		}
+		addMessageFunc(toolResult)
+		results = append(results, toolResult)
+	}
+	return append(result, results...)
+}
+
+// InsertBeforeLast returns a copy of `messages` with `newMessages` put
+// before the last message, which is the one receiving the reply.
+func InsertBeforeLast(messages []data.Message, newMessages []data.Message) []data.Message {
+	result := append([]data.Message{}, messages[:len(messages)-1]...)
+	result = append(result, newMessages...)
+	return append(result, messages[len(messages)-1])
+}
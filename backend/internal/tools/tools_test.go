@@ -0,0 +1,224 @@
+package tools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/role"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	RunSandboxHelper()
+	os.Exit(m.Run())
+}
+
+func TestEvaluate(t *testing.T) {
+	cases := map[string]float64{
+		"1 + 2 * 3":          7,
+		"(1 + 2) * 3":        9,
+		"2 ^ 3 ^ 2":          512,
+		"-2 ^ 2":             -4,
+		"10 % 4":             2,
+		"sqrt(16) + abs(-1)": 5,
+		"2 * pi":             6.283185307179586,
+	}
+	for expression, expected := range cases {
+		result, err := Evaluate(expression)
+		if err != nil || result != expected {
+			t.Errorf("Expected %s to be %g, got %g (%v)", expression, expected, result, err)
+		}
+	}
+
+	for _, expression := range []string{"1 +", "1 / 0", "foo(2)", "(1 + 2", "1 2"} {
+		if _, err := Evaluate(expression); err == nil {
+			t.Errorf("Expected %s to be an error", expression)
+		}
+	}
+}
+
+func TestReadFileStaysInDirectory(t *testing.T) {
+	root := t.TempDir()
+	directory := filepath.Join(root, "shared")
+	os.Mkdir(directory, 0755)
+	os.WriteFile(filepath.Join(directory, "notes.txt"), []byte("Hello"), 0644)
+	os.WriteFile(filepath.Join(root, "secret.txt"), []byte("Secret"), 0644)
+	os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(directory, "link.txt"))
+
+	registry := NewRegistry()
+	registry.Register(&readFileTool{directory: directory})
+
+	if result := registry.Call("read_file", `{"path": "notes.txt"}`); result != "Hello" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+	if result := registry.Call("read_file", `{"path": "."}`); !strings.Contains(result, "notes.txt") {
+		t.Errorf("Expected a directory listing, got '%s'", result)
+	}
+	for _, path := range []string{"../secret.txt", "link.txt", "/etc/passwd"} {
+		if result := registry.Call("read_file", `{"path": "`+path+`"}`); !strings.HasPrefix(result, "Error:") {
+			t.Errorf("Expected reading %s to fail, got '%s'", path, result)
+		}
+	}
+}
+
+func TestHttpTool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Key") != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/forecast/New York" {
+			w.Write([]byte("Forecast for " + r.URL.Query().Get("days") + " days: rain"))
+			return
+		}
+		w.Write([]byte("Weather in " + r.URL.Query().Get("city") + ": sunny"))
+	}))
+	defer server.Close()
+
+	configPath := filepath.Join(t.TempDir(), "tools.yaml")
+	os.WriteFile(configPath, []byte(`
+http_tools:
+  - name: weather
+    description: Get the weather
+    url: "`+server.URL+`/weather?city={city}"
+    headers:
+      X-Key: abc
+    parameters:
+      city:
+        description: Name of the city
+        required: true
+  - name: forecast
+    description: Get the forecast
+    url: "`+server.URL+`/forecast/{city}"
+    headers:
+      X-Key: abc
+    parameters:
+      city:
+        description: Name of the city
+        required: true
+      days:
+        type: integer
+        description: Number of days
+`), 0644)
+	toolsConfig, err := ReadConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("ReadConfigFile failed: %v", err)
+	}
+	registry, err := New(toolsConfig)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	names := []string{}
+	for _, definition := range registry.Definitions() {
+		names = append(names, definition.Name)
+	}
+	if strings.Join(names, ",") != "calculator,current_time,forecast,weather" {
+		t.Errorf("Unexpected tools %v", names)
+	}
+	if result := registry.Call("weather", `{"city": "New York"}`); result != "Weather in New York: sunny" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+	if result := registry.Call("forecast", `{"city": "New York", "days": 3}`); result != "Forecast for 3 days: rain" {
+		t.Errorf("Unexpected result '%s'", result)
+	}
+}
+
+func TestRunCalls(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(&calculatorTool{})
+
+	added := []data.Message{}
+	messages := registry.RunCalls([]data.Message{
+		{ToolName: "calculator", Text: `{"expression": "6 * 7"}`},
+		{ToolName: "missing", Text: `{}`},
+	}, func(message data.Message) {
+		added = append(added, message)
+	})
+
+	if len(messages) != 4 || len(added) != 4 {
+		t.Fatalf("Expected two calls and two results, got %d", len(messages))
+	}
+	if messages[0].Role != role.ToolCall || messages[2].Role != role.ToolResult || messages[2].Text != "42" {
+		t.Errorf("Unexpected messages %+v", messages)
+	}
+	if messages[0].ToolCallID == "" || messages[2].ToolCallID != messages[0].ToolCallID {
+		t.Errorf("Expected the result to refer to its call.")
+	}
+	if !strings.HasPrefix(messages[3].Text, "Error:") {
+		t.Errorf("Expected calling an unknown tool to give an error, got '%s'", messages[3].Text)
+	}
+}
+
+func TestMcpToolName(t *testing.T) {
+	cases := map[string]string{
+		McpToolName("files", "read_file"):    "files_read_file",
+		McpToolName("my server", "get.page"): "my_server_get_page",
+	}
+	for name, expected := range cases {
+		if name != expected {
+			t.Errorf("Expected %s, got %s", expected, name)
+		}
+	}
+	if name := McpToolName(strings.Repeat("a", 50), strings.Repeat("b", 50)); len(name) != MAX_TOOL_NAME_LENGTH {
+		t.Errorf("Expected a long name to be cut to %d characters, got %d", MAX_TOOL_NAME_LENGTH, len(name))
+	}
+}
+
+func TestShellSandbox(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the shell tool needs Linux")
+	}
+	directory := t.TempDir()
+	outsideDirectory := t.TempDir()
+	shell, err := newShellTool(directory, 2*time.Second)
+	if err != nil {
+		t.Skipf("no sandbox on this system: %v", err)
+	}
+
+	output, err := shell.run("echo hello > greeting && cat greeting")
+	if err != nil || output != "hello\n" {
+		t.Errorf("Expected the scratch directory to be writable, got %q (%v)", output, err)
+	}
+
+	output, _ = shell.run("touch " + filepath.Join(outsideDirectory, "escaped"))
+	if _, err := os.Stat(filepath.Join(outsideDirectory, "escaped")); err == nil {
+		t.Errorf("Expected files outside the scratch directory to be read only, got %q", output)
+	}
+
+	os.WriteFile(filepath.Join(outsideDirectory, "secret"), []byte("api_token"), 0644)
+	output, _ = shell.run("cat " + filepath.Join(outsideDirectory, "secret"))
+	if strings.Contains(output, "api_token") {
+		t.Errorf("Expected files outside the system and scratch directories to be hidden, got %q", output)
+	}
+
+	output, _ = shell.run("grep : /proc/net/dev | cut -d: -f1")
+	if strings.TrimSpace(output) != "lo" {
+		t.Errorf("Expected no network interfaces except loopback, got %q", output)
+	}
+}
+
+func TestShellTimeoutStopsBackgroundProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the shell tool needs Linux")
+	}
+	directory := t.TempDir()
+	shell, err := newShellTool(directory, 500*time.Millisecond)
+	if err != nil {
+		t.Skipf("no sandbox on this system: %v", err)
+	}
+
+	output, err := shell.run("(sleep 1; touch late) & sleep 10")
+	if err != nil || !strings.Contains(output, "[stopped after") {
+		t.Fatalf("Expected the command to be stopped, got %q (%v)", output, err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(directory, "late")); err == nil {
+		t.Errorf("Expected background processes to be stopped too")
+	}
+}
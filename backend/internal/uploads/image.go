@@ -0,0 +1,246 @@
+package uploads
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+const THUMBNAIL_EDGE = 256
+const JPEG_QUALITY = 90
+const THUMBNAIL_JPEG_QUALITY = 80
+
+// MAX_IMAGE_PIXELS guards against small files which decode into huge
+// images.
+const MAX_IMAGE_PIXELS = 100_000_000
+
+var ErrUnsupportedImage = errors.New("only JPEG, PNG and GIF images are supported")
+
+// Image is an uploaded image prepared for models and the web UI.
+type Image struct {
+	// Content is the image given to models, and is the upload itself if
+	// IsConverted is false.
+	Content     []byte
+	MimeType    string
+	IsConverted bool
+
+	Thumbnail         []byte
+	ThumbnailMimeType string
+}
+
+// PrepareImage makes the version of an uploaded image which is given to
+// models: turned upright, scaled down to fit in `maxEdge` pixels and encoded
+// as JPEG or PNG. Images which already meet these are used as they are. A
+// thumbnail is also made.
+func PrepareImage(content []byte, maxEdge int) (*Image, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	if config.Width*config.Height > MAX_IMAGE_PIXELS {
+		return nil, fmt.Errorf("the image is too large at %dx%d pixels", config.Width, config.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("the image can't be read: %w", err)
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(content)
+	}
+	bounds := decoded.Bounds()
+	isSupported := format == "jpeg" || format == "png"
+	fitsEdge := bounds.Dx() <= maxEdge && bounds.Dy() <= maxEdge
+
+	result := &Image{Content: content, MimeType: "image/" + format}
+	if !isSupported || !fitsEdge || orientation != 1 {
+		// Photos stay JPEG, while drawings and images with transparency
+		// stay lossless.
+		useJpeg := format == "jpeg"
+		prepared := orient(scaleToFit(decoded, maxEdge), orientation)
+		result.Content, result.MimeType, err = encode(prepared, useJpeg, JPEG_QUALITY)
+		if err != nil {
+			return nil, err
+		}
+		result.IsConverted = true
+	}
+
+	thumbnail := orient(scaleToFit(decoded, THUMBNAIL_EDGE), orientation)
+	result.Thumbnail, result.ThumbnailMimeType, err = encode(thumbnail, isOpaque(decoded), THUMBNAIL_JPEG_QUALITY)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func encode(picture image.Image, useJpeg bool, quality int) ([]byte, string, error) {
+	buffer := &bytes.Buffer{}
+	if useJpeg {
+		if err := jpeg.Encode(buffer, picture, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, "", err
+		}
+		return buffer.Bytes(), "image/jpeg", nil
+	}
+	if err := png.Encode(buffer, picture); err != nil {
+		return nil, "", err
+	}
+	return buffer.Bytes(), "image/png", nil
+}
+
+func isOpaque(picture image.Image) bool {
+	if opaque, ok := picture.(interface{ Opaque() bool }); ok {
+		return opaque.Opaque()
+	}
+	return false
+}
+
+// scaleToFit shrinks an image so that neither edge is longer than `maxEdge`.
+// Each new pixel is the average of the pixels it covers, which keeps fine
+// detail such as text readable.
+func scaleToFit(picture image.Image, maxEdge int) image.Image {
+	bounds := picture.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxEdge && height <= maxEdge {
+		return picture
+	}
+	newWidth, newHeight := maxEdge, max(1, height*maxEdge/width)
+	if height > width {
+		newWidth, newHeight = max(1, width*maxEdge/height), maxEdge
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		y0 := bounds.Min.Y + y*height/newHeight
+		y1 := max(bounds.Min.Y+(y+1)*height/newHeight, y0+1)
+		for x := 0; x < newWidth; x++ {
+			x0 := bounds.Min.X + x*width/newWidth
+			x1 := max(bounds.Min.X+(x+1)*width/newWidth, x0+1)
+
+			var r, g, b, a uint64
+			for sourceY := y0; sourceY < y1; sourceY++ {
+				for sourceX := x0; sourceX < x1; sourceX++ {
+					pixelR, pixelG, pixelB, pixelA := picture.At(sourceX, sourceY).RGBA()
+					r += uint64(pixelR)
+					g += uint64(pixelG)
+					b += uint64(pixelB)
+					a += uint64(pixelA)
+				}
+			}
+			count := uint64((y1 - y0) * (x1 - x0))
+			offset := result.PixOffset(x, y)
+			result.Pix[offset] = uint8(r / count >> 8)
+			result.Pix[offset+1] = uint8(g / count >> 8)
+			result.Pix[offset+2] = uint8(b / count >> 8)
+			result.Pix[offset+3] = uint8(a / count >> 8)
+		}
+	}
+	return result
+}
+
+// orient turns an image upright according to its EXIF orientation, which
+// is lost when it is encoded again.
+func orient(picture image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return picture
+	}
+	bounds := picture.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	newWidth, newHeight := width, height
+	if orientation >= 5 {
+		newWidth, newHeight = height, width
+	}
+
+	result := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			// Find the pixel of the stored image which is shown here.
+			var sourceX, sourceY int
+			switch orientation {
+			case 2:
+				sourceX, sourceY = width-1-x, y
+			case 3:
+				sourceX, sourceY = width-1-x, height-1-y
+			case 4:
+				sourceX, sourceY = x, height-1-y
+			case 5:
+				sourceX, sourceY = y, x
+			case 6:
+				sourceX, sourceY = y, height-1-x
+			case 7:
+				sourceX, sourceY = width-1-y, height-1-x
+			case 8:
+				sourceX, sourceY = width-1-y, x
+			}
+			result.Set(x, y, picture.At(bounds.Min.X+sourceX, bounds.Min.Y+sourceY))
+		}
+	}
+	return result
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, which is 1 for an
+// image which is stored upright.
+func jpegOrientation(content []byte) int {
+	if !bytes.HasPrefix(content, []byte{0xff, 0xd8}) {
+		return 1
+	}
+	position := 2
+	for position+4 <= len(content) && content[position] == 0xff {
+		marker := content[position+1]
+		if marker == 0xda || marker == 0xd9 {
+			// The image data starts, so there is no more metadata.
+			break
+		}
+		length := int(binary.BigEndian.Uint16(content[position+2:]))
+		if length < 2 {
+			break
+		}
+		end := min(position+2+length, len(content))
+		segment := content[position+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		position = end
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	directory := int(order.Uint32(tiff[4:]))
+	if directory+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[directory:]))
+	for i := 0; i < count; i++ {
+		entry := directory + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
@@ -0,0 +1,134 @@
+// Package uploads checks the files which users attach to sessions: it works
+// out their real type, enforces size limits and prepares images for models.
+package uploads
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/extract"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+	"gopkg.in/yaml.v3"
+)
+
+// DEFAULT_SIZE_LIMITS are the largest uploads in megabytes by MIME type. A
+// type ending in `/*` covers a whole family and `*` covers everything else.
+var DEFAULT_SIZE_LIMITS = map[string]float64{
+	"image/*":         20,
+	"text/*":          10,
+	"application/pdf": 50,
+	"*":               25,
+}
+
+const DEFAULT_MAX_IMAGE_EDGE = 1568
+
+const MEGABYTE = 1024 * 1024
+
+type UploadsConfig struct {
+	// SizeLimits overrides and adds to DEFAULT_SIZE_LIMITS.
+	SizeLimits map[string]float64 `yaml:"size_limits_mb"`
+
+	// MaxImageEdge is the longest edge in pixels of the images given to
+	// models. Larger images are scaled down.
+	MaxImageEdge int `yaml:"max_image_edge"`
+}
+
+func ReadConfigFile(file string) (*UploadsConfig, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read uploads config file: %w", err)
+	}
+	uploadsConfig := &UploadsConfig{}
+	if err := yaml.Unmarshal(content, uploadsConfig); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal uploads config file '%s': %w", file, err)
+	}
+	return uploadsConfig, nil
+}
+
+type Uploads struct {
+	sizeLimits   map[string]float64
+	maxImageEdge int
+}
+
+// New applies a configuration on top of the defaults. `uploadsConfig` may
+// be nil.
+func New(uploadsConfig *UploadsConfig) (*Uploads, error) {
+	this := &Uploads{
+		sizeLimits:   map[string]float64{},
+		maxImageEdge: DEFAULT_MAX_IMAGE_EDGE,
+	}
+	for mimeType, limit := range DEFAULT_SIZE_LIMITS {
+		this.sizeLimits[mimeType] = limit
+	}
+	if uploadsConfig == nil {
+		return this, nil
+	}
+
+	for mimeType, limit := range uploadsConfig.SizeLimits {
+		if limit <= 0 {
+			return nil, fmt.Errorf("the size limit for '%s' must be more than zero", mimeType)
+		}
+		this.sizeLimits[strings.ToLower(mimeType)] = limit
+	}
+	if uploadsConfig.MaxImageEdge < 0 {
+		return nil, fmt.Errorf("max_image_edge must not be negative")
+	}
+	if uploadsConfig.MaxImageEdge != 0 {
+		this.maxImageEdge = uploadsConfig.MaxImageEdge
+	}
+	return this, nil
+}
+
+// SizeLimit returns the largest allowed size in bytes of a file of a type.
+func (this *Uploads) SizeLimit(mimeType string) int64 {
+	mimeType = strings.ToLower(mimeType)
+	family, _, _ := strings.Cut(mimeType, "/")
+	for _, key := range []string{mimeType, family + "/*", "*"} {
+		if limit, ok := this.sizeLimits[key]; ok {
+			return int64(limit * MEGABYTE)
+		}
+	}
+	return int64(DEFAULT_SIZE_LIMITS["*"] * MEGABYTE)
+}
+
+// MaxSizeLimit returns the largest size limit of any type. Nothing larger
+// needs to be read.
+func (this *Uploads) MaxSizeLimit() int64 {
+	result := int64(0)
+	for mimeType := range this.sizeLimits {
+		result = max(result, this.SizeLimit(mimeType))
+	}
+	return result
+}
+
+// MaxImageEdge returns the longest edge of the images given to models.
+func (this *Uploads) MaxImageEdge() int {
+	return this.maxImageEdge
+}
+
+// DetectMimeType works out the type of a file from its contents. The type
+// sent by the client can't be trusted, but text formats can't be told apart
+// by their contents, so for text the client's type, or else the type implied
+// by the file name, is used if it is a text type.
+func DetectMimeType(content []byte, clientMimeType string, filename string) string {
+	detected := mimetype.Detect(content)
+	if !detected.Is("text/plain") {
+		return baseType(detected.String())
+	}
+	for _, candidate := range []string{clientMimeType, mime.TypeByExtension(filepath.Ext(filename))} {
+		candidate = baseType(candidate)
+		if extract.IsText(candidate) || candidate == extract.MIME_TYPE_HTML {
+			return candidate
+		}
+	}
+	return "text/plain"
+}
+
+// baseType removes any parameters such as `; charset=utf-8`.
+func baseType(mimeType string) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
@@ -0,0 +1,120 @@
+package uploads
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestSizeLimit(t *testing.T) {
+	uploads, err := New(&UploadsConfig{SizeLimits: map[string]float64{"image/png": 1, "Text/*": 0.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{
+		"image/png":       1 * MEGABYTE,
+		"image/jpeg":      20 * MEGABYTE,
+		"text/csv":        MEGABYTE / 2,
+		"application/pdf": 50 * MEGABYTE,
+		"application/zip": 25 * MEGABYTE,
+	}
+	for mimeType, limit := range expected {
+		if uploads.SizeLimit(mimeType) != limit {
+			t.Errorf("Expected a limit of %d for %s, got %d", limit, mimeType, uploads.SizeLimit(mimeType))
+		}
+	}
+	if uploads.MaxSizeLimit() != 50*MEGABYTE {
+		t.Errorf("Expected the largest limit to be 50 MB, got %d", uploads.MaxSizeLimit())
+	}
+
+	if _, err := New(&UploadsConfig{SizeLimits: map[string]float64{"*": 0}}); err == nil {
+		t.Errorf("Expected a limit of zero to be an error")
+	}
+}
+
+func makePng(width int, height int) []byte {
+	picture := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			picture.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	buffer := &bytes.Buffer{}
+	png.Encode(buffer, picture)
+	return buffer.Bytes()
+}
+
+func TestDetectMimeType(t *testing.T) {
+	if mimeType := DetectMimeType(makePng(4, 4), "text/plain", "notes.txt"); mimeType != "image/png" {
+		t.Errorf("Expected the client's type to be replaced by image/png, got %s", mimeType)
+	}
+	if mimeType := DetectMimeType([]byte("name,age\nAnn,31\n"), "text/csv", "people.csv"); mimeType != "text/csv" {
+		t.Errorf("Expected the client's text type to be kept, got %s", mimeType)
+	}
+	if mimeType := DetectMimeType([]byte("# Notes\n"), "", "notes.md"); mimeType != "text/markdown" {
+		t.Errorf("Expected the type of the file name's extension, got %s", mimeType)
+	}
+	if mimeType := DetectMimeType([]byte("just text"), "image/png", "picture.png"); mimeType != "text/plain" {
+		t.Errorf("Expected text claiming to be an image to be text/plain, got %s", mimeType)
+	}
+}
+
+func TestPrepareImage(t *testing.T) {
+	prepared, err := PrepareImage(makePng(2000, 1000), DEFAULT_MAX_IMAGE_EDGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prepared.IsConverted || prepared.MimeType != "image/png" {
+		t.Fatalf("Expected a large PNG to be converted to a PNG, got %s", prepared.MimeType)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(prepared.Content))
+	if err != nil || config.Width != 1568 || config.Height != 784 {
+		t.Errorf("Expected the image to be scaled to 1568x784, got %dx%d (%v)", config.Width, config.Height, err)
+	}
+	config, _, err = image.DecodeConfig(bytes.NewReader(prepared.Thumbnail))
+	if err != nil || config.Width != THUMBNAIL_EDGE || config.Height != THUMBNAIL_EDGE/2 {
+		t.Errorf("Unexpected thumbnail size %dx%d (%v)", config.Width, config.Height, err)
+	}
+	if prepared.ThumbnailMimeType != "image/jpeg" {
+		t.Errorf("Expected an opaque image to get a JPEG thumbnail, got %s", prepared.ThumbnailMimeType)
+	}
+
+	buffer := &bytes.Buffer{}
+	jpeg.Encode(buffer, image.NewRGBA(image.Rect(0, 0, 100, 50)), nil)
+	prepared, err = PrepareImage(buffer.Bytes(), DEFAULT_MAX_IMAGE_EDGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepared.IsConverted || !bytes.Equal(prepared.Content, buffer.Bytes()) || prepared.MimeType != "image/jpeg" {
+		t.Errorf("Expected a small JPEG to be used as it is")
+	}
+
+	if _, err := PrepareImage([]byte("not an image"), DEFAULT_MAX_IMAGE_EDGE); err != ErrUnsupportedImage {
+		t.Errorf("Expected ErrUnsupportedImage, got %v", err)
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	// An EXIF block in Motorola byte order with one entry: orientation 6.
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	content := append([]byte{0xff, 0xd8, 0xff, 0xe1, 0, byte(len(segment) + 2)}, segment...)
+	content = append(content, 0xff, 0xd9)
+	if orientation := jpegOrientation(content); orientation != 6 {
+		t.Fatalf("Expected orientation 6, got %d", orientation)
+	}
+
+	// Orientation 6 means that the image must be turned clockwise.
+	picture := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	picture.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	upright := orient(picture, 6)
+	if upright.Bounds().Dx() != 1 || upright.Bounds().Dy() != 2 {
+		t.Fatalf("Expected a 1x2 image, got %v", upright.Bounds())
+	}
+	if r, _, _, _ := upright.At(0, 0).RGBA(); r != 0xffff {
+		t.Errorf("Expected the left pixel to be turned to the top")
+	}
+}
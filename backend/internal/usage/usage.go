@@ -0,0 +1,83 @@
+package usage
+
+import (
+	"sedwards2009/llm-multitool/internal/data"
+	"sort"
+	"time"
+)
+
+type totals struct {
+	byKey map[string]*data.UsageTotal
+}
+
+func (this *totals) add(key string, usage *data.Usage) {
+	total, ok := this.byKey[key]
+	if !ok {
+		total = &data.UsageTotal{Key: key}
+		this.byKey[key] = total
+	}
+	addToTotal(total, usage)
+}
+
+// sorted returns the totals ordered by key.
+func (this *totals) sorted() []*data.UsageTotal {
+	result := make([]*data.UsageTotal, 0, len(this.byKey))
+	for _, total := range this.byKey {
+		result = append(result, total)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+func addToTotal(total *data.UsageTotal, usage *data.Usage) {
+	total.Requests++
+	total.PromptTokens += usage.PromptTokens
+	total.CompletionTokens += usage.CompletionTokens
+	if usage.Cost != nil {
+		total.Cost += *usage.Cost
+	}
+}
+
+// Aggregate sums the usage of the responses in the sessions by day, by model
+// and by session. Days are in UTC and in YYYY-MM-DD format. Responses
+// created before `since` are skipped.
+func Aggregate(sessions []*data.Session, since time.Time) *data.UsageReport {
+	total := &data.UsageTotal{Key: "total"}
+	byDay := &totals{byKey: map[string]*data.UsageTotal{}}
+	byModel := &totals{byKey: map[string]*data.UsageTotal{}}
+	bySession := &totals{byKey: map[string]*data.UsageTotal{}}
+
+	for _, session := range sessions {
+		for _, response := range session.Responses {
+			if response.Usage == nil {
+				continue
+			}
+
+			creationTime, err := time.Parse(time.RFC3339, response.CreationTimestamp)
+			if err != nil || creationTime.Before(since) {
+				continue
+			}
+
+			addToTotal(total, response.Usage)
+			byDay.add(creationTime.UTC().Format(time.DateOnly), response.Usage)
+			byModel.add(modelKey(response), response.Usage)
+			bySession.add(session.ID, response.Usage)
+		}
+	}
+
+	return &data.UsageReport{
+		Total:     total,
+		ByDay:     byDay.sorted(),
+		ByModel:   byModel.sorted(),
+		BySession: bySession.sorted(),
+	}
+}
+
+func modelKey(response *data.Response) string {
+	if response.ModelSettingsSnapshot == nil {
+		return ""
+	}
+	return response.ModelSettingsSnapshot.ModelID
+}
@@ -0,0 +1,74 @@
+package usage
+
+import (
+	"sedwards2009/llm-multitool/internal/data"
+	"testing"
+	"time"
+)
+
+func makeResponse(timestamp string, modelID string, promptTokens int, completionTokens int,
+	cost *float64) *data.Response {
+
+	return &data.Response{
+		CreationTimestamp:     timestamp,
+		ModelSettingsSnapshot: &data.ModelSettingsSnapshot{ModelSettings: data.ModelSettings{ModelID: modelID}},
+		Usage:                 &data.Usage{PromptTokens: promptTokens, CompletionTokens: completionTokens, Cost: cost},
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	cost := 0.5
+	sessions := []*data.Session{
+		{
+			ID: "session1",
+			Responses: []*data.Response{
+				makeResponse("2024-03-01T10:00:00Z", "modelA", 10, 20, &cost),
+				makeResponse("2024-03-02T10:00:00Z", "modelB", 1, 2, nil),
+				{CreationTimestamp: "2024-03-02T11:00:00Z"},
+			},
+		},
+		{
+			ID: "session2",
+			Responses: []*data.Response{
+				makeResponse("2024-03-02T12:00:00Z", "modelA", 100, 200, &cost),
+			},
+		},
+	}
+
+	report := Aggregate(sessions, time.Time{})
+
+	if report.Total.Requests != 3 || report.Total.PromptTokens != 111 || report.Total.CompletionTokens != 222 {
+		t.Errorf("Unexpected total: %+v", report.Total)
+	}
+	if report.Total.Cost != 1.0 {
+		t.Errorf("Expected a total cost of 1.0, got %f", report.Total.Cost)
+	}
+
+	if len(report.ByDay) != 2 || report.ByDay[0].Key != "2024-03-01" || report.ByDay[1].Requests != 2 {
+		t.Errorf("Unexpected totals by day: %+v %+v", report.ByDay[0], report.ByDay[1])
+	}
+	if len(report.ByModel) != 2 || report.ByModel[0].Key != "modelA" || report.ByModel[0].PromptTokens != 110 {
+		t.Errorf("Unexpected totals by model: %+v", report.ByModel[0])
+	}
+	if len(report.BySession) != 2 || report.BySession[1].CompletionTokens != 200 {
+		t.Errorf("Unexpected totals by session: %+v", report.BySession[1])
+	}
+}
+
+func TestAggregateSince(t *testing.T) {
+	sessions := []*data.Session{
+		{
+			ID: "session1",
+			Responses: []*data.Response{
+				makeResponse("2024-03-01T10:00:00Z", "modelA", 10, 20, nil),
+				makeResponse("2024-03-05T10:00:00Z", "modelA", 1, 2, nil),
+			},
+		},
+	}
+
+	since, _ := time.Parse(time.RFC3339, "2024-03-04T00:00:00Z")
+	report := Aggregate(sessions, since)
+	if report.Total.Requests != 1 || report.Total.PromptTokens != 1 {
+		t.Errorf("Expected only the newer response to be counted, got %+v", report.Total)
+	}
+}
@@ -2,28 +2,54 @@ package main
 
 import (
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"sedwards2009/llm-multitool/internal/argsparser"
+	"sedwards2009/llm-multitool/internal/auth"
 	"sedwards2009/llm-multitool/internal/broadcaster"
+	"sedwards2009/llm-multitool/internal/configcheck"
 	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/data/priority"
 	"sedwards2009/llm-multitool/internal/data/responsestatus"
 	"sedwards2009/llm-multitool/internal/data/role"
 	"sedwards2009/llm-multitool/internal/engine"
+	"sedwards2009/llm-multitool/internal/engine/types"
+	"sedwards2009/llm-multitool/internal/extract"
+	"sedwards2009/llm-multitool/internal/filewatcher"
+	"sedwards2009/llm-multitool/internal/gateway"
+	"sedwards2009/llm-multitool/internal/knowledge"
+	"sedwards2009/llm-multitool/internal/mcp"
 	"sedwards2009/llm-multitool/internal/mem_storage"
 	"sedwards2009/llm-multitool/internal/presets"
+	"sedwards2009/llm-multitool/internal/redact"
 	"sedwards2009/llm-multitool/internal/template"
+	"sedwards2009/llm-multitool/internal/titles"
+	"sedwards2009/llm-multitool/internal/tools"
+	"sedwards2009/llm-multitool/internal/uploads"
+	"sedwards2009/llm-multitool/internal/usage"
 
 	"github.com/bobg/go-generics/v2/slices"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //go:embed resources/* config/*
@@ -35,64 +61,309 @@ var llmEngine *engine.Engine = nil
 var presetDatabase *presets.PresetDatabase = nil
 var sessionBroadcaster *broadcaster.Broadcaster = nil
 var templates *template.TemplateDatabase = nil
+var authentication *auth.Auth = nil
+var titleGenerator *titles.Generator = nil
+var toolRegistry *tools.Registry = nil
+var mcpClients []*mcp.Client = nil
+var knowledgeBase *knowledge.Knowledge = nil
+var uploadRules *uploads.Uploads = nil
+
+// Names of the files in the storage directory which hold the user's templates
+// and presets when no explicit file was given on the command line.
+const userTemplatesFilename = "templates.yaml"
+const userPresetsFilename = "presets.yaml"
 
 func setupStorage(storagePath string) *mem_storage.SimpleStorage {
-	return mem_storage.New(storagePath)
+	storage := mem_storage.New(storagePath)
+	storage.RemoveOrphanedFiles()
+	return storage
 }
 
 func setupEngine(configPath string, presetDatabase *presets.PresetDatabase) *engine.Engine {
 	return engine.NewEngine(configPath, presetDatabase)
 }
 
-func setupTemplates(templatesPath string) *template.TemplateDatabase {
+func setupTemplates(templatesPath string, storagePath string) *template.TemplateDatabase {
 	if templatesPath != "" {
-		presetDatabase, err := template.MakeTemplateDatabase(templatesPath)
-		if err == nil {
-			return presetDatabase
+		// Changes are written back to the file, so it must not be replaced by
+		// the built in templates when it is broken.
+		templateDatabase, err := template.MakeTemplateDatabase(templatesPath)
+		if err != nil {
+			log.Fatal(err)
 		}
+		return templateDatabase
+	}
+
+	userTemplatesPath := filepath.Join(storagePath, userTemplatesFilename)
+	templateDatabase, err := template.MakeTemplateDatabase(userTemplatesPath)
+	if err == nil {
+		return templateDatabase
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Fatal(err)
 	}
 
 	contents, _ := staticFS.ReadFile("config/templates.yaml")
-	templateDatabase, _ := template.MakeTemplateDatabaseFromBytes(contents, "(internal)")
+	templateDatabase, _ = template.MakeTemplateDatabaseFromBytes(contents, "(internal)")
+	templateDatabase.SetFilePath(userTemplatesPath)
 	return templateDatabase
 }
 
-func setupPresets(presetsPath string) *presets.PresetDatabase {
+func setupPresets(presetsPath string, storagePath string) *presets.PresetDatabase {
 	if presetsPath != "" {
+		// Changes are written back to the file, so it must not be replaced by
+		// the built in presets when it is broken.
 		presetDatabase, err := presets.MakePresetDatabase(presetsPath)
-		if err == nil {
-			return presetDatabase
+		if err != nil {
+			log.Fatal(err)
 		}
+		return presetDatabase
+	}
+
+	userPresetsPath := filepath.Join(storagePath, userPresetsFilename)
+	presetDatabase, err := presets.MakePresetDatabase(userPresetsPath)
+	if err == nil {
+		return presetDatabase
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		log.Fatal(err)
 	}
 
 	contents, _ := staticFS.ReadFile("config/presets.yaml")
-	presetDatabase, _ := presets.MakePresentDatabaseFromBytes(contents, "(internal)")
+	presetDatabase, _ = presets.MakePresentDatabaseFromBytes(contents, "(internal)")
+	presetDatabase.SetFilePath(userPresetsPath)
 	return presetDatabase
 }
 
+// reloadLock serialises reloads triggered by the API, SIGHUP and the file watcher.
+var reloadLock sync.Mutex
+
+// reloadConfig rereads the backend config, templates and presets. Anything
+// which fails to load keeps its current configuration. The errors are returned.
+func reloadConfig() []string {
+	log.Printf("Reloading configuration")
+	return reload(llmEngine.Reload, templates.Reload, presetDatabase.Reload)
+}
+
+func reload(reloadFuncs ...func() error) []string {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	errorMessages := []string{}
+	for _, reloadFunc := range reloadFuncs {
+		if err := reloadFunc(); err != nil {
+			errorMessages = append(errorMessages, err.Error())
+		}
+	}
+
+	for _, message := range errorMessages {
+		log.Printf("Reload error: %s", message)
+	}
+	return errorMessages
+}
+
+func setupReloadTriggers() *filewatcher.FileWatcher {
+	hangupChan := make(chan os.Signal, 1)
+	signal.Notify(hangupChan, syscall.SIGHUP)
+	go func() {
+		for range hangupChan {
+			reloadConfig()
+		}
+	}()
+
+	// Only the part of the configuration which was changed is reloaded, so
+	// that editing a template doesn't rebuild the backends.
+	return filewatcher.New(map[string]func(){
+		llmEngine.ConfigFilePath(): func() {
+			log.Printf("Reloading %s", llmEngine.ConfigFilePath())
+			reload(llmEngine.Reload)
+		},
+		templates.FilePath(): func() {
+			log.Printf("Reloading %s", templates.FilePath())
+			reload(templates.Reload)
+		},
+		presetDatabase.FilePath(): func() {
+			log.Printf("Reloading %s", presetDatabase.FilePath())
+			reload(presetDatabase.Reload)
+		},
+	})
+}
+
+// resolveUserFilePath returns the templates or presets file which will be
+// used, or an empty string if the built in one will be used.
+func resolveUserFilePath(commandLinePath string, storagePath string, userFilename string) string {
+	if commandLinePath != "" {
+		return commandLinePath
+	}
+	userFilePath := filepath.Join(storagePath, userFilename)
+	if _, err := os.Stat(userFilePath); err == nil {
+		return userFilePath
+	}
+	return ""
+}
+
 func setupBroadcaster() *broadcaster.Broadcaster {
 	return broadcaster.NewBroadcaster()
 }
 
-func setupRouter() *gin.Engine {
+func setupAuth(authConfigPath string) *auth.Auth {
+	if authConfigPath == "" {
+		return nil
+	}
+
+	authConfig, err := auth.ReadConfigFile(authConfigPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authentication, err := auth.New(authConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if authentication.DefaultOwner() != "" {
+		sessionStorage.ClaimUnownedSessions(authentication.DefaultOwner())
+	}
+	if len(authConfig.Admins) == 0 {
+		log.Printf("No admins are configured in %s, so no one may change templates, presets or the configuration.",
+			authConfigPath)
+	}
+	return authentication
+}
+
+func setupTitleGenerator(titleModel string) *titles.Generator {
+	if titleModel == "" {
+		return nil
+	}
+	return titles.New(llmEngine, sessionStorage, titleModel, func(sessionId string) {
+		sessionBroadcaster.Send(sessionId, "changed")
+	})
+}
+
+func setupTools(toolsPath string) *tools.Registry {
+	if toolsPath == "" {
+		return nil
+	}
+
+	toolsConfig, err := tools.ReadConfigFile(toolsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registry, err := tools.New(toolsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mcpClients = setupMcpServers(toolsConfig.McpServers, registry)
+	return registry
+}
+
+// setupMcpServers starts the configured MCP servers and registers their
+// tools. A server which fails to start is left out so that the others can
+// still be used. The tools of a server are removed again when it stops.
+func setupMcpServers(serverConfigs []*mcp.ServerConfig, registry *tools.Registry) []*mcp.Client {
+	clients := []*mcp.Client{}
+	for _, serverConfig := range serverConfigs {
+		client, err := mcp.Start(serverConfig)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		registry.RegisterMcpServer(client)
+		go func(client *mcp.Client) {
+			<-client.Stopped()
+			registry.UnregisterMcpServer(client)
+		}(client)
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func stopMcpServers() {
+	for _, client := range mcpClients {
+		client.Close()
+	}
+}
+
+func setupKnowledge(knowledgePath string, storagePath string) *knowledge.Knowledge {
+	if knowledgePath == "" {
+		return nil
+	}
+
+	knowledgeConfig, err := knowledge.ReadConfigFile(knowledgePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	embedFunc := func(modelID string, texts []string, requestPriority priority.Priority) ([][]float32, error) {
+		vectors, _, err := llmEngine.Embed(modelID, texts, requestPriority)
+		return vectors, err
+	}
+	knowledgeBase, err := knowledge.New(knowledgeConfig, storagePath, embedFunc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		// The engine answers once it has scanned the models, which are
+		// needed for the embeddings.
+		llmEngine.ModelOverview()
+		knowledgeBase.IngestAll()
+	}()
+	return knowledgeBase
+}
+
+func setupUploads(uploadsPath string) *uploads.Uploads {
+	var uploadsConfig *uploads.UploadsConfig = nil
+	if uploadsPath != "" {
+		var err error
+		uploadsConfig, err = uploads.ReadConfigFile(uploadsPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	uploadRules, err := uploads.New(uploadsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return uploadRules
+}
+
+func setupGateway(recordApiCalls bool) *gateway.Gateway {
+	var recordStorage *mem_storage.SimpleStorage = nil
+	if recordApiCalls {
+		recordStorage = sessionStorage
+	}
+	return gateway.New(llmEngine, presetDatabase, recordStorage)
+}
+
+func setupRouter(apiGateway *gateway.Gateway) *gin.Engine {
 	r := gin.Default()
 	logger := gin.Logger()
 	r.Use(logger)
 
-	r.Use(cors.New(cors.Config{
-		// AllowOrigins:     []string{"*"},
-		AllowAllOrigins:  true,
+	corsConfig := cors.Config{
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "PATCH"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length", "Content-Type"},
 		AllowCredentials: true,
 		MaxAge:           10 * time.Second,
-	}))
+	}
+	if authentication == nil {
+		corsConfig.AllowAllOrigins = true
+		r.Use(cors.New(corsConfig))
+	} else if len(authentication.AllowedOrigins()) != 0 {
+		corsConfig.AllowOrigins = authentication.AllowedOrigins()
+		r.Use(cors.New(corsConfig))
+	}
+
+	r.GET("/api/ping", handlePing)
+
+	if authentication != nil {
+		r.Use(authentication.Middleware())
+	}
 
 	r.GET("/", handleIndex)
 	r.GET("/assets/*filepath", handleAssets)
 	r.GET("/session/:sessionId", handleIndex)
-	r.GET("/api/ping", handlePing)
+	r.POST("/api/admin/reload", handleAdminReloadPost)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	apiGateway.Register(r)
 	r.GET("/api/session", handleSessionOverview)
 	r.POST("/api/session", handleNewSession)
 	r.GET("/api/session/:sessionId", handleSessionGet)
@@ -105,14 +376,29 @@ func setupRouter() *gin.Engine {
 	r.GET("/api/session/:sessionId/changes", handleSessionChangesGet)
 	r.DELETE("/api/session/:sessionId/response/:responseId", handleResponseDelete)
 	r.GET("/api/model", handleModelOverviewGet)
+	r.GET("/api/usage", handleUsageGet)
+	r.GET("/api/storage/stats", handleStorageStatsGet)
+	r.GET("/api/queue", handleQueueGet)
 	r.POST("/api/model/scan", handleModelScanPost)
+	r.GET("/api/backend", handleBackendOverviewGet)
 	r.PUT("/api/session/:sessionId/modelSettings", handleSessionModelSettingsPut)
 	r.POST("/api/session/:sessionId/response/:responseId/message", handleNewMessagePost)
 	r.DELETE("/api/session/:sessionId/response/:responseId/message/:messageId", handleResponseMessageDelete)
 	r.POST("/api/session/:sessionId/response/:responseId/continue", handleMessageContinuePost)
 	r.POST("/api/session/:sessionId/response/:responseId/abort", handleResponseAbortPost)
 	r.GET("/api/template", handleTemplateOverviewGet)
+	r.POST("/api/template", handleTemplatePost)
+	r.PUT("/api/template/:templateId", handleTemplatePut)
+	r.DELETE("/api/template/:templateId", handleTemplateDelete)
+	r.GET("/api/mcp", handleMcpOverviewGet)
+	r.GET("/api/knowledge", handleKnowledgeOverviewGet)
+	r.POST("/api/embed", handleEmbedPost)
+	r.POST("/api/admin/knowledge/:collection/ingest", handleAdminKnowledgeIngestPost)
+	r.POST("/api/mcp/:serverName/prompt/:promptName/import", handleMcpPromptImportPost)
 	r.GET("/api/preset", handlePresetOverviewGet)
+	r.POST("/api/preset", handlePresetPost)
+	r.PUT("/api/preset/:presetId", handlePresetPut)
+	r.DELETE("/api/preset/:presetId", handlePresetDelete)
 
 	return r
 }
@@ -133,11 +419,67 @@ func handlePing(c *gin.Context) {
 	c.String(http.StatusOK, "pong")
 }
 
+func handleAdminReloadPost(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may reload the configuration")
+		return
+	}
+
+	var result struct {
+		Errors []string `json:"errors"`
+	}
+	result.Errors = reloadConfig()
+
+	if len(result.Errors) != 0 {
+		c.JSON(http.StatusInternalServerError, &result)
+		return
+	}
+	c.JSON(http.StatusOK, &result)
+}
+
+func handleAdminKnowledgeIngestPost(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may ingest knowledge collections")
+		return
+	}
+
+	collection := c.Params.ByName("collection")
+	if knowledgeBase == nil || !knowledgeBase.Exists(collection) {
+		c.String(http.StatusNotFound, "Knowledge collection not found")
+		return
+	}
+	go func() {
+		if err := knowledgeBase.Ingest(collection); err != nil {
+			log.Printf("Unable to ingest knowledge collection %s: %v", collection, err)
+		}
+	}()
+	c.Status(http.StatusAccepted)
+}
+
 var upgrader = websocket.Upgrader{
-	//Solve "request origin not allowed by Upgrader.CheckOrigin"
-	CheckOrigin: func(r *http.Request) bool {
+	CheckOrigin: checkWebsocketOrigin,
+}
+
+// checkWebsocketOrigin accepts any origin when authentication is off.
+// Otherwise only same host and configured origins may connect, so another
+// site can't use the browser's credentials to listen in.
+func checkWebsocketOrigin(r *http.Request) bool {
+	if authentication == nil {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if slices.Contains(authentication.AllowedOrigins(), origin) {
 		return true
-	},
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(originURL.Host, r.Host)
 }
 
 const (
@@ -150,9 +492,10 @@ const (
 
 func handleSessionChangesGet(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
+		return
 	}
 
 	wsSession, err := upgrader.Upgrade(c.Writer, c.Request, nil)
@@ -223,8 +566,23 @@ func websocketReader(ws *websocket.Conn) {
 }
 
 func handleSessionOverview(c *gin.Context) {
-	sessionOverview := sessionStorage.SessionOverview()
-	c.JSON(http.StatusOK, sessionOverview)
+	if authentication == nil {
+		c.JSON(http.StatusOK, sessionStorage.SessionOverview())
+		return
+	}
+	c.JSON(http.StatusOK, sessionStorage.SessionOverviewForOwner(auth.User(c)))
+}
+
+// readUserSession reads a session if it belongs to the user making the request.
+func readUserSession(c *gin.Context, sessionId string) *data.Session {
+	session := sessionStorage.ReadSession(sessionId)
+	if session == nil {
+		return nil
+	}
+	if authentication != nil && session.Owner != auth.User(c) {
+		return nil
+	}
+	return session
 }
 
 // Create a new session.
@@ -235,6 +593,8 @@ func handleNewSession(c *gin.Context) {
 		return
 	}
 
+	session.Owner = auth.User(c)
+
 	var data struct {
 		ModelID    string `json:"modelId"`
 		TemplateID string `json:"templateId"`
@@ -261,7 +621,7 @@ func handleNewSession(c *gin.Context) {
 func handleSessionGet(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
 
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session != nil {
 		c.JSON(http.StatusOK, session)
 		return
@@ -271,18 +631,21 @@ func handleSessionGet(c *gin.Context) {
 
 func handleSessionDelete(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
 	}
 	sessionStorage.DeleteSession(sessionId)
+	cancelResponses(slices.Map(session.Responses, func(response *data.Response) string {
+		return response.ID
+	})...)
 	c.Status(http.StatusNoContent)
 }
 
 func handleSessionPromptPut(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
@@ -297,6 +660,10 @@ func handleSessionPromptPut(c *gin.Context) {
 		return
 	}
 
+	if session.Prompt != data.Value {
+		// A new title will be made for the new prompt.
+		session.TitleIsGenerated = false
+	}
 	session.Prompt = data.Value
 	sessionStorage.WriteSession(session)
 
@@ -305,35 +672,156 @@ func handleSessionPromptPut(c *gin.Context) {
 
 func handleSessionFilePost(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
 	}
 
-	file, _ := c.FormFile("file")
-	filename, filepath := sessionStorage.SessionMakeAttachedFileFilepath(session.ID, file.Filename)
+	// The real type, and so the real limit, is only known once the file has
+	// been read, but nothing beyond the largest limit needs to be read.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, uploadRules.MaxSizeLimit()+uploads.MEGABYTE)
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		respondToFormError(c, err, "The upload doesn't contain a file.")
+		return
+	}
 
-	mimeType := c.Request.FormValue("mimeType")
 	originalFilename := c.Request.FormValue("filename")
-
-	c.SaveUploadedFile(file, filepath)
-
-	session.AttachedFiles = append(session.AttachedFiles,
-		&data.AttachedFile{Filename: filename, MimeType: mimeType, OriginalFilename: originalFilename})
+	if originalFilename == "" {
+		originalFilename = fileHeader.Filename
+	}
+	attachedFile := storeUploadedFile(c, fileHeader, c.Request.FormValue("mimeType"), originalFilename)
+	if attachedFile == nil {
+		return
+	}
+	session.AttachedFiles = append(session.AttachedFiles, attachedFile)
 	sessionStorage.WriteSession(session)
 
 	var successResponse struct {
 		Filename string `json:"filename"`
+		MimeType string `json:"mimeType"`
 	}
-	successResponse.Filename = filename
+	successResponse.Filename = attachedFile.Filename
+	successResponse.MimeType = attachedFile.MimeType
 
 	c.JSON(http.StatusOK, &successResponse)
 }
 
+// respondToFormError responds to an error from reading a multipart form. A
+// body which is over the size limit gets its own status.
+func respondToFormError(c *gin.Context, err error, message string) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		c.String(http.StatusRequestEntityTooLarge, "The upload is too large.")
+		return
+	}
+	c.String(http.StatusBadRequest, message)
+}
+
+// storeUploadedFile checks an uploaded file and writes it to the storage
+// directory. The type is worked out from the contents, and images are
+// prepared for models. On failure it responds with an error and returns nil.
+func storeUploadedFile(c *gin.Context, fileHeader *multipart.FileHeader, clientMimeType string,
+	originalFilename string) *data.AttachedFile {
+
+	content, err := readUploadedFile(fileHeader)
+	if err != nil {
+		c.String(http.StatusBadRequest, "Couldn't read the uploaded file.")
+		return nil
+	}
+
+	mimeType := uploads.DetectMimeType(content, clientMimeType, originalFilename)
+	sizeLimit := uploadRules.SizeLimit(mimeType)
+	if int64(len(content)) > sizeLimit {
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("Files of type %s can be at most %.1f MB.", mimeType,
+			float64(sizeLimit)/uploads.MEGABYTE))
+		return nil
+	}
+
+	attachedFile := &data.AttachedFile{MimeType: mimeType, OriginalFilename: originalFilename}
+	storedFilename := fileHeader.Filename
+	if extract.IsImage(mimeType) {
+		image, err := uploads.PrepareImage(content, uploadRules.MaxImageEdge())
+		if errors.Is(err, uploads.ErrUnsupportedImage) {
+			c.String(http.StatusUnsupportedMediaType, err.Error())
+			return nil
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return nil
+		}
+
+		if image.IsConverted {
+			// The original is kept in case it is wanted again later.
+			attachedFile.SourceFilename, err = writeAttachedFile(fileHeader.Filename, content)
+			if err != nil {
+				c.String(http.StatusInternalServerError, "Couldn't store the file.")
+				return nil
+			}
+			attachedFile.SourceMimeType = mimeType
+			content = image.Content
+			attachedFile.MimeType = image.MimeType
+			storedFilename = imageExtension(image.MimeType)
+		}
+		attachedFile.ThumbnailFilename, err = writeAttachedFile(imageExtension(image.ThumbnailMimeType),
+			image.Thumbnail)
+		if err != nil {
+			releaseAttachedFiles([]*data.AttachedFile{attachedFile})
+			c.String(http.StatusInternalServerError, "Couldn't store the file.")
+			return nil
+		}
+	}
+
+	attachedFile.Filename, err = writeAttachedFile(storedFilename, content)
+	if err != nil {
+		releaseAttachedFiles([]*data.AttachedFile{attachedFile})
+		c.String(http.StatusInternalServerError, "Couldn't store the file.")
+		return nil
+	}
+	return attachedFile
+}
+
+func readUploadedFile(fileHeader *multipart.FileHeader) ([]byte, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// writeAttachedFile stores the contents of an attached file and returns its
+// name, which has the extension of `filenameHint`.
+func writeAttachedFile(filenameHint string, content []byte) (string, error) {
+	filename, err := sessionStorage.StoreAttachedFile(content, filenameHint)
+	if err != nil {
+		log.Printf("Unable to write attached file: %v", err)
+		return "", err
+	}
+	return filename, nil
+}
+
+// releaseAttachedFiles gives up newly stored files which won't be attached
+// to a session after all.
+func releaseAttachedFiles(attachedFiles []*data.AttachedFile) {
+	for _, attachedFile := range attachedFiles {
+		for _, filename := range attachedFile.StoredFilenames() {
+			sessionStorage.ReleasePendingFile(filename)
+		}
+	}
+}
+
+func imageExtension(mimeType string) string {
+	if mimeType == "image/jpeg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
 func handleSessionFileGet(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
@@ -351,7 +839,7 @@ func handleSessionFileGet(c *gin.Context) {
 
 func handleSessionFileDelete(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
@@ -374,13 +862,15 @@ func handleSessionFileDelete(c *gin.Context) {
 // Trigger the generation of a new response in a session using the current model and prompt.
 func handleResponsePost(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
 	}
 
-	session.Title = templates.MakeTitle(session.ModelSettings.TemplateID, session.Prompt)
+	if !session.TitleIsGenerated {
+		session.Title = templates.MakeTitle(session.ModelSettings.TemplateID, session.Prompt)
+	}
 	response := CreateNewResponse(session)
 
 	responseId := response.ID
@@ -415,8 +905,13 @@ func handleResponsePost(c *gin.Context) {
 		return success
 	}
 
+	cancel, releaseCancel := makeCancelChan(responseId)
 	completeFunc := func() {
+		releaseCancel()
 		sessionBroadcaster.Send(sessionId, "changed")
+		if titleGenerator != nil {
+			titleGenerator.RequestTitle(sessionId, responseId)
+		}
 	}
 
 	setStatusFunc := func(status responsestatus.ResponseStatus) {
@@ -425,15 +920,63 @@ func handleResponsePost(c *gin.Context) {
 				return false
 			}
 			response.Status = status
+			if status == responsestatus.Running {
+				response.Error = nil
+			}
 			return true
 		})
 		sessionBroadcaster.Send(sessionId, "changed")
 	}
 
-	llmEngine.Enqueue(sessionStorage.GetStoragePath(), response.Messages, appendFunc, completeFunc, setStatusFunc, session.ModelSettings)
+	request := &types.Request{
+		AttachedFilesPath:       sessionStorage.GetStoragePath(),
+		Messages:                response.Messages,
+		AppendFunc:              appendFunc,
+		CompleteFunc:            completeFunc,
+		SetStatusFunc:           setStatusFunc,
+		ModelSettings:           session.ModelSettings,
+		SetUsageFunc:            makeSetUsageFunc(sessionId, responseId),
+		SetTimingFunc:           makeSetTimingFunc(sessionId, responseId),
+		SetContextReductionFunc: makeSetContextReductionFunc(sessionId, responseId),
+		SetActualModelFunc:      makeSetActualModelFunc(sessionId, responseId),
+		SetErrorFunc:            makeSetErrorFunc(sessionId, responseId),
+		Tools:                   toolRegistry,
+		AddMessageFunc:          makeAddMessageFunc(sessionId, responseId),
+		Priority:                priority.Interactive,
+		Cancel:                  cancel,
+		JsonSchema:              templateJsonSchema(session.ModelSettings.TemplateID),
+		SetStructuredOutputFunc: makeSetStructuredOutputFunc(sessionId, responseId),
+	}
+	collection := session.ModelSettings.KnowledgeCollection
+	if collection == "" || knowledgeBase == nil {
+		llmEngine.EnqueueRequest(request)
+	} else {
+		go enqueueWithCitations(sessionId, responseId, collection, session.Prompt, request)
+	}
 	c.JSON(http.StatusOK, response)
 }
 
+// enqueueWithCitations searches a knowledge collection for the prompt,
+// stores what was found on the response and then queues the request with
+// the citations. The request is still queued if the search fails.
+func enqueueWithCitations(sessionId string, responseId string, collection string, prompt string,
+	request *types.Request) {
+
+	citations, err := knowledgeBase.Search(collection, prompt)
+	if err != nil {
+		log.Printf("Unable to search knowledge collection %s: %v", collection, err)
+		citations = []*data.Citation{}
+	}
+	editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+		response.Citations = citations
+		return true
+	})
+	sessionBroadcaster.Send(sessionId, "changed")
+
+	request.Messages = knowledge.AddCitations(request.Messages, citations)
+	llmEngine.EnqueueRequest(request)
+}
+
 func editResponse(sessionId string, responseId string, callback func(*data.Session, *data.Response) bool) bool {
 	session := sessionStorage.ReadSession(sessionId)
 	if session == nil {
@@ -450,39 +993,166 @@ func editResponse(sessionId string, responseId string, callback func(*data.Sessi
 	return false
 }
 
-func appendToLastMessage(sessionId string, responseId string, text string) bool {
-	return editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
-		response.Messages[len(response.Messages)-1].Text += text
-		return true
-	})
+// makeSetUsageFunc returns a function which adds the usage of one request to
+// a response's total.
+func makeSetUsageFunc(sessionId string, responseId string) func(*data.Usage) {
+	return func(usage *data.Usage) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			response.Usage = response.Usage.Add(usage)
+			return true
+		})
+	}
 }
 
-func handleResponseDelete(c *gin.Context) {
-	sessionId := c.Params.ByName("sessionId")
-	responseId := c.Params.ByName("responseId")
+// makeSetTimingFunc returns a function which stores the timings of the latest
+// request made for a response.
+func makeSetTimingFunc(sessionId string, responseId string) func(*data.Timing) {
+	return func(timing *data.Timing) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			response.Timing = timing
+			return true
+		})
+	}
+}
 
-	session := sessionStorage.ReadSession(sessionId)
-	if session == nil {
-		c.String(http.StatusNotFound, fmt.Sprintf("Unable to find session with ID %s\n", sessionId))
-		return
+// makeSetContextReductionFunc returns a function which records how the
+// messages of the latest request for a response were shortened.
+func makeSetContextReductionFunc(sessionId string, responseId string) func(*data.ContextReduction) {
+	return func(reduction *data.ContextReduction) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			response.ContextReduction = reduction
+			return true
+		})
+		sessionBroadcaster.Send(sessionId, "changed")
 	}
+}
 
-	originalLength := len(session.Responses)
-	session.Responses = slices.Filter(session.Responses, func(r *data.Response) bool {
-		return r.ID != responseId
-	})
-	if originalLength == len(session.Responses) {
-		c.String(http.StatusNotFound, fmt.Sprintf("Unable to find response with ID %s\n", responseId))
-		return
+// cancelChans holds a channel for each response with a request in the
+// engine. It is closed when the response is aborted or deleted.
+var cancelChans = map[string]chan struct{}{}
+var cancelLock sync.Mutex
+
+// makeCancelChan returns the channel which tells the engine that a
+// response's request is no longer wanted. The returned function must be
+// called when the request completes.
+func makeCancelChan(responseId string) (<-chan struct{}, func()) {
+	cancelLock.Lock()
+	defer cancelLock.Unlock()
+	cancel := make(chan struct{})
+	cancelChans[responseId] = cancel
+	return cancel, func() {
+		cancelLock.Lock()
+		defer cancelLock.Unlock()
+		if cancelChans[responseId] == cancel {
+			delete(cancelChans, responseId)
+		}
 	}
-	sessionStorage.WriteSession(session)
+}
 
-	c.Status(http.StatusNoContent)
+// cancelResponses cancels the requests of responses, if they have any.
+func cancelResponses(responseIds ...string) {
+	cancelLock.Lock()
+	defer cancelLock.Unlock()
+	for _, responseId := range responseIds {
+		if cancel, ok := cancelChans[responseId]; ok {
+			close(cancel)
+			delete(cancelChans, responseId)
+		}
+	}
+}
+
+// makeSetErrorFunc returns a function which records why the latest request
+// for a response failed.
+func makeSetErrorFunc(sessionId string, responseId string) func(*types.ProcessError) {
+	return func(err *types.ProcessError) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			response.Error = err.ResponseError()
+			return true
+		})
+	}
+}
+
+// makeSetActualModelFunc returns a function which records the model which
+// processed a response.
+func makeSetActualModelFunc(sessionId string, responseId string) func(*data.Model) {
+	return func(model *data.Model) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			if response.ModelSettingsSnapshot == nil {
+				return false
+			}
+			response.ModelSettingsSnapshot.ActualModelID = model.ID
+			response.ModelSettingsSnapshot.ActualModelName = model.Name
+			return true
+		})
+	}
+}
+
+// makeSetStructuredOutputFunc returns a function which stores the JSON parsed
+// from a reply on the last message. The text is replaced if the model had to
+// repair it.
+func makeSetStructuredOutputFunc(sessionId string, responseId string) func(*types.StructuredOutput) {
+	return func(output *types.StructuredOutput) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			message := &response.Messages[len(response.Messages)-1]
+			message.Text = output.Text
+			message.Json = output.Value
+			message.JsonError = ""
+			if output.Err != nil {
+				message.JsonError = output.Err.Error()
+			}
+			return true
+		})
+		sessionBroadcaster.Send(sessionId, "changed")
+	}
+}
+
+// makeAddMessageFunc returns a function which inserts a message, such as a
+// tool call, before the message receiving the reply.
+func makeAddMessageFunc(sessionId string, responseId string) func(data.Message) {
+	return func(message data.Message) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			last := len(response.Messages) - 1
+			response.Messages = append(response.Messages[:last:last], message, response.Messages[last])
+			return true
+		})
+		sessionBroadcaster.Send(sessionId, "changed")
+	}
+}
+
+func appendToLastMessage(sessionId string, responseId string, text string) bool {
+	return editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+		response.Messages[len(response.Messages)-1].Text += text
+		return true
+	})
+}
+
+func handleResponseDelete(c *gin.Context) {
+	sessionId := c.Params.ByName("sessionId")
+	responseId := c.Params.ByName("responseId")
+
+	session := readUserSession(c, sessionId)
+	if session == nil {
+		c.String(http.StatusNotFound, fmt.Sprintf("Unable to find session with ID %s\n", sessionId))
+		return
+	}
+
+	originalLength := len(session.Responses)
+	session.Responses = slices.Filter(session.Responses, func(r *data.Response) bool {
+		return r.ID != responseId
+	})
+	if originalLength == len(session.Responses) {
+		c.String(http.StatusNotFound, fmt.Sprintf("Unable to find response with ID %s\n", responseId))
+		return
+	}
+	sessionStorage.WriteSession(session)
+	cancelResponses(responseId)
+
+	c.Status(http.StatusNoContent)
 }
 
 func handleMessageContinuePost(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
@@ -510,7 +1180,9 @@ func handleMessageContinuePost(c *gin.Context) {
 		return success
 	}
 
+	cancel, releaseCancel := makeCancelChan(responseId)
 	completeFunc := func() {
+		releaseCancel()
 		sessionBroadcaster.Send(sessionId, "changed")
 	}
 
@@ -520,19 +1192,37 @@ func handleMessageContinuePost(c *gin.Context) {
 				return false
 			}
 			response.Status = status
+			if status == responsestatus.Running {
+				response.Error = nil
+			}
 			return true
 		})
 		sessionBroadcaster.Send(sessionId, "changed")
 	}
 
-	llmEngine.Enqueue(sessionStorage.GetStoragePath(), response.Messages, appendFunc, completeFunc, setStatusFunc,
-		&response.ModelSettingsSnapshot.ModelSettings)
+	llmEngine.EnqueueRequest(&types.Request{
+		AttachedFilesPath:       sessionStorage.GetStoragePath(),
+		Messages:                knowledge.AddCitations(response.Messages, response.Citations),
+		AppendFunc:              appendFunc,
+		CompleteFunc:            completeFunc,
+		SetStatusFunc:           setStatusFunc,
+		ModelSettings:           &response.ModelSettingsSnapshot.ModelSettings,
+		SetUsageFunc:            makeSetUsageFunc(sessionId, responseId),
+		SetTimingFunc:           makeSetTimingFunc(sessionId, responseId),
+		SetContextReductionFunc: makeSetContextReductionFunc(sessionId, responseId),
+		SetActualModelFunc:      makeSetActualModelFunc(sessionId, responseId),
+		SetErrorFunc:            makeSetErrorFunc(sessionId, responseId),
+		Tools:                   toolRegistry,
+		AddMessageFunc:          makeAddMessageFunc(sessionId, responseId),
+		Priority:                priority.Interactive,
+		Cancel:                  cancel,
+	})
 	c.JSON(http.StatusOK, response)
 }
 
 func handleResponseAbortPost(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
@@ -552,24 +1242,111 @@ func handleResponseAbortPost(c *gin.Context) {
 
 	response.Status = responsestatus.Aborted
 	sessionStorage.WriteSession(session)
+	cancelResponses(responseId)
 	sessionBroadcaster.Send(sessionId, "changed")
 
 	c.Status(http.StatusNoContent)
 }
 
+// handleUsageGet reports the token usage and cost of the user's sessions.
+// The optional `days` query parameter limits the report to recent days.
+func handleUsageGet(c *gin.Context) {
+	since := time.Time{}
+	if daysParam := c.Query("days"); daysParam != "" {
+		days, err := strconv.Atoi(daysParam)
+		if err != nil || days < 1 {
+			c.String(http.StatusBadRequest, "'days' must be a positive number.")
+			return
+		}
+		since = time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	}
+
+	overview := sessionStorage.SessionOverview()
+	if authentication != nil {
+		overview = sessionStorage.SessionOverviewForOwner(auth.User(c))
+	}
+	sessions := []*data.Session{}
+	for _, summary := range overview.SessionSummaries {
+		if session := sessionStorage.ReadSession(summary.ID); session != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	c.JSON(http.StatusOK, usage.Aggregate(sessions, since))
+}
+
+// handleStorageStatsGet reports the disk space used by all users' sessions,
+// so only admins may see it.
+func handleStorageStatsGet(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may see the storage statistics")
+		return
+	}
+	c.JSON(http.StatusOK, sessionStorage.Stats())
+}
+
+func handleQueueGet(c *gin.Context) {
+	c.JSON(http.StatusOK, llmEngine.QueueOverview())
+}
+
 func handleModelOverviewGet(c *gin.Context) {
 	modelOverview := llmEngine.ModelOverview()
 	c.JSON(http.StatusOK, modelOverview)
 }
 
 func handleModelScanPost(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may scan for models")
+		return
+	}
 	llmEngine.ScanModels()
 	handleModelOverviewGet(c)
 }
 
+func handleEmbedPost(c *gin.Context) {
+	var postData struct {
+		Model    string          `json:"model"`
+		Input    json.RawMessage `json:"input"`
+		Priority string          `json:"priority"`
+	}
+	if err := c.ShouldBindJSON(&postData); err != nil {
+		c.String(http.StatusBadRequest, "Couldn't parse the JSON POST body.")
+		return
+	}
+	model := llmEngine.GetModel(postData.Model)
+	if model == nil {
+		c.String(http.StatusNotFound, "Model not found")
+		return
+	}
+	texts, err := gateway.ParseEmbeddingInput(postData.Input)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	requestPriority, err := gateway.ParsePriority(postData.Priority)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	vectors, usage, err := llmEngine.Embed(model.ID, texts, requestPriority)
+	if err != nil {
+		c.String(gateway.EmbeddingErrorStatus(err), redact.String(err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, &data.EmbedResponse{
+		Model:      model.ID,
+		Embeddings: vectors,
+		Usage:      usage,
+	})
+}
+
+func handleBackendOverviewGet(c *gin.Context) {
+	c.JSON(http.StatusOK, llmEngine.BackendOverview())
+}
+
 func handleSessionModelSettingsPut(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, "Session not found")
 		return
@@ -591,6 +1368,11 @@ func handleSessionModelSettingsPut(c *gin.Context) {
 		return
 	}
 
+	if data.KnowledgeCollection != "" && (knowledgeBase == nil || !knowledgeBase.Exists(data.KnowledgeCollection)) {
+		c.String(http.StatusBadRequest, "An invalid KnowledgeCollection was given in the PUT body.")
+		return
+	}
+
 	session.ModelSettings = data
 	sessionStorage.WriteSession(session)
 
@@ -600,11 +1382,18 @@ func handleSessionModelSettingsPut(c *gin.Context) {
 func handleNewMessagePost(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
 	responseId := c.Params.ByName("responseId")
-	var postData struct {
-		Value string `json:"value"`
+	session := readUserSession(c, sessionId)
+	if session == nil {
+		c.String(http.StatusNotFound, "Session not found")
+		return
 	}
-	if err := c.ShouldBindJSON(&postData); err != nil {
-		c.String(http.StatusBadRequest, "Couldn't parse the JSON POST body.")
+	if getResponseFromSessionByID(session, responseId) == nil {
+		c.String(http.StatusNotFound, "Response not found")
+		return
+	}
+
+	value, attachedFiles, uploadedFiles, ok := readNewMessage(c, session)
+	if !ok {
 		return
 	}
 
@@ -615,9 +1404,10 @@ func handleNewMessagePost(c *gin.Context) {
 		foundResponse = response
 		foundSession = session
 		response.Messages = append(response.Messages, data.Message{
-			ID:   uuid.NewString(),
-			Role: role.User,
-			Text: postData.Value,
+			ID:            uuid.NewString(),
+			Role:          role.User,
+			Text:          value,
+			AttachedFiles: attachedFiles,
 		})
 		response.Messages = append(response.Messages, data.Message{
 			ID:   uuid.NewString(),
@@ -626,6 +1416,7 @@ func handleNewMessagePost(c *gin.Context) {
 		})
 		return true
 	}) {
+		releaseAttachedFiles(uploadedFiles)
 		c.String(http.StatusNotFound, "Response not found")
 		return
 	}
@@ -636,29 +1427,127 @@ func handleNewMessagePost(c *gin.Context) {
 		return success
 	}
 
+	cancel, releaseCancel := makeCancelChan(responseId)
 	completeFunc := func() {
+		releaseCancel()
 		sessionBroadcaster.Send(sessionId, "changed")
 	}
 
 	setStatusFunc := func(status responsestatus.ResponseStatus) {
 		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
 			response.Status = status
+			if status == responsestatus.Running {
+				response.Error = nil
+			}
 			return true
 		})
 		sessionBroadcaster.Send(sessionId, "changed")
 	}
 
-	llmEngine.Enqueue(sessionStorage.GetStoragePath(), foundResponse.Messages, appendFunc, completeFunc, setStatusFunc,
-		foundSession.ModelSettings)
+	llmEngine.EnqueueRequest(&types.Request{
+		AttachedFilesPath:       sessionStorage.GetStoragePath(),
+		Messages:                knowledge.AddCitations(foundResponse.Messages, foundResponse.Citations),
+		AppendFunc:              appendFunc,
+		CompleteFunc:            completeFunc,
+		SetStatusFunc:           setStatusFunc,
+		ModelSettings:           foundSession.ModelSettings,
+		SetUsageFunc:            makeSetUsageFunc(sessionId, responseId),
+		SetTimingFunc:           makeSetTimingFunc(sessionId, responseId),
+		SetContextReductionFunc: makeSetContextReductionFunc(sessionId, responseId),
+		SetActualModelFunc:      makeSetActualModelFunc(sessionId, responseId),
+		SetErrorFunc:            makeSetErrorFunc(sessionId, responseId),
+		Tools:                   toolRegistry,
+		AddMessageFunc:          makeAddMessageFunc(sessionId, responseId),
+		Priority:                priority.Interactive,
+		Cancel:                  cancel,
+		JsonSchema:              templateJsonSchema(responseTemplateID(foundSession, foundResponse)),
+		SetStructuredOutputFunc: makeSetStructuredOutputFunc(sessionId, responseId),
+	})
 	c.JSON(http.StatusOK, foundResponse)
 }
 
+// readNewMessage reads the text and attachments of a follow-up message. The
+// body is either JSON, or a multipart form when files are uploaded with the
+// message. In both, `attachedFiles` names files which are already attached
+// elsewhere in the session. The files uploaded with the message are also
+// returned on their own, so that they can be released if the message isn't
+// added after all. On failure it responds with an error.
+func readNewMessage(c *gin.Context, session *data.Session) (string, []*data.AttachedFile, []*data.AttachedFile,
+	bool) {
+	var postData struct {
+		Value         string   `json:"value" form:"value"`
+		AttachedFiles []string `json:"attachedFiles" form:"attachedFiles"`
+	}
+	var fileHeaders []*multipart.FileHeader
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		// All of the files of a message together are limited to the size of
+		// the largest single file.
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, uploadRules.MaxSizeLimit()+uploads.MEGABYTE)
+		form, err := c.MultipartForm()
+		if err != nil {
+			respondToFormError(c, err, "Couldn't parse the multipart POST body.")
+			return "", nil, nil, false
+		}
+		postData.Value = strings.Join(form.Value["value"], "")
+		postData.AttachedFiles = form.Value["attachedFiles"]
+		fileHeaders = form.File["file"]
+	} else if err := c.ShouldBindJSON(&postData); err != nil {
+		c.String(http.StatusBadRequest, "Couldn't parse the JSON POST body.")
+		return "", nil, nil, false
+	}
+
+	attachedFiles := []*data.AttachedFile{}
+	existingFiles := session.GetAttachedFiles()
+	for _, filename := range postData.AttachedFiles {
+		index := slices.IndexFunc(existingFiles, func(af *data.AttachedFile) bool {
+			return af.Filename == filename
+		})
+		if index == -1 {
+			c.String(http.StatusBadRequest, fmt.Sprintf("The file %s isn't attached to the session.", filename))
+			return "", nil, nil, false
+		}
+		attachedFileCopy := *existingFiles[index]
+		attachedFiles = append(attachedFiles, &attachedFileCopy)
+	}
+
+	uploadedFiles := []*data.AttachedFile{}
+	for _, fileHeader := range fileHeaders {
+		attachedFile := storeUploadedFile(c, fileHeader, fileHeader.Header.Get("Content-Type"),
+			fileHeader.Filename)
+		if attachedFile == nil {
+			// The files stored before this one won't be used either.
+			releaseAttachedFiles(uploadedFiles)
+			return "", nil, nil, false
+		}
+		uploadedFiles = append(uploadedFiles, attachedFile)
+	}
+	return postData.Value, append(attachedFiles, uploadedFiles...), uploadedFiles, true
+}
+
+// responseTemplateID returns the template which a response was made with.
+func responseTemplateID(session *data.Session, response *data.Response) string {
+	if response.ModelSettingsSnapshot != nil {
+		return response.ModelSettingsSnapshot.TemplateID
+	}
+	return session.ModelSettings.TemplateID
+}
+
+// templateJsonSchema returns the JSON schema which a template asks replies
+// to match, or nil.
+func templateJsonSchema(templateID string) map[string]any {
+	template := templates.Get(templateID)
+	if template == nil {
+		return nil
+	}
+	return template.JsonSchema
+}
+
 func handleResponseMessageDelete(c *gin.Context) {
 	sessionId := c.Params.ByName("sessionId")
 	responseId := c.Params.ByName("responseId")
 	messageId := c.Params.ByName("messageId")
 
-	session := sessionStorage.ReadSession(sessionId)
+	session := readUserSession(c, sessionId)
 	if session == nil {
 		c.String(http.StatusNotFound, fmt.Sprintf("Unable to find session with ID %s\n", sessionId))
 		return
@@ -695,6 +1584,113 @@ func handleTemplateOverviewGet(c *gin.Context) {
 	c.JSON(http.StatusOK, templateOverview)
 }
 
+func handleTemplatePost(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may change templates")
+		return
+	}
+	newTemplate := &data.Template{}
+	if err := c.ShouldBindJSON(newTemplate); err != nil {
+		c.String(http.StatusBadRequest, "Couldn't parse the JSON POST body.")
+		return
+	}
+	if err := templates.Add(newTemplate); err != nil {
+		c.String(templateErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, newTemplate)
+}
+
+func handleTemplatePut(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may change templates")
+		return
+	}
+	templateId := c.Params.ByName("templateId")
+	updatedTemplate := &data.Template{}
+	if err := c.ShouldBindJSON(updatedTemplate); err != nil {
+		c.String(http.StatusBadRequest, "Couldn't parse the JSON PUT body.")
+		return
+	}
+	updatedTemplate.ID = templateId
+	if err := templates.Update(updatedTemplate); err != nil {
+		c.String(templateErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, updatedTemplate)
+}
+
+func handleTemplateDelete(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may change templates")
+		return
+	}
+	templateId := c.Params.ByName("templateId")
+	if err := templates.Delete(templateId); err != nil {
+		c.String(templateErrorStatus(err), err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func handleKnowledgeOverviewGet(c *gin.Context) {
+	if knowledgeBase == nil {
+		c.JSON(http.StatusOK, &data.KnowledgeOverview{Collections: []*data.KnowledgeCollection{}})
+		return
+	}
+	c.JSON(http.StatusOK, knowledgeBase.Overview())
+}
+
+func handleMcpOverviewGet(c *gin.Context) {
+	overview := &mcp.Overview{Servers: []*mcp.ServerOverview{}}
+	for _, client := range mcpClients {
+		if client.IsRunning() {
+			overview.Servers = append(overview.Servers, client.Overview())
+		}
+	}
+	c.JSON(http.StatusOK, overview)
+}
+
+func handleMcpPromptImportPost(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may import templates")
+		return
+	}
+	serverName := c.Params.ByName("serverName")
+	promptName := c.Params.ByName("promptName")
+	clientIndex := slices.IndexFunc(mcpClients, func(client *mcp.Client) bool {
+		return client.Name() == serverName
+	})
+	if clientIndex == -1 {
+		c.String(http.StatusNotFound, "MCP server not found")
+		return
+	}
+
+	newTemplate, err := mcpClients[clientIndex].PromptToTemplate(promptName)
+	if err != nil {
+		c.String(http.StatusBadGateway, err.Error())
+		return
+	}
+	if err := templates.Add(newTemplate); err != nil {
+		c.String(templateErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, newTemplate)
+}
+
+func templateErrorStatus(err error) int {
+	if errors.Is(err, template.ErrTemplateNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, template.ErrTemplateExists) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, template.ErrInvalidTemplate) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func getResponseFromSessionByID(session *data.Session, responseID string) *data.Response {
 	responseIndex := slices.IndexFunc(session.Responses, func(r *data.Response) bool {
 		return responseID == r.ID
@@ -711,6 +1707,68 @@ func handlePresetOverviewGet(c *gin.Context) {
 	c.JSON(http.StatusOK, presetOverview)
 }
 
+func handlePresetPost(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may change presets")
+		return
+	}
+	newPreset := &data.Preset{}
+	if err := c.ShouldBindJSON(newPreset); err != nil {
+		c.String(http.StatusBadRequest, "Couldn't parse the JSON POST body.")
+		return
+	}
+	if err := presetDatabase.Add(newPreset); err != nil {
+		c.String(presetErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, newPreset)
+}
+
+func handlePresetPut(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may change presets")
+		return
+	}
+	presetId := c.Params.ByName("presetId")
+	updatedPreset := &data.Preset{}
+	if err := c.ShouldBindJSON(updatedPreset); err != nil {
+		c.String(http.StatusBadRequest, "Couldn't parse the JSON PUT body.")
+		return
+	}
+	updatedPreset.ID = presetId
+	if err := presetDatabase.Update(updatedPreset); err != nil {
+		c.String(presetErrorStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, updatedPreset)
+}
+
+func handlePresetDelete(c *gin.Context) {
+	if authentication != nil && !authentication.IsAdmin(auth.User(c)) {
+		c.String(http.StatusForbidden, "Only admin users may change presets")
+		return
+	}
+	presetId := c.Params.ByName("presetId")
+	if err := presetDatabase.Delete(presetId); err != nil {
+		c.String(presetErrorStatus(err), err.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func presetErrorStatus(err error) int {
+	if errors.Is(err, presets.ErrPresetNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, presets.ErrPresetExists) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, presets.ErrInvalidPreset) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func CreateNewResponse(session *data.Session) *data.Response {
 	now := time.Now().UTC()
 
@@ -718,6 +1776,21 @@ func CreateNewResponse(session *data.Session) *data.Response {
 	template := templates.Get(session.ModelSettings.TemplateID)
 	model := llmEngine.GetModel(session.ModelSettings.ModelID)
 
+	// Templates and presets can be deleted while sessions still refer to them.
+	presetName := ""
+	if preset != nil {
+		presetName = preset.Name
+	}
+	templateName := ""
+	if template != nil {
+		templateName = template.Name
+	}
+	// The model isn't known if its backend has been down since start up.
+	modelName := session.ModelSettings.ModelID
+	if model != nil {
+		modelName = model.Name
+	}
+
 	newResponse := &data.Response{
 		ID:                uuid.NewString(),
 		CreationTimestamp: now.Format(time.RFC3339),
@@ -725,32 +1798,288 @@ func CreateNewResponse(session *data.Session) *data.Response {
 		Messages:          []data.Message{},
 		ModelSettingsSnapshot: &data.ModelSettingsSnapshot{
 			ModelSettings: data.ModelSettings{
-				ModelID:    session.ModelSettings.ModelID,
-				PresetID:   session.ModelSettings.PresetID,
-				TemplateID: session.ModelSettings.TemplateID,
+				ModelID:             session.ModelSettings.ModelID,
+				PresetID:            session.ModelSettings.PresetID,
+				TemplateID:          session.ModelSettings.TemplateID,
+				KnowledgeCollection: session.ModelSettings.KnowledgeCollection,
 			},
-			ModelName:    model.Name,
-			PresetName:   preset.Name,
-			TemplateName: template.Name,
+			ModelName:    modelName,
+			PresetName:   presetName,
+			TemplateName: templateName,
 		},
 	}
 	session.Responses = append(session.Responses, newResponse)
 	return newResponse
 }
 
+// Exit codes of the `run` command.
+const runExitError = 1
+const runExitUsage = 2
+
+// runPrompt answers a prompt read from `input` using the engine directly,
+// without the web server, and writes the reply to `output` as it arrives. A
+// reply which must match a template's JSON schema is only written once it
+// has been checked, and repaired if needed. Errors go to `errOutput`. It
+// returns the exit code.
+func runPrompt(config *argsparser.CommandLineArguments, input io.Reader, output io.Writer, errOutput io.Writer) int {
+	presetDatabase = setupPresets(config.PresetsPath, config.StoragePath)
+	llmEngine = setupEngine(config.ConfigFilePath, presetDatabase)
+	templates = setupTemplates(config.TemplatesPath, config.StoragePath)
+	sessionBroadcaster = setupBroadcaster()
+	toolRegistry = setupTools(config.ToolsPath)
+	defer stopMcpServers()
+
+	modelSettings, err := resolveRunSettings(config.Run)
+	if err != nil {
+		fmt.Fprintf(errOutput, "Error: %v\n", err)
+		return runExitUsage
+	}
+	content, err := io.ReadAll(input)
+	if err != nil {
+		fmt.Fprintf(errOutput, "Unable to read the prompt: %v\n", err)
+		return runExitUsage
+	}
+	prompt := string(content)
+	if strings.TrimSpace(prompt) == "" {
+		fmt.Fprintln(errOutput, "The prompt read from standard input is empty.")
+		return runExitUsage
+	}
+
+	messages := []data.Message{
+		{ID: uuid.NewString(), Role: role.User, Text: templates.ApplyTemplate(modelSettings.TemplateID, prompt)},
+		{ID: uuid.NewString(), Role: role.Assistant, Text: ""},
+	}
+
+	jsonSchema := templateJsonSchema(modelSettings.TemplateID)
+	status := responsestatus.Pending
+	var processError *types.ProcessError
+	var structuredOutput *types.StructuredOutput
+	endsWithNewline := true
+	done := make(chan bool)
+	request := &types.Request{
+		Messages: messages,
+		AppendFunc: func(text string) bool {
+			if jsonSchema != nil {
+				return true
+			}
+			if text != "" {
+				endsWithNewline = strings.HasSuffix(text, "\n")
+			}
+			// Stop if the reader has gone away, such as `head` in a pipe.
+			_, err := io.WriteString(output, text)
+			return err == nil
+		},
+		CompleteFunc: func() {
+			close(done)
+		},
+		SetStatusFunc: func(newStatus responsestatus.ResponseStatus) {
+			status = newStatus
+		},
+		SetErrorFunc: func(err *types.ProcessError) {
+			processError = err
+		},
+		SetStructuredOutputFunc: func(newStructuredOutput *types.StructuredOutput) {
+			structuredOutput = newStructuredOutput
+		},
+		Tools:          toolRegistry,
+		AddMessageFunc: func(message data.Message) {},
+		ModelSettings:  modelSettings,
+		Priority:       priority.Batch,
+		JsonSchema:     jsonSchema,
+	}
+
+	if config.Run.Save {
+		// A server may be using the same storage directory, so its uploads
+		// which aren't in a session yet must be left alone.
+		sessionStorage = mem_storage.New(config.StoragePath)
+		defer sessionStorage.Stop()
+		saveRunSession(request, prompt)
+	}
+
+	llmEngine.EnqueueRequest(request)
+	<-done
+
+	if status != responsestatus.Done {
+		if !endsWithNewline {
+			fmt.Fprintln(output)
+		}
+		if processError != nil {
+			fmt.Fprintf(errOutput, "The request failed: %v\n", processError)
+		} else {
+			fmt.Fprintf(errOutput, "The request finished with status %s.\n", status)
+		}
+		return runExitError
+	}
+	if jsonSchema != nil {
+		if structuredOutput == nil || structuredOutput.Err != nil {
+			var reason error = errors.New("the reply wasn't checked")
+			if structuredOutput != nil {
+				reason = structuredOutput.Err
+			}
+			fmt.Fprintf(errOutput, "The reply doesn't match the template's JSON schema: %v\n", reason)
+			return runExitError
+		}
+		if structuredOutput.IsRepaired {
+			log.Printf("The reply was repaired to match the template's JSON schema.")
+		}
+		fmt.Fprintln(output, strings.TrimRight(structuredOutput.Text, "\n"))
+		return 0
+	}
+	if !endsWithNewline {
+		fmt.Fprintln(output)
+	}
+	return 0
+}
+
+// resolveRunSettings finds the model, template and preset named on the
+// command line, which may be given by ID or by name.
+func resolveRunSettings(runArguments *argsparser.RunArguments) (*data.ModelSettings, error) {
+	modelSettings := &data.ModelSettings{
+		TemplateID: templates.DefaultID(),
+		PresetID:   presetDatabase.DefaultID(),
+	}
+
+	models := llmEngine.ModelOverview().Models
+	modelIndex := findByIDOrName(len(models), runArguments.Model, func(i int) (string, string) {
+		return models[i].ID, models[i].Name
+	})
+	if modelIndex == -1 {
+		modelIDs := slices.Map(models, func(model *data.Model) string {
+			return model.ID
+		})
+		return nil, fmt.Errorf("unable to find a model with the ID or name '%s'. The models are: %s",
+			runArguments.Model, strings.Join(modelIDs, ", "))
+	}
+	modelSettings.ModelID = models[modelIndex].ID
+
+	if runArguments.Template != "" {
+		templateList := templates.TemplateOverview().Templates
+		templateIndex := findByIDOrName(len(templateList), runArguments.Template, func(i int) (string, string) {
+			return templateList[i].ID, templateList[i].Name
+		})
+		if templateIndex == -1 {
+			return nil, fmt.Errorf("unable to find a template with the ID or name '%s'", runArguments.Template)
+		}
+		modelSettings.TemplateID = templateList[templateIndex].ID
+	}
+
+	if runArguments.Preset != "" {
+		presetList := presetDatabase.PresetOverview().Presets
+		presetIndex := findByIDOrName(len(presetList), runArguments.Preset, func(i int) (string, string) {
+			return presetList[i].ID, presetList[i].Name
+		})
+		if presetIndex == -1 {
+			return nil, fmt.Errorf("unable to find a preset with the ID or name '%s'", runArguments.Preset)
+		}
+		modelSettings.PresetID = presetList[presetIndex].ID
+	}
+	return modelSettings, nil
+}
+
+// findByIDOrName returns the index of the item whose ID is `key`, or else of
+// the first whose name is `key`. It returns -1 if there is none.
+func findByIDOrName(count int, key string, idAndName func(i int) (string, string)) int {
+	nameIndex := -1
+	for i := 0; i < count; i++ {
+		id, name := idAndName(i)
+		if id == key {
+			return i
+		}
+		if nameIndex == -1 && strings.EqualFold(name, key) {
+			nameIndex = i
+		}
+	}
+	return nameIndex
+}
+
+// saveRunSession stores the prompt of a `run` as a new session, and makes
+// the request also record its reply, status and usage in the session like
+// a request from the web UI.
+func saveRunSession(request *types.Request, prompt string) {
+	session := sessionStorage.NewSession()
+	session.ModelSettings = request.ModelSettings
+	session.Prompt = prompt
+	session.Title = templates.MakeTitle(request.ModelSettings.TemplateID, prompt)
+	response := CreateNewResponse(session)
+	response.Messages = request.Messages
+	sessionStorage.WriteSession(session)
+
+	sessionId := session.ID
+	responseId := response.ID
+	appendFunc := request.AppendFunc
+	request.AppendFunc = func(text string) bool {
+		appendToLastMessage(sessionId, responseId, text)
+		return appendFunc(text)
+	}
+	setStatusFunc := request.SetStatusFunc
+	request.SetStatusFunc = func(status responsestatus.ResponseStatus) {
+		editResponse(sessionId, responseId, func(session *data.Session, response *data.Response) bool {
+			response.Status = status
+			return true
+		})
+		setStatusFunc(status)
+	}
+	setErrorFunc := request.SetErrorFunc
+	request.SetErrorFunc = func(err *types.ProcessError) {
+		makeSetErrorFunc(sessionId, responseId)(err)
+		setErrorFunc(err)
+	}
+	setStructuredOutputFunc := request.SetStructuredOutputFunc
+	request.SetStructuredOutputFunc = func(structuredOutput *types.StructuredOutput) {
+		makeSetStructuredOutputFunc(sessionId, responseId)(structuredOutput)
+		setStructuredOutputFunc(structuredOutput)
+	}
+	request.SetUsageFunc = makeSetUsageFunc(sessionId, responseId)
+	request.SetTimingFunc = makeSetTimingFunc(sessionId, responseId)
+	request.SetContextReductionFunc = makeSetContextReductionFunc(sessionId, responseId)
+	request.SetActualModelFunc = makeSetActualModelFunc(sessionId, responseId)
+}
+
 func main() {
+	tools.RunSandboxHelper()
+
 	config := argsparser.Parse()
 	if config == nil {
+		os.Exit(runExitUsage)
+	}
+
+	// API tokens are registered with `redact` as they are loaded.
+	log.SetOutput(redact.NewWriter(os.Stderr))
+	gin.DefaultWriter = redact.NewWriter(os.Stdout)
+	gin.DefaultErrorWriter = redact.NewWriter(os.Stderr)
+
+	if config.Run != nil {
+		if !config.Run.Verbose {
+			log.SetOutput(io.Discard)
+		}
+		exitCode := runPrompt(config, os.Stdin, os.Stdout, os.Stderr)
+		os.Exit(exitCode)
+	}
+
+	if config.CheckConfig {
+		templatesPath := resolveUserFilePath(config.TemplatesPath, config.StoragePath, userTemplatesFilename)
+		presetsPath := resolveUserFilePath(config.PresetsPath, config.StoragePath, userPresetsFilename)
+		if !configcheck.Run(redact.NewWriter(os.Stdout), config.ConfigFilePath, templatesPath, presetsPath) {
+			os.Exit(1)
+		}
 		return
 	}
 
 	sessionStorage = setupStorage(config.StoragePath)
-	presetDatabase = setupPresets(config.PresetsPath)
+	presetDatabase = setupPresets(config.PresetsPath, config.StoragePath)
 	llmEngine = setupEngine(config.ConfigFilePath, presetDatabase)
 	sessionBroadcaster = setupBroadcaster()
-	templates = setupTemplates(config.TemplatesPath)
-	r := setupRouter()
+	authentication = setupAuth(config.AuthConfigPath)
+	templates = setupTemplates(config.TemplatesPath, config.StoragePath)
+	titleGenerator = setupTitleGenerator(config.TitleModel)
+	toolRegistry = setupTools(config.ToolsPath)
+	knowledgeBase = setupKnowledge(config.KnowledgePath, config.StoragePath)
+	uploadRules = setupUploads(config.UploadsPath)
+	fileWatcher := setupReloadTriggers()
+	defer fileWatcher.Stop()
+	r := setupRouter(setupGateway(config.RecordApiCalls))
 	fmt.Printf("\n    Starting server on http://%s\n\n", config.Address)
 	r.Run(config.Address)
+	stopMcpServers()
 	sessionStorage.Stop()
 }
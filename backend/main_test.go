@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sedwards2009/llm-multitool/internal/argsparser"
+	"sedwards2009/llm-multitool/internal/auth"
+	"sedwards2009/llm-multitool/internal/data"
+	"sedwards2009/llm-multitool/internal/mem_storage"
+	"sedwards2009/llm-multitool/internal/uploads"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeOpenAiServer answers model listings and streams each of its replies
+// in turn. A reply starting with "!" is sent as an error with that status.
+type fakeOpenAiServer struct {
+	lock    sync.Mutex
+	replies []string
+}
+
+func (this *fakeOpenAiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/models") {
+		w.Write([]byte(`{"object": "list", "data": [{"id": "m1", "object": "model"}, {"id": "m2", "object": "model"}]}`))
+		return
+	}
+
+	this.lock.Lock()
+	reply := this.replies[0]
+	this.replies = this.replies[1:]
+	this.lock.Unlock()
+
+	if strings.HasPrefix(reply, "!") {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"message": "` + reply[1:] + `"}}`))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	chunk, _ := json.Marshal(map[string]any{
+		"object":  "chat.completion.chunk",
+		"choices": []any{map[string]any{"index": 0, "delta": map[string]any{"content": reply}}},
+	})
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", chunk)
+}
+
+const TEST_TEMPLATES = `
+- id: plain
+  name: Instruct
+  template_string: "{{prompt}}"
+  default: true
+- id: answer
+  name: Answer
+  template_string: "{{prompt}}"
+  json_schema:
+    type: object
+    properties:
+      answer:
+        type: integer
+    required: [answer]
+`
+
+func runTestPrompt(t *testing.T, runArguments *argsparser.RunArguments, prompt string,
+	replies ...string) (int, string, string) {
+
+	server := httptest.NewServer(&fakeOpenAiServer{replies: replies})
+	t.Cleanup(server.Close)
+
+	directory := t.TempDir()
+	configPath := filepath.Join(directory, "backend.yaml")
+	os.WriteFile(configPath, []byte("- name: Fake\n  address: \""+server.URL+"/v1\"\n"), 0644)
+	templatesPath := filepath.Join(directory, "templates.yaml")
+	os.WriteFile(templatesPath, []byte(TEST_TEMPLATES), 0644)
+	storagePath := filepath.Join(directory, "data")
+	os.Mkdir(storagePath, 0755)
+
+	config := &argsparser.CommandLineArguments{
+		ConfigFilePath: configPath,
+		StoragePath:    storagePath,
+		TemplatesPath:  templatesPath,
+		Run:            runArguments,
+	}
+	output := &bytes.Buffer{}
+	errOutput := &bytes.Buffer{}
+	exitCode := runPrompt(config, strings.NewReader(prompt), output, errOutput)
+	return exitCode, output.String(), errOutput.String()
+}
+
+func TestRunPrompt(t *testing.T) {
+	exitCode, output, errOutput := runTestPrompt(t, &argsparser.RunArguments{Model: "Fake - m1"}, "Hello", "Hi there")
+	if exitCode != 0 || output != "Hi there\n" {
+		t.Errorf("Expected the reply and exit code 0, got %d %q %q", exitCode, output, errOutput)
+	}
+}
+
+func TestRunPromptExitCodes(t *testing.T) {
+	exitCode, _, _ := runTestPrompt(t, &argsparser.RunArguments{Model: "missing"}, "Hello")
+	if exitCode != runExitUsage {
+		t.Errorf("Expected an unknown model to exit with %d, got %d", runExitUsage, exitCode)
+	}
+	exitCode, _, _ = runTestPrompt(t, &argsparser.RunArguments{Model: "Fake_m1", Template: "missing"}, "Hello")
+	if exitCode != runExitUsage {
+		t.Errorf("Expected an unknown template to exit with %d, got %d", runExitUsage, exitCode)
+	}
+	exitCode, _, _ = runTestPrompt(t, &argsparser.RunArguments{Model: "Fake_m1"}, "  \n")
+	if exitCode != runExitUsage {
+		t.Errorf("Expected an empty prompt to exit with %d, got %d", runExitUsage, exitCode)
+	}
+	exitCode, _, errOutput := runTestPrompt(t, &argsparser.RunArguments{Model: "Fake_m1"}, "Hello", "!overloaded")
+	if exitCode != runExitError || !strings.Contains(errOutput, "overloaded") {
+		t.Errorf("Expected a failed request to exit with %d, got %d %q", runExitError, exitCode, errOutput)
+	}
+}
+
+func TestRunPromptRepairedJson(t *testing.T) {
+	exitCode, output, errOutput := runTestPrompt(t, &argsparser.RunArguments{Model: "Fake_m1", Template: "Answer"},
+		"What is 6 times 7?", `{"answer": "42"}`, `{"answer": 42}`)
+	if exitCode != 0 || output != "{\"answer\": 42}\n" {
+		t.Errorf("Expected only the repaired reply, got %d %q %q", exitCode, output, errOutput)
+	}
+
+	exitCode, output, _ = runTestPrompt(t, &argsparser.RunArguments{Model: "Fake_m1", Template: "answer"},
+		"What is 6 times 7?", `forty two`, `still forty two`)
+	if exitCode != runExitError || output != "" {
+		t.Errorf("Expected a reply which can't be repaired to fail, got %d %q", exitCode, output)
+	}
+}
+
+func TestFindByIDOrName(t *testing.T) {
+	items := [][2]string{{"id1", "First"}, {"id2", "Second"}, {"Second", "Third"}, {"id4", "second"}}
+	idAndName := func(i int) (string, string) {
+		return items[i][0], items[i][1]
+	}
+	cases := map[string]int{
+		"id1":     0,
+		"first":   0,
+		"Second":  2,
+		"SECOND":  1,
+		"missing": -1,
+	}
+	for key, expected := range cases {
+		if index := findByIDOrName(len(items), key, idAndName); index != expected {
+			t.Errorf("Expected %s to be found at %d, got %d", key, expected, index)
+		}
+	}
+}
+
+func TestSharedStateNeedsAdmin(t *testing.T) {
+	var err error
+	authentication, err = auth.New(&auth.AuthConfig{
+		Tokens: []*auth.TokenConfig{{User: "alice", Token: "alice-token-1234"}, {User: "bob", Token: "bob-token-1234"}},
+		Admins: []string{"alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { authentication = nil }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(authentication.Middleware())
+	r.POST("/api/model/scan", handleModelScanPost)
+	r.POST("/api/template", handleTemplatePost)
+	r.PUT("/api/template/:templateId", handleTemplatePut)
+	r.DELETE("/api/template/:templateId", handleTemplateDelete)
+	r.POST("/api/mcp/:serverName/prompt/:promptName/import", handleMcpPromptImportPost)
+	r.POST("/api/preset", handlePresetPost)
+	r.PUT("/api/preset/:presetId", handlePresetPut)
+	r.DELETE("/api/preset/:presetId", handlePresetDelete)
+
+	requests := [][2]string{
+		{http.MethodPost, "/api/model/scan"},
+		{http.MethodPost, "/api/template"},
+		{http.MethodPut, "/api/template/plain"},
+		{http.MethodDelete, "/api/template/plain"},
+		{http.MethodPost, "/api/mcp/files/prompt/summarize/import"},
+		{http.MethodPost, "/api/preset"},
+		{http.MethodPut, "/api/preset/chat"},
+		{http.MethodDelete, "/api/preset/chat"},
+	}
+	for _, methodAndPath := range requests {
+		request := httptest.NewRequest(methodAndPath[0], methodAndPath[1], strings.NewReader("{}"))
+		request.Header.Set("Authorization", "Bearer bob-token-1234")
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("Expected %s %s to be forbidden for other users, got %d", methodAndPath[0], methodAndPath[1],
+				recorder.Code)
+		}
+	}
+}
+
+func TestNewMessageReleasesStoredFiles(t *testing.T) {
+	storagePath := t.TempDir()
+	sessionStorage = mem_storage.New(storagePath)
+	defer func() { sessionStorage = nil }()
+	var err error
+	uploadRules, err = uploads.New(&uploads.UploadsConfig{SizeLimits: map[string]float64{"text/*": 0.0001}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { uploadRules = nil }()
+
+	session := sessionStorage.NewSession()
+	session.Responses = []*data.Response{{ID: "r1"}}
+	sessionStorage.WriteSession(session)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/api/session/:sessionId/response/:responseId/message", handleNewMessagePost)
+
+	// The second file is over the size limit for text.
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("value", "Compare these")
+	for _, content := range []string{"Small file", strings.Repeat("Large file ", 20)} {
+		part, _ := writer.CreateFormFile("file", "notes.txt")
+		part.Write([]byte(content))
+	}
+	writer.Close()
+	request := httptest.NewRequest(http.MethodPost, "/api/session/"+session.ID+"/response/r1/message", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected the message to be refused, got %d", recorder.Code)
+	}
+
+	entries, _ := os.ReadDir(storagePath)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".txt" {
+			t.Errorf("Expected the files of the refused message to be removed, found %s", entry.Name())
+		}
+	}
+	sessionStorage.Stop()
+}
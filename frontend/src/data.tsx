@@ -17,6 +17,7 @@ export interface AttachedFile {
   filename: string;
   mimeType: string;
   originalFilename: string;
+  thumbnailFilename?: string;
 }
 
 export interface Session {
@@ -229,15 +229,25 @@ export async function deleteResponseMessage(sessionId: string, responseId: strin
   return response.ok;
 }
 
-export async function newMessage(session: Session, responseId: string, reply: string): Promise<void> {
+export async function newMessage(session: Session, responseId: string, reply: string,
+    files: File[] = []): Promise<void> {
   await flushQueues();
 
-  const response = await fetch(`${SERVER_BASE_URL}/session/${session.id}/response/${responseId}/message`,
-    {
-      headers: {"Content-Type": "application/json"},
-      body: JSON.stringify({value: reply}),
-      method: "POST"
-    });
+  let request: RequestInit = {
+    headers: {"Content-Type": "application/json"},
+    body: JSON.stringify({value: reply}),
+    method: "POST"
+  };
+  if (files.length !== 0) {
+    const formData = new FormData();
+    formData.append("value", reply);
+    for (const file of files) {
+      formData.append("file", file);
+    }
+    request = {body: formData, method: "POST"};
+  }
+
+  const response = await fetch(`${SERVER_BASE_URL}/session/${session.id}/response/${responseId}/message`, request);
   try {
     if (response.ok) {
       return;
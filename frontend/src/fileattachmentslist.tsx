@@ -40,7 +40,7 @@ export function FileAttachmentsList({sessionId, attachedFiles, onDeleteFile}: Pr
               }
             }}
             >
-              <img src={fileURL(sessionId, af.filename)} />
+              <img src={fileURL(sessionId, af.thumbnailFilename || af.filename)} />
               {deleteButton}
             </div>;
         } else {